@@ -5,9 +5,10 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,10 +19,16 @@ import (
 	"github.com/sorenmat/pipeline/pipeline/frontend/yaml"
 	"gitlab.com/sorenmat/seneferu/builder/date"
 	"gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/logging"
+	"gitlab.com/sorenmat/seneferu/metrics"
 	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/notify"
+	"gitlab.com/sorenmat/seneferu/scm"
 	"gitlab.com/sorenmat/seneferu/storage"
+	"gitlab.com/sorenmat/seneferu/tracing"
 	yamllib "gopkg.in/yaml.v2"
 	"k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
@@ -30,12 +37,13 @@ type Config struct {
 	Platform  string
 	Branches  yaml.Constraint
 	Workspace yaml.Workspace
-	Clone     Containers
+	Clone     CloneOptions
 	Pipeline  Containers
 	Services  Containers
 	Networks  yaml.Networks
 	Volumes   yaml.Volumes
 	Labels    libcompose.SliceorMap
+	Notify    notify.Config
 }
 
 // Containers denotes an ordered collection of containers.
@@ -75,7 +83,7 @@ type Container struct {
 	ShmSize       libcompose.MemStringorInt `yaml:"shm_size,omitempty"`
 	Ulimits       libcompose.Ulimits        `yaml:"ulimits,omitempty"`
 	Volumes       libcompose.Volumes        `yaml:"volumes,omitempty"`
-	Constraints   yaml.Constraints          `yaml:"when,omitempty"`
+	Constraints   Constraints               `yaml:"when,omitempty"`
 	Vargs         map[string]interface{}    `yaml:",inline"`
 	Coverage      string                    `yaml:"coverage,omitempty"`
 	Args          []string                  `yaml:"args,omitempty"`
@@ -109,7 +117,7 @@ const SSHKEY = "sshkey"
 
 // CreateSSHKeySecret creates and ssh key in the Kubernetes cluster to be used for
 // cloning repositories
-func CreateSSHKeySecret(kubectl *kubernetes.Clientset, sshkey string, namespace string) error {
+func CreateSSHKeySecret(logger *slog.Logger, kubectl *kubernetes.Clientset, sshkey string, namespace string) error {
 	key, err := base64.StdEncoding.DecodeString(string(sshkey))
 	if err != nil {
 		return errors.Wrap(err, "unable to decode base64 encoded sshkey, is it encoded?")
@@ -120,14 +128,16 @@ func CreateSSHKeySecret(kubectl *kubernetes.Clientset, sshkey string, namespace
 	}
 	cm.Namespace = namespace
 	_, err = kubectl.CoreV1().Secrets(namespace).Create(&cm)
+	kubeError("create_secret", err)
 	if err != nil {
-		log.Println("was unable to create ssh key in ", namespace)
+		logger.Warn("was unable to create ssh key", "namespace", namespace, "error", err)
 	}
 
 	// get docker secret from default NS and copy it to the build namespace
 	sd, err := kubectl.CoreV1().Secrets("default").Get("seneferu-docker", meta_v1.GetOptions{})
+	kubeError("get_secret", err)
 	if err != nil {
-		log.Println("was unable to get seneferu docker key")
+		logger.Warn("was unable to get seneferu docker key", "error", err)
 	}
 
 	sd.Namespace = namespace
@@ -135,16 +145,18 @@ func CreateSSHKeySecret(kubectl *kubernetes.Clientset, sshkey string, namespace
 	sd.GenerateName = ""
 	sd.Generation = 0
 	_, err = kubectl.CoreV1().Secrets(namespace).Create(sd)
+	kubeError("create_secret", err)
 	if err != nil {
-		log.Println("was unable to create docker secret in ", namespace)
+		logger.Warn("was unable to create docker secret", "namespace", namespace, "error", err)
 	}
-	waitForSecret(kubectl, sd.Name, namespace)
-	waitForSecret(kubectl, SSHKEY, namespace)
+	waitForSecret(logger, kubectl, sd.Name, namespace)
+	waitForSecret(logger, kubectl, SSHKEY, namespace)
 
 	return err
 }
 
-func volumemounts() []v1.Volume {
+// volumemounts returns the volumes of the build pod, the ones holding secrets are left out of the builds of forks
+func volumemounts(build *model.Build) []v1.Volume {
 	// shared directory for the build
 	vol1 := v1.Volume{}
 	vol1.Name = "shared-data"
@@ -164,6 +176,9 @@ func volumemounts() []v1.Volume {
 	dockerSecrets.Name = "docker-secrets"
 	dockerSecrets.Secret = &v1.SecretVolumeSource{SecretName: "seneferu-docker", DefaultMode: &perm}
 
+	if build.Fork {
+		return []v1.Volume{vol1}
+	}
 	return []v1.Volume{
 		vol1,
 		sshvol,
@@ -172,7 +187,80 @@ func volumemounts() []v1.Volume {
 	}
 }
 
-func ExecuteBuild(kubectl *kubernetes.Clientset, service storage.Service, build *model.Build, repo *model.Repo, token string, targetURL string, dockerRegHost string, sshkey string) error {
+// ExecuteBuild runs the build in its own namespace and records the result in the metrics.
+// The build is traced as a child of parent.
+func ExecuteBuild(parent *tracing.Span, kubectl *kubernetes.Clientset, service storage.Service, build *model.Build, repo *model.Repo, provider scm.Provider, targetURL string, dockerRegHost string, sshkey string) error {
+	repoName := build.Org + "/" + build.Name
+	metrics.Builds.Inc(repoName, "started")
+	span := parent.Child("build", logging.OrgKey, build.Org, logging.RepoKey, build.Name, "commit", build.Commit, "ref", build.Ref)
+	err := executeBuild(span, kubectl, service, build, repo, provider, targetURL, dockerRegHost, sshkey)
+	if cause := errors.Cause(err); cause == ErrNoConfig || cause == ErrNothingToBuild {
+		span.SetAttributes("skipped", true)
+		span.End()
+		metrics.Builds.Inc(repoName, "skipped")
+		return nil
+	}
+	span.SetAttributes(logging.BuildKey, build.Number, "success", build.Success)
+	span.SetError(err)
+	span.End()
+	switch {
+	case err != nil:
+		metrics.Builds.Inc(repoName, "error")
+	case build.Success:
+		metrics.Builds.Inc(repoName, "succeeded")
+	default:
+		metrics.Builds.Inc(repoName, "failed")
+	}
+	return err
+}
+
+// SkipBuild records build as skipped for reason without running it. Every step of the build configuration is
+// reported as skipped, so required checks don't wait for it. Commits without a build configuration aren't recorded.
+func SkipBuild(parent *tracing.Span, service storage.Service, build *model.Build, repo *model.Repo, provider scm.Provider, targetURL string, reason string) error {
+	span := parent.Child("skip_build", logging.OrgKey, build.Org, logging.RepoKey, build.Name, "commit", build.Commit, "ref", build.Ref, "reason", reason)
+	defer span.End()
+	token, err := provider.Token(build.Org, build.Name)
+	if err != nil {
+		return errors.Wrap(err, "unable to get token for the repository")
+	}
+	cfg, err := getConfigfile(build, repo, provider, token)
+	if errors.Cause(err) == ErrNoConfig {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to handle buildconfig file")
+	}
+
+	build.Number, err = service.GetNextBuildNumber(build.Org, build.Name)
+	if err != nil {
+		return errors.Wrap(err, "unable to get next build number...")
+	}
+	build.Status = "Skipped"
+	build.Success = true
+	for _, c := range cfg.Pipeline.Containers {
+		build.Steps = append(build.Steps, &model.Step{StepInfo: model.StepInfo{Name: c.Name, Reponame: build.Name, BuildNumber: build.Number, Org: build.Org, Status: "Skipped"}})
+	}
+	err = service.SaveBuild(build)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("unable to save build %v", build))
+	}
+	logger := logging.Build(build)
+	logger.Info("build skipped", "reason", reason)
+	reporter := newReporter(build, provider)
+	url := fmt.Sprintf("%v/#/repo/%v/%v/build/%v", targetURL, build.Org, build.Name, build.Number)
+	for _, step := range build.Steps {
+		err = service.SaveStep(step)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unable to save build step %v", step.Name))
+		}
+		reporter.report(logging.Step(step), span, scm.Status{State: "skipped", Context: step.Name, TargetURL: url, Description: reason}, nil)
+	}
+	// only counted once the skip has been recorded and reported
+	metrics.Builds.Inc(build.Org+"/"+build.Name, "skipped")
+	return nil
+}
+
+func executeBuild(span *tracing.Span, kubectl *kubernetes.Clientset, service storage.Service, build *model.Build, repo *model.Repo, provider scm.Provider, targetURL string, dockerRegHost string, sshkey string) (err error) {
 	pod := &v1.Pod{Spec: v1.PodSpec{
 		RestartPolicy: "Never",
 	},
@@ -184,6 +272,29 @@ func ExecuteBuild(kubectl *kubernetes.Clientset, service storage.Service, build
 
 	buildUUID := "build-" + uuid.New()
 
+	// the token is given to the build steps as well, so it's only fetched once
+	token, err := provider.Token(build.Org, build.Name)
+	if err != nil {
+		return errors.Wrap(err, "unable to get token for the repository")
+	}
+	// the configuration is fetched before the build is numbered, so commits without one aren't recorded
+	configSpan := span.Child("fetch_config")
+	cfg, configErr := getConfigfile(build, repo, provider, token)
+	if errors.Cause(configErr) == ErrNoConfig {
+		configSpan.End()
+		logging.Build(build).Info("no build configuration found, skipping build")
+		return configErr
+	}
+	configSpan.SetError(configErr)
+	configSpan.End()
+	// builds filtered out entirely don't create any resources either
+	if configErr == nil {
+		if reason := buildSkipReason(build, cfg); reason != "" {
+			logging.Build(build).Info("nothing to build, skipping build", "reason", reason)
+			return ErrNothingToBuild
+		}
+	}
+
 	buildNumber, err := service.GetNextBuildNumber(build.Org, build.Name)
 	build.Number = buildNumber
 	if err != nil {
@@ -194,63 +305,78 @@ func ExecuteBuild(kubectl *kubernetes.Clientset, service storage.Service, build
 		return errors.Wrap(err, fmt.Sprintf("unable to save build %v", build))
 	}
 
-	log.Println("Scheduling build: ", buildUUID)
+	logger := logging.Build(build).With(logging.BuildUUIDKey, buildUUID)
+	span.SetAttributes(logging.BuildUUIDKey, buildUUID)
+	logger.Info("scheduling build")
+	// builds that couldn't run are notified about as well, they're the failures people want to hear about
+	defer func() {
+		if err != nil {
+			build.Status = "Failed"
+			build.Success = false
+			if saveErr := service.SaveBuild(build); saveErr != nil {
+				logger.Warn("unable to save failed build", "error", saveErr)
+			}
+		}
+		var notifyCfg notify.Config
+		if cfg != nil {
+			notifyCfg = cfg.Notify
+		}
+		notifyResult(logger, span, service, build, notifyCfg, targetURL)
+	}()
+	reporter := newReporter(build, provider)
 	pod.ObjectMeta.Name = buildUUID
 	pod.Spec.RestartPolicy = "Never"
 
-	pod.Spec.Volumes = volumemounts()
-	// add container to the pod
-	cfg, err := getConfigfile(build, token)
-	if err != nil {
-		github.ReportBack(github.GithubStatus{State: "error", Context: "fetching or parsing .ci.yaml"}, build.StatusURL, build.Commit, token)
+	if configErr != nil {
+		reporter.report(logger, span, scm.Status{State: "error", Context: "fetching or parsing .ci.yaml", Description: configErrorDescription(configErr)}, nil)
 
-		return errors.Wrap(err, "unable to handle buildconfig file")
+		return errors.Wrap(configErr, "unable to handle buildconfig file")
 	}
 	ns := &v1.Namespace{}
 	ns.Name = pod.Name
 	ns.Annotations = map[string]string{"type": "build", "managedby": "seneferu"}
 	ns.Namespace = pod.Name
+	phaseStart := time.Now()
+	nsSpan := span.Child("create_namespace", "namespace", ns.Name)
 	_, err = kubectl.CoreV1().Namespaces().Create(ns)
 	if err != nil {
+		kubeError("create_namespace", err)
+		nsSpan.SetError(err)
+		nsSpan.End()
 		return errors.Wrapf(err, "Error creating namespace %v: %v", ns, err)
 	}
-	waitForNamespace(kubectl, ns.Name)
-	defer cleanupNamespace(kubectl, ns.Name)
-
-	err = CreateSSHKeySecret(kubectl, sshkey, ns.Name)
-	if err != nil {
-		log.Fatal("Unable to create or update secret 'sshkey': ", err)
-	}
-
-	if cfg.Workspace.Path == "" {
-		cfg.Workspace.Path = build.Name
+	metrics.ActiveNamespaces.Inc()
+	waitForNamespace(logger, kubectl, ns.Name)
+	defer cleanupNamespace(logger, kubectl, ns.Name)
+	nsSpan.End()
+	build.Timing.Namespace = millis(phaseStart, time.Now())
+
+	// the builds of forks don't get the secrets, so they aren't created in their namespace
+	if !build.Fork {
+		phaseStart = time.Now()
+		secretSpan := span.Child("create_secrets")
+		err = CreateSSHKeySecret(logger, kubectl, sshkey, ns.Name)
+		secretSpan.SetError(err)
+		secretSpan.End()
+		if err != nil {
+			logger.Error("Unable to create or update secret 'sshkey'", "error", err)
+			os.Exit(1)
+		}
+		build.Timing.Secrets = millis(phaseStart, time.Now())
 	}
-	var prepareSteps []v1.Container
-	var buildSteps []v1.Container
-
-	prepareSteps = append(prepareSteps, createSSHAgentContainer())
-	prepareSteps = append(prepareSteps, createGitContainer(build, cfg.Workspace.Path))
 
-	x, err := createBuildSteps(build, cfg, token)
-	buildSteps = append(buildSteps, x...)
+	buildSteps, skipped, services, err := createPodSpec(pod, build, cfg, provider.Remote(), token, dockerRegHost)
 	if err != nil {
-		return errors.Wrap(err, "unable to create build steps")
+		return err
 	}
 
-	services, err := createServiceSteps(cfg)
-	// Add the docker containers that writes in shardir to create the socket
-	services = append(services, createDockerContainer(dockerRegHost))
-	if err != nil {
-		return errors.Wrap(err, "unable to create service")
-	}
-	// call the prepareSteps as init containers
-	pod.Spec.InitContainers = prepareSteps
-	pod.Spec.Containers = append(pod.Spec.Containers, services...)
-	pod.Spec.Containers = append(pod.Spec.Containers, buildSteps...)
-
 	pod.Namespace = ns.Name
+	scheduleSpan := span.Child("schedule_pod", "pod", buildUUID)
 	_, err = kubectl.CoreV1().Pods(ns.Name).Create(pod)
 	if err != nil {
+		kubeError("create_pod", err)
+		scheduleSpan.SetError(err)
+		scheduleSpan.End()
 		return errors.Wrapf(err, "Error starting build: %v", err)
 	}
 	build.Status = "Started"
@@ -259,27 +385,25 @@ func ExecuteBuild(kubectl *kubernetes.Clientset, service storage.Service, build
 		return errors.Wrap(err, "unable to save build")
 	}
 	for _, v := range buildSteps {
-		err := github.ReportBack(github.GithubStatus{State: "pending", Context: v.Name}, build.StatusURL, build.Commit, token)
-		if err != nil {
-			log.Println("unable to report status back to github")
-		}
+		reporter.report(logger.With(logging.StepKey, v.Name), span, scm.Status{State: "pending", Context: v.Name}, nil)
+	}
+	for _, s := range skipped {
+		reporter.report(logger.With(logging.StepKey, s.Name), span, scm.Status{State: "skipped", Context: s.Name, Description: s.Reason}, nil)
 	}
 
 	// replace above sleep with a polling of the container ready state
 	// perhaps replace with a listen hook
-	err = waitForContainer(kubectl, buildUUID, ns.Name)
+	metrics.QueueDepth.Inc()
+	err = waitForContainer(logger, kubectl, buildUUID, ns.Name)
+	metrics.QueueDepth.Dec()
+	scheduleSpan.SetError(err)
+	scheduleSpan.End()
 	if err != nil {
 		for _, v := range buildSteps {
-			err := github.ReportBack(github.GithubStatus{State: "error", Context: v.Name}, build.StatusURL, build.Commit, token)
-			if err != nil {
-				log.Println("unable to report status back to github")
-			}
+			reporter.report(logger.With(logging.StepKey, v.Name), span, scm.Status{State: "error", Context: v.Name}, nil)
 		}
 
-		gerr := github.ReportBack(github.GithubStatus{State: "error", Context: "build failed to start"}, build.StatusURL, build.Commit, token)
-		if gerr != nil {
-			log.Println("unable to report status back to github about build unable to start")
-		}
+		reporter.report(logger, span, scm.Status{State: "error", Context: "build failed to start"}, nil)
 		return err
 	}
 	build.Status = "Running"
@@ -299,8 +423,18 @@ func ExecuteBuild(kubectl *kubernetes.Clientset, service storage.Service, build
 		if err != nil {
 			return errors.Wrap(err, fmt.Sprintf("unable to save build step %v", b.Name))
 		}
+		// make the step followable before the first line is written
+		Logs.Open(StreamKey(step.Org, step.Reponame, step.BuildNumber, step.Name))
 
-		go registerLog(service, repo.Org, repo.Name, step, buildUUID, b.Name, build, kubectl, ns.Name)
+		go registerLog(logging.Step(step).With(logging.BuildUUIDKey, buildUUID), service, repo.Org, repo.Name, step, buildUUID, b.Name, build, kubectl, ns.Name)
+	}
+	for _, s := range skipped {
+		step := &model.Step{StepInfo: model.StepInfo{Name: s.Name, Reponame: build.Name, BuildNumber: build.Number, Org: build.Org, Status: "Skipped"}}
+		build.Steps = append(build.Steps, step)
+		err = service.SaveStep(step)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unable to save build step %v", s.Name))
+		}
 	}
 	for _, b := range services {
 		s := &model.Service{Name: b.Name}
@@ -309,13 +443,13 @@ func ExecuteBuild(kubectl *kubernetes.Clientset, service storage.Service, build
 		if err != nil {
 			return errors.Wrap(err, fmt.Sprintf("unable to save build %v", build))
 		}
-		go registerLogForService(service, repo.Org, repo.Name, buildUUID, b.Name, build, kubectl, ns.Name)
+		go registerLogForService(logger.With("service", b.Name), service, repo.Org, repo.Name, buildUUID, b.Name, build, kubectl, ns.Name)
 	}
 
 	//perhaps wait for pod to be in Completed or Error state
 
 	// wait for all the build steps to finish
-	log.Println("Waiting for build steps...")
+	logger.Info("waiting for build steps")
 	/*	for _, b := range buildSteps {
 			waitForContainerTermination(kubectl, b, buildUUID, ns.Name)
 		}
@@ -326,16 +460,31 @@ func ExecuteBuild(kubectl *kubernetes.Clientset, service storage.Service, build
 		for _, step := range build.Steps {
 			if step.Name == b.Name {
 				wg.Add(1)
-				go func(kubectl *kubernetes.Clientset, b v1.Container, buildUUID string, namespace string, step *model.Step, build *model.Build, token string, targetURL string) {
+				go func(kubectl *kubernetes.Clientset, b v1.Container, buildUUID string, namespace string, step *model.Step, build *model.Build, targetURL string) {
 					defer wg.Done()
-					waitForBuildStep(kubectl, b, buildUUID, ns.Name, step, build, token, targetURL)
+					waitForBuildStep(logging.Step(step).With(logging.BuildUUIDKey, buildUUID), span, kubectl, b, buildUUID, ns.Name, step, build, reporter, targetURL)
 
-				}(kubectl, b, buildUUID, ns.Name, step, build, token, targetURL)
+				}(kubectl, b, buildUUID, ns.Name, step, build, targetURL)
 			}
 		}
 	}
 	wg.Wait()
-	log.Println("All build steps done...")
+	logger.Info("all build steps done")
+
+	for _, step := range build.Steps {
+		err = service.SaveStep(step)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unable to save build step %v", step.Name))
+		}
+	}
+	finishedPod, err := kubectl.CoreV1().Pods(ns.Name).Get(buildUUID, meta_v1.GetOptions{})
+	if err != nil {
+		kubeError("get_pod", err)
+		logger.Warn("unable to get pod, build timing will be incomplete", "error", err)
+	} else {
+		build.Timing.Queue, build.Timing.Init, build.Timing.Pull = podTiming(finishedPod)
+		traceInitContainers(span, finishedPod)
+	}
 
 	// TODO fix this
 	build.Status = "Done"
@@ -354,26 +503,73 @@ func ExecuteBuild(kubectl *kubernetes.Clientset, service storage.Service, build
 	}
 
 	// Add coverage to build
-	coverage := getCoverageFromLogs(build, buildNumber, testCoverage)
+	coverage := getCoverageFromLogs(logger, service, build, testCoverage)
 	build.Coverage = coverage
 
 	// calculate the time the build took
 	t := time.Now().Sub(build.Timestamp)
 	build.Duration = format.Duration(t)
+	build.Timing.Total = millis(build.Timestamp, time.Now())
 
 	err = service.SaveBuild(build)
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("unable to save build %v", build))
 	}
+	logger.Info("build done", "success", build.Success, "duration_ms", build.Timing.Total)
 
 	return nil
 }
 
-func waitForBuildStep(kubectl *kubernetes.Clientset, b v1.Container, buildUUID string, namespace string, step *model.Step, build *model.Build, token string, targetURL string) {
-	exitCode, _ := waitForContainerTermination(kubectl, b, buildUUID, namespace)
+// Notifier sends the results of finished builds, it only sends to the targets of .ci.yaml unless replaced
+var Notifier = notify.New(notify.Config{}, notify.SMTP{})
+
+// notifyResult sends the result of build to the server wide and the repository notification targets, failures are logged
+func notifyResult(logger *slog.Logger, span *tracing.Span, service storage.Service, build *model.Build, cfg notify.Config, targetURL string) {
+	if build.Fork {
+		// the targets of forks come from the fork, only the server wide targets are notified
+		cfg = notify.Config{}
+	}
+	builds, err := service.LoadBuilds(build.Org, build.Name)
+	if err != nil {
+		logger.Warn("unable to load previous build, recovery isn't notified", "error", err)
+	}
+	events := notify.Events(build, notify.Previous(builds, build))
+	notifySpan := span.Child("notify", "events", strings.Join(events, ","))
+	defer notifySpan.End()
+	url := fmt.Sprintf("%v/#/repo/%v/%v/build/%v", targetURL, build.Org, build.Name, build.Number)
+	for _, err := range Notifier.Notify(cfg, &notify.Notification{Build: build, Events: events, URL: url}) {
+		logger.Warn("unable to send notification", "error", err)
+		notifySpan.SetError(err)
+	}
+}
+
+func waitForBuildStep(logger *slog.Logger, span *tracing.Span, kubectl *kubernetes.Clientset, b v1.Container, buildUUID string, namespace string, step *model.Step, build *model.Build, reporter *reporter, targetURL string) {
+	exitCode := int32(-1)
+	terminated, err := waitForContainerTermination(kubectl, b, buildUUID, namespace)
+	if err != nil {
+		logger.Error("error while waiting for step to finish", "error", err)
+		stepSpan := span.Child("step "+step.Name, logging.StepKey, step.Name)
+		stepSpan.SetError(err)
+		stepSpan.End()
+	} else {
+		exitCode = terminated.ExitCode
+		step.Started = terminated.StartedAt.Time
+		step.Finished = terminated.FinishedAt.Time
+		step.Duration = millis(step.Started, step.Finished)
+		metrics.StepDuration.Observe(float64(step.Duration)/1000, build.Org+"/"+build.Name, step.Name)
+		stepSpan := span.ChildAt("step "+step.Name, step.Started, logging.StepKey, step.Name, "exitcode", exitCode)
+		if exitCode != 0 {
+			stepSpan.SetError(fmt.Errorf("step exited with code %v", exitCode))
+		}
+		stepSpan.EndAt(step.Finished)
+	}
 	step.ExitCode = exitCode
-	var state string
-	if exitCode == 0 {
+	var state, description string
+	if exitCode == 0 && terminated != nil && strings.TrimSpace(terminated.Message) == skippedMessage {
+		step.Status = "Skipped"
+		state = "skipped"
+		description = "the build status doesn't match"
+	} else if exitCode == 0 {
 		state = "success"
 	} else {
 		build.Status = "Failed"
@@ -381,20 +577,28 @@ func waitForBuildStep(kubectl *kubernetes.Clientset, b v1.Container, buildUUID s
 		step.Status = "Failed"
 		state = "error"
 	}
+	logger.Info("step finished", "exitcode", exitCode, "duration_ms", step.Duration)
 	callbackURL := fmt.Sprintf("%v/#/repo/%v/%v/build/%v/step/%v", targetURL, build.Org, build.Name, build.Number, step.Name)
-	err := github.ReportBack(github.GithubStatus{State: state, Context: step.Name, TargetURL: callbackURL}, build.StatusURL, build.Commit, token)
-	if err != nil {
-		log.Println("unable to report status back to github")
+	var output *github.CheckOutput
+	if UseChecks {
+		lines, err := logTail(kubectl, namespace, buildUUID, b.Name, annotationLogLines)
+		if err != nil {
+			logger.Warn("unable to read the log for the check run", "error", err)
+		}
+		output = stepCheckOutput(step, lines, b.WorkingDir)
 	}
-
+	reporter.report(logger, span, scm.Status{State: state, Context: step.Name, TargetURL: callbackURL, Description: description}, output)
 }
-func cleanupNamespace(kubectl *kubernetes.Clientset, namespace string) {
-	log.Printf("clean up of namespace %v started", namespace)
+func cleanupNamespace(logger *slog.Logger, kubectl *kubernetes.Clientset, namespace string) {
+	logger.Info("clean up of namespace started", "namespace", namespace)
 	err := kubectl.CoreV1().Namespaces().Delete(namespace, &meta_v1.DeleteOptions{})
 	if err != nil {
-		log.Println("Error while deleing namespace: ", err)
+		kubeError("delete_namespace", err)
+		logger.Error("error while deleting namespace", "namespace", namespace, "error", err)
+		return
 	}
-	log.Printf("Namespace %v deleted!", namespace)
+	metrics.ActiveNamespaces.Dec()
+	logger.Info("namespace deleted", "namespace", namespace)
 }
 
 // generateScript is a helper function that generates a build script and base64 encode it.
@@ -425,59 +629,147 @@ func ParseBytes(b []byte) (*Config, error) {
 	return out, nil
 }
 
-func getConfigfile(build *model.Build, token string) (*Config, error) {
-	yamldata, err := github.GetConfigFile(build.TreesURL, build.Commit, token)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to fetch config file from github")
+// ConfigFiles are the paths the build configuration is looked for at, in order, unless the repository configures a path
+var ConfigFiles = []string{".ci.yaml", ".ci.yml", ".seneferu.yaml"}
+
+// ErrNoConfig is returned when there's no build configuration at the commit, such commits aren't built
+var ErrNoConfig = errors.New("no build configuration found")
+
+// ErrNothingToBuild is returned when the branches of the build configuration or the constraints of every step
+// don't match the build, such builds aren't created
+var ErrNothingToBuild = errors.New("no steps match the build")
+
+func getConfigfile(build *model.Build, repo *model.Repo, provider scm.Provider, token string) (*Config, error) {
+	paths := ConfigFiles
+	if repo != nil && repo.ConfigPath != "" {
+		paths = []string{repo.ConfigPath}
+	}
+	for _, path := range paths {
+		yamldata, err := provider.ConfigFile(build, path, token)
+		if errors.Cause(err) == scm.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("unable to fetch %v from %v", path, provider.Name()))
+		}
+		return yamlToConfig(yamldata)
+	}
+	return nil, ErrNoConfig
+}
+
+// configErrorDescription explains why the build configuration couldn't be fetched, when it's not a parse error
+func configErrorDescription(err error) string {
+	switch errors.Cause(err) {
+	case scm.ErrUnauthorized:
+		return "not allowed to read the build configuration"
+	case scm.ErrRateLimited:
+		return "rate limited while fetching the build configuration"
 	}
-	return yamlToConfig(yamldata)
+	return ""
 }
 
 func yamlToConfig(yamldata []byte) (*Config, error) {
-	log.Println("YAML data:", string(yamldata))
+	slog.Debug("parsing .ci.yaml", "yaml", string(yamldata))
 	cfg, err := ParseBytes(yamldata)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to parse .ci.yaml file")
 	}
-	log.Println("Contructed cfg: ", cfg)
+	slog.Debug("constructed config", "config", fmt.Sprintf("%+v", cfg))
 	return cfg, nil
 }
 
 func doneCmd(count int) string {
 	doneStr := fmt.Sprintf("build%v", count)
 	touchStr := "touch " + shareddir + "/" + doneStr + ".done;"
-	doneCmd := `clean() { rc=$?; ` + touchStr + ` exit $rc; }; trap clean EXIT`
+	// the failed marker lets the following steps check the status of the build
+	failStr := "if [ $rc -ne 0 ]; then touch " + failedMarker + "; fi;"
+	doneCmd := `clean() { rc=$?; ` + failStr + ` ` + touchStr + ` exit $rc; }; trap clean EXIT`
 	return doneCmd
 }
 
-func getCoverageFromLogs(build *model.Build, buildNumber int, testCoverage string) string {
+func getCoverageFromLogs(logger *slog.Logger, service storage.Service, build *model.Build, testCoverage string) string {
+	if testCoverage == "" {
+		return ""
+	}
+	r, err := regexp.Compile(testCoverage)
+	if err != nil {
+		logger.Warn("invalid coverage expression", "coverage", testCoverage, "error", err)
+		return ""
+	}
 	// Search for the coverage regex in the logs, and add it to the build if found
 	for _, s := range build.Steps {
-		r, err := regexp.Compile(testCoverage)
-		if err != nil {
-			log.Println(err)
-			return ""
-		}
-		if result := r.FindString(s.Log); result != "" {
-			return result
+		for offset := 0; ; offset += logFlushLines {
+			lines, err := service.LoadLogLines(s.Org, s.Reponame, s.BuildNumber, s.Name, offset, logFlushLines)
+			if err != nil {
+				logger.Warn("unable to read log while looking for coverage", logging.StepKey, s.Name, "error", err)
+				return ""
+			}
+			for _, l := range lines {
+				if result := r.FindString(l.Content); result != "" {
+					return result
+				}
+			}
+			if len(lines) < logFlushLines {
+				break
+			}
 		}
 	}
 	return ""
 }
 
-func createBuildSteps(build *model.Build, cfg *Config, token string) ([]v1.Container, error) {
-	log.Println("Creating build steps from YAML file")
+// skippedStep is a step whose constraints don't match the build, Reason is reported as the description of its status
+type skippedStep struct {
+	Name   string
+	Reason string
+}
+
+// createBuildSteps returns the containers of the steps to run, and the steps skipped because their constraints
+// don't match build
+// createPodSpec fills in the spec of the build pod and returns the build steps, the steps skipped and the services in it.
+// The pods of forks get no secrets: the SSH key, the registry certificates and the token are left out and they clone anonymously.
+func createPodSpec(pod *v1.Pod, build *model.Build, cfg *Config, remote scm.Remote, token string, dockerRegHost string) ([]v1.Container, []skippedStep, []v1.Container, error) {
+	if cfg.Workspace.Path == "" {
+		cfg.Workspace.Path = build.Name
+	}
+	pod.Spec.Volumes = volumemounts(build)
+
+	var prepareSteps []v1.Container
+	if !build.Fork {
+		prepareSteps = append(prepareSteps, createSSHAgentContainer())
+	}
+	prepareSteps = append(prepareSteps, createGitContainer(build, remote, cfg.Workspace.Path, token, cfg.Clone))
+
+	buildSteps, skipped, err := createBuildSteps(build, cfg, token)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "unable to create build steps")
+	}
+
+	services, err := createServiceSteps(cfg)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "unable to create service")
+	}
+	// Add the docker containers that writes in shardir to create the socket
+	services = append(services, createDockerContainer(dockerRegHost, !build.Fork))
+
+	// call the prepareSteps as init containers
+	pod.Spec.InitContainers = prepareSteps
+	pod.Spec.Containers = append(pod.Spec.Containers, services...)
+	pod.Spec.Containers = append(pod.Spec.Containers, buildSteps...)
+	return buildSteps, skipped, services, nil
+}
+
+func createBuildSteps(build *model.Build, cfg *Config, token string) ([]v1.Container, []skippedStep, error) {
+	logger := logging.Build(build)
+	logger.Debug("creating build steps from YAML file")
 	count := 0
 	var containers []v1.Container
+	var skipped []skippedStep
 	for _, cont := range cfg.Pipeline.Containers {
-		// strip "refs/heads/"
-
-		branch := strings.Replace(build.Ref, "refs/heads/", "", -1)
-		if !cont.Constraints.Branch.Match(branch) {
-			log.Printf("Branch %v didn't meet condition of %v\n", build.Ref, cont.Constraints.Branch)
+		if reason := cont.Constraints.skipReason(build); reason != "" {
+			logger.Info("skipping step, its constraints don't match", logging.StepKey, cont.Name, "ref", build.Ref, "reason", reason)
+			skipped = append(skipped, skippedStep{Name: cont.Name, Reason: reason})
 			continue
 		}
-		log.Printf("Branch %v meet condition of %v\n", build.Ref, cont.Constraints.Branch)
 		var cmds []string
 		// first command should be the wait for containers+
 		cmds = append(cmds, waitForContainerCmd("git"))
@@ -494,6 +786,9 @@ func createBuildSteps(build *model.Build, cfg *Config, token string) ([]v1.Conta
 
 		doneCmd := doneCmd(count)
 		cmds = append(cmds, doneCmd)
+		if check := cont.Constraints.statusCheck(); check != "" {
+			cmds = append(cmds, check)
+		}
 
 		for _, v := range cont.Commands {
 			cmds = append(cmds, v)
@@ -504,8 +799,12 @@ func createBuildSteps(build *model.Build, cfg *Config, token string) ([]v1.Conta
 		buildEnv = append(buildEnv, v1.EnvVar{Name: "CI_SCRIPT", Value: generateScript(cmds)})
 		buildEnv = append(buildEnv, v1.EnvVar{Name: "GOPATH", Value: shareddir + "/go"})
 		buildEnv = append(buildEnv, v1.EnvVar{Name: "GIT_REF", Value: build.Commit})
-		buildEnv = append(buildEnv, v1.EnvVar{Name: "GITHUB_TOKEN", Value: token})
+		if !build.Fork {
+			// the token can write to the repository, so the steps of forks don't get it
+			buildEnv = append(buildEnv, v1.EnvVar{Name: "GITHUB_TOKEN", Value: token})
+		}
 		buildEnv = append(buildEnv, v1.EnvVar{Name: "DOCKER_HOST", Value: fmt.Sprintf("unix:///%v/docker.sock", shareddir)})
+		buildEnv = append(buildEnv, eventEnv(build)...)
 
 		for key, value := range cont.Environment {
 			buildEnv = append(buildEnv, v1.EnvVar{Name: key, Value: value})
@@ -520,11 +819,6 @@ func createBuildSteps(build *model.Build, cfg *Config, token string) ([]v1.Conta
 					Name:      "shared-data",
 					MountPath: shareddir,
 				},
-				{
-					Name:      "sshvolume",
-					MountPath: "/root/.ssh", //TODO this needs to be fixed
-
-				},
 			},
 			Env:        buildEnv,
 			WorkingDir: workspace,
@@ -533,6 +827,13 @@ func createBuildSteps(build *model.Build, cfg *Config, token string) ([]v1.Conta
 			},
 		}
 
+		if !build.Fork {
+			c.VolumeMounts = append(c.VolumeMounts, v1.VolumeMount{
+				Name:      "sshvolume",
+				MountPath: "/root/.ssh", //TODO this needs to be fixed
+			})
+		}
+
 		if len(cont.Args) > 0 {
 			c.Args = cont.Args
 		}
@@ -544,7 +845,24 @@ func createBuildSteps(build *model.Build, cfg *Config, token string) ([]v1.Conta
 		containers = append(containers, c)
 		count++
 	}
-	return containers, nil
+	return containers, skipped, nil
+}
+
+// eventEnv returns the environment variables describing what triggered build, the tag and the release if there is one
+func eventEnv(build *model.Build) []v1.EnvVar {
+	env := []v1.EnvVar{{Name: "CI_EVENT", Value: buildEvent(build)}}
+	if strings.HasPrefix(build.Ref, "refs/tags/") {
+		env = append(env, v1.EnvVar{Name: "CI_TAG", Value: strings.TrimPrefix(build.Ref, "refs/tags/")})
+	}
+	if r := build.Release; r != nil {
+		env = append(env,
+			v1.EnvVar{Name: "CI_RELEASE_ID", Value: strconv.FormatInt(r.ID, 10)},
+			v1.EnvVar{Name: "CI_RELEASE_NAME", Value: r.Name},
+			v1.EnvVar{Name: "CI_RELEASE_URL", Value: r.URL},
+			v1.EnvVar{Name: "CI_RELEASE_PRERELEASE", Value: strconv.FormatBool(r.Prerelease)},
+		)
+	}
+	return env
 }
 
 func createServiceSteps(cfg *Config) ([]v1.Container, error) {
@@ -562,42 +880,52 @@ func createServiceSteps(cfg *Config) ([]v1.Container, error) {
 	return containers, nil
 }
 
-func createGitContainer(build *model.Build, workspace string) v1.Container {
-
-	projectName := build.Org + "/" + build.Name
-	url := "git@github.com:" + projectName
+// CloneOverHTTPS clones repositories over HTTPS with the token of the provider instead of over SSH
+var CloneOverHTTPS = false
 
+func createGitContainer(build *model.Build, remote scm.Remote, workspace string, token string, clone CloneOptions) v1.Container {
 	workspace = shareddir + "/" + workspace
 
-	sshTrustCmd := "ssh-keyscan -t rsa github.com > ~/.ssh/known_hosts"
-	cloneCmd := fmt.Sprintf("git clone %v %v", url, workspace)
-	curWDCmd := fmt.Sprintf("cd %v", workspace)
-
-	// TODO take the last element of the refs/head/init this is most likely not a good idea
-	branch := ""
-	if strings.Contains(build.Ref, "/") {
-		branch = strings.Split(build.Ref, "/")[2]
-	} else {
-		// on a pullrequestevent we only get the branchname
-		branch = build.Ref
+	// forks clone anonymously over HTTPS, they get neither the SSH key nor the token
+	https := CloneOverHTTPS || build.Fork
+	url := remote.SSHCloneURL(build.Org, build.Name)
+	if https {
+		url = remote.HTTPSCloneURL(build.Org, build.Name)
 	}
-	checkoutCmd := fmt.Sprintf("git checkout %v", branch)
-	log.Println(checkoutCmd)
+	cloneCmds := cloneCommands(build, url, workspace, clone)
+	logging.Build(build).Debug("clone commands", "command", strings.Join(cloneCmds, "; "))
 
-	exportSSH := "SSH_AUTH_SOCK=/share/socket; export SSH_AUTH_SOCK"
 	doneCmd := "touch " + shareddir + "/git.done"
 
-	sshcmds := []string{
-		"echo starting ssh-agent",
-		"eval $(ssh-agent -a /share/socket1)",
-		"mkdir ~/.ssh",
-		"echo trying ssh-add",
-		"cp /ssh/id_rsa ~/.ssh/id_rsa",
-		"ssh-add ~/.ssh/id_rsa",
+	var cmds []string
+	switch {
+	case build.Fork:
+		// nothing to set up, the clone is anonymous
+	case CloneOverHTTPS:
+		// the token is read from the environment by a credential helper, so it isn't written to the repository config.
+		// The helper only answers for the host of the provider, submodules, LFS servers and redirects elsewhere don't get the token.
+		cmds = []string{
+			"git config --global " + shellQuote("credential.https://"+remote.Host+".helper") +
+				` '!f() { echo username=` + remote.TokenUser + `; echo "password=$GIT_TOKEN"; }; f'`,
+		}
+	default:
+		exportSSH := "SSH_AUTH_SOCK=/share/socket; export SSH_AUTH_SOCK"
+		sshTrustCmd := fmt.Sprintf("ssh-keyscan -p %v -t rsa %v > ~/.ssh/known_hosts", remote.SSHPort, remote.SSHHost)
+		cmds = []string{
+			"echo starting ssh-agent",
+			"eval $(ssh-agent -a /share/socket1)",
+			"mkdir ~/.ssh",
+			"echo trying ssh-add",
+			"cp /ssh/id_rsa ~/.ssh/id_rsa",
+			"ssh-add ~/.ssh/id_rsa",
+			exportSSH,
+			sshTrustCmd,
+		}
 	}
-	cmds := append(sshcmds, exportSSH, sshTrustCmd, cloneCmd, curWDCmd, checkoutCmd, doneCmd)
+	cmds = append(cmds, cloneCmds...)
+	cmds = append(cmds, doneCmd)
 
-	return v1.Container{
+	container := v1.Container{
 		Name:            "git",
 		Image:           "sorenmat/git:1.0",
 		ImagePullPolicy: v1.PullIfNotPresent,
@@ -606,24 +934,35 @@ func createGitContainer(build *model.Build, workspace string) v1.Container {
 				Name:      "shared-data",
 				MountPath: shareddir,
 			},
-			{
-				Name:      "ssh-agent",
-				MountPath: "/.ssh-agent",
-			},
-			{
-				Name:      "sshvolume",
-				MountPath: "/ssh",
-				ReadOnly:  false,
-			},
 		},
 
 		Command: []string{"/bin/sh", "-c", "echo $CI_SCRIPT | base64 -d |/bin/sh -e"},
 
 		Env: []v1.EnvVar{
-			{Name: "SSH_AUTH_SOCK", Value: "/.ssh-agent/socket"},
 			{Name: "CI_SCRIPT", Value: generateScript(cmds)},
+			// Git LFS files are only fetched when the clone options ask for them
+			{Name: "GIT_LFS_SKIP_SMUDGE", Value: "1"},
 		},
 	}
+	if build.Fork {
+		return container
+	}
+	container.VolumeMounts = append(container.VolumeMounts,
+		v1.VolumeMount{
+			Name:      "ssh-agent",
+			MountPath: "/.ssh-agent",
+		},
+		v1.VolumeMount{
+			Name:      "sshvolume",
+			MountPath: "/ssh",
+			ReadOnly:  false,
+		},
+	)
+	container.Env = append(container.Env, v1.EnvVar{Name: "SSH_AUTH_SOCK", Value: "/.ssh-agent/socket"})
+	if CloneOverHTTPS {
+		container.Env = append(container.Env, v1.EnvVar{Name: "GIT_TOKEN", Value: token})
+	}
+	return container
 }
 
 func createSSHAgentContainer() v1.Container {
@@ -666,9 +1005,10 @@ func createSSHAgentContainer() v1.Container {
 	}
 }
 
-func createDockerContainer(dockerRegHost string) v1.Container {
+// createDockerContainer returns the Docker daemon of the build, with the certificates of the registry at dockerRegHost if registryCerts is set
+func createDockerContainer(dockerRegHost string, registryCerts bool) v1.Container {
 	priv := true
-	return v1.Container{
+	c := v1.Container{
 		Name:            "docker",
 		Image:           "docker:17-dind",
 		ImagePullPolicy: v1.PullIfNotPresent,
@@ -677,27 +1017,31 @@ func createDockerContainer(dockerRegHost string) v1.Container {
 				Name:      "shared-data",
 				MountPath: "/var/run",
 			},
-			{
-				Name:      "docker-secrets",
-				MountPath: "/etc/docker/certs.d/" + dockerRegHost,
-			},
 		},
 		SecurityContext: &v1.SecurityContext{
 			Privileged: &priv,
 		},
 	}
+	if registryCerts {
+		c.VolumeMounts = append(c.VolumeMounts, v1.VolumeMount{
+			Name:      "docker-secrets",
+			MountPath: "/etc/docker/certs.d/" + dockerRegHost,
+		})
+	}
+	return c
 }
 
-func waitForContainerTermination(kubectl *kubernetes.Clientset, b v1.Container, buildUUID string, namespace string) (int32, error) {
+func waitForContainerTermination(kubectl *kubernetes.Clientset, b v1.Container, buildUUID string, namespace string) (*v1.ContainerStateTerminated, error) {
 	for {
 		pod, err := kubectl.CoreV1().Pods(namespace).Get(buildUUID, meta_v1.GetOptions{})
 		if err != nil {
-			return -1, errors.Wrap(err, "unable to get pod, while waiting for it")
+			kubeError("get_pod", err)
+			return nil, errors.Wrap(err, "unable to get pod, while waiting for it")
 		}
 		for _, v := range pod.Status.ContainerStatuses {
 			if v.Name == b.Name {
 				if v.State.Terminated != nil && v.State.Terminated.Reason != "" {
-					return v.State.Terminated.ExitCode, nil
+					return v.State.Terminated, nil
 				}
 				time.Sleep(2 * time.Second)
 			}
@@ -705,25 +1049,110 @@ func waitForContainerTermination(kubectl *kubernetes.Clientset, b v1.Container,
 	}
 }
 
-func registerLog(service storage.Service, org string, reponame string, step *model.Step, buildUUID string, name string, build *model.Build, kubectl *kubernetes.Clientset, namespace string) error {
+// podTiming returns how long the pod was queued before being scheduled, how long the init containers
+// ran and how long it took from the init containers being done until all containers had started, in milliseconds
+func podTiming(pod *v1.Pod) (queue int64, init int64, pull int64) {
+	var scheduled, initialized time.Time
+	for _, c := range pod.Status.Conditions {
+		if c.Status != v1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case v1.PodScheduled:
+			scheduled = c.LastTransitionTime.Time
+		case v1.PodInitialized:
+			initialized = c.LastTransitionTime.Time
+		}
+	}
+	queue = millis(pod.CreationTimestamp.Time, scheduled)
+
+	var initStart, initEnd time.Time
+	for _, c := range pod.Status.InitContainerStatuses {
+		t := c.State.Terminated
+		if t == nil {
+			continue
+		}
+		if initStart.IsZero() || t.StartedAt.Time.Before(initStart) {
+			initStart = t.StartedAt.Time
+		}
+		if t.FinishedAt.Time.After(initEnd) {
+			initEnd = t.FinishedAt.Time
+		}
+	}
+	init = millis(initStart, initEnd)
+
+	var started time.Time
+	for _, c := range pod.Status.ContainerStatuses {
+		var t time.Time
+		if c.State.Running != nil {
+			t = c.State.Running.StartedAt.Time
+		} else if c.State.Terminated != nil {
+			t = c.State.Terminated.StartedAt.Time
+		}
+		if t.After(started) {
+			started = t
+		}
+	}
+	if initialized.IsZero() {
+		initialized = initEnd
+	}
+	pull = millis(initialized, started)
+	return queue, init, pull
+}
+
+// traceInitContainers adds a span for each init container of pod that has terminated
+func traceInitContainers(span *tracing.Span, pod *v1.Pod) {
+	for _, c := range pod.Status.InitContainerStatuses {
+		t := c.State.Terminated
+		if t == nil {
+			continue
+		}
+		initSpan := span.ChildAt("init "+c.Name, t.StartedAt.Time, "container", c.Name, "exitcode", t.ExitCode)
+		if t.ExitCode != 0 {
+			initSpan.SetError(fmt.Errorf("init container exited with code %v: %v", t.ExitCode, t.Reason))
+		}
+		initSpan.EndAt(t.FinishedAt.Time)
+	}
+}
+
+// millis returns the milliseconds from one time to another, or 0 if either is unknown
+func millis(from, to time.Time) int64 {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return 0
+	}
+	return int64(to.Sub(from) / time.Millisecond)
+}
+
+func registerLog(logger *slog.Logger, service storage.Service, org string, reponame string, step *model.Step, buildUUID string, name string, build *model.Build, kubectl *kubernetes.Clientset, namespace string) error {
 	// start watching the logs in a separate go routine
-	err := saveLog(kubectl, buildUUID, name, step, namespace)
+	err := saveLog(logger, kubectl, service, buildUUID, name, step, namespace)
 	if err != nil {
-		log.Println("Error while getting log ", err)
+		logger.Error("error while getting log", "error", err)
 	}
 	step.Status = "Done"
+	// nothing is written to the log after this, so it can be archived
+	step.LogComplete = true
 	err = service.SaveStep(step)
+	if err == nil {
+		if archiver, ok := service.(storage.LogArchiver); ok {
+			if aerr := archiver.ArchiveLog(step); aerr != nil {
+				logger.Warn("unable to archive log, keeping it in the database", "error", aerr)
+			}
+		}
+	}
+	// only stop streaming once the complete log can be read from storage
+	Logs.Close(StreamKey(step.Org, step.Reponame, step.BuildNumber, step.Name))
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("unable to save build step %v", step))
 	}
 	return nil
 }
 
-func registerLogForService(service storage.Service, org string, reponame string, buildUUID string, name string, build *model.Build, kubectl *kubernetes.Clientset, namespace string) error {
+func registerLogForService(logger *slog.Logger, service storage.Service, org string, reponame string, buildUUID string, name string, build *model.Build, kubectl *kubernetes.Clientset, namespace string) error {
 	// get the log without waiting, since its a service and it should be running for ever...
-	err := saveLog(kubectl, buildUUID, name, nil, namespace)
+	err := saveLog(logger, kubectl, service, buildUUID, name, nil, namespace)
 	if err != nil {
-		log.Println("Error while getting log ", err)
+		logger.Error("error while getting log", "error", err)
 	}
 	err = service.SaveBuild(build)
 	if err != nil {
@@ -732,38 +1161,39 @@ func registerLogForService(service storage.Service, org string, reponame string,
 	return nil
 }
 
-func waitForContainer(kubectl *kubernetes.Clientset, buildname string, namespace string) error {
+func waitForContainer(logger *slog.Logger, kubectl *kubernetes.Clientset, buildname string, namespace string) error {
 	for {
 		pod, err := kubectl.CoreV1().Pods(namespace).Get(buildname, meta_v1.GetOptions{})
 		if err != nil {
+			kubeError("get_pod", err)
 			return errors.Wrap(err, "unable to get pod, while waiting for it")
 		}
 		reason, err := printPod(pod)
 		if err != nil {
-			log.Println("print pod error", err)
+			logger.Error("print pod error", "error", err)
 			return err
 		}
 		if reason == "Init:Error" {
-			return fmt.Errorf(reason)
+			return errors.New(reason)
 		}
 		if reason == "Running" {
 			return nil
 		}
 		if reason == "Failed" {
-			return fmt.Errorf(reason)
+			return errors.New(reason)
 		}
-		log.Println("unknown reason state", reason)
+		logger.Debug("unknown reason state", "reason", reason)
 		if pod.Status.Phase == v1.PodRunning || pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
 			return nil
 		}
-		log.Printf("Waitting for %v %v %v\n", buildname, pod.Status.Reason, pod.Status.Phase)
+		logger.Info("waiting for pod", "pod", buildname, "reason", pod.Status.Reason, "phase", pod.Status.Phase)
 		time.Sleep(2 * time.Second)
 	}
 }
 
 // saveLog get the build of container in a running pod
-func saveLog(kubectl *kubernetes.Clientset, pod string, container string, step *model.Step, namespace string) error {
-	log.Printf("Trying to get log for %v %v\n", pod, container)
+func saveLog(logger *slog.Logger, kubectl *kubernetes.Clientset, service storage.Service, pod string, container string, step *model.Step, namespace string) error {
+	logger.Debug("trying to get log", "pod", pod, "container", container)
 	req := kubectl.CoreV1().Pods(namespace).GetLogs(pod, &v1.PodLogOptions{
 		Container: container,
 		Follow:    true,
@@ -771,35 +1201,137 @@ func saveLog(kubectl *kubernetes.Clientset, pod string, container string, step *
 	})
 	readCloser, err := req.Stream()
 	if err != nil {
+		kubeError("get_logs", err)
 		return errors.Wrap(err, "unable to get stream: ")
 	}
 	defer readCloser.Close()
-	dbw := DBLogWriter{step: step}
-	_, err = io.Copy(io.MultiWriter(os.Stdout, dbw), readCloser)
+	var writers []io.Writer
+	if EchoOutput {
+		out := &outputLogger{logger: logger}
+		defer out.Close()
+		writers = append(writers, out)
+	}
+	if step != nil {
+		dbw := NewDBLogWriter(service, step)
+		defer dbw.Close()
+		// flush the log regularly, also when the step doesn't output anything
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			ticker := time.NewTicker(logFlushInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := dbw.Flush(); err != nil {
+						logger.Warn("unable to flush log", "error", err)
+					}
+				case <-stop:
+					return
+				}
+			}
+		}()
+		writers = append(writers, dbw, Logs.Open(StreamKey(step.Org, step.Reponame, step.BuildNumber, step.Name)))
+	}
+	_, err = io.Copy(io.MultiWriter(writers...), readCloser)
 	if err != nil {
 		return errors.Wrap(err, "unable to copy stream to stdout")
 	}
 	return err
 }
 
+const (
+	// logFlushInterval is how often the log lines of a running step are persisted
+	logFlushInterval = 2 * time.Second
+	// logFlushLines is the number of buffered lines that triggers a flush
+	logFlushLines = 500
+	// logMaxPendingLines is the number of lines buffered while they can't be saved, the oldest lines are dropped beyond it
+	logMaxPendingLines = 20 * logFlushLines
+)
+
+// DBLogWriter splits the log of a step into lines and persists them in
+// batches while the step is running
 type DBLogWriter struct {
-	step *model.Step
+	service storage.Service
+	step    *model.Step
+
+	mu      sync.Mutex
+	partial []byte
+	pending []*model.LogLine
+	next    int
+}
+
+// NewDBLogWriter creates a DBLogWriter appending to the log of step
+func NewDBLogWriter(service storage.Service, step *model.Step) *DBLogWriter {
+	return &DBLogWriter{service: service, step: step}
 }
 
-func (d DBLogWriter) Write(p []byte) (n int, err error) {
-	if d.step == nil {
-		return 0, nil
+func (d *DBLogWriter) Write(p []byte) (n int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.partial = append(d.partial, p...)
+	for {
+		i := bytes.IndexByte(d.partial, '\n')
+		if i < 0 {
+			break
+		}
+		d.addLine(string(d.partial[:i]))
+		d.partial = d.partial[i+1:]
+	}
+	if len(d.pending) >= logFlushLines {
+		// failing to save the log mustn't stop the log from being streamed, the lines are saved with the next flush
+		if err := d.flush(); err != nil {
+			logging.Step(d.step).Warn("unable to flush log", "error", err)
+			if dropped := len(d.pending) - logMaxPendingLines; dropped > 0 {
+				logging.Step(d.step).Warn("dropping log lines that couldn't be saved", "lines", dropped)
+				d.pending = d.pending[dropped:]
+			}
+		}
 	}
-	d.step.Log = d.step.Log + string(p)
 	return len(p), nil
 }
 
-func waitForSecret(kubectl *kubernetes.Clientset, name, namespace string) bool {
+// Flush persists the complete lines written so far
+func (d *DBLogWriter) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.flush()
+}
+
+// Close persists everything written, including a last line without a line break
+func (d *DBLogWriter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.partial) > 0 {
+		d.addLine(string(d.partial))
+		d.partial = nil
+	}
+	return d.flush()
+}
+
+func (d *DBLogWriter) addLine(content string) {
+	d.pending = append(d.pending, &model.LogLine{Number: d.next, Timestamp: time.Now(), Content: content})
+	d.next++
+}
+
+func (d *DBLogWriter) flush() error {
+	if len(d.pending) == 0 {
+		return nil
+	}
+	err := d.service.AppendLogLines(d.step.Org, d.step.Reponame, d.step.BuildNumber, d.step.Name, d.pending)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("unable to save log of step %v", d.step.Name))
+	}
+	d.pending = nil
+	return nil
+}
+
+func waitForSecret(logger *slog.Logger, kubectl *kubernetes.Clientset, name, namespace string) bool {
 	counter := 0
 	for {
 		sd, err := kubectl.CoreV1().Secrets(namespace).Get(name, meta_v1.GetOptions{})
-		if err != nil {
-			log.Printf("was unable to get %v in %v\n", name, namespace)
+		if kubeError("get_secret", err) != nil {
+			logger.Debug("was unable to get secret", "secret", name, "namespace", namespace, "error", err)
 		}
 		if sd.Name == name {
 			return true
@@ -812,12 +1344,12 @@ func waitForSecret(kubectl *kubernetes.Clientset, name, namespace string) bool {
 	}
 }
 
-func waitForNamespace(kubectl *kubernetes.Clientset, name string) bool {
+func waitForNamespace(logger *slog.Logger, kubectl *kubernetes.Clientset, name string) bool {
 	counter := 0
 	for {
 		ns, err := kubectl.CoreV1().Namespaces().Get(name, meta_v1.GetOptions{})
-		if err != nil {
-			log.Printf("was unable to get namespace %v\n", name)
+		if kubeError("get_namespace", err) != nil {
+			logger.Debug("was unable to get namespace", "namespace", name, "error", err)
 		}
 		if ns.Name == name {
 			return true
@@ -831,6 +1363,15 @@ func waitForNamespace(kubectl *kubernetes.Clientset, name string) bool {
 	}
 }
 
+// kubeError counts err as a failed call to the Kubernetes API and returns it. Not found errors are
+// expected while waiting for resources to be created, so they aren't counted.
+func kubeError(operation string, err error) error {
+	if err != nil && !k8s_errors.IsNotFound(err) {
+		metrics.KubernetesErrors.Inc(operation)
+	}
+	return err
+}
+
 func printPod(pod *v1.Pod) (string, error) {
 	restarts := 0
 	readyContainers := 0
@@ -1,16 +1,31 @@
 package builder
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sorenmat/pipeline/pipeline/frontend/yaml"
 	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/metrics"
 	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/notify"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/storage"
+	"gitlab.com/sorenmat/seneferu/storage/memory"
+	"gitlab.com/sorenmat/seneferu/tracing"
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestSomePath(t *testing.T) {
@@ -41,7 +56,7 @@ func TestCreateBuild(t *testing.T) {
 	cfg := &Config{}
 	cfg.Pipeline.Containers = append(cfg.Pipeline.Containers, container)
 
-	steps, err := createBuildSteps(build, cfg, "")
+	steps, _, err := createBuildSteps(build, cfg, "")
 	if err != nil {
 		t.Error("createBuildStep should not have failed")
 	}
@@ -59,6 +74,58 @@ func TestCreateBuild(t *testing.T) {
 	}
 }
 
+func TestForkBuildsDontGetTheToken(t *testing.T) {
+	cfg := &Config{}
+	cfg.Pipeline.Containers = append(cfg.Pipeline.Containers, &Container{Name: "test"})
+
+	steps, _, err := createBuildSteps(&model.Build{Org: "org", Name: "repo"}, cfg, "secret-token")
+	assert.NoError(t, err)
+	assert.Contains(t, steps[0].Env, v1.EnvVar{Name: "GITHUB_TOKEN", Value: "secret-token"})
+
+	steps, _, err = createBuildSteps(&model.Build{Org: "org", Name: "repo", PullRequest: 1, Fork: true}, cfg, "secret-token")
+	assert.NoError(t, err)
+	for _, env := range steps[0].Env {
+		assert.NotEqual(t, "secret-token", env.Value, env.Name)
+	}
+}
+
+func TestForkPodsGetNoSecrets(t *testing.T) {
+	defer func(b bool) { CloneOverHTTPS = b }(CloneOverHTTPS)
+	CloneOverHTTPS = true
+	cfg := &Config{}
+	cfg.Pipeline.Containers = append(cfg.Pipeline.Containers, &Container{Name: "test", Image: "golang"})
+	build := &model.Build{Org: "org", Name: "repo", Commit: "abc", Ref: "feature", PullRequest: 1, BaseRef: "master", Fork: true}
+
+	pod := &v1.Pod{}
+	steps, _, _, err := createPodSpec(pod, build, cfg, scm.NewGitHub(nil).Remote(), "secret-token", "registry.example.com")
+	assert.NoError(t, err)
+	assert.Len(t, steps, 1)
+	for _, vol := range pod.Spec.Volumes {
+		assert.Nil(t, vol.Secret, vol.Name)
+	}
+	containers := append(pod.Spec.InitContainers, pod.Spec.Containers...)
+	assert.Len(t, containers, 3, "no ssh-agent")
+	for _, c := range containers {
+		for _, m := range c.VolumeMounts {
+			assert.Equal(t, "shared-data", m.Name, c.Name)
+		}
+		for _, env := range c.Env {
+			assert.NotContains(t, []string{"GITHUB_TOKEN", "GIT_TOKEN", "SSH_AUTH_SOCK"}, env.Name, c.Name)
+			assert.NotEqual(t, "secret-token", env.Value, c.Name)
+		}
+	}
+	script := gitScript(t, pod.Spec.InitContainers[0])
+	assert.Contains(t, script, "git clone https://github.com/org/repo.git /share/repo")
+	assert.NotContains(t, script, "credential")
+
+	build.Fork = false
+	pod = &v1.Pod{}
+	_, _, _, err = createPodSpec(pod, build, cfg, scm.NewGitHub(nil).Remote(), "secret-token", "registry.example.com")
+	assert.NoError(t, err)
+	assert.Len(t, pod.Spec.Volumes, 4)
+	assert.Len(t, pod.Spec.InitContainers, 2)
+}
+
 func TestCoverage(t *testing.T) {
 	str := `coverage: (\d+?.?\d+\%)`
 
@@ -66,11 +133,17 @@ func TestCoverage(t *testing.T) {
 	cfg := &Config{}
 	cfg.Pipeline.Containers = append(cfg.Pipeline.Containers, container)
 
+	step := &model.Step{StepInfo: model.StepInfo{Org: "org", Reponame: "repo", BuildNumber: 1, Name: "build"}}
 	build := &model.Build{
 		Number: 1,
-		Steps:  []*model.Step{{Log: "Build worked\ncoverage: 40%"}},
+		Steps:  []*model.Step{step},
 	}
-	coverageResult := getCoverageFromLogs(build, 1, str)
+	service := memory.New()
+	d := NewDBLogWriter(service, step)
+	d.Write([]byte("Build worked\ncoverage: 40%"))
+	d.Close()
+
+	coverageResult := getCoverageFromLogs(slog.Default(), service, build, str)
 	if coverageResult == "" {
 		t.Error("not able to get coverageResult ")
 	}
@@ -78,29 +151,147 @@ func TestCoverage(t *testing.T) {
 }
 
 func TestDBLogWriter(t *testing.T) {
-	step := &model.Step{}
-	d := DBLogWriter{step: step}
-	d.Write([]byte("Hello world"))
-	d.Write([]byte("Hello world, from me"))
-	if step.Log != "Hello worldHello world, from me" {
-		t.Error(step)
+	step := &model.Step{StepInfo: model.StepInfo{Org: "org", Reponame: "repo", BuildNumber: 1, Name: "build"}}
+	service := memory.New()
+	d := NewDBLogWriter(service, step)
+	d.Write([]byte("Hello world\nHello "))
+	d.Write([]byte("world, from me\nand"))
+
+	assert.NoError(t, d.Flush())
+	lines, err := service.LoadLogLines("org", "repo", 1, "build", 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(lines), "only complete lines should be flushed")
+
+	assert.NoError(t, d.Close())
+	lines, err = service.LoadLogLines("org", "repo", 1, "build", 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, 1, lines[1].Number)
+	assert.Equal(t, "Hello world, from me", lines[1].Content)
+	assert.Equal(t, "and", lines[2].Content)
+}
+
+func TestDBLogWriterFlushesFullBatches(t *testing.T) {
+	step := &model.Step{StepInfo: model.StepInfo{Org: "org", Reponame: "repo", BuildNumber: 1, Name: "build"}}
+	service := memory.New()
+	d := NewDBLogWriter(service, step)
+	for i := 0; i < logFlushLines; i++ {
+		d.Write([]byte("line\n"))
 	}
+	lines, err := service.LoadLogLines("org", "repo", 1, "build", 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, logFlushLines, len(lines))
+}
+
+// failingLogStore fails to append log lines while fail is set
+type failingLogStore struct {
+	storage.Service
+	fail bool
+}
+
+func (f *failingLogStore) AppendLogLines(org string, name string, build int, stepname string, lines []*model.LogLine) error {
+	if f.fail {
+		return errors.New("database is down")
+	}
+	return f.Service.AppendLogLines(org, name, build, stepname, lines)
+}
+
+func TestDBLogWriterKeepsWritingWhenSavingFails(t *testing.T) {
+	step := &model.Step{StepInfo: model.StepInfo{Org: "org", Reponame: "repo", BuildNumber: 1, Name: "build"}}
+	service := &failingLogStore{Service: memory.New(), fail: true}
+	d := NewDBLogWriter(service, step)
+	for i := 0; i < logMaxPendingLines+logFlushLines; i++ {
+		n, err := d.Write([]byte("line\n"))
+		assert.NoError(t, err)
+		assert.Equal(t, 5, n)
+	}
+	assert.Len(t, d.pending, logMaxPendingLines, "the buffered lines are capped")
+
+	service.fail = false
+	assert.NoError(t, d.Close())
+	lines, err := service.LoadLogLines("org", "repo", 1, "build", 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, lines, logMaxPendingLines)
+}
+
+func TestPodTiming(t *testing.T) {
+	created := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) meta_v1.Time { return meta_v1.NewTime(created.Add(d)) }
+	pod := &v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{CreationTimestamp: at(0)},
+		Status: v1.PodStatus{
+			Conditions: []v1.PodCondition{
+				{Type: v1.PodScheduled, Status: v1.ConditionTrue, LastTransitionTime: at(3 * time.Second)},
+				{Type: v1.PodInitialized, Status: v1.ConditionTrue, LastTransitionTime: at(10 * time.Second)},
+			},
+			InitContainerStatuses: []v1.ContainerStatus{
+				{Name: "clone", State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: at(4 * time.Second), FinishedAt: at(9 * time.Second)}}},
+			},
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "build", State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: at(12 * time.Second), FinishedAt: at(30 * time.Second)}}},
+				{Name: "test", State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: at(15 * time.Second)}}},
+			},
+		},
+	}
+	queue, init, pull := podTiming(pod)
+	assert.Equal(t, int64(3000), queue)
+	assert.Equal(t, int64(5000), init)
+	assert.Equal(t, int64(5000), pull)
+}
+
+func TestPodTimingUnscheduled(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: meta_v1.ObjectMeta{CreationTimestamp: meta_v1.Now()}}
+	queue, init, pull := podTiming(pod)
+	assert.Equal(t, int64(0), queue)
+	assert.Equal(t, int64(0), init)
+	assert.Equal(t, int64(0), pull)
+}
+
+func TestTraceInitContainers(t *testing.T) {
+	exporter := tracing.NewInMemoryExporter()
+	span := tracing.NewTracer(exporter).Start("build")
+	started := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	pod := &v1.Pod{Status: v1.PodStatus{InitContainerStatuses: []v1.ContainerStatus{
+		{Name: "ssh-agent", State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{StartedAt: meta_v1.NewTime(started), FinishedAt: meta_v1.NewTime(started.Add(time.Second))}}},
+		{Name: "git", State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 128, Reason: "Error", StartedAt: meta_v1.NewTime(started.Add(time.Second)), FinishedAt: meta_v1.NewTime(started.Add(4 * time.Second))}}},
+		{Name: "waiting", State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}},
+	}}}
+	traceInitContainers(span, pod)
+
+	spans := exporter.Spans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "init ssh-agent", spans[0].Name)
+	assert.Nil(t, spans[0].Err)
+	assert.Equal(t, "init git", spans[1].Name)
+	assert.Equal(t, span.SpanID, spans[1].ParentID)
+	assert.Equal(t, 3*time.Second, spans[1].EndTime.Sub(spans[1].StartTime))
+	assert.Error(t, spans[1].Err)
+}
+
+func TestReportBackIsTraced(t *testing.T) {
+	exporter := tracing.NewInMemoryExporter()
+	span := tracing.NewTracer(exporter).Start("build")
+	// without a status URL the report fails right away
+	newReporter(&model.Build{}, scm.NewGitHub(github.StaticToken(""))).report(slog.Default(), span, scm.Status{State: "pending", Context: "test"}, nil)
+
+	report := exporter.Find("report_status")
+	assert.NotNil(t, report)
+	assert.Equal(t, span.SpanID, report.ParentID)
+	assert.Equal(t, "pending", report.Attribute("state"))
+	assert.Error(t, report.Err)
 }
 
 func TestStepSerialize(t *testing.T) {
 	step := &model.Step{}
 	step.Name = "test"
-	step.Log = "Say "
-	d := DBLogWriter{step: step}
-	d.Write([]byte("Hello world"))
-	assert.Equal(t, "Say Hello world", step.Log)
+	step.Log = "Say Hello world"
 	b, err := json.Marshal(step)
 	assert.NoError(t, err)
 	assert.NotNil(t, b)
 }
 
 func TestCreateDockerContainer(t *testing.T) {
-	c := createDockerContainer("some.host.com")
+	c := createDockerContainer("some.host.com", true)
 	assert.Equal(t, "/var/run", c.VolumeMounts[0].MountPath)
 	assert.Equal(t, "/etc/docker/certs.d/some.host.com", c.VolumeMounts[1].MountPath)
 	assert.True(t, *c.SecurityContext.Privileged)
@@ -142,29 +333,29 @@ func TestBuildPipeline(t *testing.T) {
 	c := Config{Pipeline: Containers{Containers: []*Container{
 		&Container{
 			Name: "MyStep",
-			Constraints: yaml.Constraints{
+			Constraints: Constraints{Constraints: yaml.Constraints{
 				Branch: yaml.Constraint{
 					Include: []string{"master"},
 				},
-			},
+			}},
 		}, &Container{
 			Name: "My Production Step",
-			Constraints: yaml.Constraints{
+			Constraints: Constraints{Constraints: yaml.Constraints{
 				Branch: yaml.Constraint{
 					Include: []string{"production"},
 				},
-			},
+			}},
 		}, &Container{
 			Name: "My Excluded Production Step",
-			Constraints: yaml.Constraints{
+			Constraints: Constraints{Constraints: yaml.Constraints{
 				Branch: yaml.Constraint{
 					Exclude: []string{"myproduction"},
 				},
-			},
+			}},
 		},
 	}}}
 	build := model.Build{Ref: "refs/heads/master"}
-	containers, err := createBuildSteps(&build, &c, "")
+	containers, _, err := createBuildSteps(&build, &c, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, containers)
 	assert.Equal(t, 2, len(containers))
@@ -179,7 +370,7 @@ func TestEmptyBuildPipeline(t *testing.T) {
 		},
 	}}}
 	build := model.Build{Ref: "refs/heads/master"}
-	containers, err := createBuildSteps(&build, &c, "")
+	containers, _, err := createBuildSteps(&build, &c, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, containers)
 	assert.Equal(t, 1, len(containers))
@@ -209,21 +400,244 @@ func TestBranchesFromYAMLFile(t *testing.T) {
 	c, err := yamlToConfig(data)
 
 	build := model.Build{Ref: "refs/heads/master"}
-	containers, err := createBuildSteps(&build, c, "")
+	containers, _, err := createBuildSteps(&build, c, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, containers)
 	assert.Equal(t, 3, len(containers))
 	// branch not matching
 	build = model.Build{Ref: "refs/heads/mysuperbranch"}
-	containers, err = createBuildSteps(&build, c, "")
+	containers, _, err = createBuildSteps(&build, c, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, containers)
 	assert.Equal(t, 2, len(containers))
 	// mathcing tags
 	build = model.Build{Ref: "refs/tags/v1.0"}
-	containers, err = createBuildSteps(&build, c, "")
+	containers, _, err = createBuildSteps(&build, c, "")
 	assert.NoError(t, err)
 	assert.NotNil(t, containers)
 	assert.Equal(t, 3, len(containers))
 
 }
+
+func TestNotifyFromYAML(t *testing.T) {
+	c, err := yamlToConfig([]byte(`
+pipeline:
+  test:
+    image: golang
+notify:
+  slack:
+    - url: https://hooks.slack.com/services/x
+      channel: "#ci"
+  webhook:
+    - url: https://example.com/hook
+      secret: s3cret
+      when: [always]
+  email:
+    - to: [dev@example.com]
+      when: [failure]
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "#ci", c.Notify.Slack[0].Channel)
+	assert.Equal(t, "s3cret", c.Notify.Webhook[0].Secret)
+	assert.Equal(t, []string{"always"}, c.Notify.Webhook[0].When)
+	assert.Equal(t, []string{"dev@example.com"}, c.Notify.Email[0].To)
+}
+
+func gitScript(t *testing.T, c v1.Container) string {
+	for _, e := range c.Env {
+		if e.Name == "CI_SCRIPT" {
+			script, err := base64.StdEncoding.DecodeString(e.Value)
+			assert.NoError(t, err)
+			return string(script)
+		}
+	}
+	t.Fatal("no CI_SCRIPT in container")
+	return ""
+}
+
+func TestGitContainerClonesFromHost(t *testing.T) {
+	defer func(h github.Host) { github.DefaultHost = h }(github.DefaultHost)
+	github.DefaultHost = github.NewHost("github.example.com", "", "", 2222)
+
+	build := &model.Build{Org: "org", Name: "repo", Ref: "refs/heads/master", Commit: "abc"}
+	script := gitScript(t, createGitContainer(build, scm.NewGitHub(nil).Remote(), "repo", "secret-token", CloneOptions{}))
+	assert.Contains(t, script, "ssh-keyscan -p 2222 -t rsa github.example.com")
+	assert.Contains(t, script, "git clone ssh://git@github.example.com:2222/org/repo.git /share/repo")
+	assert.Contains(t, script, "git checkout -q -B master abc")
+	assert.NotContains(t, script, "secret-token")
+}
+
+func TestGitContainerClonesOverHTTPS(t *testing.T) {
+	defer func(b bool) { CloneOverHTTPS = b }(CloneOverHTTPS)
+	CloneOverHTTPS = true
+
+	build := &model.Build{Org: "org", Name: "repo", Ref: "refs/heads/master"}
+	c := createGitContainer(build, scm.NewGitHub(nil).Remote(), "repo", "secret-token", CloneOptions{})
+	script := gitScript(t, c)
+	assert.Contains(t, script, "git clone https://github.com/org/repo.git /share/repo")
+	assert.NotContains(t, script, "ssh-add")
+	assert.NotContains(t, script, "secret-token")
+	assert.Contains(t, c.Env, v1.EnvVar{Name: "GIT_TOKEN", Value: "secret-token"})
+	assert.Contains(t, script, `git config --global credential.https://github.com.helper '!f() { echo username=x-access-token; echo "password=$GIT_TOKEN"; }; f'`+"\n")
+	assert.NotContains(t, script, "credential.helper")
+}
+
+func TestGitContainerClonesFromGitLab(t *testing.T) {
+	defer func(b bool) { CloneOverHTTPS = b }(CloneOverHTTPS)
+	CloneOverHTTPS = true
+
+	gitlab, err := scm.NewGitLab("https://gitlab.example.com", "secret-token", "secret", "", 0)
+	assert.NoError(t, err)
+	build := &model.Build{Org: "group/sub", Name: "repo", Ref: "refs/heads/master"}
+	script := gitScript(t, createGitContainer(build, gitlab.Remote(), "repo", "secret-token", CloneOptions{}))
+	assert.Contains(t, script, "git clone https://gitlab.example.com/group/sub/repo.git /share/repo")
+	assert.Contains(t, script, "git config --global credential.https://gitlab.example.com.helper '!f() { echo username=oauth2;")
+}
+
+// fileProvider serves the files in files, any other path isn't found
+type fileProvider struct {
+	*scm.GitHub
+	files     map[string]string
+	requested []string
+}
+
+func (p *fileProvider) ConfigFile(build *model.Build, path string, token string) ([]byte, error) {
+	p.requested = append(p.requested, path)
+	if f, ok := p.files[path]; ok {
+		return []byte(f), nil
+	}
+	return nil, errors.Wrap(scm.ErrNotFound, path)
+}
+
+func TestConfigFileFallbacks(t *testing.T) {
+	build := &model.Build{Org: "org", Name: "repo"}
+	p := &fileProvider{files: map[string]string{".seneferu.yaml": "workspace:\n  path: seneferu\n", "ci/build.yaml": "workspace:\n  path: custom\n"}}
+	cfg, err := getConfigfile(build, &model.Repo{}, p, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "seneferu", cfg.Workspace.Path)
+	assert.Equal(t, []string{".ci.yaml", ".ci.yml", ".seneferu.yaml"}, p.requested)
+
+	p.requested = nil
+	cfg, err = getConfigfile(build, &model.Repo{ConfigPath: "ci/build.yaml"}, p, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "custom", cfg.Workspace.Path)
+	assert.Equal(t, []string{"ci/build.yaml"}, p.requested)
+
+	_, err = getConfigfile(build, &model.Repo{ConfigPath: "missing.yaml"}, p, "")
+	assert.Equal(t, ErrNoConfig, errors.Cause(err))
+	p.files = nil
+	_, err = getConfigfile(build, nil, p, "")
+	assert.Equal(t, ErrNoConfig, errors.Cause(err))
+}
+
+func TestConfigErrorDescription(t *testing.T) {
+	assert.Equal(t, "not allowed to read the build configuration", configErrorDescription(errors.Wrap(scm.ErrUnauthorized, "github returned 401")))
+	assert.Equal(t, "rate limited while fetching the build configuration", configErrorDescription(errors.Wrap(scm.ErrRateLimited, "github returned 429")))
+	assert.Empty(t, configErrorDescription(errors.New("unable to parse .ci.yaml file")))
+}
+
+// statusProvider serves files like fileProvider and records the statuses reported
+type statusProvider struct {
+	fileProvider
+	statuses []scm.Status
+}
+
+func (p *statusProvider) Token(string, string) (string, error) {
+	return "token", nil
+}
+
+func (p *statusProvider) ReportStatus(build *model.Build, status scm.Status, token string) error {
+	p.statuses = append(p.statuses, status)
+	return nil
+}
+
+func TestBuildsThatCantRunAreNotified(t *testing.T) {
+	var notified []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n struct {
+			Status string `json:"status"`
+		}
+		json.NewDecoder(r.Body).Decode(&n)
+		notified = append(notified, n.Status)
+	}))
+	defer ts.Close()
+	defer func(n *notify.Notifier) { Notifier = n }(Notifier)
+	Notifier = notify.New(notify.Config{Webhook: []notify.Webhook{{URL: ts.URL}}}, notify.SMTP{})
+
+	service := memory.New()
+	p := &statusProvider{fileProvider: fileProvider{files: map[string]string{".ci.yaml": "pipeline: ["}}}
+	build := &model.Build{Org: "org", Name: "repo", Commit: "abc", Ref: "refs/heads/master"}
+	err := executeBuild(tracing.Start("test"), nil, service, build, &model.Repo{}, p, "http://ci", "", "")
+	assert.Error(t, err)
+	assert.Equal(t, "Failed", build.Status)
+	assert.Equal(t, []string{"Failed"}, notified, "a build configuration that can't be parsed is a failure")
+}
+
+func TestSkipBuild(t *testing.T) {
+	service := memory.New()
+	p := &statusProvider{fileProvider: fileProvider{files: map[string]string{".ci.yaml": "pipeline:\n  build:\n    image: golang\n  test:\n    image: golang\n"}}}
+	build := &model.Build{Org: "org", Name: "repo", Commit: "abc", Ref: "refs/heads/master"}
+	err := SkipBuild(tracing.Start("test"), service, build, &model.Repo{}, p, "http://ci", "skipped by the commit message")
+	assert.NoError(t, err)
+	assert.Equal(t, "Skipped", build.Status)
+	assert.Equal(t, 1, build.Number)
+	steps, err := service.LoadSteps("org", "repo", 1)
+	assert.NoError(t, err)
+	assert.Len(t, steps, 2)
+	assert.Equal(t, "Skipped", steps[0].Status)
+	assert.Equal(t, []scm.Status{
+		{State: "skipped", Context: "build", TargetURL: "http://ci/#/repo/org/repo/build/1", Description: "skipped by the commit message"},
+		{State: "skipped", Context: "test", TargetURL: "http://ci/#/repo/org/repo/build/1", Description: "skipped by the commit message"},
+	}, p.statuses)
+
+	// commits without a build configuration aren't recorded
+	p = &statusProvider{}
+	build = &model.Build{Org: "org", Name: "other", Commit: "abc"}
+	assert.NoError(t, SkipBuild(tracing.Start("test"), service, build, &model.Repo{}, p, "http://ci", "skipped"))
+	assert.Equal(t, 0, build.Number)
+	assert.Empty(t, p.statuses)
+
+	var buf bytes.Buffer
+	assert.NoError(t, metrics.Default.Write(&buf))
+	assert.Contains(t, buf.String(), `seneferu_builds_total{repo="org/repo",result="skipped"} 1`)
+	assert.NotContains(t, buf.String(), `seneferu_builds_total{repo="org/other",result="skipped"}`, "nothing was skipped")
+}
+
+func TestGitContainerChecksOutRef(t *testing.T) {
+	build := &model.Build{Org: "org", Name: "repo", Ref: "refs/heads/feature/login", Commit: "abc"}
+	assert.Contains(t, gitScript(t, createGitContainer(build, scm.NewGitHub(nil).Remote(), "repo", "", CloneOptions{})), "git checkout -q -B feature/login abc\n")
+	build.Ref = "refs/tags/v1.0"
+	assert.Contains(t, gitScript(t, createGitContainer(build, scm.NewGitHub(nil).Remote(), "repo", "", CloneOptions{})), "git checkout -q abc\n")
+}
+
+func TestEventEnv(t *testing.T) {
+	assert.Equal(t, []v1.EnvVar{{Name: "CI_EVENT", Value: "push"}}, eventEnv(&model.Build{Ref: "refs/heads/master"}))
+	assert.Equal(t, []v1.EnvVar{{Name: "CI_EVENT", Value: "tag"}, {Name: "CI_TAG", Value: "v1.0"}}, eventEnv(&model.Build{Ref: "refs/tags/v1.0", Event: "tag"}))
+	build := &model.Build{Ref: "refs/tags/v1.0", Event: "release", Release: &model.Release{ID: 7, Name: "First", URL: "https://github.com/org/repo/releases/tag/v1.0", Prerelease: true}}
+	assert.Equal(t, []v1.EnvVar{
+		{Name: "CI_EVENT", Value: "release"},
+		{Name: "CI_TAG", Value: "v1.0"},
+		{Name: "CI_RELEASE_ID", Value: "7"},
+		{Name: "CI_RELEASE_NAME", Value: "First"},
+		{Name: "CI_RELEASE_URL", Value: "https://github.com/org/repo/releases/tag/v1.0"},
+		{Name: "CI_RELEASE_PRERELEASE", Value: "true"},
+	}, eventEnv(build))
+}
+
+func TestGitContainerChecksOutPullRequest(t *testing.T) {
+	defer func(s string) { PullRequestCheckout = s }(PullRequestCheckout)
+	build := &model.Build{Org: "org", Name: "repo", Commit: "abc", Ref: "feature", PullRequest: 7, BaseRef: "master"}
+
+	script := gitScript(t, createGitContainer(build, scm.NewGitHub(nil).Remote(), "repo", "", CloneOptions{}))
+	assert.Contains(t, script, "git clone git@github.com:org/repo.git /share/repo")
+	assert.Contains(t, script, "git fetch origin abc\n")
+	assert.Contains(t, script, "git fetch origin +refs/pull/7/merge:refs/remotes/origin/pull/7/merge || true\n")
+	assert.Contains(t, script, `if [ "$(git rev-parse -q --verify refs/remotes/origin/pull/7/merge^2)" = abc ]; then git checkout -q refs/remotes/origin/pull/7/merge;`)
+	assert.Contains(t, script, "git fetch origin master && git checkout -q FETCH_HEAD")
+	assert.NotContains(t, script, "git checkout feature")
+
+	PullRequestCheckout = "head"
+	script = gitScript(t, createGitContainer(build, scm.NewGitHub(nil).Remote(), "repo", "", CloneOptions{}))
+	assert.Contains(t, script, "git fetch origin abc\ngit checkout -q abc\n")
+	assert.NotContains(t, script, "merge")
+}
@@ -0,0 +1,165 @@
+package builder
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/tracing"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// UseChecks publishes check runs through the GitHub Checks API instead of commit statuses
+var UseChecks = false
+
+// CheckLogLines is the number of lines at the end of the log of a step shown in its check run
+var CheckLogLines = 100
+
+const (
+	// annotationLogLines is the number of lines at the end of the log of a step searched for annotations
+	annotationLogLines = 5000
+	// maxCheckText is the length of the text of a check run GitHub accepts
+	maxCheckText = 65535
+)
+
+// reporter reports the status of a build back to its provider, as commit statuses or, on GitHub, as check runs
+type reporter struct {
+	build    *model.Build
+	provider scm.Provider
+
+	mu sync.Mutex
+	// runs are the ids of the check runs created, by name
+	runs map[string]int64
+}
+
+func newReporter(build *model.Build, provider scm.Provider) *reporter {
+	return &reporter{build: build, provider: provider, runs: make(map[string]int64)}
+}
+
+// report reports status, output is only used for check runs and may be nil. Failures are logged.
+func (r *reporter) report(logger *slog.Logger, span *tracing.Span, status scm.Status, output *github.CheckOutput) {
+	reportSpan := span.Child("report_status", "state", status.State, "context", status.Context)
+	// the token is fetched for every report, tokens of GitHub Apps expire during long builds
+	token, err := r.provider.Token(r.build.Org, r.build.Name)
+	if err == nil {
+		if _, ok := r.provider.(*scm.GitHub); ok && UseChecks {
+			err = r.reportCheck(status, output, token)
+		} else {
+			err = r.provider.ReportStatus(r.build, status, token)
+		}
+	}
+	reportSpan.SetError(err)
+	reportSpan.End()
+	if err != nil {
+		logger.Warn("unable to report status back", "provider", r.provider.Name(), "state", status.State, "context", status.Context, "error", err)
+	}
+}
+
+func (r *reporter) reportCheck(status scm.Status, output *github.CheckOutput, token string) error {
+	repoURL, err := github.RepoURL(r.build.StatusURL)
+	if err != nil {
+		return err
+	}
+	run := &github.CheckRun{
+		Name:       status.Context,
+		HeadSHA:    r.build.Commit,
+		DetailsURL: status.TargetURL,
+		ExternalID: CheckRunExternalID(r.build),
+		Output:     output,
+	}
+	if status.State == "pending" {
+		run.Status = "queued"
+	} else {
+		now := time.Now()
+		run.Status = "completed"
+		run.CompletedAt = &now
+		run.Conclusion = "failure"
+		if status.State == "success" || status.State == "skipped" {
+			run.Conclusion = status.State
+		}
+		run.Actions = []github.CheckAction{{Label: "Re-run", Description: "Build this commit again", Identifier: github.RerunAction}}
+		if run.Output == nil {
+			run.Output = &github.CheckOutput{Title: status.Context + " " + run.Conclusion, Summary: status.Description}
+		}
+	}
+
+	r.mu.Lock()
+	id, ok := r.runs[status.Context]
+	r.mu.Unlock()
+	if ok {
+		return github.UpdateCheckRun(repoURL, id, run, token)
+	}
+	id, err = github.CreateCheckRun(repoURL, run, token)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.runs[status.Context] = id
+	r.mu.Unlock()
+	return nil
+}
+
+// CheckRunExternalID identifies build in the check runs reporting it
+func CheckRunExternalID(build *model.Build) string {
+	return fmt.Sprintf("%v/%v/%v", build.Org, build.Name, build.Number)
+}
+
+// ParseCheckRunExternalID returns the build a check run external id identifies
+func ParseCheckRunExternalID(id string) (org string, name string, number int, err error) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 3 {
+		return "", "", 0, fmt.Errorf("%v isn't a check run external id", id)
+	}
+	number, err = strconv.Atoi(parts[2])
+	if err != nil {
+		return "", "", 0, fmt.Errorf("%v isn't a check run external id", id)
+	}
+	return parts[0], parts[1], number, nil
+}
+
+// stepCheckOutput describes the result of step for its check run, from the lines at the end of its log
+func stepCheckOutput(step *model.Step, lines []string, workdir string) *github.CheckOutput {
+	output := &github.CheckOutput{}
+	if step.ExitCode == 0 {
+		output.Title = step.Name + " passed"
+	} else {
+		output.Title = step.Name + " failed"
+	}
+	output.Summary = fmt.Sprintf("`%v` exited with code %v after %v.", step.Name, step.ExitCode, time.Duration(step.Duration)*time.Millisecond)
+	if step.ExitCode == 0 {
+		return output
+	}
+	output.Annotations = github.ParseAnnotations(lines, workdir, step.Reponame)
+	if len(output.Annotations) > 0 {
+		output.Summary += fmt.Sprintf(" %v problems are annotated in the code.", len(output.Annotations))
+	}
+
+	tail := lines
+	if len(tail) > CheckLogLines {
+		tail = tail[len(tail)-CheckLogLines:]
+	}
+	text := strings.Join(tail, "\n")
+	// leave room for the heading and the code fence
+	if len(text) > maxCheckText-100 {
+		text = text[len(text)-(maxCheckText-100):]
+	}
+	output.Text = fmt.Sprintf("Last %v lines of the log:\n\n```\n%v\n```", len(tail), text)
+	return output
+}
+
+// logTail returns the lines at the end of the log of container
+func logTail(kubectl *kubernetes.Clientset, namespace string, pod string, container string, lines int) ([]string, error) {
+	tail := int64(lines)
+	raw, err := kubectl.CoreV1().Pods(namespace).GetLogs(pod, &v1.PodLogOptions{Container: container, TailLines: &tail}).Do().Raw()
+	if err != nil {
+		return nil, kubeError("get_logs", err)
+	}
+	return strings.Split(strings.TrimRight(string(raw), "\n"), "\n"), nil
+}
@@ -0,0 +1,83 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/tracing"
+)
+
+func TestCheckRunExternalID(t *testing.T) {
+	id := CheckRunExternalID(&model.Build{Org: "org", Name: "repo", Number: 12})
+	org, name, number, err := ParseCheckRunExternalID(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "org", org)
+	assert.Equal(t, "repo", name)
+	assert.Equal(t, 12, number)
+
+	_, _, _, err = ParseCheckRunExternalID("org/repo")
+	assert.Error(t, err)
+	_, _, _, err = ParseCheckRunExternalID("org/repo/x")
+	assert.Error(t, err)
+}
+
+func TestStepCheckOutput(t *testing.T) {
+	defer func(n int) { CheckLogLines = n }(CheckLogLines)
+	CheckLogLines = 2
+
+	step := &model.Step{StepInfo: model.StepInfo{Name: "test", Reponame: "repo", ExitCode: 1, Duration: 1500}}
+	lines := []string{"go test ./...", "--- FAIL: TestX (0.00s)", "    x_test.go:3: wrong", "FAIL\tgitlab.com/org/repo/x\t0.01s"}
+	output := stepCheckOutput(step, lines, "/go/src/gitlab.com/org/repo")
+	assert.Equal(t, "test failed", output.Title)
+	assert.Equal(t, "`test` exited with code 1 after 1.5s. 1 problems are annotated in the code.", output.Summary)
+	assert.Equal(t, "x/x_test.go", output.Annotations[0].Path)
+	assert.Equal(t, "Last 2 lines of the log:\n\n```\n    x_test.go:3: wrong\nFAIL\tgitlab.com/org/repo/x\t0.01s\n```", output.Text)
+
+	step.ExitCode = 0
+	output = stepCheckOutput(step, lines, "/go/src/gitlab.com/org/repo")
+	assert.Equal(t, "test passed", output.Title)
+	assert.Empty(t, output.Text)
+	assert.Empty(t, output.Annotations)
+}
+
+func TestReporterUpdatesCheckRun(t *testing.T) {
+	defer func(b bool) { UseChecks = b }(UseChecks)
+	UseChecks = true
+
+	var runs []github.CheckRun
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var run github.CheckRun
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&run))
+		runs = append(runs, run)
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		fmt.Fprint(w, `{"id": 7}`)
+	}))
+	defer server.Close()
+
+	build := &model.Build{Org: "org", Name: "repo", Number: 3, Commit: "abc", StatusURL: server.URL + "/repos/org/repo/statuses/{sha}"}
+	r := newReporter(build, scm.NewGitHub(github.StaticToken("token")))
+	span := tracing.NewTracer(tracing.NoopExporter{}).Start("build")
+	r.report(slog.Default(), span, scm.Status{State: "pending", Context: "test"}, nil)
+	r.report(slog.Default(), span, scm.Status{State: "error", Context: "test", TargetURL: "http://ci/step"},
+		&github.CheckOutput{Title: "test failed", Summary: "exit code 1"})
+
+	assert.Equal(t, []string{"POST /repos/org/repo/check-runs", "PATCH /repos/org/repo/check-runs/7"}, requests)
+	assert.Equal(t, "queued", runs[0].Status)
+	assert.Equal(t, "abc", runs[0].HeadSHA)
+	assert.Equal(t, "org/repo/3", runs[0].ExternalID)
+	assert.Equal(t, "completed", runs[1].Status)
+	assert.Equal(t, "failure", runs[1].Conclusion)
+	assert.Equal(t, "http://ci/step", runs[1].DetailsURL)
+	assert.Equal(t, "test failed", runs[1].Output.Title)
+	assert.Equal(t, github.RerunAction, runs[1].Actions[0].Identifier)
+	assert.True(t, len(runs[1].Actions[0].Description) <= 40)
+}
@@ -0,0 +1,181 @@
+package builder
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+// PullRequestCheckout is what's built of pull requests, merge for the result of merging them into their base branch
+// or head for their head commit
+var PullRequestCheckout = "merge"
+
+// CloneOptions are the clone section of the build configuration
+type CloneOptions struct {
+	// Depth is the number of commits fetched, the full history is cloned if it's 0
+	Depth int
+	// Submodules checks out the submodules, recursive checks out their submodules as well
+	Submodules Submodules
+	// Sparse are the directories checked out, everything is checked out if it's empty.
+	// Only the files in the directories are fetched.
+	Sparse []string
+	// LFS fetches the Git LFS files, they're checked out as pointer files otherwise
+	LFS bool
+	// Tags fetches every tag, clones with a depth or sparse directories only fetch the tag being built otherwise
+	Tags bool
+}
+
+// sparsePath matches the relative paths allowed in the sparse section
+var sparsePath = regexp.MustCompile(`^[A-Za-z0-9_.@+-]+(/[A-Za-z0-9_.@+-]+)*/?$`)
+
+// UnmarshalYAML implements the Unmarshaller interface, the sparse paths must be plain relative paths
+func (o *CloneOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type options CloneOptions
+	if err := unmarshal((*options)(o)); err != nil {
+		return err
+	}
+	for _, p := range o.Sparse {
+		if !sparsePath.MatchString(p) || p == ".." || strings.HasPrefix(p, "../") || strings.Contains(p, "/../") {
+			return fmt.Errorf("sparse path %q must be a relative path of letters, digits and _.@+-", p)
+		}
+	}
+	if o.Depth < 0 {
+		return fmt.Errorf("depth is %v, it can't be negative", o.Depth)
+	}
+	return nil
+}
+
+// Submodules is how submodules are checked out, true or recursive, they aren't checked out if it's empty
+type Submodules string
+
+// UnmarshalYAML implements the Unmarshaller interface, submodules can be true, false or recursive.
+func (s *Submodules) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var b bool
+	if err := unmarshal(&b); err == nil {
+		*s = ""
+		if b {
+			*s = "true"
+		}
+		return nil
+	}
+	var mode string
+	if err := unmarshal(&mode); err != nil {
+		return err
+	}
+	if mode != "true" && mode != "false" && mode != "recursive" {
+		return fmt.Errorf("submodules is %v, it must be true, false or recursive", mode)
+	}
+	*s = Submodules(strings.Replace(mode, "false", "", 1))
+	return nil
+}
+
+// cloneCommands returns the commands cloning the repository at url into workspace and checking out the commit of build
+func cloneCommands(build *model.Build, url string, workspace string, opts CloneOptions) []string {
+	var cmds []string
+	fetch := "git fetch"
+	if opts.Depth == 0 && len(opts.Sparse) == 0 {
+		// the full history is cloned, with every branch and tag
+		cmds = append(cmds, fmt.Sprintf("git clone %v %v", shellQuote(url), shellQuote(workspace)), "cd "+shellQuote(workspace))
+		fetch += " origin"
+	} else {
+		cmds = append(cmds, "git init -q "+shellQuote(workspace), "cd "+shellQuote(workspace), "git remote add origin "+shellQuote(url))
+		if opts.Depth > 0 {
+			fetch += fmt.Sprintf(" --depth %v", opts.Depth)
+		}
+		if len(opts.Sparse) > 0 {
+			// a partial clone, the files outside the sparse directories are never fetched
+			fetch += " --filter=blob:none"
+			cmds = append(cmds,
+				"git config remote.origin.promisor true",
+				"git config remote.origin.partialclonefilter blob:none",
+				"git sparse-checkout init --cone",
+				"git sparse-checkout set "+shellQuote(opts.Sparse...),
+			)
+		}
+		if opts.Tags {
+			fetch += " --tags"
+		} else {
+			fetch += " --no-tags"
+		}
+		fetch += " origin"
+		// only the commit being built is fetched, pull requests fetch theirs when checking out
+		if build.PullRequest == 0 {
+			refs := []string{build.Commit}
+			if strings.HasPrefix(build.Ref, "refs/tags/") {
+				refs = append(refs, fmt.Sprintf("+%v:%v", build.Ref, build.Ref))
+			}
+			cmds = append(cmds, fetch+" "+shellQuote(refs...))
+		}
+	}
+	cmds = append(cmds, checkoutCommands(build, fetch, opts.Depth > 0)...)
+
+	switch opts.Submodules {
+	case "true":
+		cmds = append(cmds, "git submodule update --init"+depthFlag(opts.Depth))
+	case "recursive":
+		cmds = append(cmds, "git submodule update --init --recursive"+depthFlag(opts.Depth))
+	}
+	if opts.LFS {
+		cmds = append(cmds, "git lfs install --local", "git lfs pull")
+	}
+	return cmds
+}
+
+// checkoutCommands returns the commands checking out the commit of build in the cloned repository,
+// fetch is the command fetching from the repository and shallow is set when it fetches a limited depth
+func checkoutCommands(build *model.Build, fetch string, shallow bool) []string {
+	if build.PullRequest == 0 {
+		// the checkout is pinned to the commit, a branch is pointed at it so the branch name is known in the build
+		if strings.HasPrefix(build.Ref, "refs/tags/") {
+			return []string{"git checkout -q " + shellQuote(build.Commit)}
+		}
+		return []string{"git checkout -q -B " + shellQuote(strings.TrimPrefix(build.Ref, "refs/heads/"), build.Commit)}
+	}
+	// the head commit is fetched by its SHA, so commits pushed to the pull request later aren't built
+	commit := shellQuote(build.Commit)
+	cmds := []string{fmt.Sprintf("%v %v", fetch, commit)}
+	if PullRequestCheckout != "merge" {
+		return append(cmds, "git checkout -q "+commit)
+	}
+	// GitHub updates the merge ref some time after the pull request changed, and not at all when it has conflicts,
+	// so the commit is merged into the base branch here unless the merge ref is of the commit.
+	// Merging needs the history back to where the pull request branched off.
+	merge := fmt.Sprintf("refs/remotes/origin/pull/%v/merge", build.PullRequest)
+	fetchBase := fmt.Sprintf("%v %v", fetch, shellQuote(build.BaseRef))
+	if shallow {
+		fetchBase = "git fetch --unshallow origin " + shellQuote(build.BaseRef, build.Commit)
+	}
+	return append(cmds,
+		fmt.Sprintf("%v +refs/pull/%v/merge:%v || true", fetch, build.PullRequest, merge),
+		fmt.Sprintf(`if [ "$(git rev-parse -q --verify %v^2)" = %v ]; then git checkout -q %v; `+
+			`else %v && git checkout -q FETCH_HEAD && git -c user.name=seneferu -c user.email=seneferu@localhost merge --no-edit %v; fi`,
+			merge, commit, merge, fetchBase, commit),
+	)
+}
+
+// depthFlag returns the flag fetching depth commits, or nothing when the full history is fetched
+func depthFlag(depth int) string {
+	if depth == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" --depth %v", depth)
+}
+
+// safeArgument matches the arguments that don't need quoting in the shell
+var safeArgument = regexp.MustCompile(`^[A-Za-z0-9_./:@%+=,-]+$`)
+
+// shellQuote returns args quoted for the shell and separated by spaces, so values from webhooks and the
+// build configuration can't run commands in the git container, which has the SSH key
+func shellQuote(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if safeArgument.MatchString(a) {
+			quoted[i] = a
+			continue
+		}
+		quoted[i] = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,83 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+func TestCloneFromYAML(t *testing.T) {
+	c, err := yamlToConfig([]byte(`
+clone:
+  depth: 10
+  submodules: recursive
+  sparse: [ services/api, go.mod ]
+  lfs: true
+  tags: true
+pipeline:
+  test:
+    image: golang
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, CloneOptions{Depth: 10, Submodules: "recursive", Sparse: []string{"services/api", "go.mod"}, LFS: true, Tags: true}, c.Clone)
+
+	c, err = yamlToConfig([]byte("clone:\n  submodules: true\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, Submodules("true"), c.Clone.Submodules)
+
+	_, err = yamlToConfig([]byte("clone:\n  submodules: all\n"))
+	assert.Error(t, err)
+	_, err = yamlToConfig([]byte("clone:\n  sparse: [ \"x; cat /ssh/id_rsa\" ]\n"))
+	assert.Error(t, err, "sparse paths are plain relative paths")
+	_, err = yamlToConfig([]byte("clone:\n  sparse: [ ../other ]\n"))
+	assert.Error(t, err)
+	_, err = yamlToConfig([]byte("clone:\n  sparse: [ /etc ]\n"))
+	assert.Error(t, err)
+}
+
+func TestCloneCommandsQuoteArguments(t *testing.T) {
+	assert.Equal(t, "abc refs/heads/master", shellQuote("abc", "refs/heads/master"))
+	assert.Equal(t, `'x; cat /ssh/id_rsa' 'it'\''s' ''`, shellQuote("x; cat /ssh/id_rsa", "it's", ""))
+
+	build := &model.Build{Ref: "refs/heads/$(id)", Commit: "abc"}
+	assert.Contains(t, cloneCommands(build, "git@github.com:org/repo.git", "/share/repo", CloneOptions{}), "git checkout -q -B '$(id)' abc")
+	build = &model.Build{Ref: "feature", Commit: "abc", PullRequest: 7, BaseRef: "main;id"}
+	cmds := cloneCommands(build, "git@github.com:org/repo.git", "/share/repo", CloneOptions{Depth: 1})
+	assert.Contains(t, cmds[len(cmds)-1], "git fetch --unshallow origin 'main;id' abc")
+}
+
+func TestCloneCommands(t *testing.T) {
+	build := &model.Build{Ref: "refs/heads/master", Commit: "abc"}
+	assert.Equal(t, []string{
+		"git clone git@github.com:org/repo.git /share/repo",
+		"cd /share/repo",
+		"git checkout -q -B master abc",
+	}, cloneCommands(build, "git@github.com:org/repo.git", "/share/repo", CloneOptions{}))
+
+	assert.Equal(t, []string{
+		"git init -q /share/repo",
+		"cd /share/repo",
+		"git remote add origin git@github.com:org/repo.git",
+		"git config remote.origin.promisor true",
+		"git config remote.origin.partialclonefilter blob:none",
+		"git sparse-checkout init --cone",
+		"git sparse-checkout set services/api",
+		"git fetch --depth 1 --filter=blob:none --no-tags origin abc",
+		"git checkout -q -B master abc",
+		"git submodule update --init --recursive --depth 1",
+		"git lfs install --local",
+		"git lfs pull",
+	}, cloneCommands(build, "git@github.com:org/repo.git", "/share/repo", CloneOptions{Depth: 1, Submodules: "recursive", Sparse: []string{"services/api"}, LFS: true}))
+
+	build = &model.Build{Ref: "refs/tags/v1.0", Commit: "abc"}
+	cmds := cloneCommands(build, "git@github.com:org/repo.git", "/share/repo", CloneOptions{Depth: 1})
+	assert.Contains(t, cmds, "git fetch --depth 1 --no-tags origin abc +refs/tags/v1.0:refs/tags/v1.0")
+	assert.Contains(t, cmds, "git checkout -q abc")
+	assert.Contains(t, cloneCommands(build, "git@github.com:org/repo.git", "/share/repo", CloneOptions{Depth: 1, Tags: true}), "git fetch --depth 1 --tags origin abc +refs/tags/v1.0:refs/tags/v1.0")
+
+	build = &model.Build{Ref: "feature", Commit: "abc", PullRequest: 7, BaseRef: "master"}
+	cmds = cloneCommands(build, "git@github.com:org/repo.git", "/share/repo", CloneOptions{Depth: 1})
+	assert.Contains(t, cmds, "git fetch --depth 1 --no-tags origin abc")
+	assert.Contains(t, cmds[len(cmds)-1], "else git fetch --unshallow origin master abc && git checkout -q FETCH_HEAD")
+}
@@ -0,0 +1,179 @@
+package builder
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sorenmat/pipeline/pipeline/frontend/yaml"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+// Environment is the environment Seneferu runs in, like staging or production, steps can be limited to environments
+var Environment string
+
+// failedMarker is the file created in the shared directory when a step fails
+const failedMarker = shareddir + "/failed"
+
+// skippedMessage is the termination message of steps that found the build status doesn't match theirs
+const skippedMessage = "skipped"
+
+// Constraints are the conditions in the when section of a step
+type Constraints struct {
+	yaml.Constraints `yaml:",inline"`
+	// Ref and Tag are patterns of the full ref and of the tag being built, ** matches any number of path segments
+	Ref yaml.Constraint
+	Tag yaml.Constraint
+	// Paths are patterns of the changed files the step runs for, ** matches any number of directories
+	Paths yaml.Constraint
+}
+
+// skipReason returns why the step with the constraints c doesn't run in build, or an empty string if it runs.
+// The status of the build isn't known until the previous steps are done, see statusCheck.
+func (c *Constraints) skipReason(build *model.Build) string {
+	branch := buildBranch(build)
+	if !c.Branch.Match(branch) {
+		return fmt.Sprintf("branch %v doesn't match", branch)
+	}
+	event := buildEvent(build)
+	if !c.Event.Match(event) {
+		return fmt.Sprintf("event %v doesn't match", event)
+	}
+	ref := fullRef(build.Ref)
+	if !matchConstraint(c.Ref, ref) {
+		return fmt.Sprintf("ref %v doesn't match", ref)
+	}
+	if len(c.Tag.Include) > 0 || len(c.Tag.Exclude) > 0 {
+		if !strings.HasPrefix(ref, "refs/tags/") {
+			if len(c.Tag.Include) > 0 {
+				return "not a tag"
+			}
+		} else if tag := strings.TrimPrefix(ref, "refs/tags/"); !matchConstraint(c.Tag, tag) {
+			return fmt.Sprintf("tag %v doesn't match", tag)
+		}
+	}
+	if !c.Environment.Match(Environment) {
+		return fmt.Sprintf("environment %v doesn't match", Environment)
+	}
+	if !c.Status.Match("success") && !c.Status.Match("failure") {
+		return "no build status matches"
+	}
+	if !c.MatchPaths(build.ChangedFiles) {
+		return "no changed files match the paths"
+	}
+	return ""
+}
+
+// statusCheck returns a command ending the step as skipped when the status of the build, failure once a step
+// failed, doesn't match the status constraint. It's empty when the step runs regardless of the status.
+func (c *Constraints) statusCheck() string {
+	success, failure := c.Status.Match("success"), c.Status.Match("failure")
+	if success == failure {
+		return ""
+	}
+	test := "test -f " + failedMarker
+	if success {
+		test = "! " + test
+	}
+	return fmt.Sprintf("if %v; then echo %v > /dev/termination-log; exit 0; fi", test, skippedMessage)
+}
+
+// buildSkipReason returns why nothing of cfg runs in build, or an empty string if one of the steps runs
+func buildSkipReason(build *model.Build, cfg *Config) string {
+	branch := buildBranch(build)
+	if !cfg.Branches.Match(branch) {
+		return fmt.Sprintf("branch %v doesn't match the branches of the build configuration", branch)
+	}
+	for _, c := range cfg.Pipeline.Containers {
+		if c.Constraints.skipReason(build) == "" {
+			return ""
+		}
+	}
+	return "no steps match"
+}
+
+// buildBranch returns the branch constraints are matched against, the ref without refs/heads/, so tags are
+// matched like refs/tags/v1.0
+func buildBranch(build *model.Build) string {
+	return strings.Replace(build.Ref, "refs/heads/", "", -1)
+}
+
+// buildEvent returns the event build was triggered by, builds of tags are tag builds when it isn't known
+func buildEvent(build *model.Build) string {
+	if build.Event != "" {
+		return build.Event
+	}
+	if strings.HasPrefix(build.Ref, "refs/tags/") {
+		return "tag"
+	}
+	return "push"
+}
+
+// fullRef returns ref as a full ref, pull requests are built with only the name of their branch
+func fullRef(ref string) string {
+	if strings.HasPrefix(ref, "refs/") {
+		return ref
+	}
+	return "refs/heads/" + ref
+}
+
+// matchConstraint is yaml.Constraint.Match with the patterns matched by matchPath
+func matchConstraint(c yaml.Constraint, v string) bool {
+	if matchAnyPath(c.Exclude, v) {
+		return false
+	}
+	return len(c.Include) == 0 || matchAnyPath(c.Include, v)
+}
+
+// MatchPaths returns true if one of files is included and not excluded by the path patterns.
+// Steps always run when files is nil, the changed files aren't known, or when there are no patterns.
+func (c *Constraints) MatchPaths(files []string) bool {
+	if files == nil || (len(c.Paths.Include) == 0 && len(c.Paths.Exclude) == 0) {
+		return true
+	}
+	for _, f := range files {
+		if matchAnyPath(c.Paths.Exclude, f) {
+			continue
+		}
+		if len(c.Paths.Include) == 0 || matchAnyPath(c.Paths.Include, f) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAnyPath(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if matchPath(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath returns true if the slash separated name matches pattern. The segments of pattern are
+// matched like path.Match, except for ** which matches any number of segments.
+func matchPath(pattern string, name string) bool {
+	return matchSegments(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
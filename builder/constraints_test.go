@@ -0,0 +1,140 @@
+package builder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+func TestMatchPath(t *testing.T) {
+	assert.True(t, matchPath("services/api/**", "services/api/main.go"))
+	assert.True(t, matchPath("services/api/**", "services/api/handlers/users.go"))
+	assert.False(t, matchPath("services/api/**", "services/web/main.go"))
+	assert.True(t, matchPath("**/*.md", "README.md"))
+	assert.True(t, matchPath("**/*.md", "docs/guide/setup.md"))
+	assert.False(t, matchPath("*.md", "docs/setup.md"))
+	assert.True(t, matchPath("/go.mod", "go.mod"))
+	assert.True(t, matchPath("services/*/Dockerfile", "services/api/Dockerfile"))
+}
+
+func TestPathsFromYAML(t *testing.T) {
+	c, err := yamlToConfig([]byte(`
+pipeline:
+  api:
+    image: golang
+    when:
+      branch: master
+      paths:
+        include: [ services/api/**, go.mod ]
+        exclude: [ "**/*.md" ]
+  docs:
+    image: alpine
+    when:
+      paths: docs/**
+  all:
+    image: alpine
+`))
+	assert.NoError(t, err)
+	api := c.Pipeline.Containers[0].Constraints
+	assert.Equal(t, []string{"master"}, api.Branch.Include)
+	assert.Equal(t, []string{"services/api/**", "go.mod"}, api.Paths.Include)
+	assert.Equal(t, []string{"**/*.md"}, api.Paths.Exclude)
+	assert.Equal(t, []string{"docs/**"}, c.Pipeline.Containers[1].Constraints.Paths.Include)
+
+	assert.True(t, api.MatchPaths([]string{"docs/index.md", "services/api/main.go"}))
+	assert.False(t, api.MatchPaths([]string{"services/api/README.md", "services/web/main.go"}))
+	assert.True(t, api.MatchPaths(nil), "unknown changes run every step")
+	assert.False(t, api.MatchPaths([]string{}))
+
+	build := &model.Build{Ref: "refs/heads/master", ChangedFiles: []string{"docs/index.md"}}
+	steps, skipped, err := createBuildSteps(build, c, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []skippedStep{{Name: "api", Reason: "no changed files match the paths"}}, skipped)
+	assert.Len(t, steps, 2)
+	assert.Equal(t, "docs", steps[0].Name)
+	assert.Equal(t, "all", steps[1].Name)
+}
+
+func TestConstraintsFromYAML(t *testing.T) {
+	c, err := yamlToConfig([]byte(`
+pipeline:
+  test:
+    image: golang
+    when:
+      event: [ push, pull_request ]
+  release:
+    image: golang
+    when:
+      event: tag
+      tag: v*
+  feature:
+    image: golang
+    when:
+      ref: refs/heads/feature/**
+  production:
+    image: golang
+    when:
+      environment: production
+  cleanup:
+    image: alpine
+    commands: [ ./cleanup.sh ]
+    when:
+      status: [ success, failure ]
+  notify:
+    image: alpine
+    commands: [ ./notify.sh ]
+    when:
+      status: failure
+`))
+	assert.NoError(t, err)
+	names := func(build *model.Build) []string {
+		steps, _, err := createBuildSteps(build, c, "")
+		assert.NoError(t, err)
+		var names []string
+		for _, s := range steps {
+			names = append(names, s.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"test", "cleanup", "notify"}, names(&model.Build{Ref: "refs/heads/master", Event: "push"}))
+	assert.Equal(t, []string{"test", "feature", "cleanup", "notify"}, names(&model.Build{Ref: "feature/a/b", Event: "pull_request"}))
+	assert.Equal(t, []string{"release", "cleanup", "notify"}, names(&model.Build{Ref: "refs/tags/v1.0"}))
+	assert.Equal(t, []string{"cleanup", "notify"}, names(&model.Build{Ref: "refs/tags/latest", Event: "tag"}))
+	assert.Equal(t, []string{"cleanup", "notify"}, names(&model.Build{Ref: "refs/heads/master", Event: "manual"}))
+
+	Environment = "production"
+	defer func() { Environment = "" }()
+	assert.Contains(t, names(&model.Build{Ref: "refs/heads/master", Event: "manual"}), "production")
+
+	_, skipped, _ := createBuildSteps(&model.Build{Ref: "refs/tags/latest", Event: "tag"}, c, "")
+	assert.Equal(t, skippedStep{Name: "release", Reason: "tag latest doesn't match"}, skipped[1])
+
+	assert.Equal(t, "", c.Pipeline.Containers[4].Constraints.statusCheck())
+	assert.Equal(t, "if test -f /share/failed; then echo skipped > /dev/termination-log; exit 0; fi", c.Pipeline.Containers[5].Constraints.statusCheck())
+}
+
+func TestBuildSkipReason(t *testing.T) {
+	c, err := yamlToConfig([]byte(`
+branches:
+  include: [ master, release/*, refs/tags/* ]
+  exclude: release/old
+pipeline:
+  api:
+    image: golang
+    when:
+      paths: services/api/**
+  docs:
+    image: alpine
+    when:
+      paths: docs/**
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "", buildSkipReason(&model.Build{Ref: "refs/heads/master"}, c))
+	assert.Equal(t, "", buildSkipReason(&model.Build{Ref: "refs/tags/v1.0"}, c))
+	assert.Equal(t, "", buildSkipReason(&model.Build{Ref: "release/1.0", ChangedFiles: []string{"docs/index.md"}}, c))
+	assert.Equal(t, "branch feature doesn't match the branches of the build configuration", buildSkipReason(&model.Build{Ref: "refs/heads/feature"}, c))
+	assert.NotEqual(t, "", buildSkipReason(&model.Build{Ref: "refs/heads/release/old"}, c))
+	assert.Equal(t, "no steps match", buildSkipReason(&model.Build{Ref: "refs/heads/master", ChangedFiles: []string{"README.md"}}, c))
+}
@@ -0,0 +1,249 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/storage"
+)
+
+// subscriberBuffer is the number of chunks a subscriber can lag behind
+// before it is disconnected
+const subscriberBuffer = 256
+
+// replayLines is the number of lines at the end of the log of a running step kept for new subscribers, the lines
+// before them are read from storage. It covers the lines a DBLogWriter holds on to while they can't be saved.
+var replayLines = logMaxPendingLines + logFlushLines
+
+// Logs is the broker used to fan out live step logs to subscribers
+var Logs = NewLogBroker()
+
+// EchoOutput writes the output of build steps and services to the server log as well
+var EchoOutput = true
+
+// LogBroker keeps track of the logs of running steps, so they can be
+// followed while the step is still running
+type LogBroker struct {
+	mu      sync.Mutex
+	streams map[string]*LogStream
+}
+
+// LogStream holds the end of the log written so far for a single running step and
+// the subscribers currently following it
+type LogStream struct {
+	mu sync.Mutex
+	// lines is a ring of the last complete lines written, the oldest at head. first is the number of the oldest line.
+	lines   [][]byte
+	head    int
+	first   int
+	partial []byte
+	subs    map[*Subscription]struct{}
+	closed  bool
+}
+
+// NewLogBroker creates an empty LogBroker
+func NewLogBroker() *LogBroker {
+	return &LogBroker{streams: make(map[string]*LogStream)}
+}
+
+// StreamKey returns the key identifying the log stream of a step
+func StreamKey(org, reponame string, build int, step string) string {
+	return fmt.Sprintf("%v/%v/%v/%v", org, reponame, build, step)
+}
+
+// Open returns the stream registered with key, creating it if needed
+func (b *LogBroker) Open(key string) *LogStream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.streams[key]
+	if !ok {
+		s = &LogStream{subs: make(map[*Subscription]struct{})}
+		b.streams[key] = s
+	}
+	return s
+}
+
+// Close marks the stream as finished, disconnects all subscribers and
+// forgets about it. Late joiners should read the log from storage.
+func (b *LogBroker) Close(key string) {
+	b.mu.Lock()
+	s, ok := b.streams[key]
+	delete(b.streams, key)
+	b.mu.Unlock()
+	if ok {
+		s.close()
+	}
+}
+
+// Subscription follows the log of a running step
+type Subscription struct {
+	// Replay is the end of the log written before subscribing, starting at line Offset.
+	// The lines before it are read from storage, see ReplayLog.
+	Replay []byte
+	Offset int
+	// C receives every chunk written afterwards, it's closed when the step finishes or the subscriber lags behind
+	C <-chan []byte
+
+	stream *LogStream
+	c      chan []byte
+	lagged bool
+}
+
+// Subscribe returns a subscription to the log of the step streaming under key.
+// ok is false if no step is currently streaming under key.
+func (b *LogBroker) Subscribe(key string) (sub *Subscription, ok bool) {
+	b.mu.Lock()
+	s, ok := b.streams[key]
+	b.mu.Unlock()
+	if !ok {
+		return &Subscription{}, false
+	}
+	return s.subscribe()
+}
+
+// Cancel stops following the log
+func (sub *Subscription) Cancel() {
+	if sub.stream == nil {
+		return
+	}
+	sub.stream.mu.Lock()
+	defer sub.stream.mu.Unlock()
+	if _, ok := sub.stream.subs[sub]; ok {
+		delete(sub.stream.subs, sub)
+		close(sub.c)
+	}
+}
+
+// Lagged returns true if C was closed because the subscriber couldn't keep up, rather than because the step finished.
+// The log received is incomplete then, and should be read again from storage.
+func (sub *Subscription) Lagged() bool {
+	if sub.stream == nil {
+		return false
+	}
+	sub.stream.mu.Lock()
+	defer sub.stream.mu.Unlock()
+	return sub.lagged
+}
+
+// Write appends p to the stream and sends it to all subscribers. A
+// subscriber that can't keep up is disconnected rather than blocking the build.
+func (s *LogStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return len(p), nil
+	}
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := make([]byte, i+1)
+		copy(line, s.partial)
+		s.addLine(line)
+		s.partial = s.partial[i+1:]
+	}
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+	for sub := range s.subs {
+		select {
+		case sub.c <- chunk:
+		default:
+			sub.lagged = true
+			delete(s.subs, sub)
+			close(sub.c)
+		}
+	}
+	return len(p), nil
+}
+
+// addLine adds line to the ring, replacing the oldest line once it's full
+func (s *LogStream) addLine(line []byte) {
+	if len(s.lines) < replayLines {
+		s.lines = append(s.lines, line)
+		return
+	}
+	s.lines[s.head] = line
+	s.head = (s.head + 1) % len(s.lines)
+	s.first++
+}
+
+func (s *LogStream) subscribe() (*Subscription, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return &Subscription{}, false
+	}
+	var replay []byte
+	for i := range s.lines {
+		replay = append(replay, s.lines[(s.head+i)%len(s.lines)]...)
+	}
+	replay = append(replay, s.partial...)
+	c := make(chan []byte, subscriberBuffer)
+	sub := &Subscription{Replay: replay, Offset: s.first, C: c, stream: s, c: c}
+	s.subs[sub] = struct{}{}
+	return sub, true
+}
+
+func (s *LogStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for sub := range s.subs {
+		delete(s.subs, sub)
+		close(sub.c)
+	}
+}
+
+// ReplayLog returns the log of step written before sub subscribed to it, the lines no longer kept by the stream
+// are read from service
+func ReplayLog(service storage.Service, org, reponame string, build int, step string, sub *Subscription) ([]byte, error) {
+	var log []byte
+	for offset := 0; offset < sub.Offset; offset += logFlushLines {
+		lines, err := service.LoadLogLines(org, reponame, build, step, offset, logFlushLines)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load the beginning of the log")
+		}
+		for _, l := range lines {
+			if l.Number < sub.Offset {
+				log = append(append(log, l.Content...), '\n')
+			}
+		}
+		if len(lines) < logFlushLines {
+			break
+		}
+	}
+	return append(log, sub.Replay...), nil
+}
+
+// outputLogger writes every line of build output as a record in the server log
+type outputLogger struct {
+	logger  *slog.Logger
+	partial []byte
+}
+
+func (o *outputLogger) Write(p []byte) (int, error) {
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		o.logger.Info("output", "line", string(o.partial[:i]))
+		o.partial = o.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close writes the last line, if it wasn't terminated by a newline
+func (o *outputLogger) Close() error {
+	if len(o.partial) > 0 {
+		o.logger.Info("output", "line", string(o.partial))
+		o.partial = nil
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package builder
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/storage/memory"
+)
+
+func TestLogStreamReplay(t *testing.T) {
+	b := NewLogBroker()
+	key := StreamKey("org", "repo", 1, "build")
+	s := b.Open(key)
+	s.Write([]byte("first\n"))
+
+	sub, ok := b.Subscribe(key)
+	defer sub.Cancel()
+	assert.True(t, ok)
+	assert.Equal(t, "first\n", string(sub.Replay))
+
+	s.Write([]byte("second\n"))
+	assert.Equal(t, "second\n", string(<-sub.C))
+
+	b.Close(key)
+	_, open := <-sub.C
+	assert.False(t, open, "subscribers should be disconnected when the step is done")
+	assert.False(t, sub.Lagged())
+}
+
+func TestLogStreamKeepsTheEndOfTheLog(t *testing.T) {
+	defer func(n int) { replayLines = n }(replayLines)
+	replayLines = 2
+	service := memory.New()
+	step := &model.Step{StepInfo: model.StepInfo{Org: "org", Reponame: "repo", BuildNumber: 1, Name: "build"}}
+	dbw := NewDBLogWriter(service, step)
+
+	b := NewLogBroker()
+	key := StreamKey("org", "repo", 1, "build")
+	s := b.Open(key)
+	w := io.MultiWriter(dbw, s)
+	w.Write([]byte("first\nsecond\nthird\nfou"))
+	assert.NoError(t, dbw.Flush())
+
+	sub, ok := b.Subscribe(key)
+	defer sub.Cancel()
+	assert.True(t, ok)
+	assert.Equal(t, "second\nthird\nfou", string(sub.Replay), "only the last lines should be kept")
+	assert.Equal(t, 1, sub.Offset)
+	replay, err := ReplayLog(service, "org", "repo", 1, "build", sub)
+	assert.NoError(t, err)
+	assert.Equal(t, "first\nsecond\nthird\nfou", string(replay))
+}
+
+func TestLogStreamSubscribeUnknown(t *testing.T) {
+	b := NewLogBroker()
+	sub, ok := b.Subscribe(StreamKey("org", "repo", 1, "build"))
+	defer sub.Cancel()
+	assert.False(t, ok)
+	assert.Nil(t, sub.C)
+}
+
+func TestLogStreamSlowSubscriber(t *testing.T) {
+	b := NewLogBroker()
+	key := StreamKey("org", "repo", 1, "build")
+	s := b.Open(key)
+	sub, _ := b.Subscribe(key)
+	defer sub.Cancel()
+	for i := 0; i <= subscriberBuffer; i++ {
+		s.Write([]byte("x"))
+	}
+	count := 0
+	for range sub.C {
+		count++
+	}
+	assert.Equal(t, subscriberBuffer, count)
+	assert.True(t, sub.Lagged(), "the subscriber should know its log is incomplete")
+}
+
+func TestOutputLoggerWritesLines(t *testing.T) {
+	var buf bytes.Buffer
+	o := &outputLogger{logger: slog.New(slog.NewTextHandler(&buf, nil)).With("step", "build")}
+	o.Write([]byte("first\nsec"))
+	o.Write([]byte("ond\nlast"))
+	assert.Equal(t, 2, bytes.Count(buf.Bytes(), []byte("\n")))
+	o.Close()
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	assert.Len(t, lines, 3)
+	assert.Contains(t, string(lines[0]), `msg=output step=build line=first`)
+	assert.Contains(t, string(lines[1]), `line=second`)
+	assert.Contains(t, string(lines[2]), `line=last`)
+}
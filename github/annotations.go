@@ -0,0 +1,81 @@
+package github
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxAnnotations is the number of annotations parsed from the log of a step at most
+const MaxAnnotations = 200
+
+var (
+	// fileLine matches the file:line:column: message output of compilers, go vet and go test
+	fileLine = regexp.MustCompile(`^\s*(/?(?:[\w.@+-]+/)*[\w.@+-]+\.\w+):(\d+)(?::(\d+))?:\s+(.+)$`)
+	// goTestResult matches the line go test ends the output of a package with
+	goTestResult = regexp.MustCompile(`^(?:FAIL|ok)\s+(\S+)`)
+)
+
+// ParseAnnotations finds the failures pointing at a file and line in the output of a step.
+// workdir is the directory the step ran in, absolute paths outside of it are ignored.
+// go test only prints the file name of a failing test, its directory is found from the
+// import path of the package, which is expected to contain repo.
+func ParseAnnotations(lines []string, workdir string, repo string) []Annotation {
+	var annotations []Annotation
+	seen := make(map[string]bool)
+	// annotations of go test, waiting for the package they are in
+	var pending []int
+	for _, line := range lines {
+		if m := goTestResult.FindStringSubmatch(line); m != nil {
+			dir := packageDir(m[1], repo)
+			for _, i := range pending {
+				annotations[i].Path = path.Join(dir, annotations[i].Path)
+			}
+			pending = nil
+			continue
+		}
+		m := fileLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		file := m[1]
+		if path.IsAbs(file) {
+			if !strings.HasPrefix(file, workdir+"/") {
+				continue
+			}
+			file = strings.TrimPrefix(file, workdir+"/")
+		}
+		file = path.Clean(file)
+		if strings.HasPrefix(file, "../") {
+			continue
+		}
+		if seen[line] {
+			continue
+		}
+		seen[line] = true
+		lineNo, _ := strconv.Atoi(m[2])
+		a := Annotation{Path: file, StartLine: lineNo, EndLine: lineNo, AnnotationLevel: "failure", Message: m[4]}
+		if m[3] != "" {
+			a.StartColumn, _ = strconv.Atoi(m[3])
+			a.EndColumn = a.StartColumn
+		}
+		if !strings.Contains(file, "/") && strings.HasSuffix(file, "_test.go") {
+			pending = append(pending, len(annotations))
+		}
+		annotations = append(annotations, a)
+		if len(annotations) == MaxAnnotations {
+			break
+		}
+	}
+	return annotations
+}
+
+// packageDir returns the directory of the package with importPath, relative to the root of repo
+func packageDir(importPath string, repo string) string {
+	i := strings.Index(importPath+"/", "/"+repo+"/")
+	if i < 0 {
+		return ""
+	}
+	return strings.Trim(importPath[i+len(repo)+1:], "/")
+}
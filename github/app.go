@@ -0,0 +1,211 @@
+package github
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// DefaultAPIURL is the URL of the GitHub API
+const DefaultAPIURL = "https://api.github.com"
+
+const (
+	// jwtLifetime is how long the JWT authenticating as the app is valid, GitHub accepts at most 10 minutes
+	jwtLifetime = 9 * time.Minute
+	// jwtClockSkew backdates the JWT to allow for the clock of GitHub being behind
+	jwtClockSkew = time.Minute
+	// tokenRefreshMargin is how long before it expires an installation token is replaced
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+// TokenSource provides the token used to access a repository through the API
+type TokenSource interface {
+	Token(owner string, repo string) (string, error)
+}
+
+// StaticToken is a token used for every repository, like a personal access token
+type StaticToken string
+
+// Token returns the token
+func (t StaticToken) Token(string, string) (string, error) {
+	return string(t), nil
+}
+
+// App authenticates as a GitHub App and provides access tokens of its installations.
+// Tokens are cached until shortly before they expire, or until the installation is removed.
+type App struct {
+	id     int64
+	key    *rsa.PrivateKey
+	apiURL string
+	now    func() time.Time
+
+	mu sync.Mutex
+	// installations are the installation ids by account
+	installations map[string]int64
+	tokens        map[int64]installationToken
+	// creating are the tokens being created by installation, concurrent builds wait for the same token
+	creating map[int64]*tokenRequest
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// tokenRequest is the creation of an installation token, done is closed once token or err is set
+type tokenRequest struct {
+	done  chan struct{}
+	token installationToken
+	err   error
+}
+
+// NewApp creates a GitHub App with id, authenticating with the PEM encoded private key of the app
+func NewApp(id int64, privateKey []byte, apiURL string) (*App, error) {
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse GitHub App private key")
+	}
+	return &App{
+		id:            id,
+		key:           key,
+		apiURL:        apiURL,
+		now:           time.Now,
+		installations: make(map[string]int64),
+		tokens:        make(map[int64]installationToken),
+		creating:      make(map[int64]*tokenRequest),
+	}, nil
+}
+
+// JWT returns a token authenticating as the app itself
+func (a *App) JWT() (string, error) {
+	now := a.now()
+	claims := jwt.StandardClaims{
+		IssuedAt:  now.Add(-jwtClockSkew).Unix(),
+		ExpiresAt: now.Add(jwtLifetime).Unix(),
+		Issuer:    strconv.FormatInt(a.id, 10),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(a.key)
+}
+
+// SetInstallation records the installation of the app on account, as received in installation events
+func (a *App) SetInstallation(account string, id int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.installations[account] = id
+}
+
+// RemoveInstallation forgets the installation with id and its token, as when the app is uninstalled
+func (a *App) RemoveInstallation(id int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for account, installation := range a.installations {
+		if installation == id {
+			delete(a.installations, account)
+		}
+	}
+	delete(a.tokens, id)
+}
+
+// Token returns an access token of the installation of the app on the repository
+func (a *App) Token(owner string, repo string) (string, error) {
+	id, err := a.installationID(owner, repo)
+	if err != nil {
+		return "", err
+	}
+	return a.InstallationToken(id)
+}
+
+// InstallationToken returns an access token of the installation with id, a new one is created when
+// there's no cached token or it's about to expire. Only one token is created at a time for an installation.
+func (a *App) InstallationToken(id int64) (string, error) {
+	a.mu.Lock()
+	t, ok := a.tokens[id]
+	if ok && a.now().Add(tokenRefreshMargin).Before(t.ExpiresAt) {
+		a.mu.Unlock()
+		return t.Token, nil
+	}
+	req, creating := a.creating[id]
+	if !creating {
+		req = &tokenRequest{done: make(chan struct{})}
+		a.creating[id] = req
+	}
+	a.mu.Unlock()
+	if creating {
+		<-req.done
+		return req.token.Token, req.err
+	}
+
+	req.token, req.err = a.createToken(id)
+	a.mu.Lock()
+	delete(a.creating, id)
+	if req.err == nil {
+		a.tokens[id] = req.token
+	}
+	a.mu.Unlock()
+	close(req.done)
+	return req.token.Token, req.err
+}
+
+// createToken creates an access token of the installation with id. The installation is forgotten when GitHub
+// doesn't know it or won't give it a token, it's looked up again the next time.
+func (a *App) createToken(id int64) (installationToken, error) {
+	var t installationToken
+	err := a.appRequest("POST", fmt.Sprintf("%v/app/installations/%v/access_tokens", a.apiURL, id), "create_installation_token", &t)
+	if se, ok := err.(*StatusError); ok && (se.StatusCode == http.StatusUnauthorized || se.StatusCode == http.StatusNotFound) {
+		a.RemoveInstallation(id)
+	}
+	if err != nil {
+		return t, errors.Wrap(err, fmt.Sprintf("unable to create access token for installation %v", id))
+	}
+	return t, nil
+}
+
+// installationID returns the installation of the app on owner, looking it up through the repository if it isn't known
+func (a *App) installationID(owner string, repo string) (int64, error) {
+	a.mu.Lock()
+	id, ok := a.installations[owner]
+	a.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	err := a.appRequest("GET", fmt.Sprintf("%v/repos/%v/%v/installation", a.apiURL, owner, repo), "get_installation", &installation)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("unable to find the installation of the app on %v/%v", owner, repo))
+	}
+	a.SetInstallation(owner, installation.ID)
+	return installation.ID, nil
+}
+
+// appRequest sends a request authenticated as the app and decodes the response into result
+func (a *App) appRequest(method string, url string, operation string, result interface{}) error {
+	token, err := a.JWT()
+	if err != nil {
+		return errors.Wrap(err, "unable to sign JWT")
+	}
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return errors.Wrap(err, "unable to create request to github")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := do(getHTTPSClient(), req, operation)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return newStatusError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,157 @@
+package github
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func testApp(t *testing.T, apiURL string) (*App, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	app, err := NewApp(1234, der, apiURL)
+	assert.NoError(t, err)
+	return app, key
+}
+
+func TestAppJWT(t *testing.T) {
+	app, key := testApp(t, DefaultAPIURL)
+	signed, err := app.JWT()
+	assert.NoError(t, err)
+
+	token, err := jwt.ParseWithClaims(signed, &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, jwt.SigningMethodRS256, token.Method)
+		return &key.PublicKey, nil
+	})
+	assert.NoError(t, err)
+	claims := token.Claims.(*jwt.StandardClaims)
+	assert.Equal(t, "1234", claims.Issuer)
+	assert.True(t, claims.ExpiresAt-claims.IssuedAt <= 10*60)
+}
+
+func TestNewAppWithInvalidKey(t *testing.T) {
+	_, err := NewApp(1, []byte("not a key"), DefaultAPIURL)
+	assert.Error(t, err)
+}
+
+func TestAppInstallationTokens(t *testing.T) {
+	var requests []string
+	expires := time.Date(2026, 1, 1, 13, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "))
+		switch r.URL.Path {
+		case "/repos/org/repo/installation":
+			fmt.Fprint(w, `{"id": 99}`)
+		case "/app/installations/99/access_tokens":
+			fmt.Fprintf(w, `{"token": "token-%v", "expires_at": "%v"}`, len(requests), expires.Format(time.RFC3339))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	app, _ := testApp(t, server.URL)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	app.now = func() time.Time { return now }
+
+	token, err := app.Token("org", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+
+	// cached, also for other repositories of the installation
+	token, err = app.Token("org", "other")
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+	assert.Len(t, requests, 2)
+
+	// refreshed shortly before it expires
+	now = expires.Add(-time.Minute)
+	token, err = app.Token("org", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "token-3", token)
+
+	_, err = app.Token("unknown", "repo")
+	assert.Error(t, err)
+}
+
+func TestAppForgetsRemovedInstallations(t *testing.T) {
+	var requests []string
+	revoked := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch {
+		case r.URL.Path == "/repos/org/repo/installation":
+			fmt.Fprint(w, `{"id": 99}`)
+		case r.URL.Path == "/app/installations/99/access_tokens" && !revoked:
+			fmt.Fprint(w, `{"token": "token", "expires_at": "2026-01-01T13:00:00Z"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	app, _ := testApp(t, server.URL)
+	app.now = func() time.Time { return time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC) }
+
+	_, err := app.Token("org", "repo")
+	assert.NoError(t, err)
+	app.RemoveInstallation(99)
+	_, err = app.Token("org", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GET /repos/org/repo/installation", "POST /app/installations/99/access_tokens",
+		"GET /repos/org/repo/installation", "POST /app/installations/99/access_tokens"}, requests, "the installation should have been looked up again")
+
+	// the app was uninstalled without the event reaching us
+	revoked = true
+	app.RemoveInstallation(99)
+	app.SetInstallation("org", 99)
+	_, err = app.Token("org", "repo")
+	assert.Error(t, err)
+	assert.Empty(t, app.installations)
+}
+
+func TestAppCreatesOneTokenAtATime(t *testing.T) {
+	var created int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&created, 1)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, `{"token": "token", "expires_at": "2026-01-01T13:00:00Z"}`)
+	}))
+	defer server.Close()
+
+	app, _ := testApp(t, server.URL)
+	app.now = func() time.Time { return time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC) }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := app.InstallationToken(99)
+			assert.NoError(t, err)
+			assert.Equal(t, "token", token)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&created))
+}
+
+func TestStaticToken(t *testing.T) {
+	token, err := StaticToken("pat").Token("org", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "pat", token)
+}
@@ -0,0 +1,154 @@
+package github
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxAnnotationsPerRequest is the number of annotations GitHub accepts in one request,
+// more are sent by updating the check run again
+const maxAnnotationsPerRequest = 50
+
+// RerunAction is the identifier of the action asking seneferu to build the commit again
+const RerunAction = "rerun"
+
+// CheckRun is a check run as created and updated through the GitHub Checks API
+type CheckRun struct {
+	ID          int64         `json:"id,omitempty"`
+	Name        string        `json:"name,omitempty"`
+	HeadSHA     string        `json:"head_sha,omitempty"`
+	DetailsURL  string        `json:"details_url,omitempty"`
+	ExternalID  string        `json:"external_id,omitempty"`
+	Status      string        `json:"status,omitempty"`
+	Conclusion  string        `json:"conclusion,omitempty"`
+	StartedAt   *time.Time    `json:"started_at,omitempty"`
+	CompletedAt *time.Time    `json:"completed_at,omitempty"`
+	Output      *CheckOutput  `json:"output,omitempty"`
+	Actions     []CheckAction `json:"actions,omitempty"`
+}
+
+// CheckOutput is the description of a check run shown on GitHub
+type CheckOutput struct {
+	Title       string       `json:"title"`
+	Summary     string       `json:"summary"`
+	Text        string       `json:"text,omitempty"`
+	Annotations []Annotation `json:"annotations,omitempty"`
+}
+
+// Annotation points at a line of a file in the commit being checked
+type Annotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	StartColumn     int    `json:"start_column,omitempty"`
+	EndColumn       int    `json:"end_column,omitempty"`
+	AnnotationLevel string `json:"annotation_level"`
+	Message         string `json:"message"`
+}
+
+// CheckAction is a button on the check run, GitHub sends a check_run event with the identifier when it's clicked
+type CheckAction struct {
+	Label       string `json:"label"`
+	Description string `json:"description"`
+	Identifier  string `json:"identifier"`
+}
+
+// RepoURL returns the API URL of the repository a statuses URL like
+// https://api.github.com/repos/org/repo/statuses/{sha} belongs to
+func RepoURL(statusURL string) (string, error) {
+	i := strings.LastIndex(statusURL, "/statuses/")
+	if i < 0 {
+		return "", fmt.Errorf("%v isn't a statuses URL", statusURL)
+	}
+	return statusURL[:i], nil
+}
+
+// CreateCheckRun creates run in the repository at repoURL and returns its id
+func CreateCheckRun(repoURL string, run *CheckRun, token string) (int64, error) {
+	first, rest := splitAnnotations(run)
+	resp, err := sendCheckRun("POST", repoURL+"/check-runs", first, token, "create_check_run")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var created CheckRun
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return 0, errors.Wrap(err, "unable to decode check run")
+	}
+	return created.ID, sendAnnotations(repoURL, created.ID, run, rest, token)
+}
+
+// UpdateCheckRun updates the check run with id in the repository at repoURL
+func UpdateCheckRun(repoURL string, id int64, run *CheckRun, token string) error {
+	first, rest := splitAnnotations(run)
+	resp, err := sendCheckRun("PATCH", fmt.Sprintf("%v/check-runs/%v", repoURL, id), first, token, "update_check_run")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return sendAnnotations(repoURL, id, run, rest, token)
+}
+
+// splitAnnotations returns a copy of run with the annotations that fit in one request, and the remaining annotations
+func splitAnnotations(run *CheckRun) (*CheckRun, []Annotation) {
+	if run.Output == nil || len(run.Output.Annotations) <= maxAnnotationsPerRequest {
+		return run, nil
+	}
+	first := *run
+	output := *run.Output
+	output.Annotations = run.Output.Annotations[:maxAnnotationsPerRequest]
+	first.Output = &output
+	return &first, run.Output.Annotations[maxAnnotationsPerRequest:]
+}
+
+// sendAnnotations adds annotations to the check run with id, GitHub appends annotations on every update
+func sendAnnotations(repoURL string, id int64, run *CheckRun, annotations []Annotation, token string) error {
+	for len(annotations) > 0 {
+		n := len(annotations)
+		if n > maxAnnotationsPerRequest {
+			n = maxAnnotationsPerRequest
+		}
+		update := &CheckRun{Output: &CheckOutput{Title: run.Output.Title, Summary: run.Output.Summary, Annotations: annotations[:n]}}
+		resp, err := sendCheckRun("PATCH", fmt.Sprintf("%v/check-runs/%v", repoURL, id), update, token, "update_check_run")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		annotations = annotations[n:]
+	}
+	return nil
+}
+
+func sendCheckRun(method, url string, run *CheckRun, token string, operation string) (*http.Response, error) {
+	body, err := json.Marshal(run)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to marshal check run")
+	}
+	slog.Debug("sending check run to github", "url", url, "name", run.Name, "status", run.Status, "conclusion", run.Conclusion)
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create request to github")
+	}
+	authorize(req, token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := do(getHTTPSClient(), req, operation)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to send check run to github")
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("github returned %v when sending check run: %v", resp.Status, string(b))
+	}
+	return resp, nil
+}
@@ -0,0 +1,86 @@
+package github
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepoURL(t *testing.T) {
+	url, err := RepoURL("https://api.github.com/repos/org/repo/statuses/{sha}")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.github.com/repos/org/repo", url)
+
+	_, err = RepoURL("https://api.github.com/repos/org/repo")
+	assert.Error(t, err)
+}
+
+func TestCheckRunAnnotationsAreBatched(t *testing.T) {
+	var requests []string
+	var batches []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/vnd.github+json", r.Header.Get("Accept"))
+		var run CheckRun
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&run))
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		batches = append(batches, len(run.Output.Annotations))
+		if r.Method == "POST" {
+			assert.Equal(t, "test", run.Name)
+			assert.Equal(t, "completed", run.Status)
+			fmt.Fprint(w, `{"id": 42}`)
+		}
+	}))
+	defer server.Close()
+
+	run := &CheckRun{Name: "test", HeadSHA: "abc", Status: "completed", Conclusion: "failure", Output: &CheckOutput{Title: "test failed", Summary: "exit code 1"}}
+	for i := 0; i < 120; i++ {
+		run.Output.Annotations = append(run.Output.Annotations, Annotation{Path: "main.go", StartLine: i + 1, EndLine: i + 1, AnnotationLevel: "failure", Message: "x"})
+	}
+	id, err := CreateCheckRun(server.URL+"/repos/org/repo", run, "token")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), id)
+	assert.Equal(t, []string{"POST /repos/org/repo/check-runs", "PATCH /repos/org/repo/check-runs/42", "PATCH /repos/org/repo/check-runs/42"}, requests)
+	assert.Equal(t, []int{50, 50, 20}, batches)
+	assert.Len(t, run.Output.Annotations, 120)
+}
+
+func TestCheckRunError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "Resource not accessible by integration"}`, http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	err := UpdateCheckRun(server.URL, 1, &CheckRun{Status: "in_progress"}, "token")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not accessible")
+}
+
+func TestParseAnnotations(t *testing.T) {
+	log := `# gitlab.com/org/repo/server
+./server.go:12:5: undefined: foo
+server/handler.go:40:2: declared and not used: x
+/go/src/gitlab.com/org/repo/main.go:7: unreachable code
+/usr/local/go/src/runtime/panic.go:12: not ours
+--- FAIL: TestThing (0.00s)
+    thing_test.go:33: expected 1, got 2
+    thing_test.go:33: expected 1, got 2
+FAIL
+FAIL	gitlab.com/org/repo/pkg/thing	0.012s
+--- FAIL: TestRoot (0.00s)
+    root_test.go:9: boom
+FAIL	gitlab.com/org/repo	0.002s`
+	annotations := ParseAnnotations(strings.Split(log, "\n"), "/go/src/gitlab.com/org/repo", "repo")
+	assert.Len(t, annotations, 5)
+	assert.Equal(t, Annotation{Path: "server.go", StartLine: 12, EndLine: 12, StartColumn: 5, EndColumn: 5, AnnotationLevel: "failure", Message: "undefined: foo"}, annotations[0])
+	assert.Equal(t, "server/handler.go", annotations[1].Path)
+	assert.Equal(t, "main.go", annotations[2].Path)
+	assert.Equal(t, 0, annotations[2].StartColumn)
+	assert.Equal(t, "pkg/thing/thing_test.go", annotations[3].Path)
+	assert.Equal(t, "expected 1, got 2", annotations[3].Message)
+	assert.Equal(t, "root_test.go", annotations[4].Path)
+}
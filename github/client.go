@@ -0,0 +1,222 @@
+package github
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/metrics"
+)
+
+const (
+	// maxRetries is how often a request failing with a server error or being rate limited is retried
+	maxRetries = 3
+	// maxRetryWait is the longest seneferu waits before retrying a request, or for a rate limit to reset
+	maxRetryWait = time.Minute
+	// lowRateLimit is the number of remaining calls a warning is logged at
+	lowRateLimit = 100
+)
+
+var (
+	// retryBackoff is the wait before the first retry, it doubles for every retry
+	retryBackoff = time.Second
+	// sleep waits between retries, it's replaced in tests
+	sleep = time.Sleep
+)
+
+// ClientConfig configures the HTTP client used for all calls to GitHub
+type ClientConfig struct {
+	// CABundle is a PEM file with certificates trusted in addition to the system roots,
+	// for GitHub Enterprise Servers with a certificate of an internal CA
+	CABundle string
+	// InsecureSkipVerify disables verifying the certificate of GitHub
+	InsecureSkipVerify bool
+	// Timeout is the time limit of a single request
+	Timeout time.Duration
+}
+
+// DefaultClientConfig verifies certificates against the system roots
+var DefaultClientConfig = ClientConfig{Timeout: 30 * time.Second}
+
+// client is shared by all calls to GitHub
+var client = newClient(DefaultClientConfig, nil)
+
+// Configure replaces the HTTP client used for all calls to GitHub
+func Configure(cfg ClientConfig) error {
+	var pool *x509.CertPool
+	if cfg.CABundle != "" {
+		pem, err := ioutil.ReadFile(cfg.CABundle)
+		if err != nil {
+			return errors.Wrap(err, "unable to read CA bundle")
+		}
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA bundle %v", cfg.CABundle)
+		}
+	}
+	if cfg.InsecureSkipVerify {
+		slog.Warn("TLS verification of GitHub is disabled")
+	}
+	client = newClient(cfg, pool)
+	return nil
+}
+
+func newClient(cfg ClientConfig, roots *x509.CertPool) *http.Client {
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     &tls.Config{RootCAs: roots, InsecureSkipVerify: cfg.InsecureSkipVerify},
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConnsPerHost: 10,
+	}
+	return &http.Client{Transport: tr, Timeout: cfg.Timeout}
+}
+
+func getHTTPSClient() *http.Client {
+	return client
+}
+
+// rateLimit is the state of the GitHub rate limit, as last reported in X-RateLimit headers
+type rateLimit struct {
+	mu        sync.Mutex
+	known     bool
+	remaining int
+	reset     time.Time
+	// warned is set once running low on calls has been logged for the current window
+	warned bool
+}
+
+var limits = &rateLimit{}
+
+// update records the rate limit reported in the headers of a response
+func (l *rateLimit) update(h http.Header) {
+	remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, _ := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.known = true
+	l.remaining = remaining
+	l.reset = time.Unix(reset, 0)
+	metrics.GitHubRateLimitRemaining.Set(float64(remaining))
+	if remaining >= lowRateLimit {
+		l.warned = false
+	} else if !l.warned {
+		l.warned = true
+		slog.Warn("running low on GitHub API calls", "remaining", remaining, "reset", l.reset)
+	}
+}
+
+// wait returns how long to wait before sending a request, or an error if the rate limit resets too far in the future
+func (l *rateLimit) wait(now time.Time) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.known || l.remaining > 0 || !now.Before(l.reset) {
+		return 0, nil
+	}
+	wait := l.reset.Sub(now)
+	if wait > maxRetryWait {
+		return 0, fmt.Errorf("GitHub rate limit exceeded until %v", l.reset.Format(time.RFC3339))
+	}
+	return wait, nil
+}
+
+// idempotentMethods are the methods retried on server errors, the server may have handled the request already
+// and sending it again mustn't have another effect, like a second comment
+var idempotentMethods = map[string]bool{"GET": true, "HEAD": true, "PUT": true, "DELETE": true, "OPTIONS": true}
+
+// retryDelay returns how long to wait before retrying a request that got resp, and false if it shouldn't be retried.
+// Rate limited requests weren't handled, so they're retried whatever their method.
+func retryDelay(resp *http.Response, attempt int, now time.Time) (time.Duration, bool) {
+	if attempt >= maxRetries {
+		return 0, false
+	}
+	backoff := retryBackoff << uint(attempt)
+	switch {
+	case resp.StatusCode >= 500:
+		return backoff, resp.Request != nil && idempotentMethods[resp.Request.Method]
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusForbidden:
+		// secondary rate limits say when to retry, a forbidden response without it is final
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait := time.Duration(s) * time.Second
+			return wait, wait <= maxRetryWait
+		}
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			wait := time.Unix(reset, 0).Sub(now)
+			if wait < 0 {
+				wait = 0
+			}
+			return wait, wait <= maxRetryWait
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return backoff, true
+		}
+	}
+	return 0, false
+}
+
+// do sends req to GitHub, recording the latency and any errors of operation. Requests are
+// retried with backoff on server errors and when rate limited, if the wait isn't too long.
+func do(client *http.Client, req *http.Request, operation string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		wait, err := limits.wait(time.Now())
+		if err != nil {
+			metrics.GitHubErrors.Inc(operation)
+			return nil, err
+		}
+		if wait > 0 {
+			slog.Warn("waiting for GitHub rate limit to reset", "operation", operation, "wait", wait)
+			sleep(wait)
+		}
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		metrics.GitHubRequestDuration.Observe(metrics.Since(start), operation)
+		if err != nil {
+			metrics.GitHubErrors.Inc(operation)
+			return nil, err
+		}
+		limits.update(resp.Header)
+
+		delay, retry := retryDelay(resp, attempt, time.Now())
+		if retry && req.Body != nil && req.GetBody == nil {
+			retry = false
+		}
+		if !retry {
+			if resp.StatusCode >= 400 {
+				metrics.GitHubErrors.Inc(operation)
+			}
+			return resp, nil
+		}
+
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		metrics.GitHubRetries.Inc(operation)
+		slog.Warn("retrying GitHub request", "operation", operation, "status", resp.StatusCode, "attempt", attempt+1, "wait", delay)
+		sleep(delay)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to reset request body for retry")
+			}
+			req.Body = body
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package github
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withTestClient records the waits between retries instead of sleeping, and restores the shared client state afterwards
+func withTestClient(t *testing.T) *[]time.Duration {
+	var waits []time.Duration
+	oldClient, oldSleep, oldLimits := client, sleep, limits
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+	limits = &rateLimit{}
+	t.Cleanup(func() { client, sleep, limits = oldClient, oldSleep, oldLimits })
+	return &waits
+}
+
+func TestTLSIsVerified(t *testing.T) {
+	withTestClient(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	assert.NoError(t, Configure(DefaultClientConfig))
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := do(getHTTPSClient(), req, "test")
+	assert.Error(t, err)
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, ioutil.WriteFile(bundle, cert, 0600))
+	assert.NoError(t, Configure(ClientConfig{CABundle: bundle, Timeout: time.Second}))
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	resp, err := do(getHTTPSClient(), req, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestConfigureWithInvalidCABundle(t *testing.T) {
+	withTestClient(t)
+	assert.Error(t, Configure(ClientConfig{CABundle: filepath.Join(t.TempDir(), "missing.pem")}))
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(bundle, []byte("no certificates"), 0600))
+	assert.Error(t, Configure(ClientConfig{CABundle: bundle}))
+}
+
+func TestRetryOnServerError(t *testing.T) {
+	waits := withTestClient(t)
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("PUT", server.URL, strings.NewReader(`{"state":"success"}`))
+	resp, err := do(getHTTPSClient(), req, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{`{"state":"success"}`, `{"state":"success"}`, `{"state":"success"}`}, bodies)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, *waits)
+}
+
+func TestPostIsOnlyRetriedWhenRateLimited(t *testing.T) {
+	waits := withTestClient(t)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL, strings.NewReader(`{"body":"comment"}`))
+	resp, err := do(getHTTPSClient(), req, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, 2, calls, "a comment may have been created before the server error")
+	assert.Equal(t, []time.Duration{time.Second}, *waits)
+}
+
+func TestRetriesAreLimited(t *testing.T) {
+	waits := withTestClient(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := do(getHTTPSClient(), req, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Len(t, *waits, maxRetries)
+}
+
+func TestSecondaryRateLimit(t *testing.T) {
+	waits := withTestClient(t)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch calls {
+		case 1:
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusForbidden)
+		case 2:
+			// forbidden without a rate limit isn't retried
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := do(getHTTPSClient(), req, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, []time.Duration{7 * time.Second}, *waits)
+}
+
+func TestRateLimitRemaining(t *testing.T) {
+	withTestClient(t)
+	now := time.Unix(1000, 0)
+	h := http.Header{}
+	h.Set("X-RateLimit-Remaining", "0")
+	h.Set("X-RateLimit-Reset", "1030")
+	limits.update(h)
+
+	wait, err := limits.wait(now)
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, wait)
+
+	wait, err = limits.wait(now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+
+	h.Set("X-RateLimit-Reset", "5000")
+	limits.update(h)
+	_, err = limits.wait(now)
+	assert.Error(t, err)
+
+	h.Set("X-RateLimit-Remaining", "10")
+	limits.update(h)
+	wait, err = limits.wait(now)
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+}
@@ -1,109 +1,176 @@
 package github
 
 import (
-	"crypto/tls"
-	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"bytes"
 	"encoding/json"
 
-	"github.com/bmatsuo/go-jsontree"
 	"github.com/pkg/errors"
 )
 
-const configfilename = ".ci.yaml"
-
-// GetConfigFile tries to fetch the .ci.yaml file from the github repository
-func GetConfigFile(treeURL, commit, token string) ([]byte, error) {
-	j, err := fetchConfigFromGithub(treeURL, commit, token)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to binary data")
+// GetConfigFile fetches the file at path in the repository at repoURL, like https://api.github.com/repos/org/repo,
+// at commit through the contents API. Error statuses are returned as a *StatusError.
+func GetConfigFile(repoURL, path, commit, token string) ([]byte, error) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
 	}
-	url, err := parseGithubTree(j)
+	u := fmt.Sprintf("%v/contents/%v?ref=%v", repoURL, strings.Join(segments, "/"), url.QueryEscape(commit))
+	slog.Debug("fetching file from github", "url", u)
+	req, err := githubRequest("GET", u, token)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable fetch url")
+		return nil, err
 	}
-	client := getHTTPSClient()
-
-	req, err := githubRequest("GET", url, token)
-	resp, err := client.Do(req)
-
+	req.Header.Set("Accept", "application/vnd.github.raw")
+	resp, err := do(getHTTPSClient(), req, "get_config")
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to read body")
+		return nil, errors.Wrap(err, "unable to fetch file from github")
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, newStatusError(resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
 
-	j, err = ioutil.ReadAll(resp.Body)
+// RefCommit returns the SHA of the commit ref, like tags/v1.0 or heads/master, points at in the repository at repoURL.
+// Annotated tags are resolved to the commit they tag.
+func RefCommit(repoURL, ref, token string) (string, error) {
+	segments := strings.Split(ref, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	u := fmt.Sprintf("%v/commits/%v", repoURL, strings.Join(segments, "/"))
+	slog.Debug("resolving ref on github", "url", u)
+	req, err := githubRequest("GET", u, token)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to read body")
+		return "", err
 	}
-
-	request := jsontree.New()
-	err = request.UnmarshalJSON(j)
-	k, err := request.Get("content").String()
+	req.Header.Set("Accept", "application/vnd.github.sha")
+	resp, err := do(getHTTPSClient(), req, "get_commit")
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to get content")
+		return "", errors.Wrap(err, "unable to resolve ref on github")
 	}
-
-	o, err := base64.StdEncoding.DecodeString(k)
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", newStatusError(resp)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to decode content")
+		return "", errors.Wrap(err, "unable to read commit from github")
 	}
+	return strings.TrimSpace(string(b)), nil
+}
 
-	return o, nil
+// Release is a published release of a repository
+type Release struct {
+	ID         int64  `json:"id"`
+	TagName    string `json:"tag_name"`
+	Name       string `json:"name"`
+	HTMLURL    string `json:"html_url"`
+	Prerelease bool   `json:"prerelease"`
 }
 
-func parseGithubTree(j []byte) (string, error) {
-	request := jsontree.New()
-	err := request.UnmarshalJSON(j)
+// TagRelease returns the published release of tag in the repository at repoURL, or nil when the tag has no release
+func TagRelease(repoURL, tag, token string) (*Release, error) {
+	u := fmt.Sprintf("%v/releases/tags/%v", repoURL, url.PathEscape(tag))
+	slog.Debug("getting release of tag on github", "url", u)
+	req, err := githubRequest("GET", u, token)
 	if err != nil {
-		return "", errors.Wrap(err, "unable to parse JSON")
+		return nil, err
 	}
-	t := request.Get("tree")
-	l, err := t.Len()
+	resp, err := do(getHTTPSClient(), req, "get_release")
 	if err != nil {
-		return "", errors.Wrap(err, "unable to get length")
+		return nil, errors.Wrap(err, "unable to get release from github")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode >= 300 {
+		return nil, newStatusError(resp)
 	}
-	for i := 0; i < l; i++ {
-		path, err := t.GetIndex(i).Get("path").String()
+	var release Release
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return nil, errors.Wrap(err, "unable to decode release")
+	}
+	return &release, nil
+}
+
+// pullRequestFilesPage is the number of files requested per page, GitHub lists at most 3000 files of a pull request
+const pullRequestFilesPage = 100
+
+// PullRequestFiles returns the paths of the files changed by the pull request at pullURL,
+// like https://api.github.com/repos/org/repo/pulls/1. Renamed files are returned with both their old and new path.
+func PullRequestFiles(pullURL, token string) ([]string, error) {
+	files := []string{}
+	for page := 1; ; page++ {
+		u := fmt.Sprintf("%v/files?per_page=%v&page=%v", pullURL, pullRequestFilesPage, page)
+		slog.Debug("fetching pull request files from github", "url", u)
+		req, err := githubRequest("GET", u, token)
 		if err != nil {
-			return "", errors.Wrap(err, "unable to get path")
+			return nil, err
 		}
-
-		if path == configfilename {
-			url, err := t.GetIndex(i).Get("url").String()
-			if err != nil {
-				return "", errors.Wrap(err, "unable to get url")
+		resp, err := do(getHTTPSClient(), req, "pull_request_files")
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to fetch pull request files from github")
+		}
+		if resp.StatusCode >= 300 {
+			err = newStatusError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result []struct {
+			Filename         string `json:"filename"`
+			PreviousFilename string `json:"previous_filename"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to decode pull request files")
+		}
+		for _, f := range result {
+			files = append(files, f.Filename)
+			if f.PreviousFilename != "" {
+				files = append(files, f.PreviousFilename)
 			}
-			return url, nil
+		}
+		if len(result) < pullRequestFilesPage {
+			return files, nil
 		}
 	}
-	return "", fmt.Errorf("unable to find URL to .ci.yaml file in repository")
 }
 
-func fetchConfigFromGithub(treeURL, commit, token string) ([]byte, error) {
-	client := getHTTPSClient()
-
-	url := strings.Replace(treeURL, "{/sha}", "/"+commit, -1)
-	log.Println("About to fetch: ", url)
+// StatusError is returned when GitHub responds with an error status
+type StatusError struct {
+	StatusCode int
+	Status     string
+	// RateLimited is set when the request was rejected because the rate limit was exceeded
+	RateLimited bool
+	Message     string
+}
 
-	req, err := githubRequest("GET", url, token)
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("github returned %v: %v", e.Status, e.Message)
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("unable to fetch file from github %v", req.URL))
+// newStatusError reads the error of resp, GitHub rejects requests exceeding the rate limit with 403 or 429
+func newStatusError(resp *http.Response) *StatusError {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RateLimited: resp.StatusCode == http.StatusTooManyRequests ||
+			(resp.StatusCode == http.StatusForbidden && (resp.Header.Get("X-RateLimit-Remaining") == "0" || resp.Header.Get("Retry-After") != "")),
+		Message: string(b),
 	}
-
-	j, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to read body from response")
-	}
-
-	return j, nil
 }
 
 func githubRequest(method, url, token string) (*http.Request, error) {
@@ -111,16 +178,13 @@ func githubRequest(method, url, token string) (*http.Request, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to create request to github")
 	}
-	req.SetBasicAuth("", token)
+	authorize(req, token)
 	return req, nil
 }
 
-func getHTTPSClient() *http.Client {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	client := &http.Client{Transport: tr}
-	return client
+// authorize authenticates req with token, a personal access token or an installation token of a GitHub App
+func authorize(req *http.Request, token string) {
+	req.Header.Set("Authorization", "token "+token)
 }
 
 // ReportBack sends the build status back to Github
@@ -132,16 +196,20 @@ func ReportBack(state GithubStatus, statusURL, sha, token string) error {
 
 	client := getHTTPSClient()
 	url := strings.Replace(statusURL, "{sha}", sha, -1)
-	log.Println("Reporting status back to ", url)
+	slog.Debug("reporting status back to github", "url", url, "state", state.State, "context", state.Context)
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
 	if err != nil {
 		return errors.Wrap(err, "unable to create request to github")
 	}
-	req.SetBasicAuth("", token)
-	_, err = client.Do(req)
+	authorize(req, token)
+	resp, err := do(client, req, "report_status")
 	if err != nil {
 		return errors.Wrap(err, "unable to post status to github")
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("github returned %v when posting status", resp.Status)
+	}
 	return nil
 }
 
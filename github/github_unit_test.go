@@ -1,116 +1,108 @@
 package github
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 )
 
-func TestURLExtractor(t *testing.T) {
-	url, err := parseGithubTree([]byte(gittreedata))
-	if err != nil {
-		t.Error(err)
-	}
-	if url == "" {
-		t.Error("url should not be empty")
-	}
+func TestGetConfigFile(t *testing.T) {
+	withTestClient(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/vnd.github.raw", r.Header.Get("Accept"))
+		switch r.URL.RequestURI() {
+		case "/repos/org/repo/contents/ci/build.yaml?ref=abc":
+			fmt.Fprint(w, "steps:\n")
+		case "/repos/org/repo/contents/.ci.yaml?ref=limited":
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	b, err := GetConfigFile(server.URL+"/repos/org/repo", "ci/build.yaml", "abc", "token")
+	assert.NoError(t, err)
+	assert.Equal(t, "steps:\n", string(b))
+
+	_, err = GetConfigFile(server.URL+"/repos/org/repo", ".ci.yaml", "abc", "token")
+	se, ok := errors.Cause(err).(*StatusError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, se.StatusCode)
+	assert.False(t, se.RateLimited)
+
+	_, err = GetConfigFile(server.URL+"/repos/org/repo", ".ci.yaml", "limited", "token")
+	se, ok = errors.Cause(err).(*StatusError)
+	assert.True(t, ok)
+	assert.True(t, se.RateLimited)
+}
+
+func TestPullRequestFiles(t *testing.T) {
+	withTestClient(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/repos/org/repo/pulls/1/files", r.URL.Path)
+		assert.Equal(t, "100", r.URL.Query().Get("per_page"))
+		if r.URL.Query().Get("page") == "1" {
+			fmt.Fprint(w, "[")
+			for i := 0; i < 100; i++ {
+				if i > 0 {
+					fmt.Fprint(w, ",")
+				}
+				fmt.Fprintf(w, `{"filename":"services/api/%v.go"}`, i)
+			}
+			fmt.Fprint(w, "]")
+			return
+		}
+		fmt.Fprint(w, `[{"filename":"docs/new.md","previous_filename":"docs/old.md"}]`)
+	}))
+	defer server.Close()
+
+	files, err := PullRequestFiles(server.URL+"/repos/org/repo/pulls/1", "token")
+	assert.NoError(t, err)
+	assert.Len(t, files, 102)
+	assert.Equal(t, "services/api/0.go", files[0])
+	assert.Equal(t, []string{"docs/new.md", "docs/old.md"}, files[100:])
+}
+
+func TestTagRelease(t *testing.T) {
+	withTestClient(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/repos/org/repo/releases/tags/v1.0" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"id": 7, "tag_name": "v1.0", "name": "First", "html_url": "https://github.com/org/repo/releases/tag/v1.0", "prerelease": true}`)
+	}))
+	defer server.Close()
+
+	release, err := TagRelease(server.URL+"/repos/org/repo", "v1.0", "token")
+	assert.NoError(t, err)
+	assert.Equal(t, &Release{ID: 7, TagName: "v1.0", Name: "First", HTMLURL: "https://github.com/org/repo/releases/tag/v1.0", Prerelease: true}, release)
+	release, err = TagRelease(server.URL+"/repos/org/repo", "v2.0", "token")
+	assert.NoError(t, err)
+	assert.Nil(t, release)
 }
 
-const gittreedata = `{
-  "sha": "0c92b8088b3dec03be37c7c523b8d32ea92cf681",
-  "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/trees/0c92b8088b3dec03be37c7c523b8d32ea92cf681",
-  "tree": [
-    {
-      "path": ".ci.yaml",
-      "mode": "100644",
-      "type": "blob",
-      "sha": "4e5f17d166c69a57010c63cff97e8575eb40aaab",
-      "size": 340,
-      "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/blobs/4e5f17d166c69a57010c63cff97e8575eb40aaab"
-    },
-    {
-      "path": ".gitignore",
-      "mode": "100644",
-      "type": "blob",
-      "sha": "485dee64bcfb48793379b200a1afd14e85a8aaf4",
-      "size": 6,
-      "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/blobs/485dee64bcfb48793379b200a1afd14e85a8aaf4"
-    },
-    {
-      "path": "README.md",
-      "mode": "100644",
-      "type": "blob",
-      "sha": "f0f9a39f1cdf7d4e745fe0aeb0191c33a17f76d2",
-      "size": 150,
-      "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/blobs/f0f9a39f1cdf7d4e745fe0aeb0191c33a17f76d2"
-    },
-    {
-      "path": "build.sh",
-      "mode": "100755",
-      "type": "blob",
-      "sha": "cea192594f076226ea1548bc346d2559bb2ed109",
-      "size": 52,
-      "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/blobs/cea192594f076226ea1548bc346d2559bb2ed109"
-    },
-    {
-      "path": "charts",
-      "mode": "040000",
-      "type": "tree",
-      "sha": "1b94fd887ee4602e1d8b10f8075ff43c9c1754fd",
-      "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/trees/1b94fd887ee4602e1d8b10f8075ff43c9c1754fd"
-    },
-    {
-      "path": "index.js",
-      "mode": "100644",
-      "type": "blob",
-      "sha": "c40f9b0755a4c3d44b691a1dd5b192b1a3abc6b5",
-      "size": 551,
-      "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/blobs/c40f9b0755a4c3d44b691a1dd5b192b1a3abc6b5"
-    },
-    {
-      "path": "package-lock.json",
-      "mode": "100644",
-      "type": "blob",
-      "sha": "84f7cbb4342bdd977cfa1a7eb4f8225716f83e38",
-      "size": 74,
-      "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/blobs/84f7cbb4342bdd977cfa1a7eb4f8225716f83e38"
-    },
-    {
-      "path": "package.json",
-      "mode": "100644",
-      "type": "blob",
-      "sha": "c3856880a054ccb4fc131be8d2b8da24daceb854",
-      "size": 912,
-      "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/blobs/c3856880a054ccb4fc131be8d2b8da24daceb854"
-    },
-    {
-      "path": "public",
-      "mode": "040000",
-      "type": "tree",
-      "sha": "e30651f0f260954659fe75214fc12c6309959202",
-      "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/trees/e30651f0f260954659fe75214fc12c6309959202"
-    },
-    {
-      "path": "src",
-      "mode": "040000",
-      "type": "tree",
-      "sha": "cc9461f0716f7c46c5195ab471f15f349a69023c",
-      "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/trees/cc9461f0716f7c46c5195ab471f15f349a69023c"
-    },
-    {
-      "path": "webpack.config.js",
-      "mode": "100644",
-      "type": "blob",
-      "sha": "746cf1feacefa13a31ea8bba224dadadcff55414",
-      "size": 399,
-      "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/blobs/746cf1feacefa13a31ea8bba224dadadcff55414"
-    },
-    {
-      "path": "yarn.lock",
-      "mode": "100644",
-      "type": "blob",
-      "sha": "bd493748712340df79513fba6e0044b8a7272055",
-      "size": 95213,
-      "url": "https://api.github.com/repos/callebjorkell/cuddle-cake/git/blobs/bd493748712340df79513fba6e0044b8a7272055"
-    }
-  ],
-  "truncated": false
-}`
+func TestRefCommit(t *testing.T) {
+	withTestClient(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/vnd.github.sha", r.Header.Get("Accept"))
+		if r.URL.EscapedPath() != "/repos/org/repo/commits/tags/release/1.0%23rc" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "abc123\n")
+	}))
+	defer server.Close()
+
+	sha, err := RefCommit(server.URL+"/repos/org/repo", "tags/release/1.0#rc", "token")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123", sha)
+	_, err = RefCommit(server.URL+"/repos/org/repo", "tags/v2.0", "token")
+	assert.Error(t, err)
+}
@@ -0,0 +1,47 @@
+package github
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Host is the GitHub instance repositories are built from, github.com or a GitHub Enterprise Server
+type Host struct {
+	// Name is the host name of the web interface, like github.example.com
+	Name string
+	// APIURL is the base URL of the REST API, without a trailing slash
+	APIURL string
+	// SSHHost and SSHPort are where repositories are cloned from over SSH, see scm.Remote for the clone URLs
+	SSHHost string
+	SSHPort int
+}
+
+// GitHubCom is github.com
+var GitHubCom = Host{Name: "github.com", APIURL: DefaultAPIURL, SSHHost: "github.com", SSHPort: 22}
+
+// DefaultHost is the GitHub instance used, github.com unless replaced
+var DefaultHost = GitHubCom
+
+// NewHost returns the GitHub instance at name. The API of a GitHub Enterprise Server is at /api/v3 and
+// it's cloned from over SSH at name port 22, unless apiURL, sshHost or sshPort are given.
+func NewHost(name string, apiURL string, sshHost string, sshPort int) Host {
+	h := GitHubCom
+	if name != "" && name != GitHubCom.Name {
+		h = Host{Name: name, APIURL: "https://" + name + "/api/v3", SSHHost: name, SSHPort: 22}
+	}
+	if apiURL != "" {
+		h.APIURL = strings.TrimSuffix(apiURL, "/")
+	}
+	if sshHost != "" {
+		h.SSHHost = sshHost
+	}
+	if sshPort != 0 {
+		h.SSHPort = sshPort
+	}
+	return h
+}
+
+// WebURL returns the URL of repository org/name in the web interface
+func (h Host) WebURL(org string, name string) string {
+	return fmt.Sprintf("https://%v/%v/%v", h.Name, org, name)
+}
@@ -0,0 +1,24 @@
+package github
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitHubComHost(t *testing.T) {
+	h := NewHost("", "", "", 0)
+	assert.Equal(t, GitHubCom, h)
+	assert.Equal(t, "https://github.com/org/repo", h.WebURL("org", "repo"))
+}
+
+func TestEnterpriseHost(t *testing.T) {
+	h := NewHost("github.example.com", "", "", 0)
+	assert.Equal(t, "https://github.example.com/api/v3", h.APIURL)
+	assert.Equal(t, Host{Name: "github.example.com", APIURL: "https://github.example.com/api/v3", SSHHost: "github.example.com", SSHPort: 22}, h)
+
+	h = NewHost("github.example.com", "https://api.example.com/", "ssh.example.com", 2222)
+	assert.Equal(t, "https://api.example.com", h.APIURL)
+	assert.Equal(t, "ssh.example.com", h.SSHHost)
+	assert.Equal(t, 2222, h.SSHPort)
+}
@@ -0,0 +1,51 @@
+// Package logging sets up the structured server log
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+// Keys of the fields correlating log records with a build
+const (
+	OrgKey       = "org"
+	RepoKey      = "repo"
+	BuildKey     = "build"
+	BuildUUIDKey = "build_uuid"
+	StepKey      = "step"
+)
+
+// Setup makes a logger writing records in format, json or logfmt, the default logger.
+// Records below level are dropped. The standard log package writes through it as well.
+func Setup(w io.Writer, format string, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %v", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "logfmt":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %v, use json or logfmt", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// Build returns a logger with the fields identifying build
+func Build(build *model.Build) *slog.Logger {
+	return slog.Default().With(OrgKey, build.Org, RepoKey, build.Name, BuildKey, build.Number)
+}
+
+// Step returns a logger with the fields identifying step
+func Step(step *model.Step) *slog.Logger {
+	return slog.Default().With(OrgKey, step.Org, RepoKey, step.Reponame, BuildKey, step.BuildNumber, StepKey, step.Name)
+}
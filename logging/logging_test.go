@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+func TestBuildFieldsAsJSON(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var buf bytes.Buffer
+	assert.NoError(t, Setup(&buf, "json", "info"))
+
+	Build(&model.Build{Org: "org", Name: "repo", Number: 42}).With(BuildUUIDKey, "build-1").Info("scheduling build")
+
+	var record map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "scheduling build", record["msg"])
+	assert.Equal(t, "org", record["org"])
+	assert.Equal(t, "repo", record["repo"])
+	assert.Equal(t, float64(42), record["build"])
+	assert.Equal(t, "build-1", record["build_uuid"])
+}
+
+func TestStepFieldsAsLogfmt(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var buf bytes.Buffer
+	assert.NoError(t, Setup(&buf, "logfmt", "debug"))
+
+	Step(&model.Step{StepInfo: model.StepInfo{Org: "org", Reponame: "repo", BuildNumber: 1, Name: "test"}}).Debug("step done")
+	assert.Contains(t, buf.String(), `msg="step done" org=org repo=repo build=1 step=test`)
+}
+
+func TestStandardLogWritesThroughSetup(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var buf bytes.Buffer
+	assert.NoError(t, Setup(&buf, "logfmt", "info"))
+
+	log.Println("plain message")
+	assert.Contains(t, buf.String(), `msg="plain message"`)
+}
+
+func TestLevel(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var buf bytes.Buffer
+	assert.NoError(t, Setup(&buf, "json", "warn"))
+	slog.Info("dropped")
+	assert.Empty(t, buf.String())
+
+	assert.Error(t, Setup(&buf, "xml", "info"))
+	assert.Error(t, Setup(&buf, "json", "loud"))
+}
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"io/ioutil"
 	"log"
+	"os"
 
 	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/builder"
+	"gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/logging"
+	"gitlab.com/sorenmat/seneferu/notify"
+	"gitlab.com/sorenmat/seneferu/retention"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/storage"
+	"gitlab.com/sorenmat/seneferu/storage/logstore"
+	"gitlab.com/sorenmat/seneferu/storage/logstore/disk"
+	"gitlab.com/sorenmat/seneferu/storage/logstore/s3"
 	"gitlab.com/sorenmat/seneferu/storage/sql"
+	"gitlab.com/sorenmat/seneferu/tracing"
 	"gitlab.com/sorenmat/seneferu/web"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"k8s.io/client-go/kubernetes"
@@ -13,16 +26,107 @@ import (
 )
 
 var (
-	kubeCfgFile   = kingpin.Flag("kubeconfig", "Kubernetes Config File").Envar("KUBE_CONFIG").String()
-	githubSecret  = kingpin.Flag("githubsecret", "Github secret token, needs to match the one on Github ").Envar("GITHUB_SECRET").Required().String()
-	githubToken   = kingpin.Flag("githubToken", "Github access token, to access the API").Envar("GITHUB_TOKEN").Required().String()
-	sshkey        = kingpin.Flag("sshkey", "Github ssh key, used for cloning the repositories").Envar("SSH_KEY").Required().String()
-	targetURL     = kingpin.Flag("targetURL", "Base URL to use for reporting status to Github").Envar("TARGET_URL").Required().String()
-	dockerRegHost = kingpin.Flag("dockerhost", "Host name of a private docker registry").Envar("DOCKER_REGISTRY_HOST").String()
+	kubeCfgFile    = kingpin.Flag("kubeconfig", "Kubernetes Config File").Envar("KUBE_CONFIG").String()
+	githubSecret   = kingpin.Flag("githubsecret", "Github secret token, needs to match the one on Github ").Envar("GITHUB_SECRET").Required().String()
+	githubToken    = kingpin.Flag("githubToken", "Github access token, to access the API. Not needed when running as a GitHub App").Envar("GITHUB_TOKEN").String()
+	githubAppID    = kingpin.Flag("github-app-id", "ID of the GitHub App to run as instead of using githubToken").Envar("GITHUB_APP_ID").Int64()
+	githubAppKey   = kingpin.Flag("github-app-key", "File with the PEM encoded private key of the GitHub App").Envar("GITHUB_APP_KEY").String()
+	githubHost     = kingpin.Flag("github-host", "Host name of the GitHub Enterprise Server to build from, github.com if empty").Envar("GITHUB_HOST").String()
+	githubAPIURL   = kingpin.Flag("github-api-url", "Base URL of the GitHub API, https://<github-host>/api/v3 for GitHub Enterprise Server if empty").Envar("GITHUB_API_URL").String()
+	githubSSHHost  = kingpin.Flag("github-ssh-host", "Host repositories are cloned from over SSH, github-host if empty").Envar("GITHUB_SSH_HOST").String()
+	githubSSHPort  = kingpin.Flag("github-ssh-port", "Port repositories are cloned from over SSH").Envar("GITHUB_SSH_PORT").Default("22").Int()
+	githubCABundle = kingpin.Flag("github-ca-bundle", "PEM file with certificates to trust for GitHub in addition to the system roots").Envar("GITHUB_CA_BUNDLE").String()
+	githubInsecure = kingpin.Flag("github-insecure-skip-verify", "Don't verify the TLS certificate of GitHub").Envar("GITHUB_INSECURE_SKIP_VERIFY").Bool()
+	githubTimeout  = kingpin.Flag("github-timeout", "Time limit of a single call to GitHub").Envar("GITHUB_TIMEOUT").Default("30s").Duration()
+	gitClone       = kingpin.Flag("git-clone", "Clone repositories over ssh with sshkey or over https with the GitHub token").Envar("GIT_CLONE").Default("ssh").Enum("ssh", "https")
+	sshkey         = kingpin.Flag("sshkey", "Github ssh key, used for cloning the repositories").Envar("SSH_KEY").Required().String()
+	targetURL      = kingpin.Flag("targetURL", "Base URL to use for reporting status to Github").Envar("TARGET_URL").Required().String()
+	dockerRegHost  = kingpin.Flag("dockerhost", "Host name of a private docker registry").Envar("DOCKER_REGISTRY_HOST").String()
+	adminToken     = kingpin.Flag("admin-token", "Bearer token needed to change repository settings and see the retention plan, they are disabled if empty").Envar("ADMIN_TOKEN").String()
+
+	logStore    = kingpin.Flag("logstore", "Where to keep the logs of finished steps, db, disk or s3").Envar("LOG_STORE").Default("db").Enum("db", "disk", "s3")
+	logDir      = kingpin.Flag("logdir", "Directory to keep logs in when using the disk log store").Envar("LOG_DIR").Default("logs").String()
+	s3Endpoint  = kingpin.Flag("s3endpoint", "URL of the S3 compatible endpoint used by the s3 log store").Envar("S3_ENDPOINT").Default("https://s3.amazonaws.com").String()
+	s3Bucket    = kingpin.Flag("s3bucket", "Bucket used by the s3 log store").Envar("S3_BUCKET").String()
+	s3Region    = kingpin.Flag("s3region", "Region of the bucket used by the s3 log store").Envar("S3_REGION").Default("us-east-1").String()
+	s3AccessKey = kingpin.Flag("s3accesskey", "Access key for the s3 log store").Envar("S3_ACCESS_KEY").String()
+	s3SecretKey = kingpin.Flag("s3secretkey", "Secret key for the s3 log store").Envar("S3_SECRET_KEY").String()
+
+	keepBuilds        = kingpin.Flag("keep-builds", "Number of builds to keep per branch, 0 keeps all builds").Envar("KEEP_BUILDS").Default("0").Int()
+	logMaxAge         = kingpin.Flag("log-max-age", "How long to keep build logs, like 2160h for 90 days, 0 keeps logs forever").Envar("LOG_MAX_AGE").Default("0").Duration()
+	keepTags          = kingpin.Flag("keep-tags", "Always keep builds of tags, including their logs").Envar("KEEP_TAGS").Default("true").Bool()
+	retentionInterval = kingpin.Flag("retention-interval", "How often old builds and logs are pruned").Envar("RETENTION_INTERVAL").Default("1h").Duration()
+
+	logFormat  = kingpin.Flag("log-format", "Format of the server log, logfmt or json").Envar("LOG_FORMAT").Default("logfmt").Enum("logfmt", "json")
+	logLevel   = kingpin.Flag("log-level", "Lowest level written to the server log, debug, info, warn or error").Envar("LOG_LEVEL").Default("info").Enum("debug", "info", "warn", "error")
+	echoOutput = kingpin.Flag("echo-build-output", "Write the output of build steps to the server log as well").Envar("ECHO_BUILD_OUTPUT").Default("true").Bool()
+
+	otlpEndpoint    = kingpin.Flag("otlp-endpoint", "URL of an OpenTelemetry collector receiving traces over OTLP/HTTP, like http://localhost:4318. Traces are discarded if empty").Envar("OTEL_EXPORTER_OTLP_ENDPOINT").String()
+	otlpServiceName = kingpin.Flag("otlp-service-name", "Service name of the exported traces").Envar("OTEL_SERVICE_NAME").Default("seneferu").String()
+
+	notifySlack         = kingpin.Flag("notify-slack", "Slack incoming webhook URL notified about the builds of every repository").Envar("NOTIFY_SLACK").String()
+	notifyWebhook       = kingpin.Flag("notify-webhook", "URL the builds of every repository are posted to as JSON").Envar("NOTIFY_WEBHOOK").String()
+	notifyWebhookSecret = kingpin.Flag("notify-webhook-secret", "Secret used to sign the payload posted to notify-webhook").Envar("NOTIFY_WEBHOOK_SECRET").String()
+	notifyEmail         = kingpin.Flag("notify-email", "Email address notified about the builds of every repository, can be repeated").Envar("NOTIFY_EMAIL").Strings()
+	notifyWhen          = kingpin.Flag("notify-when", "When to send the server wide notifications, failure, recovery or always, can be repeated").Envar("NOTIFY_WHEN").Default("failure", "recovery").Enums("failure", "recovery", "always")
+	smtpAddr            = kingpin.Flag("smtp-addr", "host:port of the SMTP server used for email notifications").Envar("SMTP_ADDR").String()
+	smtpFrom            = kingpin.Flag("smtp-from", "Sender address of email notifications").Envar("SMTP_FROM").Default("seneferu@localhost").String()
+	smtpUsername        = kingpin.Flag("smtp-username", "Username for the SMTP server").Envar("SMTP_USERNAME").String()
+	smtpPassword        = kingpin.Flag("smtp-password", "Password for the SMTP server").Envar("SMTP_PASSWORD").String()
+
+	githubChecks  = kingpin.Flag("github-checks", "Report builds as GitHub check runs instead of commit statuses, needs a token of a GitHub App").Envar("GITHUB_CHECKS").Bool()
+	checkLogLines = kingpin.Flag("github-checks-log-lines", "Number of lines at the end of the log of a failed step shown in its check run").Envar("GITHUB_CHECKS_LOG_LINES").Default("100").Int()
+
+	gitlabURL        = kingpin.Flag("gitlab-url", "Base URL of the GitLab to build from as well, like https://gitlab.example.com").Envar("GITLAB_URL").String()
+	gitlabToken      = kingpin.Flag("gitlab-token", "GitLab access token with the api scope, to fetch .ci.yaml and report statuses").Envar("GITLAB_TOKEN").String()
+	gitlabSecret     = kingpin.Flag("gitlab-secret", "Secret token of the GitLab webhooks, needs to match the one on GitLab").Envar("GITLAB_SECRET").String()
+	gitlabSSHHost    = kingpin.Flag("gitlab-ssh-host", "Host GitLab repositories are cloned from over SSH, the host of gitlab-url if empty").Envar("GITLAB_SSH_HOST").String()
+	gitlabSSHPort    = kingpin.Flag("gitlab-ssh-port", "Port GitLab repositories are cloned from over SSH").Envar("GITLAB_SSH_PORT").Default("22").Int()
+	bitbucketURL     = kingpin.Flag("bitbucket-url", "Base URL of the Bitbucket Server to build from as well, or https://bitbucket.org for Bitbucket Cloud").Envar("BITBUCKET_URL").String()
+	bitbucketToken   = kingpin.Flag("bitbucket-token", "Bitbucket access token with read access to repositories and write access to build statuses").Envar("BITBUCKET_TOKEN").String()
+	bitbucketUser    = kingpin.Flag("bitbucket-user", "User name sent with bitbucket-token when cloning over https").Envar("BITBUCKET_USER").Default("x-token-auth").String()
+	bitbucketSecret  = kingpin.Flag("bitbucket-secret", "Secret the Bitbucket webhooks are signed with").Envar("BITBUCKET_SECRET").String()
+	bitbucketSSHHost = kingpin.Flag("bitbucket-ssh-host", "Host Bitbucket repositories are cloned from over SSH, the host of bitbucket-url if empty").Envar("BITBUCKET_SSH_HOST").String()
+	bitbucketSSHPort = kingpin.Flag("bitbucket-ssh-port", "Port Bitbucket repositories are cloned from over SSH, 22 on Bitbucket Cloud and 7999 on Bitbucket Server if 0").Envar("BITBUCKET_SSH_PORT").Default("0").Int()
+	giteaURL         = kingpin.Flag("gitea-url", "Base URL of the Gitea or Forgejo to build from as well, like https://gitea.example.com").Envar("GITEA_URL").String()
+	giteaToken       = kingpin.Flag("gitea-token", "Gitea access token with read access to repositories and write access to commit statuses").Envar("GITEA_TOKEN").String()
+	giteaSecret      = kingpin.Flag("gitea-secret", "Secret the Gitea webhooks are signed with").Envar("GITEA_SECRET").String()
+	giteaSSHHost     = kingpin.Flag("gitea-ssh-host", "Host Gitea repositories are cloned from over SSH, the host of gitea-url if empty").Envar("GITEA_SSH_HOST").String()
+	giteaSSHPort     = kingpin.Flag("gitea-ssh-port", "Port Gitea repositories are cloned from over SSH").Envar("GITEA_SSH_PORT").Default("22").Int()
+
+	environment = kingpin.Flag("environment", "Environment Seneferu runs in, like staging or production, matched by the environment constraint of steps").Envar("ENVIRONMENT").String()
+	skipLabel   = kingpin.Flag("pr-skip-label", "Label of pull requests that aren't built, pull requests are always built if empty").Envar("PR_SKIP_LABEL").Default("skip-ci").String()
+	prForks     = kingpin.Flag("pr-build-forks", "Build pull requests from forks, their steps can read the SSH key, so only for trusted forks").Envar("PR_BUILD_FORKS").Bool()
+	prCheckout  = kingpin.Flag("pr-checkout", "What's built of pull requests, merge for the result of merging them or head for their head commit").Envar("PR_CHECKOUT").Default("merge").Enum("merge", "head")
 )
 
 func main() {
 	kingpin.Parse()
+	if err := logging.Setup(os.Stdout, *logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+	builder.EchoOutput = *echoOutput
+	err := github.Configure(github.ClientConfig{CABundle: *githubCABundle, InsecureSkipVerify: *githubInsecure, Timeout: *githubTimeout})
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "unable to configure GitHub client"))
+	}
+	github.DefaultHost = github.NewHost(*githubHost, *githubAPIURL, *githubSSHHost, *githubSSHPort)
+	builder.CloneOverHTTPS = *gitClone == "https"
+	builder.UseChecks = *githubChecks
+	builder.CheckLogLines = *checkLogLines
+	builder.Environment = *environment
+	web.SkipLabel = *skipLabel
+	builder.PullRequestCheckout = *prCheckout
+	web.BuildForks = *prForks
+	if *otlpEndpoint != "" {
+		exporter, err := tracing.NewOTLPExporter(*otlpEndpoint, *otlpServiceName)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "unable to create OTLP exporter"))
+		}
+		defer exporter.Shutdown()
+		tracing.Default = tracing.NewTracer(exporter)
+	}
+	builder.Notifier = notify.New(notifyDefaults(), notify.SMTP{Addr: *smtpAddr, From: *smtpFrom, Username: *smtpUsername, Password: *smtpPassword})
 
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -42,12 +146,114 @@ func main() {
 	}
 	log.Println("... connected")
 
+	service, err = withLogStore(service)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "unable to create log store"))
+	}
+
 	log.Println("Setting up Kubernets access")
 	kubectl, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		log.Fatal(errors.Wrap(err, "unable create kubectl"))
 	}
 
+	policy := retention.Policy{KeepBuilds: *keepBuilds, LogMaxAge: *logMaxAge, KeepTags: *keepTags}
+	janitor := retention.NewJanitor(service, policy, *retentionInterval)
+	janitor.Start()
+
+	tokens, err := githubTokens()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	providers, err := sourceProviders()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	log.Println("Starting web server...")
-	web.StartWebServer(service, kubectl, *githubSecret, *targetURL, *githubToken, *dockerRegHost, *sshkey)
+	web.StartWebServer(service, kubectl, *githubSecret, *targetURL, tokens, providers, *dockerRegHost, *sshkey, janitor, *adminToken)
+}
+
+// sourceProviders returns the providers besides GitHub that have a URL configured
+func sourceProviders() (web.Providers, error) {
+	var providers web.Providers
+	var err error
+	if *gitlabURL != "" {
+		providers.GitLab, err = scm.NewGitLab(*gitlabURL, *gitlabToken, *gitlabSecret, *gitlabSSHHost, *gitlabSSHPort)
+		if err != nil {
+			return providers, err
+		}
+	}
+	if *bitbucketURL != "" {
+		providers.Bitbucket, err = scm.NewBitbucket(*bitbucketURL, *bitbucketToken, *bitbucketUser, *bitbucketSecret, *bitbucketSSHHost, *bitbucketSSHPort)
+		if err != nil {
+			return providers, err
+		}
+	}
+	if *giteaURL != "" {
+		providers.Gitea, err = scm.NewGitea(*giteaURL, *giteaToken, *giteaSecret, *giteaSSHHost, *giteaSSHPort)
+		if err != nil {
+			return providers, err
+		}
+	}
+	return providers, nil
+}
+
+// githubTokens returns the tokens used to access GitHub, of the GitHub App if one is configured
+func githubTokens() (github.TokenSource, error) {
+	if *githubAppID == 0 {
+		if *githubToken == "" {
+			return nil, errors.New("either githubToken or github-app-id and github-app-key are required")
+		}
+		return github.StaticToken(*githubToken), nil
+	}
+	key, err := ioutil.ReadFile(*githubAppKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read GitHub App private key")
+	}
+	return github.NewApp(*githubAppID, key, github.DefaultHost.APIURL)
+}
+
+// notifyDefaults returns the notification targets of every repository
+func notifyDefaults() notify.Config {
+	var cfg notify.Config
+	if *notifySlack != "" {
+		cfg.Slack = append(cfg.Slack, notify.Slack{URL: *notifySlack, When: *notifyWhen})
+	}
+	if *notifyWebhook != "" {
+		cfg.Webhook = append(cfg.Webhook, notify.Webhook{URL: *notifyWebhook, Secret: *notifyWebhookSecret, When: *notifyWhen})
+	}
+	if len(*notifyEmail) > 0 {
+		cfg.Email = append(cfg.Email, notify.Email{To: *notifyEmail, When: *notifyWhen})
+	}
+	return cfg
+}
+
+// withLogStore moves the logs of finished steps out of the database, if configured
+func withLogStore(service storage.Service) (storage.Service, error) {
+	var store logstore.LogStore
+	var err error
+	switch *logStore {
+	case "disk":
+		store, err = disk.New(*logDir)
+	case "s3":
+		store, err = s3.New(*s3Endpoint, *s3Bucket, *s3Region, *s3AccessKey, *s3SecretKey)
+	default:
+		return service, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Keeping logs of finished steps in the %v log store\n", *logStore)
+	archiver := logstore.New(service, store)
+	// move the logs still kept in the database without holding up the start
+	go func() {
+		archived, err := archiver.ArchiveStoredLogs()
+		if err != nil {
+			log.Println("unable to archive the logs kept in the database", err)
+		}
+		log.Printf("Archived %v logs kept in the database\n", archived)
+	}()
+	return archiver, nil
 }
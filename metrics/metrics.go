@@ -0,0 +1,55 @@
+// Package metrics exposes the metrics of the build server in the Prometheus text format
+package metrics
+
+import (
+	"net/http"
+	"time"
+)
+
+// Default is the registry holding the metrics of the build server
+var Default = NewRegistry()
+
+var (
+	// WebhooksReceived counts the webhooks received, by event type
+	WebhooksReceived = Default.NewCounter("seneferu_webhooks_received_total",
+		"Number of webhooks received.", "event")
+	// Builds counts builds by repository and result, which is one of started, succeeded, failed, error or skipped.
+	// Builds end in error when they couldn't be run to completion, like when the pod never started,
+	// and are skipped when the commit has no build configuration or none of its steps match the build.
+	Builds = Default.NewCounter("seneferu_builds_total",
+		"Number of builds by repository and result.", "repo", "result")
+	// StepDuration observes the run time of build steps, in seconds
+	StepDuration = Default.NewHistogram("seneferu_step_duration_seconds",
+		"Run time of build steps.", []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600}, "repo", "step")
+	// QueueDepth is the number of builds waiting for their pod to start
+	QueueDepth = Default.NewGauge("seneferu_queue_depth",
+		"Number of builds waiting for their pod to start.")
+	// GitHubRequestDuration observes the latency of calls to the GitHub API, by operation
+	GitHubRequestDuration = Default.NewHistogram("seneferu_github_request_duration_seconds",
+		"Latency of calls to the GitHub API.", DefBuckets, "operation")
+	// GitHubErrors counts failed calls to the GitHub API, by operation
+	GitHubErrors = Default.NewCounter("seneferu_github_errors_total",
+		"Number of failed calls to the GitHub API.", "operation")
+	// GitHubRetries counts calls to the GitHub API retried after a server error or being rate limited, by operation
+	GitHubRetries = Default.NewCounter("seneferu_github_retries_total",
+		"Number of calls to the GitHub API retried.", "operation")
+	// GitHubRateLimitRemaining is the number of calls to the GitHub API left in the current rate limit window
+	GitHubRateLimitRemaining = Default.NewGauge("seneferu_github_rate_limit_remaining",
+		"Number of calls to the GitHub API left before being rate limited.")
+	// KubernetesErrors counts failed calls to the Kubernetes API, by operation
+	KubernetesErrors = Default.NewCounter("seneferu_kubernetes_errors_total",
+		"Number of failed calls to the Kubernetes API.", "operation")
+	// ActiveNamespaces is the number of build namespaces currently existing
+	ActiveNamespaces = Default.NewGauge("seneferu_active_namespaces",
+		"Number of build namespaces currently existing.")
+)
+
+// Handler serves the metrics of the default registry
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// Since returns the seconds passed since start, for observing durations
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
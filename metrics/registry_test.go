@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A counter.", "repo", "result")
+	c.Inc("org/b", "failed")
+	c.Inc("org/a", "succeeded")
+	c.Add(2, "org/a", "succeeded")
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.Write(&buf))
+	assert.Equal(t, `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{repo="org/a",result="succeeded"} 3
+test_total{repo="org/b",result="failed"} 1
+`, buf.String())
+}
+
+func TestGauge(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("test_gauge", "A gauge.")
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	assert.Contains(t, buf.String(), "test_gauge 0\n")
+
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	buf.Reset()
+	r.Write(&buf)
+	assert.Contains(t, buf.String(), "test_gauge 1\n")
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("test_seconds", "A histogram.", []float64{1, 0.5}, "op")
+	h.Observe(0.2, "get")
+	h.Observe(0.7, "get")
+	h.Observe(3, "get")
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	assert.Equal(t, `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{op="get",le="0.5"} 1
+test_seconds_bucket{op="get",le="1"} 2
+test_seconds_bucket{op="get",le="+Inf"} 3
+test_seconds_sum{op="get"} 3.9
+test_seconds_count{op="get"} 3
+`, buf.String())
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Escapes \\ and\nnewlines.", "event")
+	c.Inc("a \"quoted\"\nvalue")
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	assert.Contains(t, buf.String(), "# HELP test_total Escapes \\\\ and\\nnewlines.\n")
+	assert.Contains(t, buf.String(), `test_total{event="a \"quoted\"\nvalue"} 1`)
+}
+
+func TestWrongNumberOfLabels(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A counter.", "repo")
+	assert.Panics(t, func() { c.Inc() })
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("b_total", "B.").Inc()
+	r.NewCounter("a_total", "A.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.True(t, bytes.Index(rec.Body.Bytes(), []byte("a_total")) < bytes.Index(rec.Body.Bytes(), []byte("b_total")))
+}
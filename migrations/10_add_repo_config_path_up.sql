@@ -0,0 +1,2 @@
+ALTER TABLE repositories
+    ADD COLUMN config_path VARCHAR(300) DEFAULT '' NOT NULL;
@@ -0,0 +1,6 @@
+ALTER TABLE builds
+  DROP COLUMN event,
+  DROP COLUMN pull_request,
+  DROP COLUMN base_ref,
+  DROP COLUMN fork,
+  DROP COLUMN changed_files
@@ -0,0 +1,6 @@
+ALTER TABLE builds
+    ADD COLUMN event VARCHAR DEFAULT '' NOT NULL,
+    ADD COLUMN pull_request INTEGER DEFAULT 0 NOT NULL,
+    ADD COLUMN base_ref VARCHAR DEFAULT '' NOT NULL,
+    ADD COLUMN fork BOOLEAN DEFAULT FALSE NOT NULL,
+    ADD COLUMN changed_files TEXT
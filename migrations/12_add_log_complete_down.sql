@@ -0,0 +1,2 @@
+ALTER TABLE steps
+  DROP COLUMN log_complete
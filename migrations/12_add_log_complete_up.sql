@@ -0,0 +1,4 @@
+ALTER TABLE steps
+    ADD COLUMN log_complete BOOLEAN DEFAULT FALSE NOT NULL;
+-- no step is streaming its log while migrating, the logs stored so far are complete
+UPDATE steps SET log_complete = TRUE;
@@ -0,0 +1,2 @@
+-- the moved logs stay in log_lines, where they are read from
+ALTER TABLE log_lines ALTER COLUMN created TYPE TIMESTAMP;
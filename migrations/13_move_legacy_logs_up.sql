@@ -0,0 +1,13 @@
+-- the lines were written with the time of the server, without its time zone
+ALTER TABLE log_lines ALTER COLUMN created TYPE TIMESTAMP WITH TIME ZONE;
+
+-- logs from before they were stored line by line move to log_lines, so they are read and searched like the others
+INSERT INTO log_lines (org, reponame, buildnumber, step, line, created, content)
+SELECT s.org, s.reponame, s.buildnumber, s.name, l.n - 1, COALESCE(b.created, NOW()), l.content
+FROM steps s
+LEFT JOIN builds b ON b.org = s.org AND b.name = s.reponame AND b.number = s.buildnumber,
+regexp_split_to_table(regexp_replace(s.log, E'\n$', ''), E'\n') WITH ORDINALITY AS l(content, n)
+WHERE s.log <> ''
+AND NOT EXISTS (SELECT 1 FROM log_lines ll WHERE ll.org = s.org AND ll.reponame = s.reponame AND ll.buildnumber = s.buildnumber AND ll.step = s.name);
+
+UPDATE steps SET log = '' WHERE log <> '';
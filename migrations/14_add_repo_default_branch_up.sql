@@ -0,0 +1,2 @@
+ALTER TABLE repositories
+    ADD COLUMN default_branch VARCHAR(300) DEFAULT '' NOT NULL;
@@ -0,0 +1 @@
+DROP TABLE log_lines;
\ No newline at end of file
@@ -0,0 +1,13 @@
+CREATE TABLE log_lines (
+  uid         SERIAL PRIMARY KEY,
+  org         VARCHAR,
+  reponame    VARCHAR,
+  buildnumber INTEGER,
+  step        VARCHAR,
+  line        INTEGER,
+  created     TIMESTAMP DEFAULT NOW(),
+  content     TEXT,
+
+  CONSTRAINT log_line_uq
+  UNIQUE (org, reponame, buildnumber, step, line)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE steps
+  DROP COLUMN logref
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE steps
+    ADD COLUMN logref VARCHAR
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE builds
+  DROP COLUMN ref,
+  DROP COLUMN logs_pruned
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE builds
+    ADD COLUMN ref VARCHAR,
+    ADD COLUMN logs_pruned BOOLEAN DEFAULT FALSE NOT NULL
@@ -0,0 +1 @@
+DROP INDEX log_lines_content_trgm;
\ No newline at end of file
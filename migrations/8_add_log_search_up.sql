@@ -0,0 +1,2 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX log_lines_content_trgm ON log_lines USING gin (content gin_trgm_ops);
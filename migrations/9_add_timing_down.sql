@@ -0,0 +1,11 @@
+ALTER TABLE builds
+  DROP COLUMN queue_ms,
+  DROP COLUMN namespace_ms,
+  DROP COLUMN secrets_ms,
+  DROP COLUMN init_ms,
+  DROP COLUMN pull_ms,
+  DROP COLUMN total_ms;
+ALTER TABLE steps
+  DROP COLUMN started,
+  DROP COLUMN finished,
+  DROP COLUMN duration
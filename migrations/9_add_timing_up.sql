@@ -0,0 +1,11 @@
+ALTER TABLE builds
+    ADD COLUMN queue_ms BIGINT DEFAULT 0 NOT NULL,
+    ADD COLUMN namespace_ms BIGINT DEFAULT 0 NOT NULL,
+    ADD COLUMN secrets_ms BIGINT DEFAULT 0 NOT NULL,
+    ADD COLUMN init_ms BIGINT DEFAULT 0 NOT NULL,
+    ADD COLUMN pull_ms BIGINT DEFAULT 0 NOT NULL,
+    ADD COLUMN total_ms BIGINT DEFAULT 0 NOT NULL;
+ALTER TABLE steps
+    ADD COLUMN started TIMESTAMP WITH TIME ZONE DEFAULT '0001-01-01 00:00:00Z' NOT NULL,
+    ADD COLUMN finished TIMESTAMP WITH TIME ZONE DEFAULT '0001-01-01 00:00:00Z' NOT NULL,
+    ADD COLUMN duration BIGINT DEFAULT 0 NOT NULL
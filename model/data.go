@@ -19,10 +19,49 @@ type Build struct {
 	Commit     string     `json:"commit"`
 	Coverage   string     `json:"coverage"`
 	Duration   string     `json:"duration"`
+	LogsPruned bool       `json:"logspruned"`
+	Timing     Timing     `json:"timing"`
 
 	Ref       string
 	TreesURL  string
 	StatusURL string
+	// Event is what the build was triggered by, push, pull_request, tag, release or manual
+	Event string `json:"-"`
+	// PullRequest is the number of the pull request being built, 0 for other builds, and BaseRef is the branch it's
+	// merged into. Ref is the branch of the pull request.
+	PullRequest int    `json:"-"`
+	BaseRef     string `json:"-"`
+	// Fork is set for pull requests from another repository, their build configuration isn't trusted
+	Fork bool `json:"-"`
+	// Release is the release a build of the release event was triggered by
+	Release *Release `json:"-"`
+	// ChangedFiles are the paths of the files changed by the commits being built, nil when they aren't known
+	ChangedFiles []string `json:"-"`
+}
+
+// Release is a release published on the source code host, of the tag of the build
+type Release struct {
+	ID         int64
+	Name       string
+	URL        string
+	Prerelease bool
+}
+
+// Timing is the time spent in each phase of a build, in milliseconds
+type Timing struct {
+	// Queue is the time from the build pod being created until it was scheduled on a node
+	Queue int64 `json:"queue"`
+	// Namespace is the time it took to create the build namespace
+	Namespace int64 `json:"namespace"`
+	// Secrets is the time it took to set up the secrets in the build namespace
+	Secrets int64 `json:"secrets"`
+	// Init is the time spent running the init containers, including cloning the repository
+	Init int64 `json:"init"`
+	// Pull is the time from the init containers being done until all containers had started,
+	// this is mostly spent pulling images
+	Pull int64 `json:"pull"`
+	// Total is the time from the build being created until it was done
+	Total int64 `json:"total"`
 }
 
 // StepInfo contains information about each build step
@@ -33,6 +72,15 @@ type StepInfo struct {
 	Name        string `json:"name"`
 	Status      string `json:"status"`
 	ExitCode    int32  `json:"exitcode"`
+	// Started and Finished are when the container of the step started and terminated
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Duration is the run time of the step in milliseconds
+	Duration int64 `json:"duration"`
+	// LogRef points to the log in the log store once it's been archived
+	LogRef string `json:"-"`
+	// LogComplete is set once the whole log of the step has been stored, only then it's archived
+	LogComplete bool `json:"-"`
 }
 
 // Step contains step information and the log entry
@@ -41,6 +89,39 @@ type Step struct {
 	Log string `json:"log"`
 }
 
+// StepLines contains step information and a range of the lines in its log
+type StepLines struct {
+	StepInfo
+	Lines []*LogLine `json:"lines"`
+}
+
+// LogLine is a single line of a step log
+type LogLine struct {
+	Number    int       `json:"number"`
+	Timestamp time.Time `json:"timestamp"`
+	Content   string    `json:"content"`
+	// Highlight is the HTML escaped line with the search hits marked, only set on search results
+	Highlight string `json:"highlight,omitempty"`
+}
+
+// LogQuery describes a search in the build logs
+type LogQuery struct {
+	Text     string
+	Org      string
+	Reponame string
+	Since    time.Time
+	Limit    int
+}
+
+// LogMatch is a step with log lines matching a search
+type LogMatch struct {
+	Org         string     `json:"org"`
+	Reponame    string     `json:"reponame"`
+	BuildNumber int        `json:"buildnumber"`
+	Step        string     `json:"step"`
+	Lines       []*LogLine `json:"lines"`
+}
+
 // Service is used to describe a service which is a thing builds can depend on
 // typically this could be postgres database or something like that
 type Service struct {
@@ -53,6 +134,10 @@ type Repo struct {
 	Org  string `json:"org"`
 	Name string `json:"name"`
 	URL  string `json:"url"`
+	// ConfigPath is the path of the build configuration in the repository, the default file names are tried if empty
+	ConfigPath string `json:"configpath"`
+	// DefaultBranch is the branch pull requests are merged into, as reported by the provider or set by hand
+	DefaultBranch string `json:"defaultbranch"`
 }
 
 // Deployment is a structure defining a Helm deployment
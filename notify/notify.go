@@ -0,0 +1,264 @@
+// Package notify sends the results of builds to Slack, HTTP webhooks and email
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+// Events a notification can be sent on
+const (
+	// OnFailure is every failed build
+	OnFailure = "failure"
+	// OnRecovery is a successful build following a failed one on the same branch
+	OnRecovery = "recovery"
+	// OnAlways is every build
+	OnAlways = "always"
+)
+
+// defaultWhen are the events notified on when a target doesn't list any
+var defaultWhen = []string{OnFailure, OnRecovery}
+
+// Config is the notify section of .ci.yaml, it's also used for the server wide defaults
+type Config struct {
+	Slack   []Slack   `yaml:"slack"`
+	Webhook []Webhook `yaml:"webhook"`
+	Email   []Email   `yaml:"email"`
+}
+
+// Slack posts to a Slack incoming webhook
+type Slack struct {
+	URL     string   `yaml:"url"`
+	Channel string   `yaml:"channel"`
+	When    []string `yaml:"when"`
+}
+
+// Webhook posts the build as JSON to any URL. If Secret is set the body is signed
+// with HMAC-SHA256 in the X-Seneferu-Signature header.
+type Webhook struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	When   []string `yaml:"when"`
+}
+
+// Email sends a mail through the SMTP server of the Notifier
+type Email struct {
+	To   []string `yaml:"to"`
+	When []string `yaml:"when"`
+}
+
+// SMTP is the mail server used for email notifications
+type SMTP struct {
+	// Addr is the host:port of the server, email isn't sent if it's empty
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// Notifier sends notifications to the server wide defaults and the targets configured by a repository
+type Notifier struct {
+	defaults Config
+	smtp     SMTP
+	client   *http.Client
+}
+
+// New creates a notifier sending to defaults for every repository, and email through server
+func New(defaults Config, server SMTP) *Notifier {
+	return &Notifier{defaults: defaults, smtp: server, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Notification is a build result being sent
+type Notification struct {
+	Build *model.Build
+	// Events are the events the build triggers
+	Events []string
+	// URL links to the build in the user interface
+	URL string
+}
+
+// Events returns the events triggered by build, given the previous build of the same branch, which may be nil
+func Events(build *model.Build, previous *model.Build) []string {
+	events := []string{OnAlways}
+	if !build.Success {
+		events = append(events, OnFailure)
+	} else if previous != nil && !previous.Success {
+		events = append(events, OnRecovery)
+	}
+	return events
+}
+
+// Previous returns the latest finished build of the same branch before build, or nil
+func Previous(builds []*model.Build, build *model.Build) *model.Build {
+	var previous *model.Build
+	for _, b := range builds {
+		if b.Org != build.Org || b.Name != build.Name || b.Ref != build.Ref || b.Number >= build.Number {
+			continue
+		}
+		if b.Status != "Done" && b.Status != "Failed" {
+			continue
+		}
+		if previous == nil || b.Number > previous.Number {
+			previous = b
+		}
+	}
+	return previous
+}
+
+// Notify sends n to the server wide targets and the ones in repo, the errors of all failed sends are returned
+func (s *Notifier) Notify(repo Config, n *Notification) []error {
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, cfg := range []Config{s.defaults, repo} {
+		for _, t := range cfg.Slack {
+			if triggered(t.When, n.Events) {
+				add(errors.Wrap(s.slack(t, n), "unable to notify slack"))
+			}
+		}
+		for _, t := range cfg.Webhook {
+			if triggered(t.When, n.Events) {
+				add(errors.Wrap(s.webhook(t, n), fmt.Sprintf("unable to notify webhook %v", t.URL)))
+			}
+		}
+		for _, t := range cfg.Email {
+			if triggered(t.When, n.Events) {
+				add(errors.Wrap(s.email(t, n), fmt.Sprintf("unable to send email to %v", strings.Join(t.To, ", "))))
+			}
+		}
+	}
+	return errs
+}
+
+// triggered returns true if any of events is one of when
+func triggered(when []string, events []string) bool {
+	if len(when) == 0 {
+		when = defaultWhen
+	}
+	for _, w := range when {
+		for _, e := range events {
+			if w == e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// event returns the most specific event of n, used to describe it
+func (n *Notification) event() string {
+	return n.Events[len(n.Events)-1]
+}
+
+// Summary is a one line description of the build result
+func (n *Notification) Summary() string {
+	result := "succeeded"
+	switch n.event() {
+	case OnFailure:
+		result = "failed"
+	case OnRecovery:
+		result = "is fixed"
+	}
+	branch := strings.TrimPrefix(n.Build.Ref, "refs/heads/")
+	commit := n.Build.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	return fmt.Sprintf("%v/%v build #%v %v on %v (%v)", n.Build.Org, n.Build.Name, n.Build.Number, result, branch, commit)
+}
+
+func (s *Notifier) slack(t Slack, n *Notification) error {
+	text := n.Summary()
+	if n.URL != "" {
+		text += fmt.Sprintf(" <%v|details>", n.URL)
+	}
+	body, err := json.Marshal(map[string]string{"text": text, "channel": t.Channel})
+	if err != nil {
+		return err
+	}
+	return s.post(t.URL, body, nil)
+}
+
+func (s *Notifier) webhook(t Webhook, n *Notification) error {
+	body, err := json.Marshal(n.Build)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal build")
+	}
+	headers := map[string]string{"X-Seneferu-Event": n.event()}
+	if t.Secret != "" {
+		headers["X-Seneferu-Signature"] = "sha256=" + Sign(t.Secret, body)
+	}
+	return s.post(t.URL, body, headers)
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body with secret, as sent in the X-Seneferu-Signature header
+func Sign(secret string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *Notifier) post(url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%v returned %v: %v", url, resp.Status, string(b))
+	}
+	return nil
+}
+
+func (s *Notifier) email(t Email, n *Notification) error {
+	if s.smtp.Addr == "" {
+		return errors.New("no SMTP server is configured")
+	}
+	if len(t.To) == 0 {
+		return errors.New("no recipients")
+	}
+	var auth smtp.Auth
+	if s.smtp.Username != "" {
+		host := s.smtp.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.smtp.Username, s.smtp.Password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %v\r\n", s.smtp.From)
+	fmt.Fprintf(&msg, "To: %v\r\n", strings.Join(t.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [seneferu] %v\r\n", n.Summary())
+	fmt.Fprintf(&msg, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%v\r\n", n.Summary())
+	if n.URL != "" {
+		fmt.Fprintf(&msg, "\r\n%v\r\n", n.URL)
+	}
+	return smtp.SendMail(s.smtp.Addr, auth, s.smtp.From, t.To, msg.Bytes())
+}
@@ -0,0 +1,158 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+func TestEvents(t *testing.T) {
+	failed := &model.Build{Success: false}
+	passed := &model.Build{Success: true}
+
+	assert.Equal(t, []string{OnAlways}, Events(passed, nil))
+	assert.Equal(t, []string{OnAlways}, Events(passed, passed))
+	assert.Equal(t, []string{OnAlways, OnFailure}, Events(failed, passed))
+	assert.Equal(t, []string{OnAlways, OnFailure}, Events(failed, failed))
+	assert.Equal(t, []string{OnAlways, OnRecovery}, Events(passed, failed))
+}
+
+func TestPrevious(t *testing.T) {
+	build := &model.Build{Org: "org", Name: "repo", Ref: "refs/heads/master", Number: 5}
+	builds := []*model.Build{
+		{Org: "org", Name: "repo", Ref: "refs/heads/master", Number: 5, Status: "Running"},
+		{Org: "org", Name: "repo", Ref: "refs/heads/other", Number: 4, Status: "Done"},
+		{Org: "org", Name: "repo", Ref: "refs/heads/master", Number: 3, Status: "Running"},
+		{Org: "org", Name: "repo", Ref: "refs/heads/master", Number: 2, Status: "Done"},
+		{Org: "org", Name: "repo", Ref: "refs/heads/master", Number: 1, Status: "Done"},
+	}
+	assert.Equal(t, 2, Previous(builds, build).Number)
+	assert.Nil(t, Previous(builds[:3], build))
+}
+
+func TestTriggered(t *testing.T) {
+	assert.True(t, triggered(nil, []string{OnAlways, OnFailure}))
+	assert.True(t, triggered(nil, []string{OnAlways, OnRecovery}))
+	assert.False(t, triggered(nil, []string{OnAlways}))
+	assert.True(t, triggered([]string{OnAlways}, []string{OnAlways}))
+	assert.False(t, triggered([]string{OnRecovery}, []string{OnAlways, OnFailure}))
+}
+
+func TestSlackAndWebhook(t *testing.T) {
+	requests := make(map[string]*http.Request)
+	bodies := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests[r.URL.Path] = r
+		bodies[r.URL.Path] = body
+	}))
+	defer server.Close()
+
+	build := &model.Build{Org: "org", Name: "repo", Number: 7, Ref: "refs/heads/master", Commit: "0123456789abcdef"}
+	n := New(Config{Slack: []Slack{{URL: server.URL + "/slack", Channel: "#ci"}}}, SMTP{})
+	errs := n.Notify(Config{Webhook: []Webhook{
+		{URL: server.URL + "/hook", Secret: "s3cret"},
+		{URL: server.URL + "/never", When: []string{OnRecovery}},
+	}}, &Notification{Build: build, Events: Events(build, nil), URL: "http://ci/build/7"})
+	assert.Empty(t, errs)
+	assert.Len(t, requests, 2)
+
+	var slack map[string]string
+	assert.NoError(t, json.Unmarshal(bodies["/slack"], &slack))
+	assert.Equal(t, "#ci", slack["channel"])
+	assert.Equal(t, "org/repo build #7 failed on master (0123456) <http://ci/build/7|details>", slack["text"])
+
+	hook := requests["/hook"]
+	assert.Equal(t, "application/json", hook.Header.Get("Content-Type"))
+	assert.Equal(t, OnFailure, hook.Header.Get("X-Seneferu-Event"))
+	assert.Equal(t, "sha256="+Sign("s3cret", bodies["/hook"]), hook.Header.Get("X-Seneferu-Signature"))
+	var received model.Build
+	assert.NoError(t, json.Unmarshal(bodies["/hook"], &received))
+	assert.Equal(t, 7, received.Number)
+}
+
+func TestWebhookError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	n := New(Config{}, SMTP{})
+	errs := n.Notify(Config{
+		Webhook: []Webhook{{URL: server.URL}},
+		Email:   []Email{{To: []string{"dev@example.com"}}},
+	}, &Notification{Build: &model.Build{}, Events: []string{OnAlways, OnFailure}})
+	assert.Len(t, errs, 2)
+	assert.Contains(t, errs[0].Error(), "500")
+	assert.Contains(t, errs[1].Error(), "no SMTP server")
+}
+
+func TestEmail(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	received := make(chan string, 1)
+	go serveSMTP(l, received)
+
+	n := New(Config{}, SMTP{Addr: l.Addr().String(), From: "ci@example.com"})
+	build := &model.Build{Org: "org", Name: "repo", Number: 8, Ref: "refs/heads/master", Commit: "abc", Success: true}
+	errs := n.Notify(Config{Email: []Email{{To: []string{"dev@example.com"}}}},
+		&Notification{Build: build, Events: Events(build, &model.Build{Success: false})})
+	assert.Empty(t, errs)
+
+	msg := <-received
+	assert.Contains(t, msg, "MAIL FROM:<ci@example.com>")
+	assert.Contains(t, msg, "RCPT TO:<dev@example.com>")
+	assert.Contains(t, msg, "Subject: [seneferu] org/repo build #8 is fixed on master (abc)")
+}
+
+// serveSMTP accepts one connection and speaks just enough SMTP for net/smtp to deliver a message,
+// the whole conversation is sent on received
+func serveSMTP(l net.Listener, received chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var conversation strings.Builder
+	reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+	reply("220 localhost ESMTP")
+	data := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		conversation.WriteString(line)
+		if data {
+			if line == ".\r\n" {
+				data = false
+				reply("250 OK")
+			}
+			continue
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case cmd == "DATA":
+			data = true
+			reply("354 go ahead")
+		case cmd == "QUIT":
+			reply("221 bye")
+			received <- conversation.String()
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+	received <- conversation.String()
+}
@@ -0,0 +1,125 @@
+package retention
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/storage"
+)
+
+// Policy describes which builds and logs are kept
+type Policy struct {
+	// KeepBuilds is the number of builds kept per branch, 0 keeps all builds
+	KeepBuilds int
+	// LogMaxAge is how long logs are kept, 0 keeps logs forever
+	LogMaxAge time.Duration
+	// KeepTags keeps builds of tags, including their logs, regardless of the other rules
+	KeepTags bool
+}
+
+// Enabled returns true if the policy prunes anything at all
+func (p Policy) Enabled() bool {
+	return p.KeepBuilds > 0 || p.LogMaxAge > 0
+}
+
+// Plan lists what is pruned when a policy is enforced
+type Plan struct {
+	// Builds are deleted together with their steps and logs
+	Builds []*model.Build `json:"builds"`
+	// Logs are builds where only the logs are deleted
+	Logs []*model.Build `json:"logs"`
+}
+
+// Janitor enforces a retention policy in the background
+type Janitor struct {
+	service  storage.Service
+	policy   Policy
+	interval time.Duration
+}
+
+// NewJanitor creates a janitor enforcing policy every interval
+func NewJanitor(service storage.Service, policy Policy, interval time.Duration) *Janitor {
+	return &Janitor{service: service, policy: policy, interval: interval}
+}
+
+// Policy returns the policy enforced by the janitor
+func (j *Janitor) Policy() Policy {
+	return j.policy
+}
+
+// Plan returns what would be pruned if the policy was enforced now. The builds beyond the ones kept per branch and
+// the builds with logs that are too old are selected by the storage, so not every build has to be loaded.
+func (j *Janitor) Plan() (*Plan, error) {
+	plan := &Plan{Builds: make([]*model.Build, 0), Logs: make([]*model.Build, 0)}
+	deleted := make(map[string]bool)
+	if j.policy.KeepBuilds > 0 {
+		builds, err := j.service.LoadSupersededBuilds(j.policy.KeepBuilds, j.policy.KeepTags)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load the builds beyond the ones kept")
+		}
+		for _, b := range builds {
+			plan.Builds = append(plan.Builds, b)
+			deleted[buildKey(b)] = true
+		}
+	}
+	if j.policy.LogMaxAge > 0 {
+		builds, err := j.service.LoadBuildsWithLogsBefore(time.Now().Add(-j.policy.LogMaxAge), j.policy.KeepTags)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load the builds with old logs")
+		}
+		for _, b := range builds {
+			// the logs of deleted builds go with them
+			if !deleted[buildKey(b)] {
+				plan.Logs = append(plan.Logs, b)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// buildKey identifies a build across repositories
+func buildKey(b *model.Build) string {
+	return fmt.Sprintf("%v/%v#%v", b.Org, b.Name, b.Number)
+}
+
+// Prune enforces the policy, and returns what was pruned
+func (j *Janitor) Prune() (*Plan, error) {
+	plan, err := j.Plan()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range plan.Builds {
+		err = j.service.DeleteBuild(b.Org, b.Name, b.Number)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to delete build %v/%v#%v", b.Org, b.Name, b.Number)
+		}
+	}
+	for _, b := range plan.Logs {
+		err = j.service.DeleteLogs(b.Org, b.Name, b.Number)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to delete logs of build %v/%v#%v", b.Org, b.Name, b.Number)
+		}
+	}
+	return plan, nil
+}
+
+// Start enforces the policy every interval in a separate go routine
+func (j *Janitor) Start() {
+	if !j.policy.Enabled() {
+		return
+	}
+	go func() {
+		for {
+			plan, err := j.Prune()
+			if err != nil {
+				slog.Error("unable to prune builds", "error", err)
+			} else {
+				slog.Info("pruned builds", "builds", len(plan.Builds), "logs", len(plan.Logs))
+			}
+			time.Sleep(j.interval)
+		}
+	}()
+}
@@ -0,0 +1,77 @@
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/storage"
+)
+
+// prunableBuilds is a storage returning the builds selected for pruning, and recording what they were selected by
+type prunableBuilds struct {
+	storage.Service
+	superseded []*model.Build
+	oldLogs    []*model.Build
+
+	keep     int
+	before   time.Time
+	keepTags []bool
+}
+
+func (s *prunableBuilds) LoadSupersededBuilds(keep int, keepTags bool) ([]*model.Build, error) {
+	s.keep = keep
+	s.keepTags = append(s.keepTags, keepTags)
+	return s.superseded, nil
+}
+
+func (s *prunableBuilds) LoadBuildsWithLogsBefore(before time.Time, keepTags bool) ([]*model.Build, error) {
+	s.before = before
+	s.keepTags = append(s.keepTags, keepTags)
+	return s.oldLogs, nil
+}
+
+func build(number int) *model.Build {
+	return &model.Build{Org: "org", Name: "repo", Number: number, Ref: "refs/heads/master"}
+}
+
+func numbers(bb []*model.Build) []int {
+	result := make([]int, 0)
+	for _, b := range bb {
+		result = append(result, b.Number)
+	}
+	return result
+}
+
+func TestPlan(t *testing.T) {
+	day := 24 * time.Hour
+	service := &prunableBuilds{
+		superseded: []*model.Build{build(1)},
+		oldLogs:    []*model.Build{build(1), build(2)},
+	}
+	plan, err := NewJanitor(service, Policy{KeepBuilds: 2, LogMaxAge: 90 * day, KeepTags: true}, time.Hour).Plan()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, numbers(plan.Builds))
+	assert.Equal(t, []int{2}, numbers(plan.Logs), "the logs of deleted builds aren't planned")
+	assert.Equal(t, 2, service.keep)
+	assert.WithinDuration(t, time.Now().Add(-90*day), service.before, time.Minute)
+	assert.Equal(t, []bool{true, true}, service.keepTags)
+}
+
+func TestPlanOnlyLoadsWhatThePolicyPrunes(t *testing.T) {
+	service := &prunableBuilds{oldLogs: []*model.Build{build(1)}}
+	plan, err := NewJanitor(service, Policy{LogMaxAge: time.Hour}, time.Hour).Plan()
+	assert.NoError(t, err)
+	assert.Empty(t, plan.Builds)
+	assert.Equal(t, []int{1}, numbers(plan.Logs))
+	assert.Equal(t, []bool{false}, service.keepTags)
+}
+
+func TestDisabledPolicy(t *testing.T) {
+	assert.False(t, Policy{KeepTags: true}.Enabled())
+	plan, err := NewJanitor(&prunableBuilds{}, Policy{}, time.Hour).Plan()
+	assert.NoError(t, err)
+	assert.Empty(t, plan.Builds)
+	assert.Empty(t, plan.Logs)
+}
@@ -0,0 +1,183 @@
+package scm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+// BitbucketCloud is the URL of Bitbucket Cloud
+const BitbucketCloud = "https://bitbucket.org"
+
+// maxBitbucketKey is the length of the key of a build status Bitbucket accepts
+const maxBitbucketKey = 40
+
+// Bitbucket is Bitbucket Cloud or a Bitbucket Server / Data Center, accessed with an access token.
+// Repositories are identified by workspace and slug on Bitbucket Cloud, and by project key and slug on Bitbucket Server.
+type Bitbucket struct {
+	// URL is the base URL of the web interface, like https://bitbucket.example.com
+	URL string
+	// APIURL is the base URL of the REST API
+	APIURL string
+	// Server is set for Bitbucket Server, which has a different API than Bitbucket Cloud
+	Server bool
+	// Secret is the secret webhooks are signed with
+	Secret string
+	// User is the user name sent with the token when cloning over HTTPS
+	User string
+	// SSHHost and SSHPort are where repositories are cloned from over SSH
+	SSHHost string
+	SSHPort int
+
+	token  string
+	client *http.Client
+}
+
+// NewBitbucket returns the Bitbucket at baseURL, Bitbucket Cloud if it's https://bitbucket.org. Repositories are
+// cloned over SSH from the host of baseURL, on port 7999 for Bitbucket Server, unless sshHost or sshPort are given.
+func NewBitbucket(baseURL string, token string, user string, secret string, sshHost string, sshPort int) (*Bitbucket, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%v isn't a valid Bitbucket URL", baseURL)
+	}
+	if secret == "" {
+		// webhooks without a secret would let anyone start builds with the SSH key and the token
+		return nil, fmt.Errorf("a webhook secret is required for Bitbucket")
+	}
+	base := strings.TrimSuffix(baseURL, "/")
+	b := &Bitbucket{
+		URL:     base,
+		APIURL:  "https://api.bitbucket.org/2.0",
+		Secret:  secret,
+		User:    user,
+		SSHHost: u.Hostname(),
+		SSHPort: 22,
+		token:   token,
+		client:  newClient(),
+	}
+	if u.Host != "bitbucket.org" {
+		b.Server = true
+		b.APIURL = base + "/rest"
+		b.SSHPort = 7999
+	}
+	if b.User == "" {
+		b.User = "x-token-auth"
+	}
+	if sshHost != "" {
+		b.SSHHost = sshHost
+	}
+	if sshPort != 0 {
+		b.SSHPort = sshPort
+	}
+	return b, nil
+}
+
+// Name returns bitbucket
+func (b *Bitbucket) Name() string {
+	return "bitbucket"
+}
+
+// Token returns the access token, it's used for every repository
+func (b *Bitbucket) Token(string, string) (string, error) {
+	return b.token, nil
+}
+
+// ConfigFile fetches the file at the commit of build
+func (b *Bitbucket) ConfigFile(build *model.Build, path string, token string) ([]byte, error) {
+	u := fmt.Sprintf("%v/src/%v/%v", b.repoURL(build), url.PathEscape(build.Commit), escapePath(path))
+	if b.Server {
+		u = fmt.Sprintf("%v/raw/%v?at=%v", b.repoURL(build), escapePath(path), url.QueryEscape(build.Commit))
+	}
+	slog.Debug("fetching file from bitbucket", "url", u)
+	resp, err := b.do("GET", u, nil, token)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to fetch file from bitbucket")
+	}
+	return readAll(resp)
+}
+
+// bitbucketStatus is the build status accepted by both Bitbucket Cloud and Bitbucket Server
+type bitbucketStatus struct {
+	State       string `json:"state"`
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+}
+
+// ReportStatus sets the build status of the commit of build. Bitbucket requires a URL,
+// the repository is linked when the status has no target URL.
+func (b *Bitbucket) ReportStatus(build *model.Build, status Status, token string) error {
+	// STOPPED would fail a required build, skipped steps are reported as successful
+	if status.State == "skipped" {
+		status = skippedAsSuccess(status)
+	}
+	state := "FAILED"
+	switch status.State {
+	case "pending":
+		state = "INPROGRESS"
+	case "success":
+		state = "SUCCESSFUL"
+	}
+	s := &bitbucketStatus{State: state, Key: status.Context, Name: status.Context, URL: status.TargetURL, Description: status.Description}
+	if len(s.Key) > maxBitbucketKey {
+		s.Key = s.Key[:maxBitbucketKey]
+	}
+	if s.URL == "" {
+		s.URL = b.webURL(build)
+	}
+	body, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal status")
+	}
+	u := fmt.Sprintf("%v/commit/%v/statuses/build", b.repoURL(build), build.Commit)
+	if b.Server {
+		u = fmt.Sprintf("%v/build-status/1.0/commits/%v", b.APIURL, build.Commit)
+	}
+	slog.Debug("reporting status back to bitbucket", "url", u, "state", state, "context", status.Context)
+	resp, err := b.do("POST", u, body, token)
+	if err != nil {
+		return errors.Wrap(err, "unable to post status to bitbucket")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Remote returns the clone location of the Bitbucket, Bitbucket Server serves repositories below /scm
+func (b *Bitbucket) Remote() Remote {
+	u, _ := url.Parse(b.URL)
+	r := Remote{Host: u.Host, SSHHost: b.SSHHost, SSHPort: b.SSHPort, TokenUser: b.User}
+	if b.Server {
+		r.Host += "/scm"
+	}
+	return r
+}
+
+// repoURL returns the API URL of the repository of build
+func (b *Bitbucket) repoURL(build *model.Build) string {
+	if b.Server {
+		return fmt.Sprintf("%v/api/1.0/projects/%v/repos/%v", b.APIURL, Owner(build.Org), build.Name)
+	}
+	return fmt.Sprintf("%v/repositories/%v/%v", b.APIURL, Owner(build.Org), build.Name)
+}
+
+// webURL returns the URL of the repository of build in the web interface
+func (b *Bitbucket) webURL(build *model.Build) string {
+	if b.Server {
+		return fmt.Sprintf("%v/projects/%v/repos/%v", b.URL, Owner(build.Org), build.Name)
+	}
+	return fmt.Sprintf("%v/%v/%v", b.URL, Owner(build.Org), build.Name)
+}
+
+// do sends a request authenticated with token
+func (b *Bitbucket) do(method string, u string, body []byte, token string) (*http.Response, error) {
+	return send(b.client, "bitbucket", method, u, body, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	})
+}
@@ -0,0 +1,74 @@
+package scm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+func TestBitbucketServer(t *testing.T) {
+	var requests []string
+	var status bitbucketStatus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if r.Method == "POST" {
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&status))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		fmt.Fprint(w, "steps:\n")
+	}))
+	defer server.Close()
+
+	b, err := NewBitbucket(server.URL, "token", "", "secret", "", 0)
+	assert.NoError(t, err)
+	assert.True(t, b.Server)
+	build := &model.Build{Org: "PROJ", Name: "repo", Commit: "abc"}
+	cfg, err := b.ConfigFile(build, ".ci.yaml", "token")
+	assert.NoError(t, err)
+	assert.Equal(t, "steps:\n", string(cfg))
+	assert.NoError(t, b.ReportStatus(build, Status{State: "pending", Context: strings.Repeat("x", 50)}, "token"))
+
+	assert.Equal(t, []string{"GET /rest/api/1.0/projects/PROJ/repos/repo/raw/.ci.yaml?at=abc", "POST /rest/build-status/1.0/commits/abc"}, requests)
+	assert.Equal(t, "INPROGRESS", status.State)
+	assert.Len(t, status.Key, maxBitbucketKey)
+	assert.Equal(t, server.URL+"/projects/PROJ/repos/repo", status.URL)
+
+	r := b.Remote()
+	assert.Equal(t, "ssh://git@127.0.0.1:7999/PROJ/repo.git", r.SSHCloneURL("PROJ", "repo"))
+	assert.Equal(t, "https://"+strings.TrimPrefix(server.URL, "http://")+"/scm/PROJ/repo.git", r.HTTPSCloneURL("PROJ", "repo"))
+	assert.Equal(t, "x-token-auth", r.TokenUser)
+}
+
+func TestBitbucketCloud(t *testing.T) {
+	var requests []string
+	var status bitbucketStatus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if r.Method == "POST" {
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&status))
+		}
+	}))
+	defer server.Close()
+
+	b, err := NewBitbucket(BitbucketCloud, "token", "", "secret", "", 0)
+	assert.NoError(t, err)
+	assert.False(t, b.Server)
+	b.APIURL = server.URL + "/2.0"
+	build := &model.Build{Org: "workspace", Name: "repo", Commit: "abc"}
+	_, err = b.ConfigFile(build, ".ci.yaml", "token")
+	assert.NoError(t, err)
+	assert.NoError(t, b.ReportStatus(build, Status{State: "success", Context: "test", TargetURL: "http://ci/step"}, "token"))
+
+	assert.Equal(t, []string{"GET /2.0/repositories/workspace/repo/src/abc/.ci.yaml", "POST /2.0/repositories/workspace/repo/commit/abc/statuses/build"}, requests)
+	assert.Equal(t, bitbucketStatus{State: "SUCCESSFUL", Key: "test", Name: "test", URL: "http://ci/step"}, status)
+	assert.Equal(t, "git@bitbucket.org:workspace/repo.git", b.Remote().SSHCloneURL("workspace", "repo"))
+	assert.Equal(t, "https://bitbucket.org/workspace/repo.git", b.Remote().HTTPSCloneURL("workspace", "repo"))
+}
@@ -0,0 +1,31 @@
+package scm
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned by providers, possibly wrapped, for the statuses that need handling
+var (
+	// ErrNotFound is returned when a file or repository doesn't exist
+	ErrNotFound = errors.New("not found")
+	// ErrUnauthorized is returned when the token is invalid or isn't allowed to access the repository
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrRateLimited is returned when the provider rejected the request because too many were sent
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// statusError returns the error for a response with an error status, message describes the response.
+// Statuses without a typed error are returned as a plain error.
+func statusError(code int, rateLimited bool, message string) error {
+	switch {
+	case rateLimited || code == http.StatusTooManyRequests:
+		return errors.Wrap(ErrRateLimited, message)
+	case code == http.StatusNotFound:
+		return errors.Wrap(ErrNotFound, message)
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return errors.Wrap(ErrUnauthorized, message)
+	}
+	return errors.New(message)
+}
@@ -0,0 +1,126 @@
+package scm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+// Gitea is a Gitea or Forgejo, accessed with an access token
+type Gitea struct {
+	// URL is the base URL of the web interface, like https://gitea.example.com
+	URL string
+	// APIURL is the base URL of the REST API, URL/api/v1
+	APIURL string
+	// Secret is the secret webhooks are signed with
+	Secret string
+	// SSHHost and SSHPort are where repositories are cloned from over SSH
+	SSHHost string
+	SSHPort int
+
+	token  string
+	client *http.Client
+}
+
+// NewGitea returns the Gitea or Forgejo at baseURL, accessed with token. Repositories are cloned
+// from the host of baseURL over SSH, unless sshHost or sshPort are given.
+func NewGitea(baseURL string, token string, secret string, sshHost string, sshPort int) (*Gitea, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%v isn't a valid Gitea URL", baseURL)
+	}
+	if secret == "" {
+		// webhooks without a secret would let anyone start builds with the SSH key and the token
+		return nil, fmt.Errorf("a webhook secret is required for Gitea")
+	}
+	base := strings.TrimSuffix(baseURL, "/")
+	g := &Gitea{
+		URL:     base,
+		APIURL:  base + "/api/v1",
+		Secret:  secret,
+		SSHHost: u.Hostname(),
+		SSHPort: 22,
+		token:   token,
+		client:  newClient(),
+	}
+	if sshHost != "" {
+		g.SSHHost = sshHost
+	}
+	if sshPort != 0 {
+		g.SSHPort = sshPort
+	}
+	return g, nil
+}
+
+// Name returns gitea
+func (g *Gitea) Name() string {
+	return "gitea"
+}
+
+// Token returns the access token, it's used for every repository
+func (g *Gitea) Token(string, string) (string, error) {
+	return g.token, nil
+}
+
+// ConfigFile fetches the file at the commit of build
+func (g *Gitea) ConfigFile(build *model.Build, path string, token string) ([]byte, error) {
+	u := fmt.Sprintf("%v/raw/%v?ref=%v", g.repoURL(build), escapePath(path), url.QueryEscape(build.Commit))
+	slog.Debug("fetching file from gitea", "url", u)
+	resp, err := g.do("GET", u, nil, token)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to fetch file from gitea")
+	}
+	return readAll(resp)
+}
+
+// giteaStatus is the commit status accepted by Gitea, its states are the ones of GitHub
+type giteaStatus struct {
+	State       string `json:"state"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+	Context     string `json:"context"`
+}
+
+// ReportStatus creates a commit status on the commit of build. Statuses have no skipped state, and a warning
+// blocks merging when the status is required.
+func (g *Gitea) ReportStatus(build *model.Build, status Status, token string) error {
+	if status.State == "skipped" {
+		status = skippedAsSuccess(status)
+	}
+	body, err := json.Marshal(&giteaStatus{State: status.State, TargetURL: status.TargetURL, Description: status.Description, Context: status.Context})
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal status")
+	}
+	u := fmt.Sprintf("%v/statuses/%v", g.repoURL(build), build.Commit)
+	slog.Debug("reporting status back to gitea", "url", u, "state", status.State, "context", status.Context)
+	resp, err := g.do("POST", u, body, token)
+	if err != nil {
+		return errors.Wrap(err, "unable to post status to gitea")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Remote returns the clone location of the Gitea, which accepts the token as password with any user name
+func (g *Gitea) Remote() Remote {
+	u, _ := url.Parse(g.URL)
+	return Remote{Host: u.Host, SSHHost: g.SSHHost, SSHPort: g.SSHPort, TokenUser: "oauth2"}
+}
+
+// repoURL returns the API URL of the repository of build
+func (g *Gitea) repoURL(build *model.Build) string {
+	return fmt.Sprintf("%v/repos/%v/%v", g.APIURL, Owner(build.Org), build.Name)
+}
+
+// do sends a request authenticated with token
+func (g *Gitea) do(method string, u string, body []byte, token string) (*http.Response, error) {
+	return send(g.client, "gitea", method, u, body, func(req *http.Request) {
+		req.Header.Set("Authorization", "token "+token)
+	})
+}
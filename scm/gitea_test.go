@@ -0,0 +1,49 @@
+package scm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+func TestGitea(t *testing.T) {
+	var requests []string
+	var status giteaStatus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "token secret-token", r.Header.Get("Authorization"))
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if r.Method == "POST" {
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&status))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		fmt.Fprint(w, "steps:\n")
+	}))
+	defer server.Close()
+
+	g, err := NewGitea(server.URL, "secret-token", "secret", "", 0)
+	assert.NoError(t, err)
+	build := &model.Build{Org: "org", Name: "repo", Commit: "abc"}
+	cfg, err := g.ConfigFile(build, ".ci.yaml", "secret-token")
+	assert.NoError(t, err)
+	assert.Equal(t, "steps:\n", string(cfg))
+	assert.NoError(t, g.ReportStatus(build, Status{State: "failure", Context: "test", TargetURL: "http://ci/step"}, "secret-token"))
+
+	assert.Equal(t, []string{"GET /api/v1/repos/org/repo/raw/.ci.yaml?ref=abc", "POST /api/v1/repos/org/repo/statuses/abc"}, requests)
+	assert.Equal(t, giteaStatus{State: "failure", Context: "test", TargetURL: "http://ci/step"}, status)
+	assert.Equal(t, "git@127.0.0.1:org/repo.git", g.Remote().SSHCloneURL("org", "repo"))
+
+	status = giteaStatus{}
+	assert.NoError(t, g.ReportStatus(build, Status{State: "skipped", Context: "test", Description: "no changed files match the paths"}, "secret-token"))
+	assert.Equal(t, giteaStatus{State: "success", Context: "test", Description: "Skipped: no changed files match the paths"}, status)
+}
+
+func TestSkippedAsSuccess(t *testing.T) {
+	assert.Equal(t, Status{State: "success", Context: "test", Description: "skipped by the commit message"}, skippedAsSuccess(Status{State: "skipped", Context: "test", Description: "skipped by the commit message"}))
+	assert.Equal(t, "Skipped", skippedAsSuccess(Status{State: "skipped"}).Description)
+}
@@ -0,0 +1,50 @@
+package scm
+
+import (
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+// GitHub is github.com or the GitHub Enterprise Server in github.DefaultHost
+type GitHub struct {
+	github.TokenSource
+}
+
+// NewGitHub returns the GitHub provider accessing repositories with the tokens of tokens
+func NewGitHub(tokens github.TokenSource) *GitHub {
+	return &GitHub{TokenSource: tokens}
+}
+
+// Name returns github
+func (g *GitHub) Name() string {
+	return "github"
+}
+
+// ConfigFile fetches the file through the contents API of the repository the statuses URL of the build belongs to
+func (g *GitHub) ConfigFile(build *model.Build, path string, token string) ([]byte, error) {
+	repoURL, err := github.RepoURL(build.StatusURL)
+	if err != nil {
+		return nil, err
+	}
+	b, err := github.GetConfigFile(repoURL, path, build.Commit, token)
+	if se, ok := errors.Cause(err).(*github.StatusError); ok {
+		return nil, statusError(se.StatusCode, se.RateLimited, se.Error())
+	}
+	return b, err
+}
+
+// ReportStatus creates a commit status through the statuses URL of the build, statuses have no skipped state
+func (g *GitHub) ReportStatus(build *model.Build, status Status, token string) error {
+	if status.State == "skipped" {
+		status = skippedAsSuccess(status)
+	}
+	s := github.GithubStatus{State: status.State, TargetURL: status.TargetURL, Description: status.Description, Context: status.Context}
+	return github.ReportBack(s, build.StatusURL, build.Commit, token)
+}
+
+// Remote returns the clone location of github.DefaultHost
+func (g *GitHub) Remote() Remote {
+	h := github.DefaultHost
+	return Remote{Host: h.Name, SSHHost: h.SSHHost, SSHPort: h.SSHPort, TokenUser: "x-access-token"}
+}
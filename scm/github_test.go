@@ -0,0 +1,28 @@
+package scm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/github"
+)
+
+func TestGitHubRemote(t *testing.T) {
+	r := NewGitHub(nil).Remote()
+	assert.Equal(t, "git@github.com:org/repo.git", r.SSHCloneURL("org", "repo"))
+	assert.Equal(t, "https://github.com/org/repo.git", r.HTTPSCloneURL("org", "repo"))
+
+	defer func(h github.Host) { github.DefaultHost = h }(github.DefaultHost)
+	github.DefaultHost = github.NewHost("github.example.com", "", "ssh.example.com", 2222)
+	r = NewGitHub(nil).Remote()
+	assert.Equal(t, "ssh://git@ssh.example.com:2222/org/repo.git", r.SSHCloneURL("org", "repo"))
+	assert.Equal(t, "https://github.example.com/org/repo.git", r.HTTPSCloneURL("org", "repo"))
+}
+
+func TestQualifiedOrg(t *testing.T) {
+	assert.Equal(t, "org", QualifiedOrg("github", "org"))
+	assert.Equal(t, "gitlab:group/sub", QualifiedOrg("gitlab", "group/sub"))
+	assert.Equal(t, "group/sub", Owner("gitlab:group/sub"))
+	assert.Equal(t, "org", Owner("org"))
+	assert.Equal(t, "git@gitlab.example.com:group/repo.git", Remote{SSHHost: "gitlab.example.com"}.SSHCloneURL("gitlab:group", "repo"))
+}
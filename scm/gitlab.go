@@ -0,0 +1,129 @@
+package scm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+// GitLab is gitlab.com or a self-hosted GitLab, accessed with a personal, group or project access token
+type GitLab struct {
+	// URL is the base URL of the web interface, like https://gitlab.example.com
+	URL string
+	// APIURL is the base URL of the REST API, URL/api/v4 unless replaced
+	APIURL string
+	// Secret is the secret token GitLab sends in the X-Gitlab-Token header of webhooks
+	Secret string
+	// SSHHost and SSHPort are where repositories are cloned from over SSH
+	SSHHost string
+	SSHPort int
+
+	token  string
+	client *http.Client
+}
+
+// NewGitLab returns the GitLab at baseURL, accessed with token. Repositories are cloned
+// from the host of baseURL over SSH, unless sshHost or sshPort are given.
+func NewGitLab(baseURL string, token string, secret string, sshHost string, sshPort int) (*GitLab, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%v isn't a valid GitLab URL", baseURL)
+	}
+	if secret == "" {
+		// webhooks without a secret would let anyone start builds with the SSH key and the token
+		return nil, fmt.Errorf("a webhook secret is required for GitLab")
+	}
+	base := strings.TrimSuffix(baseURL, "/")
+	g := &GitLab{
+		URL:     base,
+		APIURL:  base + "/api/v4",
+		Secret:  secret,
+		SSHHost: u.Hostname(),
+		SSHPort: 22,
+		token:   token,
+		client:  newClient(),
+	}
+	if sshHost != "" {
+		g.SSHHost = sshHost
+	}
+	if sshPort != 0 {
+		g.SSHPort = sshPort
+	}
+	return g, nil
+}
+
+// Name returns gitlab
+func (g *GitLab) Name() string {
+	return "gitlab"
+}
+
+// Token returns the access token, it's used for every project
+func (g *GitLab) Token(string, string) (string, error) {
+	return g.token, nil
+}
+
+// ConfigFile fetches the file at the commit of build through the repository files API, which takes the URL encoded path
+func (g *GitLab) ConfigFile(build *model.Build, path string, token string) ([]byte, error) {
+	u := fmt.Sprintf("%v/repository/files/%v/raw?ref=%v", g.projectURL(build), url.PathEscape(strings.Trim(path, "/")), url.QueryEscape(build.Commit))
+	slog.Debug("fetching file from gitlab", "url", u)
+	resp, err := g.do("GET", u, nil, token)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to fetch file from gitlab")
+	}
+	return readAll(resp)
+}
+
+// gitlabStatus is the commit status accepted by the GitLab commit status API
+type gitlabStatus struct {
+	State       string `json:"state"`
+	Name        string `json:"name"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// ReportStatus sets the status of the commit of build, a pending step is shown as running
+func (g *GitLab) ReportStatus(build *model.Build, status Status, token string) error {
+	state := "failed"
+	switch status.State {
+	case "pending":
+		state = "running"
+	case "success", "skipped":
+		state = status.State
+	}
+	body, err := json.Marshal(&gitlabStatus{State: state, Name: status.Context, TargetURL: status.TargetURL, Description: status.Description})
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal status")
+	}
+	u := fmt.Sprintf("%v/statuses/%v", g.projectURL(build), build.Commit)
+	slog.Debug("reporting status back to gitlab", "url", u, "state", state, "context", status.Context)
+	resp, err := g.do("POST", u, body, token)
+	if err != nil {
+		return errors.Wrap(err, "unable to post status to gitlab")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Remote returns the clone location of the GitLab, tokens are sent with the user name oauth2
+func (g *GitLab) Remote() Remote {
+	u, _ := url.Parse(g.URL)
+	return Remote{Host: u.Host, SSHHost: g.SSHHost, SSHPort: g.SSHPort, TokenUser: "oauth2"}
+}
+
+// projectURL returns the API URL of the project of build, projects are identified by their URL encoded path
+func (g *GitLab) projectURL(build *model.Build) string {
+	return fmt.Sprintf("%v/projects/%v", g.APIURL, url.PathEscape(Owner(build.Org)+"/"+build.Name))
+}
+
+// do sends a request authenticated with token
+func (g *GitLab) do(method string, u string, body []byte, token string) (*http.Response, error) {
+	return send(g.client, "gitlab", method, u, body, func(req *http.Request) {
+		req.Header.Set("PRIVATE-TOKEN", token)
+	})
+}
@@ -0,0 +1,96 @@
+package scm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+func TestGitLabConfigFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret-token", r.Header.Get("PRIVATE-TOKEN"))
+		if r.URL.EscapedPath() != "/api/v4/projects/group%2Fsub%2Frepo/repository/files/.ci.yaml/raw" || r.URL.Query().Get("ref") != "abc" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "steps:\n")
+	}))
+	defer server.Close()
+
+	g, err := NewGitLab(server.URL, "secret-token", "secret", "", 0)
+	assert.NoError(t, err)
+	b, err := g.ConfigFile(&model.Build{Org: "group/sub", Name: "repo", Commit: "abc"}, ".ci.yaml", "secret-token")
+	assert.NoError(t, err)
+	assert.Equal(t, "steps:\n", string(b))
+
+	_, err = g.ConfigFile(&model.Build{Org: "group", Name: "missing", Commit: "abc"}, ".ci.yaml", "secret-token")
+	assert.Error(t, err)
+}
+
+func TestGitLabReportStatus(t *testing.T) {
+	var statuses []gitlabStatus
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s gitlabStatus
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&s))
+		statuses = append(statuses, s)
+		paths = append(paths, r.Method+" "+r.URL.EscapedPath())
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	g, err := NewGitLab(server.URL+"/", "token", "secret", "", 0)
+	assert.NoError(t, err)
+	build := &model.Build{Org: "group", Name: "repo", Commit: "abc"}
+	assert.NoError(t, g.ReportStatus(build, Status{State: "pending", Context: "test"}, "token"))
+	assert.NoError(t, g.ReportStatus(build, Status{State: "error", Context: "test", TargetURL: "http://ci/step"}, "token"))
+
+	assert.Equal(t, []string{"POST /api/v4/projects/group%2Frepo/statuses/abc", "POST /api/v4/projects/group%2Frepo/statuses/abc"}, paths)
+	assert.Equal(t, gitlabStatus{State: "running", Name: "test"}, statuses[0])
+	assert.Equal(t, gitlabStatus{State: "failed", Name: "test", TargetURL: "http://ci/step"}, statuses[1])
+}
+
+func TestGitLabRemote(t *testing.T) {
+	g, err := NewGitLab("https://gitlab.example.com", "token", "secret", "", 2222)
+	assert.NoError(t, err)
+	r := g.Remote()
+	assert.Equal(t, "ssh://git@gitlab.example.com:2222/group/repo.git", r.SSHCloneURL("group", "repo"))
+	assert.Equal(t, "https://gitlab.example.com/group/repo.git", r.HTTPSCloneURL("group", "repo"))
+	assert.Equal(t, "oauth2", r.TokenUser)
+
+	_, err = NewGitLab("gitlab.example.com", "token", "secret", "", 0)
+	assert.Error(t, err)
+	_, err = NewGitLab("https://gitlab.example.com", "token", "", "", 0)
+	assert.Error(t, err, "webhooks need a secret")
+}
+
+func TestProviderErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("ref") {
+		case "unauthorized":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	g, err := NewGitLab(server.URL, "token", "secret", "", 0)
+	assert.NoError(t, err)
+	fetch := func(commit string) error {
+		_, err := g.ConfigFile(&model.Build{Org: "group", Name: "repo", Commit: commit}, ".ci.yaml", "token")
+		return errors.Cause(err)
+	}
+	assert.Equal(t, ErrUnauthorized, fetch("unauthorized"))
+	assert.Equal(t, ErrRateLimited, fetch("limited"))
+	assert.Error(t, fetch("broken"))
+	assert.NotEqual(t, ErrNotFound, fetch("broken"))
+}
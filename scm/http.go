@@ -0,0 +1,57 @@
+package scm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// newClient returns the HTTP client used for the API of a provider
+func newClient() *http.Client {
+	return &http.Client{Timeout: 30 * time.Second}
+}
+
+// send sends a request to the API of provider, authenticated by authorize. A response with an error status is returned
+// as an error, which is ErrNotFound, ErrUnauthorized or ErrRateLimited for those statuses.
+func send(client *http.Client, provider string, method string, u string, body []byte, authorize func(*http.Request)) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("unable to create request to %v", provider))
+	}
+	authorize(req)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, statusError(resp.StatusCode, false, fmt.Sprintf("%v returned %v: %v", provider, resp.Status, string(b)))
+	}
+	return resp, nil
+}
+
+// escapePath escapes the segments of a path in a repository for use in a URL
+func escapePath(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// readAll reads and closes the body of resp
+func readAll(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,91 @@
+// Package scm abstracts the source code hosts repositories are built from.
+// A provider fetches the build configuration of a commit and reports the status of builds back to the host.
+package scm
+
+import (
+	"fmt"
+	"strings"
+
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+// Provider is a source code host builds are triggered from and reported back to
+type Provider interface {
+	// Name identifies the provider, like github or gitlab
+	Name() string
+	// Token returns the token used to access repository owner/repo through the API and when cloning over HTTPS
+	Token(owner string, repo string) (string, error)
+	// ConfigFile returns the content of the file at path in the repository of build at its commit,
+	// the error is ErrNotFound if there's no such file
+	ConfigFile(build *model.Build, path string, token string) ([]byte, error)
+	// ReportStatus reports status on the commit of build
+	ReportStatus(build *model.Build, status Status, token string) error
+	// Remote returns where the repositories of the provider are cloned from
+	Remote() Remote
+}
+
+// Status is the state of a build or one of its steps, reported on the commit being built
+type Status struct {
+	// State is pending, success, failure, error or skipped, a step that didn't run.
+	// GitLab and check runs have a skipped state, the other providers only have states blocking or passing
+	// required checks and report skipped steps as successful, see skippedAsSuccess.
+	State       string
+	TargetURL   string
+	Description string
+	// Context is the name of the status, the step name
+	Context string
+}
+
+// skippedAsSuccess returns the skipped status as successful for providers without a neutral state, the description
+// tells it apart from a step that passed
+func skippedAsSuccess(status Status) Status {
+	status.State = "success"
+	if !strings.HasPrefix(strings.ToLower(status.Description), "skipped") {
+		status.Description = strings.TrimSuffix("Skipped: "+status.Description, ": ")
+	}
+	return status
+}
+
+// Remote is where the repositories of a provider are cloned from
+type Remote struct {
+	// Host is the host name repositories are cloned from over HTTPS, followed by a path prefix on some providers
+	Host string
+	// SSHHost and SSHPort are where repositories are cloned from over SSH
+	SSHHost string
+	SSHPort int
+	// TokenUser is the user name sent with the token when cloning over HTTPS
+	TokenUser string
+}
+
+// QualifiedOrg returns the org the repositories of org on provider are stored under. The repositories of the other
+// providers are qualified with the provider, so a repository with the same path on two providers doesn't share its
+// builds and settings. GitHub repositories aren't qualified, they keep the builds stored before there were providers.
+func QualifiedOrg(provider string, org string) string {
+	if provider == "github" {
+		return org
+	}
+	return provider + ":" + org
+}
+
+// Owner returns the owner of a repository on its provider from the org it's stored under
+func Owner(org string) string {
+	if i := strings.Index(org, ":"); i >= 0 {
+		return org[i+1:]
+	}
+	return org
+}
+
+// SSHCloneURL returns the URL repository org/name is cloned from over SSH
+func (r Remote) SSHCloneURL(org string, name string) string {
+	org = Owner(org)
+	if r.SSHPort == 0 || r.SSHPort == 22 {
+		return fmt.Sprintf("git@%v:%v/%v.git", r.SSHHost, org, name)
+	}
+	return fmt.Sprintf("ssh://git@%v:%v/%v/%v.git", r.SSHHost, r.SSHPort, org, name)
+}
+
+// HTTPSCloneURL returns the URL repository org/name is cloned from over HTTPS
+func (r Remote) HTTPSCloneURL(org string, name string) string {
+	org = Owner(org)
+	return fmt.Sprintf("https://%v/%v/%v.git", r.Host, org, name)
+}
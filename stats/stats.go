@@ -0,0 +1,197 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+// maxFailingSteps is the number of steps listed in FailingSteps
+const maxFailingSteps = 5
+
+// Stats are the statistics of the builds of a single branch of a repository
+type Stats struct {
+	Org    string `json:"org"`
+	Name   string `json:"name"`
+	Branch string `json:"branch"`
+
+	// Builds is the number of builds started in the window, including the ones still running
+	Builds    int `json:"builds"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+	// SuccessRate is the fraction of the finished builds that succeeded
+	SuccessRate float64 `json:"successrate"`
+
+	// Duration percentiles of the finished builds, in milliseconds
+	Duration Percentiles `json:"duration"`
+
+	// MTTR is the mean time in milliseconds from the default branch turning red until it's green again,
+	// it's only calculated for the default branch
+	MTTR       int64 `json:"mttr"`
+	Recoveries int   `json:"recoveries"`
+
+	// FailingSteps are the steps failing most often, most failures first
+	FailingSteps []*StepFailures `json:"failingsteps"`
+	// ErroredSteps are the steps most often ending without an exit code, like when their container couldn't be
+	// watched. They say more about the build server than about the step, so they aren't in FailingSteps.
+	ErroredSteps []*StepFailures `json:"erroredsteps"`
+}
+
+// Percentiles of a set of durations in milliseconds
+type Percentiles struct {
+	P50 int64 `json:"p50"`
+	P90 int64 `json:"p90"`
+	P99 int64 `json:"p99"`
+}
+
+// StepFailures is the number of times a step failed
+type StepFailures struct {
+	Name     string `json:"name"`
+	Failures int    `json:"failures"`
+}
+
+// Branch returns the branch or tag a build was built from
+func Branch(b *model.Build) string {
+	return strings.TrimPrefix(b.Ref, "refs/heads/")
+}
+
+// unknownExitCode is the exit code of steps that ended without one
+const unknownExitCode = -1
+
+func finished(b *model.Build) bool {
+	return b.Status == "Done" || b.Status == "Failed"
+}
+
+// Compute calculates the statistics of every repository and branch in builds, steps are
+// the steps of the builds. MTTR is calculated for the default branch of a repository in defaultBranches, by org/name.
+func Compute(builds []*model.Build, steps []*model.StepInfo, defaultBranches map[string]string) []*Stats {
+	stepsByBuild := make(map[string][]*model.StepInfo)
+	for _, s := range steps {
+		key := buildKey(s.Org, s.Reponame, s.BuildNumber)
+		stepsByBuild[key] = append(stepsByBuild[key], s)
+	}
+
+	branches := make(map[string][]*model.Build)
+	keys := make([]string, 0)
+	for _, b := range builds {
+		key := b.Org + "/" + b.Name + "/" + Branch(b)
+		if _, ok := branches[key]; !ok {
+			keys = append(keys, key)
+		}
+		branches[key] = append(branches[key], b)
+	}
+	sort.Strings(keys)
+
+	result := make([]*Stats, 0, len(keys))
+	for _, key := range keys {
+		bb := branches[key]
+		sort.Slice(bb, func(i, j int) bool { return bb[i].Number < bb[j].Number })
+		s := &Stats{Org: bb[0].Org, Name: bb[0].Name, Branch: Branch(bb[0]), Builds: len(bb)}
+
+		durations := make([]int64, 0, len(bb))
+		failures := make(map[string]int)
+		errored := make(map[string]int)
+		for _, b := range bb {
+			if !finished(b) {
+				continue
+			}
+			if b.Success {
+				s.Succeeded++
+			} else {
+				s.Failed++
+			}
+			if b.Timing.Total > 0 {
+				durations = append(durations, b.Timing.Total)
+			}
+			for _, step := range stepsByBuild[buildKey(b.Org, b.Name, b.Number)] {
+				switch step.ExitCode {
+				case 0:
+				case unknownExitCode:
+					errored[step.Name]++
+				default:
+					failures[step.Name]++
+				}
+			}
+		}
+		if s.Succeeded+s.Failed > 0 {
+			s.SuccessRate = float64(s.Succeeded) / float64(s.Succeeded+s.Failed)
+		}
+		s.Duration = percentiles(durations)
+		s.FailingSteps = mostFailing(failures)
+		s.ErroredSteps = mostFailing(errored)
+		if branch := defaultBranches[s.Org+"/"+s.Name]; branch != "" && s.Branch == branch {
+			s.MTTR, s.Recoveries = mttr(bb)
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func buildKey(org, name string, number int) string {
+	return fmt.Sprintf("%v/%v/%v", org, name, number)
+}
+
+// percentiles returns the nearest rank percentiles of durations
+func percentiles(durations []int64) Percentiles {
+	if len(durations) == 0 {
+		return Percentiles{}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	rank := func(p int) int64 {
+		i := (p*len(durations)+99)/100 - 1
+		if i < 0 {
+			i = 0
+		}
+		return durations[i]
+	}
+	return Percentiles{P50: rank(50), P90: rank(90), P99: rank(99)}
+}
+
+// mttr returns the mean time to recover and the number of recoveries of the builds of a branch,
+// ordered by build number. The branch is red from the first failed build until a build succeeds.
+func mttr(bb []*model.Build) (int64, int) {
+	var red time.Time
+	var total int64
+	recoveries := 0
+	for _, b := range bb {
+		if !finished(b) {
+			continue
+		}
+		if !b.Success {
+			if red.IsZero() {
+				red = b.Timestamp
+			}
+			continue
+		}
+		if !red.IsZero() {
+			green := b.Timestamp.Add(time.Duration(b.Timing.Total) * time.Millisecond)
+			total += int64(green.Sub(red) / time.Millisecond)
+			recoveries++
+			red = time.Time{}
+		}
+	}
+	if recoveries == 0 {
+		return 0, 0
+	}
+	return total / int64(recoveries), recoveries
+}
+
+func mostFailing(failures map[string]int) []*StepFailures {
+	result := make([]*StepFailures, 0, len(failures))
+	for name, n := range failures {
+		result = append(result, &StepFailures{Name: name, Failures: n})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Failures != result[j].Failures {
+			return result[i].Failures > result[j].Failures
+		}
+		return result[i].Name < result[j].Name
+	})
+	if len(result) > maxFailingSteps {
+		result = result[:maxFailingSteps]
+	}
+	return result
+}
@@ -0,0 +1,89 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+)
+
+var start = time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func build(number int, ref string, success bool, total time.Duration) *model.Build {
+	status := "Done"
+	if !success {
+		status = "Failed"
+	}
+	return &model.Build{
+		Org:       "org",
+		Name:      "repo",
+		Number:    number,
+		Ref:       ref,
+		Success:   success,
+		Status:    status,
+		Timestamp: start.Add(time.Duration(number) * time.Hour),
+		Timing:    model.Timing{Total: int64(total / time.Millisecond)},
+	}
+}
+
+func step(number int, name string, exitCode int32) *model.StepInfo {
+	return &model.StepInfo{Org: "org", Reponame: "repo", BuildNumber: number, Name: name, ExitCode: exitCode}
+}
+
+func TestCompute(t *testing.T) {
+	running := build(6, "refs/heads/master", false, 0)
+	running.Status = "Running"
+	builds := []*model.Build{
+		build(1, "refs/heads/master", true, time.Minute),
+		build(2, "refs/heads/master", false, 2*time.Minute),
+		build(3, "refs/heads/master", false, 3*time.Minute),
+		build(4, "refs/heads/master", true, 4*time.Minute),
+		build(5, "refs/heads/feature", false, 5*time.Minute),
+		running,
+	}
+	steps := []*model.StepInfo{
+		step(2, "test", 1),
+		step(2, "lint", 0),
+		step(3, "test", 2),
+		step(3, "lint", 1),
+		step(5, "lint", 1),
+		// the container of the step couldn't be watched
+		step(4, "deploy", -1),
+	}
+
+	result := Compute(builds, steps, map[string]string{"org/repo": "master"})
+	assert.Len(t, result, 2)
+
+	feature := result[0]
+	assert.Equal(t, "feature", feature.Branch)
+	assert.Equal(t, 1, feature.Builds)
+	assert.Equal(t, 0.0, feature.SuccessRate)
+	assert.Equal(t, int64(0), feature.MTTR, "MTTR is only calculated for the default branch")
+
+	master := result[1]
+	assert.Equal(t, "master", master.Branch)
+	assert.Equal(t, 5, master.Builds)
+	assert.Equal(t, 2, master.Succeeded)
+	assert.Equal(t, 2, master.Failed)
+	assert.Equal(t, 0.5, master.SuccessRate)
+	assert.Equal(t, Percentiles{P50: 120000, P90: 240000, P99: 240000}, master.Duration)
+	// red at build 2, green when build 4 finished 2 hours and 4 minutes later
+	assert.Equal(t, int64((2*time.Hour+4*time.Minute)/time.Millisecond), master.MTTR)
+	assert.Equal(t, 1, master.Recoveries)
+	assert.Equal(t, []*StepFailures{{Name: "test", Failures: 2}, {Name: "lint", Failures: 1}}, master.FailingSteps)
+	assert.Equal(t, []*StepFailures{{Name: "deploy", Failures: 1}}, master.ErroredSteps)
+
+	result = Compute(builds, steps, map[string]string{})
+	assert.Equal(t, int64(0), result[1].MTTR, "MTTR needs the default branch of the repository")
+}
+
+func TestPercentiles(t *testing.T) {
+	durations := make([]int64, 0)
+	for i := 100; i > 0; i-- {
+		durations = append(durations, int64(i))
+	}
+	assert.Equal(t, Percentiles{P50: 50, P90: 90, P99: 99}, percentiles(durations))
+	assert.Equal(t, Percentiles{P50: 7, P90: 7, P99: 7}, percentiles([]int64{7}))
+	assert.Equal(t, Percentiles{}, percentiles(nil))
+}
@@ -0,0 +1,69 @@
+package disk
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/storage/logstore"
+)
+
+// Disk is a log store keeping the logs as files in a local directory
+type Disk struct {
+	dir string
+}
+
+// New creates a log store writing logs below dir
+func New(dir string) (*Disk, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create log directory")
+	}
+	return &Disk{dir: dir}, nil
+}
+
+func (d *Disk) path(key string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(filepath.Clean("/"+key)))
+}
+
+// Put stores the content of r under key, the log is only visible once it has been completely written
+func (d *Disk) Put(key string, r io.Reader) error {
+	path := d.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.Wrap(err, "unable to create log directory")
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".log")
+	if err != nil {
+		return errors.Wrap(err, "unable to create log file")
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "unable to write log file")
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Get opens the log stored under key
+func (d *Disk) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(key))
+	if os.IsNotExist(err) {
+		return nil, logstore.ErrNotFound
+	}
+	return f, err
+}
+
+// Delete removes the log stored under key
+func (d *Disk) Delete(key string) error {
+	err := os.Remove(d.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,274 @@
+package logstore
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/logging"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/storage"
+)
+
+// ErrNotFound is returned by a LogStore when no log is stored under a key
+var ErrNotFound = errors.New("log not found")
+
+// LogStore is a blob store holding the logs of finished steps
+type LogStore interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// pageSize is the number of lines read from the database at a time while archiving
+const pageSize = 1000
+
+// Key returns the key the log of a step is stored under. Logs are gzip compressed, which the standard library
+// provides; zstd compresses logs slightly better but needs a dependency, the extension of the key leaves room for it.
+func Key(org, reponame string, build int, step string) string {
+	return fmt.Sprintf("%v/%v/%v/%v.log.gz", org, reponame, build, step)
+}
+
+// Service keeps the logs of finished steps in a LogStore, the database
+// only keeps a pointer to the log. Everything else is handled by the
+// wrapped service.
+type Service struct {
+	storage.Service
+	store LogStore
+}
+
+// New wraps service, so step logs are archived in store
+func New(service storage.Service, store LogStore) *Service {
+	return &Service{Service: service, store: store}
+}
+
+// SearchLogs returns storage.ErrSearchUnsupported, the logs of finished steps are moved to the log store
+// where they can't be searched, so searching the database would silently miss them
+func (s *Service) SearchLogs(query model.LogQuery) ([]*model.LogMatch, error) {
+	return nil, storage.ErrSearchUnsupported
+}
+
+// ArchiveLog moves the log of a step from the database to the log store, once the whole log has been stored
+func (s *Service) ArchiveLog(step *model.Step) error {
+	if !step.LogComplete {
+		return errors.Errorf("the log of step %v is still being written", step.Name)
+	}
+	return s.archive(step, func(w io.Writer) error {
+		for offset := 0; ; offset += pageSize {
+			lines, err := s.Service.LoadLogLines(step.Org, step.Reponame, step.BuildNumber, step.Name, offset, pageSize)
+			if err != nil {
+				return err
+			}
+			for _, l := range lines {
+				if _, err := io.WriteString(w, l.Content+"\n"); err != nil {
+					return err
+				}
+			}
+			if len(lines) < pageSize {
+				return nil
+			}
+		}
+	})
+}
+
+// archive stores what write writes gzip compressed in the log store, and
+// replaces the log in the database with a pointer to it
+func (s *Service) archive(step *model.Step, write func(io.Writer) error) error {
+	key := Key(step.Org, step.Reponame, step.BuildNumber, step.Name)
+
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		err := write(gz)
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	err := s.store.Put(key, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("unable to archive log of step %v", step.Name))
+	}
+	return s.Service.SaveLogRef(step.Org, step.Reponame, step.BuildNumber, step.Name, key)
+}
+
+// LoadStep loads the step, reading the log from the log store if it has been archived
+func (s *Service) LoadStep(org, reponame string, build int, stepname string) (*model.Step, error) {
+	step, err := s.Service.LoadStep(org, reponame, build, stepname)
+	if err != nil {
+		return nil, err
+	}
+	return step, s.resolveLog(step)
+}
+
+// LoadSteps loads the steps of a build, reading the logs from the log store if they have been archived
+func (s *Service) LoadSteps(org string, name string, build int) ([]*model.Step, error) {
+	steps, err := s.Service.LoadSteps(org, name, build)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range steps {
+		if err := s.resolveLog(step); err != nil {
+			return nil, err
+		}
+	}
+	return steps, nil
+}
+
+// LoadLogLines loads a range of log lines, reading them from the log store if the log has been archived.
+// Lines read from the log store have no timestamp.
+func (s *Service) LoadLogLines(org string, name string, build int, stepname string, offset int, limit int) ([]*model.LogLine, error) {
+	info, err := s.Service.LoadStepInfo(org, name, stepname, build)
+	if err != nil || info.LogRef == "" {
+		return s.Service.LoadLogLines(org, name, build, stepname, offset, limit)
+	}
+
+	r, err := s.open(info.LogRef)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	result := make([]*model.LogLine, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 0; scanner.Scan(); n++ {
+		if n < offset {
+			continue
+		}
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		result = append(result, &model.LogLine{Number: n, Content: scanner.Text()})
+	}
+	return result, scanner.Err()
+}
+
+// resolveLog fills in the log of an archived step, the logs still kept in the database are already loaded
+func (s *Service) resolveLog(step *model.Step) error {
+	if step.LogRef == "" {
+		return nil
+	}
+	r, err := s.open(step.LogRef)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "unable to read archived log")
+	}
+	step.Log = string(b)
+	return nil
+}
+
+// ArchiveStoredLogs moves the complete logs still kept in the database to the log store, the logs from before
+// there was a log store and the ones that couldn't be archived when their step finished.
+// It returns the number of logs archived, and stops when the remaining logs can't be archived.
+func (s *Service) ArchiveStoredLogs() (int, error) {
+	archived := 0
+	for {
+		infos, err := s.Service.LoadUnarchivedSteps(pageSize)
+		if err != nil {
+			return archived, err
+		}
+		var failed error
+		batch := 0
+		for _, info := range infos {
+			step, err := s.Service.LoadStep(info.Org, info.Reponame, info.BuildNumber, info.Name)
+			if err == nil {
+				err = s.archiveStoredLog(step)
+			}
+			if err != nil {
+				failed = err
+				slog.Warn("unable to archive log", logging.OrgKey, info.Org, logging.RepoKey, info.Reponame,
+					logging.BuildKey, info.BuildNumber, logging.StepKey, info.Name, "error", err)
+				continue
+			}
+			batch++
+		}
+		archived += batch
+		// the same steps would be loaded again if none of them could be archived
+		if len(infos) < pageSize || batch == 0 {
+			return archived, failed
+		}
+	}
+}
+
+// archiveStoredLog archives the complete log of a step that is still kept in the database
+func (s *Service) archiveStoredLog(step *model.Step) error {
+	lines, err := s.Service.LoadLogLines(step.Org, step.Reponame, step.BuildNumber, step.Name, 0, 1)
+	if err != nil {
+		return err
+	}
+	if len(lines) > 0 {
+		return s.ArchiveLog(step)
+	}
+	// logs from before they were stored line by line are kept in the steps table
+	return s.archive(step, func(w io.Writer) error {
+		_, err := io.WriteString(w, step.Log)
+		return err
+	})
+}
+
+// DeleteBuild deletes a build, including the logs in the log store
+func (s *Service) DeleteBuild(org string, name string, build int) error {
+	err := s.deleteArchived(org, name, build)
+	if err != nil {
+		return err
+	}
+	return s.Service.DeleteBuild(org, name, build)
+}
+
+// DeleteLogs deletes the logs of a build, including the logs in the log store
+func (s *Service) DeleteLogs(org string, name string, build int) error {
+	err := s.deleteArchived(org, name, build)
+	if err != nil {
+		return err
+	}
+	return s.Service.DeleteLogs(org, name, build)
+}
+
+func (s *Service) deleteArchived(org string, name string, build int) error {
+	steps, err := s.Service.LoadSteps(org, name, build)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		if step.LogRef == "" {
+			continue
+		}
+		if err := s.store.Delete(step.LogRef); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("unable to delete log %v", step.LogRef))
+		}
+	}
+	return nil
+}
+
+func (s *Service) open(key string) (io.ReadCloser, error) {
+	r, err := s.store.Get(key)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("unable to get log %v", key))
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		r.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("unable to decompress log %v", key))
+	}
+	return &gzipReadCloser{Reader: gz, body: r}, nil
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
@@ -0,0 +1,111 @@
+package logstore_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/storage/logstore"
+	"gitlab.com/sorenmat/seneferu/storage/logstore/disk"
+	"gitlab.com/sorenmat/seneferu/storage/memory"
+)
+
+func newService(t *testing.T) (*logstore.Service, *memory.MemStorage, func()) {
+	dir, err := ioutil.TempDir("", "logstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := disk.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := memory.New()
+	return logstore.New(mem, store), mem, func() { os.RemoveAll(dir) }
+}
+
+func TestArchiveLog(t *testing.T) {
+	service, mem, cleanup := newService(t)
+	defer cleanup()
+
+	step := &model.Step{StepInfo: model.StepInfo{Org: "org", Reponame: "repo", BuildNumber: 1, Name: "build", Status: "Done", LogComplete: true}}
+	assert.NoError(t, service.SaveStep(step))
+	assert.NoError(t, service.AppendLogLines("org", "repo", 1, "build", []*model.LogLine{{Number: 0, Content: "first"}, {Number: 1, Content: "second"}}))
+
+	assert.NoError(t, service.ArchiveLog(step))
+
+	// the database only has a pointer to the log
+	info, err := mem.LoadStepInfo("org", "repo", "build", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, logstore.Key("org", "repo", 1, "build"), info.LogRef)
+	lines, err := mem.LoadLogLines("org", "repo", 1, "build", 0, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, lines)
+
+	loaded, err := service.LoadStep("org", "repo", 1, "build")
+	assert.NoError(t, err)
+	assert.Equal(t, "first\nsecond\n", loaded.Log)
+
+	lines, err = service.LoadLogLines("org", "repo", 1, "build", 1, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(lines))
+	assert.Equal(t, 1, lines[0].Number)
+	assert.Equal(t, "second", lines[0].Content)
+}
+
+func TestStoredLogsAreArchived(t *testing.T) {
+	service, mem, cleanup := newService(t)
+	defer cleanup()
+
+	legacy := &model.Step{StepInfo: model.StepInfo{Org: "org", Reponame: "repo", BuildNumber: 1, Name: "build", Status: "Done", LogComplete: true}, Log: "old log\n"}
+	assert.NoError(t, mem.SaveStep(legacy))
+	lines := &model.Step{StepInfo: model.StepInfo{Org: "org", Reponame: "repo", BuildNumber: 1, Name: "test", Status: "Done", LogComplete: true}}
+	assert.NoError(t, mem.SaveStep(lines))
+	assert.NoError(t, mem.AppendLogLines("org", "repo", 1, "test", []*model.LogLine{{Number: 0, Content: "first"}}))
+
+	// reading leaves the database alone
+	loaded, err := service.LoadStep("org", "repo", 1, "build")
+	assert.NoError(t, err)
+	assert.Equal(t, "old log\n", loaded.Log)
+	stored, err := mem.LoadStep("org", "repo", 1, "build")
+	assert.NoError(t, err)
+	assert.Equal(t, "old log\n", stored.Log)
+
+	archived, err := service.ArchiveStoredLogs()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, archived)
+
+	stored, err = mem.LoadStep("org", "repo", 1, "build")
+	assert.NoError(t, err)
+	assert.Equal(t, "", stored.Log, "the log should have been moved out of the database")
+	assert.NotEqual(t, "", stored.LogRef)
+
+	steps, err := service.LoadSteps("org", "repo", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "old log\n", steps[0].Log)
+	assert.Equal(t, "first\n", steps[1].Log)
+}
+
+func TestIncompleteLogIsNotArchived(t *testing.T) {
+	service, mem, cleanup := newService(t)
+	defer cleanup()
+
+	// the step has finished, but its log is still being saved
+	step := &model.Step{StepInfo: model.StepInfo{Org: "org", Reponame: "repo", BuildNumber: 1, Name: "build", Status: "Done"}}
+	assert.NoError(t, service.SaveStep(step))
+	assert.NoError(t, service.AppendLogLines("org", "repo", 1, "build", []*model.LogLine{{Number: 0, Content: "first"}}))
+
+	assert.Error(t, service.ArchiveLog(step))
+	archived, err := service.ArchiveStoredLogs()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, archived)
+
+	loaded, err := service.LoadStep("org", "repo", 1, "build")
+	assert.NoError(t, err)
+	assert.Equal(t, "first\n", loaded.Log)
+
+	info, err := mem.LoadStepInfo("org", "repo", "build", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "", info.LogRef)
+}
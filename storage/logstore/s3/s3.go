@@ -0,0 +1,319 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/storage/logstore"
+)
+
+// partSize is the size of the parts logs are uploaded in, the smallest part S3 accepts.
+// Only one part is kept in memory at a time.
+var partSize = 5 << 20
+
+// S3 is a log store keeping the logs in an S3 compatible bucket, like AWS S3 or MinIO.
+// Objects are addressed path style, {endpoint}/{bucket}/{key}.
+type S3 struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+
+	client *http.Client
+	now    func() time.Time
+}
+
+// New creates a log store writing to bucket on the S3 compatible endpoint
+func New(endpoint, bucket, region, accessKey, secretKey string) (*S3, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse S3 endpoint")
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint %v must be an absolute URL", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket is required for the S3 log store")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+		now:       time.Now,
+	}, nil
+}
+
+// Put uploads the content of r under key. Logs fitting in a single part are uploaded in one request,
+// larger logs are streamed with a multipart upload.
+func (s *S3) Put(key string, r io.Reader) error {
+	part := make([]byte, partSize)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.putObject(key, part[:n])
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to read log")
+	}
+	uploadID, err := s.createUpload(key)
+	if err != nil {
+		return err
+	}
+	parts, err := s.uploadParts(key, uploadID, part, r)
+	if err == nil {
+		err = s.completeUpload(key, uploadID, parts)
+	}
+	if err != nil {
+		// don't leave the uploaded parts behind in the bucket
+		if aerr := s.abortUpload(key, uploadID); aerr != nil {
+			return errors.Wrap(err, fmt.Sprintf("unable to abort upload: %v", aerr))
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *S3) putObject(key string, body []byte) error {
+	resp, err := s.do("PUT", key, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *S3) createUpload(key string) (string, error) {
+	resp, err := s.do("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", responseError(resp)
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errors.Wrap(err, "unable to read multipart upload")
+	}
+	return result.UploadID, nil
+}
+
+// uploadParts uploads the first part, which has already been read, followed by the rest of r
+func (s *S3) uploadParts(key, uploadID string, part []byte, r io.Reader) ([]completedPart, error) {
+	var parts []completedPart
+	for number := 1; ; number++ {
+		resp, err := s.do("PUT", key, url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}, part)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, responseError(resp)
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		n, err := io.ReadFull(r, part[:cap(part)])
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, errors.Wrap(err, "unable to read log")
+		}
+		part = part[:n]
+	}
+}
+
+func (s *S3) completeUpload(key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return errors.Wrap(err, "unable to create multipart upload request")
+	}
+	resp, err := s.do("POST", key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	// S3 can report a failure after it has answered 200 OK
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "unable to read multipart upload result")
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		return fmt.Errorf("S3 was unable to complete the upload: %v", string(b))
+	}
+	return nil
+}
+
+func (s *S3) abortUpload(key, uploadID string) error {
+	resp, err := s.do("DELETE", key, url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// Get downloads the object stored under key
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, logstore.ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the object stored under key
+func (s *S3) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return responseError(resp)
+	}
+	return nil
+}
+
+func (s *S3) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + strings.TrimPrefix(key, "/")
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create request to S3")
+	}
+	s.sign(req, body)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("unable to %v %v", method, key))
+	}
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 authorization header to req
+func (s *S3) sign(req *http.Request, body []byte) {
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := hexSHA256(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(canonicalRequest))
+	signature := hex.EncodeToString(hmacSHA256(signingKey(s.secretKey, date, s.region, "s3"), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v", s.accessKey, scope, signedHeaders, signature))
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// canonicalQuery encodes the query sorted by name, the way AWS expects it in canonical requests
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, v := range values {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode encodes s the way AWS expects it in canonical requests, slashes are kept in paths
+func uriEncode(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~', b == '/' && !encodeSlash:
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func responseError(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 returned %v: %v", resp.Status, string(b))
+}
@@ -0,0 +1,140 @@
+package s3
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/storage/logstore"
+)
+
+// fakeS3 is a bucket stand-in, keeping objects and the parts of multipart uploads in memory
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	parts   map[string][][]byte
+	uploads int
+}
+
+type completeUpload struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+	switch {
+	case r.Method == "POST" && query.Has("uploads"):
+		f.uploads++
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>upload-%v</UploadId></InitiateMultipartUploadResult>", f.uploads)
+	case r.Method == "PUT" && uploadID != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		b, _ := ioutil.ReadAll(r.Body)
+		f.parts[uploadID] = append(f.parts[uploadID], b)
+		w.Header().Set("ETag", fmt.Sprintf(`"%v-%v"`, uploadID, number))
+	case r.Method == "POST" && uploadID != "":
+		var complete completeUpload
+		xml.NewDecoder(r.Body).Decode(&complete)
+		var object []byte
+		for i, part := range complete.Parts {
+			if part.ETag != fmt.Sprintf(`"%v-%v"`, uploadID, i+1) {
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code></Error>")
+				return
+			}
+			object = append(object, f.parts[uploadID][i]...)
+		}
+		f.objects[r.URL.EscapedPath()] = object
+		delete(f.parts, uploadID)
+	case r.Method == "DELETE" && uploadID != "":
+		delete(f.parts, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT":
+		b, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.EscapedPath()] = b
+	case r.Method == "GET":
+		b, ok := f.objects[r.URL.EscapedPath()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	case r.Method == "DELETE":
+		delete(f.objects, r.URL.EscapedPath())
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestPutGetDelete(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte), parts: make(map[string][][]byte)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	store, err := New(ts.URL, "logs", "", "access", "secret")
+	assert.NoError(t, err)
+
+	key := logstore.Key("org", "repo", 1, "my step")
+	assert.NoError(t, store.Put(key, strings.NewReader("some log")))
+	_, ok := fake.objects["/logs/org/repo/1/my%20step.log.gz"]
+	assert.True(t, ok, "object should be stored path style in the bucket")
+
+	r, err := store.Get(key)
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "some log", string(b))
+
+	assert.NoError(t, store.Delete(key))
+	_, err = store.Get(key)
+	assert.Equal(t, logstore.ErrNotFound, err)
+}
+
+func TestPutStreamsLargeLogs(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte), parts: make(map[string][][]byte)}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	defer func(size int) { partSize = size }(partSize)
+	partSize = 4
+
+	store, err := New(ts.URL, "logs", "", "access", "secret")
+	assert.NoError(t, err)
+
+	key := logstore.Key("org", "repo", 1, "build")
+	assert.NoError(t, store.Put(key, strings.NewReader("a log spanning parts")))
+	assert.Equal(t, 1, fake.uploads)
+	assert.Empty(t, fake.parts, "the parts should have been assembled")
+
+	r, err := store.Get(key)
+	assert.NoError(t, err)
+	b, _ := ioutil.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "a log spanning parts", string(b))
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	assert.Equal(t, "partNumber=2&uploadId=a%2Fb", canonicalQuery(url.Values{"uploadId": {"a/b"}, "partNumber": {"2"}}))
+	assert.Equal(t, "uploads=", canonicalQuery(url.Values{"uploads": {""}}))
+}
+
+func TestSigningKey(t *testing.T) {
+	// example from the AWS Signature Version 4 documentation
+	k := signingKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	assert.Equal(t, "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d", hex.EncodeToString(k))
+}
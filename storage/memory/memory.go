@@ -2,16 +2,48 @@ package memory
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"gitlab.com/sorenmat/seneferu/model"
 )
 
 type MemStorage struct {
 	repos []*model.Repo
+	mu    sync.Mutex
+	steps []*model.Step
+	logs  map[string][]*model.LogLine
 }
 
 func New() *MemStorage {
-	return &MemStorage{}
+	return &MemStorage{logs: make(map[string][]*model.LogLine)}
+}
+
+func stepKey(org string, name string, build int, stepname string) string {
+	return fmt.Sprintf("%v/%v/%v/%v", org, name, build, stepname)
+}
+
+// findStep returns the stored step, the caller must hold the lock
+func (m *MemStorage) findStep(org string, name string, build int, stepname string) *model.Step {
+	for _, s := range m.steps {
+		if s.Org == org && s.Reponame == name && s.BuildNumber == build && s.Name == stepname {
+			return s
+		}
+	}
+	return nil
+}
+
+// withLog returns a copy of the step with the log lines added, the caller must hold the lock
+func (m *MemStorage) withLog(s *model.Step) *model.Step {
+	step := *s
+	if lines := m.logs[stepKey(s.Org, s.Reponame, s.BuildNumber, s.Name)]; len(lines) > 0 && step.LogRef == "" {
+		step.Log = ""
+		for _, l := range lines {
+			step.Log += l.Content + "\n"
+		}
+	}
+	return &step
 }
 
 func (m *MemStorage) All() ([]*model.Repo, error) {
@@ -29,28 +61,194 @@ func (m *MemStorage) LoadByOrgAndName(org string, name string) (*model.Repo, err
 func (m *MemStorage) LoadBuilds(org string, name string) ([]*model.Build, error) {
 	return nil, nil
 }
+func (m *MemStorage) LoadAllBuilds(max int) ([]*model.Build, error) {
+	return nil, nil
+}
+func (m *MemStorage) LoadBuildsSince(org string, name string, since time.Time) ([]*model.Build, error) {
+	return nil, nil
+}
+func (m *MemStorage) LoadSupersededBuilds(keep int, keepTags bool) ([]*model.Build, error) {
+	return nil, nil
+}
+func (m *MemStorage) LoadBuildsWithLogsBefore(before time.Time, keepTags bool) ([]*model.Build, error) {
+	return nil, nil
+}
 func (m *MemStorage) LoadBuild(org string, name string, buildid int) (*model.Build, error) {
 	return nil, nil
 }
 func (m *MemStorage) LoadStep(org string, name string, buildid int, stepname string) (*model.Step, error) {
-	return nil, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.findStep(org, name, buildid, stepname)
+	if s == nil {
+		return &model.Step{}, nil
+	}
+	return m.withLog(s), nil
 }
 func (m *MemStorage) LoadSteps(org string, name string, build int) ([]*model.Step, error) {
-	return nil, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]*model.Step, 0)
+	for _, s := range m.steps {
+		if s.Org == org && s.Reponame == name && s.BuildNumber == build {
+			result = append(result, m.withLog(s))
+		}
+	}
+	return result, nil
 }
 func (m *MemStorage) LoadStepInfo(org string, name string, stepname string, build int) (*model.StepInfo, error) {
-	return nil, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.findStep(org, name, build, stepname)
+	if s == nil {
+		return nil, fmt.Errorf("couldn't find step %v in %v/%v with build number %v ", stepname, org, name, build)
+	}
+	info := s.StepInfo
+	return &info, nil
+}
+func (m *MemStorage) LoadStepInfos(org string, name string, since time.Time) ([]*model.StepInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]*model.StepInfo, 0)
+	// builds aren't kept, steps are selected by when they started
+	for _, s := range m.steps {
+		if (org == "" || s.Org == org) && (name == "" || s.Reponame == name) && !s.Started.Before(since) {
+			info := s.StepInfo
+			result = append(result, &info)
+		}
+	}
+	return result, nil
 }
 func (m *MemStorage) SaveRepo(r *model.Repo) error {
+	for i, repo := range m.repos {
+		if repo.Org == r.Org && repo.Name == r.Name {
+			m.repos[i] = r
+			return nil
+		}
+	}
 	m.repos = append(m.repos, r)
 	return nil
 }
 func (m *MemStorage) SaveBuild(*model.Build) error {
 	return nil
 }
-func (m *MemStorage) SaveStep(*model.Step) error {
+func (m *MemStorage) SaveStep(step *model.Step) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.findStep(step.Org, step.Reponame, step.BuildNumber, step.Name)
+	if s == nil {
+		s = &model.Step{}
+		m.steps = append(m.steps, s)
+	}
+	ref, complete := s.LogRef, s.LogComplete
+	*s = *step
+	s.LogRef = ref
+	s.LogComplete = complete || step.LogComplete
+	return nil
+}
+func (m *MemStorage) AppendLogLines(org string, name string, build int, stepname string, lines []*model.LogLine) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := stepKey(org, name, build, stepname)
+	m.logs[key] = append(m.logs[key], lines...)
+	return nil
+}
+func (m *MemStorage) LoadLogLines(org string, name string, build int, stepname string, offset int, limit int) ([]*model.LogLine, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lines := m.logs[stepKey(org, name, build, stepname)]
+	if offset >= len(lines) {
+		return nil, nil
+	}
+	lines = lines[offset:]
+	if limit > 0 && limit < len(lines) {
+		lines = lines[:limit]
+	}
+	return lines, nil
+}
+func (m *MemStorage) LoadUnarchivedSteps(limit int) ([]*model.StepInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]*model.StepInfo, 0)
+	for _, s := range m.steps {
+		if len(result) == limit {
+			break
+		}
+		_, hasLines := m.logs[stepKey(s.Org, s.Reponame, s.BuildNumber, s.Name)]
+		if s.LogComplete && s.LogRef == "" && (s.Log != "" || hasLines) {
+			info := s.StepInfo
+			result = append(result, &info)
+		}
+	}
+	return result, nil
+}
+func (m *MemStorage) SaveLogRef(org string, name string, build int, stepname string, ref string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.findStep(org, name, build, stepname)
+	if s == nil {
+		return fmt.Errorf("couldn't find step %v in %v/%v with build number %v ", stepname, org, name, build)
+	}
+	s.LogRef = ref
+	s.Log = ""
+	delete(m.logs, stepKey(org, name, build, stepname))
+	return nil
+}
+func (m *MemStorage) DeleteBuild(org string, name string, build int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	steps := m.steps[:0]
+	for _, s := range m.steps {
+		if s.Org == org && s.Reponame == name && s.BuildNumber == build {
+			delete(m.logs, stepKey(org, name, build, s.Name))
+			continue
+		}
+		steps = append(steps, s)
+	}
+	m.steps = steps
+	return nil
+}
+func (m *MemStorage) DeleteLogs(org string, name string, build int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.steps {
+		if s.Org == org && s.Reponame == name && s.BuildNumber == build {
+			delete(m.logs, stepKey(org, name, build, s.Name))
+			s.Log = ""
+			s.LogRef = ""
+		}
+	}
 	return nil
 }
+func (m *MemStorage) SearchLogs(query model.LogQuery) ([]*model.LogMatch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]*model.LogMatch, 0)
+	count := 0
+	text := strings.ToLower(query.Text)
+	for _, s := range m.steps {
+		if (query.Org != "" && s.Org != query.Org) || (query.Reponame != "" && s.Reponame != query.Reponame) {
+			continue
+		}
+		var match *model.LogMatch
+		for _, l := range m.logs[stepKey(s.Org, s.Reponame, s.BuildNumber, s.Name)] {
+			if query.Limit > 0 && count >= query.Limit {
+				return result, nil
+			}
+			if l.Timestamp.Before(query.Since) || !strings.Contains(strings.ToLower(l.Content), text) {
+				continue
+			}
+			if match == nil {
+				match = &model.LogMatch{Org: s.Org, Reponame: s.Reponame, BuildNumber: s.BuildNumber, Step: s.Name}
+				result = append(result, match)
+			}
+			line := *l
+			match.Lines = append(match.Lines, &line)
+			count++
+		}
+	}
+	return result, nil
+}
 func (m *MemStorage) GetNextBuildNumber(string, string) (int, error) {
 	return 1, nil
 }
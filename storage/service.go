@@ -1,27 +1,47 @@
 package storage
 
 import (
+	"errors"
 	"time"
 
 	"gitlab.com/sorenmat/seneferu/model"
 )
 
+// ErrSearchUnsupported is returned by SearchLogs when the logs are kept where they can't be searched
+var ErrSearchUnsupported = errors.New("logs can only be searched when they are kept in the database")
+
 type Service interface {
 	All() ([]*model.Repo, error)
 	LoadByOrgAndName(string, string) (*model.Repo, error)
 	LoadBuilds(string, string) ([]*model.Build, error)
 	LoadAllBuilds(int) ([]*model.Build, error)
+	LoadBuildsSince(org string, name string, since time.Time) ([]*model.Build, error)
+	LoadSupersededBuilds(keep int, keepTags bool) ([]*model.Build, error)
+	LoadBuildsWithLogsBefore(before time.Time, keepTags bool) ([]*model.Build, error)
 	LoadBuild(string, string, int) (*model.Build, error)
 	LoadStep(string, string, int, string) (*model.Step, error)
 	LoadSteps(org string, name string, build int) ([]*model.Step, error)
 	LoadStepInfo(org string, name string, stepname string, build int) (*model.StepInfo, error)
+	LoadStepInfos(org string, name string, since time.Time) ([]*model.StepInfo, error)
 	SaveRepo(*model.Repo) error
 	SaveBuild(*model.Build) error
 	SaveStep(*model.Step) error
+	AppendLogLines(org string, name string, build int, stepname string, lines []*model.LogLine) error
+	LoadLogLines(org string, name string, build int, stepname string, offset int, limit int) ([]*model.LogLine, error)
+	SaveLogRef(org string, name string, build int, stepname string, ref string) error
+	LoadUnarchivedSteps(limit int) ([]*model.StepInfo, error)
+	DeleteBuild(org string, name string, build int) error
+	DeleteLogs(org string, name string, build int) error
+	SearchLogs(query model.LogQuery) ([]*model.LogMatch, error)
 	GetNextBuildNumber(string, string) (int, error)
 	Close()
 }
 
+// LogArchiver is implemented by services that move the logs of finished steps out of the database
+type LogArchiver interface {
+	ArchiveLog(*model.Step) error
+}
+
 type Build struct {
 	Number     int        `json:"number" storm:"id"`
 	Committers []string   `json:"committers"`
@@ -1,6 +1,7 @@
 package sql
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 
@@ -8,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/DavidHuie/gomigrate"
 	_ "github.com/lib/pq"
@@ -118,7 +120,7 @@ func (r *SQLDB) syncSchema() {
 func (r *SQLDB) All() ([]*model.Repo, error) {
 	result := make([]*model.Repo, 0)
 
-	rows, err := r.db.Query("SELECT org, name, url FROM repositories")
+	rows, err := r.db.Query("SELECT org, name, url, config_path, default_branch FROM repositories")
 	if err != nil {
 		return result, err
 	}
@@ -127,11 +129,13 @@ func (r *SQLDB) All() ([]*model.Repo, error) {
 		var org string
 		var name string
 		var url string
-		err = rows.Scan(&org, &name, &url)
+		var configPath string
+		var defaultBranch string
+		err = rows.Scan(&org, &name, &url, &configPath, &defaultBranch)
 		if err != nil {
 			return result, err
 		}
-		result = append(result, &model.Repo{Org: org, Name: name, URL: url})
+		result = append(result, &model.Repo{Org: org, Name: name, URL: url, ConfigPath: configPath, DefaultBranch: defaultBranch})
 	}
 	return result, nil
 }
@@ -140,7 +144,7 @@ func (r *SQLDB) All() ([]*model.Repo, error) {
 func (r *SQLDB) LoadByOrgAndName(org, name string) (*model.Repo, error) {
 	var repo model.Repo
 
-	rows, err := r.db.Query("SELECT org,url,name FROM repositories WHERE ORG=$1 AND NAME=$2", org, name)
+	rows, err := r.db.Query("SELECT org,url,name,config_path,default_branch FROM repositories WHERE ORG=$1 AND NAME=$2", org, name)
 	if err != nil {
 		return &repo, err
 	}
@@ -148,7 +152,7 @@ func (r *SQLDB) LoadByOrgAndName(org, name string) (*model.Repo, error) {
 
 	found := false
 	for rows.Next() {
-		err = rows.Scan(&repo.Org, &repo.URL, &repo.Name)
+		err = rows.Scan(&repo.Org, &repo.URL, &repo.Name, &repo.ConfigPath, &repo.DefaultBranch)
 		if err != nil {
 			return nil, err
 		}
@@ -160,11 +164,36 @@ func (r *SQLDB) LoadByOrgAndName(org, name string) (*model.Repo, error) {
 	return &repo, nil
 }
 
+// buildColumns are the columns read by scanBuild
+const buildColumns = "org, name, number, comitters, created, success, status, commit, coverage, duration, COALESCE(ref, ''), logs_pruned, " +
+	"queue_ms, namespace_ms, secrets_ms, init_ms, pull_ms, total_ms, event, pull_request, base_ref, fork, changed_files"
+
+// scanBuild reads a build selected with buildColumns
+func scanBuild(rows *sql.Rows) (*model.Build, error) {
+	b := &model.Build{}
+	var c string
+	var changed sql.NullString
+	t := &b.Timing
+	err := rows.Scan(&b.Org, &b.Name, &b.Number, &c, &b.Timestamp, &b.Success, &b.Status, &b.Commit, &b.Coverage, &b.Duration, &b.Ref, &b.LogsPruned,
+		&t.Queue, &t.Namespace, &t.Secrets, &t.Init, &t.Pull, &t.Total, &b.Event, &b.PullRequest, &b.BaseRef, &b.Fork, &changed)
+	if err != nil {
+		return nil, err
+	}
+	b.Committers = strings.Split(c, ",")
+	if changed.Valid {
+		b.ChangedFiles = []string{}
+		if changed.String != "" {
+			b.ChangedFiles = strings.Split(changed.String, "\n")
+		}
+	}
+	return b, nil
+}
+
 // LoadBuild loads a given build from the repository
 func (r *SQLDB) LoadBuild(org, name string, build int) (*model.Build, error) {
 	bb := &model.Build{}
 
-	rows, err := r.db.Query("SELECT org, name, number, comitters, created, success, status, commit, coverage, duration FROM builds WHERE ORG=$1 AND NAME=$2 AND NUMBER=$3", org, name, build)
+	rows, err := r.db.Query("SELECT "+buildColumns+" FROM builds WHERE ORG=$1 AND NAME=$2 AND NUMBER=$3", org, name, build)
 	if err != nil {
 		return bb, err
 	}
@@ -172,9 +201,7 @@ func (r *SQLDB) LoadBuild(org, name string, build int) (*model.Build, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var commiters string
-		err = rows.Scan(&bb.Org, &bb.Name, &bb.Number, &commiters, &bb.Timestamp, &bb.Success, &bb.Status, &bb.Commit, &bb.Coverage, &bb.Duration)
-		bb.Committers = strings.Split(commiters, ",")
+		bb, err = scanBuild(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -187,55 +214,118 @@ func (r *SQLDB) LoadBuild(org, name string, build int) (*model.Build, error) {
 func (r *SQLDB) LoadBuilds(org, name string) ([]*model.Build, error) {
 	bb := make([]*model.Build, 0)
 
-	rows, err := r.db.Query("SELECT org,name,number,comitters,created,success,status,commit,coverage,duration FROM builds WHERE ORG=$1 AND NAME=$2 ORDER BY created DESC", org, name)
+	rows, err := r.db.Query("SELECT "+buildColumns+" FROM builds WHERE ORG=$1 AND NAME=$2 ORDER BY created DESC", org, name)
 	if err != nil {
 		return bb, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		b := &model.Build{}
-		var c string
-		err = rows.Scan(&b.Org, &b.Name, &b.Number, &c, &b.Timestamp, &b.Success, &b.Status, &b.Commit, &b.Coverage, &b.Duration)
-		b.Committers = strings.Split(c, ",")
-		bb = append(bb, b)
+		b, err := scanBuild(rows)
 		if err != nil {
 			return nil, err
 		}
+		bb = append(bb, b)
 	}
 	return bb, nil
 }
 
-// LoadAllBuilds loads a all builds for a given repository
+// LoadAllBuilds loads the max newest builds of all repositories, or every build if max is 0
 func (r *SQLDB) LoadAllBuilds(max int) ([]*model.Build, error) {
 	bb := make([]*model.Build, 0)
-	maxStr := "ALL"
+	query := "SELECT " + buildColumns + " FROM builds ORDER BY created DESC"
+	var args []interface{}
 	if max > 0 {
-		maxStr = fmt.Sprintf("%v", max)
+		// Postgres doesn't take ALL as a parameter, so the limit is left out when every build is loaded
+		query += " LIMIT $1"
+		args = append(args, max)
 	}
-	rows, err := r.db.Query("SELECT org,name,number,comitters,created,success,status,commit,coverage,duration FROM builds ORDER BY created DESC LIMIT $1", maxStr)
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
 		return bb, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		b := &model.Build{}
-		var c string
-		err = rows.Scan(&b.Org, &b.Name, &b.Number, &c, &b.Timestamp, &b.Success, &b.Status, &b.Commit, &b.Coverage, &b.Duration)
-		b.Committers = strings.Split(c, ",")
-		bb = append(bb, b)
+		b, err := scanBuild(rows)
 		if err != nil {
 			return nil, err
 		}
+		bb = append(bb, b)
 	}
 	return bb, nil
 }
 
+// LoadBuildsSince loads the builds created since a given time, newest first. An empty org or name
+// matches all organisations or repositories.
+func (r *SQLDB) LoadBuildsSince(org string, name string, since time.Time) ([]*model.Build, error) {
+	bb := make([]*model.Build, 0)
+	rows, err := r.db.Query("SELECT "+buildColumns+" FROM builds WHERE created >= $1 AND ($2 = '' OR org=$2) AND ($3 = '' OR name=$3) "+
+		"ORDER BY created DESC", since, org, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		b, err := scanBuild(rows)
+		if err != nil {
+			return nil, err
+		}
+		bb = append(bb, b)
+	}
+	return bb, rows.Err()
+}
+
+// LoadSupersededBuilds loads the builds that aren't among the keep newest of their repository and branch, ordered by
+// repository and number. Builds without a ref are of unknown branches and never loaded, neither are builds of tags
+// if keepTags is set.
+func (r *SQLDB) LoadSupersededBuilds(keep int, keepTags bool) ([]*model.Build, error) {
+	return r.queryBuilds("SELECT "+buildColumns+" FROM ("+
+		"SELECT *, ROW_NUMBER() OVER (PARTITION BY org, name, regexp_replace(ref, '^refs/heads/', '') ORDER BY number DESC) AS position "+
+		"FROM builds WHERE COALESCE(ref, '') <> '' AND NOT ($2 AND ref LIKE 'refs/tags/%')) AS branches "+
+		"WHERE position > $1 ORDER BY org, name, number", keep, keepTags)
+}
+
+// LoadBuildsWithLogsBefore loads the builds created before a given time whose logs weren't pruned yet, ordered by
+// repository and number. Builds of tags aren't loaded if keepTags is set.
+func (r *SQLDB) LoadBuildsWithLogsBefore(before time.Time, keepTags bool) ([]*model.Build, error) {
+	return r.queryBuilds("SELECT "+buildColumns+" FROM builds WHERE created < $1 AND NOT logs_pruned "+
+		"AND NOT ($2 AND COALESCE(ref, '') LIKE 'refs/tags/%') ORDER BY org, name, number", before, keepTags)
+}
+
+// queryBuilds loads the builds selected with buildColumns by query
+func (r *SQLDB) queryBuilds(query string, args ...interface{}) ([]*model.Build, error) {
+	bb := make([]*model.Build, 0)
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		b, err := scanBuild(rows)
+		if err != nil {
+			return nil, err
+		}
+		bb = append(bb, b)
+	}
+	return bb, rows.Err()
+}
+
+// stepInfoColumns are the columns read by scanStepInfo
+const stepInfoColumns = "org, reponame, buildnumber, name, status, exitcode, COALESCE(logref, ''), started, finished, duration, log_complete"
+
+// scanStepInfo reads step information selected with stepInfoColumns, followed by extra columns
+func scanStepInfo(rows *sql.Rows, info *model.StepInfo, extra ...interface{}) error {
+	dest := []interface{}{&info.Org, &info.Reponame, &info.BuildNumber, &info.Name, &info.Status, &info.ExitCode, &info.LogRef, &info.Started, &info.Finished, &info.Duration, &info.LogComplete}
+	return rows.Scan(append(dest, extra...)...)
+}
+
 // LoadStep loads a given step in a repo based on the repo name, build id and step name
 func (r *SQLDB) LoadStep(org, reponame string, build int, stepname string) (*model.Step, error) {
 	result := &model.Step{}
-	rows, err := r.db.Query("SELECT org, reponame, buildnumber,name,log,status,exitcode FROM steps WHERE ORG=$1 AND REPONAME=$2 AND buildnumber=$3 AND NAME=$4", org, reponame, build, stepname)
+	rows, err := r.db.Query("SELECT "+stepInfoColumns+", log FROM steps WHERE ORG=$1 AND REPONAME=$2 AND buildnumber=$3 AND NAME=$4", org, reponame, build, stepname)
 	if err != nil {
 		return result, err
 	}
@@ -243,11 +333,15 @@ func (r *SQLDB) LoadStep(org, reponame string, build int, stepname string) (*mod
 	defer rows.Close()
 
 	for rows.Next() {
-		err = rows.Scan(&result.Org, &result.Reponame, &result.BuildNumber, &result.Name, &result.Log, &result.Status, &result.ExitCode)
+		err = scanStepInfo(rows, &result.StepInfo, &result.Log)
 		if err != nil {
 			return nil, err
 		}
 	}
+	err = r.loadLog(result)
+	if err != nil {
+		return nil, err
+	}
 	return result, nil
 
 }
@@ -255,7 +349,7 @@ func (r *SQLDB) LoadStep(org, reponame string, build int, stepname string) (*mod
 // LoadSteps loads all step informations in a repo based on the repo name, build id and step name
 func (r *SQLDB) LoadSteps(org string, name string, build int) ([]*model.Step, error) {
 	result := make([]*model.Step, 0)
-	rows, err := r.db.Query("SELECT org, reponame, buildnumber,name,status,exitcode,log FROM steps WHERE ORG=$1 AND REPONAME=$2 AND buildnumber=$3", org, name, build)
+	rows, err := r.db.Query("SELECT "+stepInfoColumns+", log FROM steps WHERE ORG=$1 AND REPONAME=$2 AND buildnumber=$3", org, name, build)
 	if err != nil {
 		return nil, err
 	}
@@ -263,19 +357,25 @@ func (r *SQLDB) LoadSteps(org string, name string, build int) ([]*model.Step, er
 
 	for rows.Next() {
 		var stepinfo model.Step
-		err = rows.Scan(&stepinfo.Org, &stepinfo.Reponame, &stepinfo.BuildNumber, &stepinfo.Name, &stepinfo.Status, &stepinfo.ExitCode, &stepinfo.Log)
+		err = scanStepInfo(rows, &stepinfo.StepInfo, &stepinfo.Log)
 		if err != nil {
 			return nil, err
 		}
 		result = append(result, &stepinfo)
 	}
+	for _, step := range result {
+		err = r.loadLog(step)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return result, nil
 
 }
 
 // LoadStepInfo loads a given step information in a repo based on the repo name, build id and step name
 func (r *SQLDB) LoadStepInfo(org string, name string, stepname string, build int) (*model.StepInfo, error) {
-	rows, err := r.db.Query("SELECT org, reponame, buildnumber,name,status,exitcode FROM steps WHERE ORG=$1 AND REPONAME=$2 AND NAME=$3 AND buildnumber=$4", org, name, stepname, build)
+	rows, err := r.db.Query("SELECT "+stepInfoColumns+" FROM steps WHERE ORG=$1 AND REPONAME=$2 AND NAME=$3 AND buildnumber=$4", org, name, stepname, build)
 	if err != nil {
 		return nil, err
 	}
@@ -283,7 +383,7 @@ func (r *SQLDB) LoadStepInfo(org string, name string, stepname string, build int
 
 	for rows.Next() {
 		var stepinfo model.StepInfo
-		err = rows.Scan(&stepinfo.Org, &stepinfo.Reponame, &stepinfo.BuildNumber, &stepinfo.Name, &stepinfo.Status, &stepinfo.ExitCode)
+		err = scanStepInfo(rows, &stepinfo)
 		if err != nil {
 			return nil, err
 		}
@@ -293,7 +393,29 @@ func (r *SQLDB) LoadStepInfo(org string, name string, stepname string, build int
 
 }
 
-// SaveRepo saves the repository in the database
+// LoadStepInfos loads the step informations of all builds created since a given time. An empty org or name
+// matches all organisations or repositories.
+func (r *SQLDB) LoadStepInfos(org string, name string, since time.Time) ([]*model.StepInfo, error) {
+	result := make([]*model.StepInfo, 0)
+	rows, err := r.db.Query("SELECT "+stepInfoColumns+" FROM steps WHERE (org, reponame, buildnumber) IN "+
+		"(SELECT org, name, number FROM builds WHERE created >= $1 AND ($2 = '' OR org=$2) AND ($3 = '' OR name=$3))", since, org, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var stepinfo model.StepInfo
+		err = scanStepInfo(rows, &stepinfo)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, &stepinfo)
+	}
+	return result, rows.Err()
+}
+
+// SaveRepo saves the repository in the database, replacing the repository with the same org and name
 func (r *SQLDB) SaveRepo(repo *model.Repo) error {
 	if repo.Org == "" {
 		return fmt.Errorf("org is required for a repository")
@@ -302,12 +424,21 @@ func (r *SQLDB) SaveRepo(repo *model.Repo) error {
 		return fmt.Errorf("name is required for a repository")
 	}
 
-	stmt, err := r.db.Prepare("INSERT INTO repositories(org, name, url) VALUES($1, $2, $3)")
+	// repositories have no unique key on org and name, so a known repository is updated instead of inserted
+	res, err := r.db.Exec("UPDATE repositories SET url=$3, config_path=$4, default_branch=$5 WHERE org=$1 AND name=$2", repo.Org, repo.Name, repo.URL, repo.ConfigPath, repo.DefaultBranch)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+
+	stmt, err := r.db.Prepare("INSERT INTO repositories(org, name, url, config_path, default_branch) VALUES($1, $2, $3, $4, $5)")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(repo.Org, repo.Name, repo.URL)
+	_, err = stmt.Exec(repo.Org, repo.Name, repo.URL, repo.ConfigPath, repo.DefaultBranch)
 	if err != nil {
 		return err
 	}
@@ -323,16 +454,26 @@ func (r *SQLDB) SaveBuild(build *model.Build) error {
 		return fmt.Errorf("name is required for the build struct")
 	}
 
-	stmt, err := r.db.Prepare("INSERT INTO builds(org,name,number,comitters,status,success,commit,coverage,duration) " +
-		"VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)" +
+	stmt, err := r.db.Prepare("INSERT INTO builds(org,name,number,comitters,status,success,commit,coverage,duration,ref," +
+		"queue_ms,namespace_ms,secrets_ms,init_ms,pull_ms,total_ms,event,pull_request,base_ref,fork,changed_files) " +
+		"VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)" +
 		"ON CONFLICT (org,name, number) DO UPDATE SET " +
-		"comitters=$4, status=$5, success=$6, commit=$7, coverage=$8, duration=$9 WHERE builds.org=$1 AND builds.name=$2 AND builds.number=$3")
+		"comitters=$4, status=$5, success=$6, commit=$7, coverage=$8, duration=$9, ref=$10, " +
+		"queue_ms=$11, namespace_ms=$12, secrets_ms=$13, init_ms=$14, pull_ms=$15, total_ms=$16, " +
+		"event=$17, pull_request=$18, base_ref=$19, fork=$20, changed_files=$21 WHERE builds.org=$1 AND builds.name=$2 AND builds.number=$3")
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(build.Org, build.Name, build.Number, fmt.Sprintf("%v", build.Committers), build.Status, build.Success, build.Commit, build.Coverage, build.Duration)
+	t := build.Timing
+	// the changed files are NULL when they aren't known, so a build of them runs every step
+	var changed sql.NullString
+	if build.ChangedFiles != nil {
+		changed = sql.NullString{String: strings.Join(build.ChangedFiles, "\n"), Valid: true}
+	}
+	_, err = stmt.Exec(build.Org, build.Name, build.Number, fmt.Sprintf("%v", build.Committers), build.Status, build.Success, build.Commit, build.Coverage, build.Duration, build.Ref,
+		t.Queue, t.Namespace, t.Secrets, t.Init, t.Pull, t.Total, build.Event, build.PullRequest, build.BaseRef, build.Fork, changed)
 	if err != nil {
 		return err
 	}
@@ -352,22 +493,216 @@ func (r *SQLDB) SaveStep(step *model.Step) error {
 		return fmt.Errorf("a build number larger then 0 is required")
 	}
 
-	stmt, err := r.db.Prepare("INSERT INTO steps(buildnumber, reponame, name, log, status, exitcode,org) " +
-		"VALUES($1, $2, $3, $4, $5, $6,$7) ON CONFLICT (buildnumber, reponame, name,org) DO UPDATE SET " +
-		"buildnumber=$1, reponame=$2, name=$3, log=$4, status=$5, exitcode=$6, org=$7 WHERE steps.buildnumber=$1 AND steps.reponame=$2 AND steps.name=$3 AND steps.org=$7")
+	// a complete log stays complete, also when the step is saved again from a copy loaded earlier
+	stmt, err := r.db.Prepare("INSERT INTO steps(buildnumber, reponame, name, log, status, exitcode,org, started, finished, duration, log_complete) " +
+		"VALUES($1, $2, $3, $4, $5, $6,$7, $8, $9, $10, $11) ON CONFLICT (buildnumber, reponame, name,org) DO UPDATE SET " +
+		"buildnumber=$1, reponame=$2, name=$3, log=$4, status=$5, exitcode=$6, org=$7, started=$8, finished=$9, duration=$10, " +
+		"log_complete=steps.log_complete OR $11 WHERE steps.buildnumber=$1 AND steps.reponame=$2 AND steps.name=$3 AND steps.org=$7")
 
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(step.BuildNumber, step.Reponame, step.Name, step.Log, step.Status, step.ExitCode, step.Org)
+	_, err = stmt.Exec(step.BuildNumber, step.Reponame, step.Name, step.Log, step.Status, step.ExitCode, step.Org, step.Started, step.Finished, step.Duration, step.LogComplete)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// AppendLogLines stores lines at the end of the log of a step
+func (r *SQLDB) AppendLogLines(org string, name string, build int, stepname string, lines []*model.LogLine) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO log_lines(org, reponame, buildnumber, step, line, created, content) " +
+		"VALUES($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (org, reponame, buildnumber, step, line) DO NOTHING")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, l := range lines {
+		_, err = stmt.Exec(org, name, build, stepname, l.Number, l.Timestamp, l.Content)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LoadLogLines loads the lines of a step log starting at line offset, at most limit lines are returned.
+// A limit of 0 or less returns all the remaining lines
+func (r *SQLDB) LoadLogLines(org string, name string, build int, stepname string, offset int, limit int) ([]*model.LogLine, error) {
+	result := make([]*model.LogLine, 0)
+	var max sql.NullInt64
+	if limit > 0 {
+		max = sql.NullInt64{Int64: int64(limit), Valid: true}
+	}
+	rows, err := r.db.Query("SELECT line, created, content FROM log_lines WHERE org=$1 AND reponame=$2 AND buildnumber=$3 AND step=$4 AND line >= $5 ORDER BY line LIMIT $6", org, name, build, stepname, offset, max)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		l := &model.LogLine{}
+		err = rows.Scan(&l.Number, &l.Timestamp, &l.Content)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, l)
+	}
+	return result, rows.Err()
+}
+
+// LoadUnarchivedSteps loads up to limit steps with a complete log that is still kept in the database
+func (r *SQLDB) LoadUnarchivedSteps(limit int) ([]*model.StepInfo, error) {
+	rows, err := r.db.Query("SELECT "+stepInfoColumns+" FROM steps s WHERE log_complete AND COALESCE(logref, '') = '' AND (COALESCE(log, '') <> '' OR EXISTS "+
+		"(SELECT 1 FROM log_lines l WHERE l.org=s.org AND l.reponame=s.reponame AND l.buildnumber=s.buildnumber AND l.step=s.name)) ORDER BY uid LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*model.StepInfo, 0)
+	for rows.Next() {
+		info := &model.StepInfo{}
+		if err := scanStepInfo(rows, info); err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+	return result, rows.Err()
+}
+
+// SaveLogRef records where the log of a step has been archived to, and removes
+// the copy of the log kept in the database
+func (r *SQLDB) SaveLogRef(org string, name string, build int, stepname string, ref string) error {
+	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
+	_, err = tx.Exec("UPDATE steps SET logref=$5, log='' WHERE org=$1 AND reponame=$2 AND buildnumber=$3 AND name=$4", org, name, build, stepname, ref)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM log_lines WHERE org=$1 AND reponame=$2 AND buildnumber=$3 AND step=$4", org, name, build, stepname)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// loadLog replaces the log of the step with the stored log lines, if any.
+// Steps from before logs were stored line by line keep the log from the steps table
+func (r *SQLDB) loadLog(step *model.Step) error {
+	if step.LogRef != "" {
+		// the log has been archived, and isn't in the database anymore
+		return nil
+	}
+	lines, err := r.LoadLogLines(step.Org, step.Reponame, step.BuildNumber, step.Name, 0, 0)
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, l := range lines {
+		buf.WriteString(l.Content)
+		buf.WriteString("\n")
+	}
+	step.Log = buf.String()
 	return nil
 }
 
+// DeleteBuild deletes a build together with its steps and logs
+func (r *SQLDB) DeleteBuild(org string, name string, build int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, q := range []string{
+		"DELETE FROM log_lines WHERE org=$1 AND reponame=$2 AND buildnumber=$3",
+		"DELETE FROM steps WHERE org=$1 AND reponame=$2 AND buildnumber=$3",
+		"DELETE FROM builds WHERE org=$1 AND name=$2 AND number=$3",
+	} {
+		_, err = tx.Exec(q, org, name, build)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteLogs deletes the logs of all the steps in a build, but keeps the build and steps
+func (r *SQLDB) DeleteLogs(org string, name string, build int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, q := range []string{
+		"DELETE FROM log_lines WHERE org=$1 AND reponame=$2 AND buildnumber=$3",
+		"UPDATE steps SET log='', logref=NULL WHERE org=$1 AND reponame=$2 AND buildnumber=$3",
+		"UPDATE builds SET logs_pruned=TRUE WHERE org=$1 AND name=$2 AND number=$3",
+	} {
+		_, err = tx.Exec(q, org, name, build)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SearchLogs finds the log lines containing the query text, ignoring case. The steps with the newest lines are
+// returned first. Only logs kept in the database are searched, not the ones moved to a log store.
+func (r *SQLDB) SearchLogs(query model.LogQuery) ([]*model.LogMatch, error) {
+	result := make([]*model.LogMatch, 0)
+	var max sql.NullInt64
+	if query.Limit > 0 {
+		max = sql.NullInt64{Int64: int64(query.Limit), Valid: true}
+	}
+	pattern := "%" + likeEscaper.Replace(query.Text) + "%"
+	// the steps with the newest matches come first, with the lines of a step together in order
+	rows, err := r.db.Query("SELECT org, reponame, buildnumber, step, line, created, content FROM log_lines "+
+		"WHERE content ILIKE $1 AND ($2 = '' OR org=$2) AND ($3 = '' OR reponame=$3) AND created >= $4 "+
+		"ORDER BY MAX(created) OVER (PARTITION BY org, reponame, buildnumber, step) DESC, "+
+		"org, reponame, buildnumber DESC, step, line LIMIT $5", pattern, query.Org, query.Reponame, query.Since, max)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var match *model.LogMatch
+	for rows.Next() {
+		m := &model.LogMatch{}
+		l := &model.LogLine{}
+		err = rows.Scan(&m.Org, &m.Reponame, &m.BuildNumber, &m.Step, &l.Number, &l.Timestamp, &l.Content)
+		if err != nil {
+			return nil, err
+		}
+		if match == nil || match.Org != m.Org || match.Reponame != m.Reponame || match.BuildNumber != m.BuildNumber || match.Step != m.Step {
+			match = m
+			result = append(result, match)
+		}
+		match.Lines = append(match.Lines, l)
+	}
+	return result, rows.Err()
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 // GetNextBuildNumber returns the next available build number, this is currently globally unique
 func (r *SQLDB) GetNextBuildNumber(org, repo_name string) (int, error) {
 	if org == "" {
@@ -2,6 +2,7 @@ package sql
 
 import (
 	"testing"
+	"time"
 
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
@@ -29,6 +30,21 @@ func TestSaveAndLoadRepo(t *testing.T) {
 
 }
 
+func TestSaveRepoReplacesConfigPath(t *testing.T) {
+	service, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	name := "repo-" + uuid.New()
+	assert.NoError(t, service.SaveRepo(&model.Repo{Org: "Seneferu", Name: name}))
+	assert.NoError(t, service.SaveRepo(&model.Repo{Org: "Seneferu", Name: name, ConfigPath: "ci/build.yaml"}))
+
+	loaded, err := service.LoadByOrgAndName("Seneferu", name)
+	assert.NoError(t, err)
+	assert.Equal(t, "ci/build.yaml", loaded.ConfigPath)
+}
+
 func TestSaveAndLoadAllBuilds(t *testing.T) {
 	service, err := New()
 	defer service.Close()
@@ -62,6 +78,114 @@ func TestSaveAndLoadAllBuilds(t *testing.T) {
 	}
 }
 
+func TestLoadAllBuildsWithoutLimit(t *testing.T) {
+	service, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	name := "repo-" + uuid.New()
+	assert.NoError(t, service.SaveRepo(&model.Repo{Org: "Seneferu", Name: name}))
+	assert.NoError(t, service.SaveBuild(&model.Build{Org: "Seneferu", Name: name, Number: 1}))
+	assert.NoError(t, service.SaveBuild(&model.Build{Org: "Seneferu", Name: name, Number: 2}))
+
+	all, err := service.LoadAllBuilds(0)
+	assert.NoError(t, err)
+	found := 0
+	for _, b := range all {
+		if b.Name == name {
+			found++
+		}
+	}
+	assert.Equal(t, 2, found)
+
+	limited, err := service.LoadAllBuilds(1)
+	assert.NoError(t, err)
+	assert.Len(t, limited, 1)
+}
+
+func TestLoadBuildsSince(t *testing.T) {
+	service, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	name := "repo-" + uuid.New()
+	assert.NoError(t, service.SaveRepo(&model.Repo{Org: "Seneferu", Name: name}))
+	assert.NoError(t, service.SaveBuild(&model.Build{Org: "Seneferu", Name: name, Number: 1}))
+
+	builds, err := service.LoadBuildsSince("Seneferu", name, time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	if assert.Len(t, builds, 1) {
+		assert.Equal(t, 1, builds[0].Number)
+	}
+	builds, err = service.LoadBuildsSince("", "", time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, builds)
+	builds, err = service.LoadBuildsSince("Seneferu", name, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, builds)
+}
+
+func TestLoadSupersededBuilds(t *testing.T) {
+	service, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	name := "repo-" + uuid.New()
+	assert.NoError(t, service.SaveRepo(&model.Repo{Org: "Seneferu", Name: name}))
+	for i, ref := range []string{"refs/heads/master", "refs/heads/feature", "master", "refs/heads/master", "refs/tags/v1.0", "refs/tags/v1.1", ""} {
+		assert.NoError(t, service.SaveBuild(&model.Build{Org: "Seneferu", Name: name, Number: i + 1, Ref: ref}))
+	}
+
+	numbers := func(bb []*model.Build) []int {
+		result := make([]int, 0)
+		for _, b := range bb {
+			if b.Name == name {
+				result = append(result, b.Number)
+			}
+		}
+		return result
+	}
+	builds, err := service.LoadSupersededBuilds(2, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, numbers(builds))
+	builds, err = service.LoadSupersededBuilds(1, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, numbers(builds), "tags are kept per tag when not always kept")
+}
+
+func TestLoadBuildsWithLogsBefore(t *testing.T) {
+	service, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	name := "repo-" + uuid.New()
+	assert.NoError(t, service.SaveRepo(&model.Repo{Org: "Seneferu", Name: name}))
+	for i, ref := range []string{"refs/heads/master", "refs/tags/v1.0", "refs/heads/master"} {
+		assert.NoError(t, service.SaveBuild(&model.Build{Org: "Seneferu", Name: name, Number: i + 1, Ref: ref}))
+	}
+	assert.NoError(t, service.DeleteLogs("Seneferu", name, 3))
+
+	builds, err := service.LoadBuildsWithLogsBefore(time.Now().Add(time.Hour), true)
+	assert.NoError(t, err)
+	found := make([]int, 0)
+	for _, b := range builds {
+		if b.Name == name {
+			found = append(found, b.Number)
+		}
+	}
+	assert.Equal(t, []int{1}, found)
+
+	builds, err = service.LoadBuildsWithLogsBefore(time.Now().Add(-time.Hour), false)
+	assert.NoError(t, err)
+	for _, b := range builds {
+		assert.NotEqual(t, name, b.Name)
+	}
+}
+
 func TestSaveAndLoadBuild(t *testing.T) {
 	service, err := New()
 	defer service.Close()
@@ -157,6 +281,32 @@ func TestSaveAndLoadStep(t *testing.T) {
 	assert.Equal(t, "something happend", loadedStep.Log)
 }
 
+func TestAppendAndLoadLogLines(t *testing.T) {
+	service, err := New()
+	defer service.Close()
+	assert.NoError(t, err)
+
+	org := "Seneferu"
+	name := "repo-" + uuid.New()
+	step := &model.Step{StepInfo: model.StepInfo{Org: org, Reponame: name, BuildNumber: 1, Name: "build"}}
+	err = service.SaveStep(step)
+	assert.NoError(t, err)
+
+	err = service.AppendLogLines(org, name, 1, "build", []*model.LogLine{{Number: 0, Content: "first"}, {Number: 1, Content: "second"}})
+	assert.NoError(t, err)
+	err = service.AppendLogLines(org, name, 1, "build", []*model.LogLine{{Number: 2, Content: "third"}})
+	assert.NoError(t, err)
+
+	lines, err := service.LoadLogLines(org, name, 1, "build", 1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(lines))
+	assert.Equal(t, "second", lines[0].Content)
+
+	loadedStep, err := service.LoadStep(org, name, 1, "build")
+	assert.NoError(t, err)
+	assert.Equal(t, "first\nsecond\nthird\n", loadedStep.Log)
+}
+
 func TestSaveAndLoadStepInfo(t *testing.T) {
 	service, err := New()
 	defer service.Close()
@@ -209,3 +359,54 @@ func TestGetNextBuildNumber(t *testing.T) {
 	assert.Equal(t, 2, buildnum, "Build number increments when build is saved")
 
 }
+
+func TestSearchLogsGroupsLinesByStep(t *testing.T) {
+	service, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	name := "repo-" + uuid.New()
+	assert.NoError(t, service.SaveRepo(&model.Repo{Org: "Seneferu", Name: name}))
+	assert.NoError(t, service.SaveBuild(&model.Build{Org: "Seneferu", Name: name, Number: 1}))
+	now := time.Now()
+	for _, step := range []string{"build", "test"} {
+		assert.NoError(t, service.SaveStep(&model.Step{StepInfo: model.StepInfo{Org: "Seneferu", Reponame: name, BuildNumber: 1, Name: step}}))
+	}
+	// the lines of the steps are written interleaved, like steps running in parallel
+	assert.NoError(t, service.AppendLogLines("Seneferu", name, 1, "build", []*model.LogLine{{Number: 0, Timestamp: now, Content: "error one"}, {Number: 1, Timestamp: now.Add(2 * time.Second), Content: "error two"}}))
+	assert.NoError(t, service.AppendLogLines("Seneferu", name, 1, "test", []*model.LogLine{{Number: 0, Timestamp: now.Add(time.Second), Content: "error three"}}))
+
+	matches, err := service.SearchLogs(model.LogQuery{Text: "error", Org: "Seneferu", Reponame: name})
+	assert.NoError(t, err)
+	steps := map[string]int{}
+	for _, m := range matches {
+		steps[m.Step] += len(m.Lines)
+	}
+	assert.Len(t, matches, 2, "every step is one match")
+	assert.Equal(t, map[string]int{"build": 2, "test": 1}, steps)
+}
+
+func TestSaveBuildKeepsWhatTriggeredIt(t *testing.T) {
+	service, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	name := "repo-" + uuid.New()
+	assert.NoError(t, service.SaveBuild(&model.Build{Org: "Seneferu", Name: name, Number: 1, Ref: "feature", Event: "pull_request",
+		PullRequest: 7, BaseRef: "master", Fork: true, ChangedFiles: []string{"go.mod", "main.go"}}))
+	assert.NoError(t, service.SaveBuild(&model.Build{Org: "Seneferu", Name: name, Number: 2, Ref: "refs/heads/master", Event: "push"}))
+
+	b, err := service.LoadBuild("Seneferu", name, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "pull_request", b.Event)
+	assert.Equal(t, 7, b.PullRequest)
+	assert.Equal(t, "master", b.BaseRef)
+	assert.True(t, b.Fork)
+	assert.Equal(t, []string{"go.mod", "main.go"}, b.ChangedFiles)
+
+	b, err = service.LoadBuild("Seneferu", name, 2)
+	assert.NoError(t, err)
+	assert.Nil(t, b.ChangedFiles, "unknown changes stay unknown")
+}
@@ -0,0 +1,250 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// otlpBatchSize is the number of spans sent in one request
+	otlpBatchSize = 512
+	// otlpQueueSize is the number of spans waiting to be sent before new spans are dropped
+	otlpQueueSize = 4096
+	// otlpFlushInterval is how often queued spans are sent
+	otlpFlushInterval = 5 * time.Second
+)
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP over HTTP, JSON encoded.
+// Spans are queued and sent in batches in the background.
+type OTLPExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+
+	queue chan *Span
+	flush chan chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewOTLPExporter creates an exporter sending spans to the collector at endpoint, like http://localhost:4318
+func NewOTLPExporter(endpoint string, serviceName string) (*OTLPExporter, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("OTLP endpoint %v must be a http or https URL", endpoint)
+	}
+	e := &OTLPExporter{
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, otlpQueueSize),
+		flush:       make(chan chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// Export queues span to be sent, it's dropped if the queue is full
+func (e *OTLPExporter) Export(span *Span) error {
+	select {
+	case e.queue <- span:
+		return nil
+	default:
+		return errors.New("OTLP export queue is full, dropping span")
+	}
+}
+
+// Flush sends all queued spans
+func (e *OTLPExporter) Flush() {
+	done := make(chan struct{})
+	select {
+	case e.flush <- done:
+		<-done
+	case <-e.done:
+	}
+}
+
+// Shutdown sends all queued spans and stops the exporter
+func (e *OTLPExporter) Shutdown() error {
+	e.once.Do(func() {
+		e.Flush()
+		close(e.done)
+	})
+	return nil
+}
+
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, otlpBatchSize)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			slog.Warn("unable to send spans", "count", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= otlpBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-e.flush:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+				if len(batch) >= otlpBatchSize {
+					send()
+				}
+			}
+			send()
+			close(done)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *OTLPExporter) send(spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal spans")
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "unable to send spans to collector")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("collector returned %v: %v", resp.Status, string(b))
+	}
+	return nil
+}
+
+// The types below are the JSON encoding of the OTLP ExportTraceServiceRequest
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+const (
+	spanKindInternal = 1
+	statusCodeOk     = 1
+	statusCodeError  = 2
+)
+
+func (e *OTLPExporter) request(spans []*Span) *otlpRequest {
+	result := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Status:            otlpStatus{Code: statusCodeOk},
+		}
+		if s.ParentID.IsValid() {
+			span.ParentSpanID = s.ParentID.String()
+		}
+		for _, a := range s.Attributes() {
+			span.Attributes = append(span.Attributes, keyValue(a.Key, a.Value))
+		}
+		if s.Err != nil {
+			span.Status = otlpStatus{Code: statusCodeError, Message: s.Err.Error()}
+		}
+		result = append(result, span)
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{keyValue("service.name", e.serviceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "gitlab.com/sorenmat/seneferu"}, Spans: result}},
+	}}}
+}
+
+func keyValue(key string, value interface{}) otlpKeyValue {
+	var v otlpValue
+	switch x := value.(type) {
+	case bool:
+		v.BoolValue = &x
+	case int:
+		s := strconv.FormatInt(int64(x), 10)
+		v.IntValue = &s
+	case int32:
+		s := strconv.FormatInt(int64(x), 10)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &x
+	default:
+		s := fmt.Sprint(x)
+		v.StringValue = &s
+	}
+	return otlpKeyValue{Key: key, Value: v}
+}
@@ -0,0 +1,219 @@
+// Package tracing records traces of the build lifecycle and exports them, for example over OTLP.
+//
+// It isn't built on the OpenTelemetry SDK, since go.opentelemetry.io/otel, its SDK and the otlptracehttp exporter
+// aren't vendored and need a module aware build. Spans follow the OpenTelemetry data model and Start, End,
+// SetError and Exporter mirror the SDK, so moving to it once the dependencies are accepted only touches this package.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid returns false for the zero span id, used by root spans as parent
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// Attribute is a key value pair describing a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Exporter receives spans when they end
+type Exporter interface {
+	Export(span *Span) error
+	Shutdown() error
+}
+
+// Tracer starts traces and hands finished spans to its exporter
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer creates a tracer exporting to exporter
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// Default is the tracer used to trace builds, it discards all spans unless replaced
+var Default = NewTracer(NoopExporter{})
+
+// Start starts a new trace with a root span
+func (t *Tracer) Start(name string, kv ...interface{}) *Span {
+	var traceID TraceID
+	rand.Read(traceID[:])
+	return t.start(traceID, SpanID{}, name, time.Now(), kv)
+}
+
+// Start starts a new trace with a root span using the default tracer
+func Start(name string, kv ...interface{}) *Span {
+	return Default.Start(name, kv...)
+}
+
+func (t *Tracer) start(traceID TraceID, parent SpanID, name string, start time.Time, kv []interface{}) *Span {
+	s := &Span{tracer: t, TraceID: traceID, ParentID: parent, Name: name, StartTime: start}
+	rand.Read(s.SpanID[:])
+	s.SetAttributes(kv...)
+	return s
+}
+
+// Span is a timed operation within a trace
+type Span struct {
+	TraceID   TraceID
+	SpanID    SpanID
+	ParentID  SpanID
+	Name      string
+	StartTime time.Time
+	EndTime   time.Time
+	// Err is set if the operation failed
+	Err error
+
+	tracer     *Tracer
+	mu         sync.Mutex
+	attributes []Attribute
+	ended      bool
+}
+
+// Child starts a span as a child of s
+func (s *Span) Child(name string, kv ...interface{}) *Span {
+	return s.ChildAt(name, time.Now(), kv...)
+}
+
+// ChildAt starts a span as a child of s at a given time, for operations that
+// are only known after they started
+func (s *Span) ChildAt(name string, start time.Time, kv ...interface{}) *Span {
+	return s.tracer.start(s.TraceID, s.SpanID, name, start, kv)
+}
+
+// SetAttributes adds alternating keys and values to the span, like slog does
+func (s *Span) SetAttributes(kv ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var value interface{} = "!MISSING"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		s.attributes = append(s.attributes, Attribute{Key: key, Value: value})
+	}
+}
+
+// Attributes returns the attributes of the span
+func (s *Span) Attributes() []Attribute {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]Attribute, len(s.attributes))
+	copy(result, s.attributes)
+	return result
+}
+
+// Attribute returns the value of the attribute with key, or nil
+func (s *Span) Attribute(key string) interface{} {
+	for _, a := range s.Attributes() {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+// SetError marks the operation as failed, a nil err is ignored
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err
+}
+
+// End ends the span now and exports it
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends the span at a given time and exports it. Ending a span more than once has no effect.
+func (s *Span) EndAt(end time.Time) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = end
+	s.mu.Unlock()
+	if err := s.tracer.exporter.Export(s); err != nil {
+		slog.Warn("unable to export span", "span", s.Name, "error", err)
+	}
+}
+
+// NoopExporter discards all spans
+type NoopExporter struct{}
+
+// Export discards span
+func (NoopExporter) Export(*Span) error { return nil }
+
+// Shutdown does nothing
+func (NoopExporter) Shutdown() error { return nil }
+
+// InMemoryExporter keeps all spans in memory, it's meant for tests
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewInMemoryExporter creates an empty in memory exporter
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+// Export keeps span
+func (e *InMemoryExporter) Export(span *Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+	return nil
+}
+
+// Shutdown does nothing, the spans are kept
+func (e *InMemoryExporter) Shutdown() error { return nil }
+
+// Spans returns the exported spans, in the order they ended
+func (e *InMemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	result := make([]*Span, len(e.spans))
+	copy(result, e.spans)
+	return result
+}
+
+// Find returns the first exported span with name, or nil
+func (e *InMemoryExporter) Find(name string) *Span {
+	for _, s := range e.Spans() {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Reset forgets all exported spans
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
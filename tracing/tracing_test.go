@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpansShareTrace(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	tracer := NewTracer(exporter)
+
+	root := tracer.Start("webhook", "event", "push")
+	child := root.Child("build", "build", 1)
+	start := time.Now().Add(-time.Minute)
+	step := child.ChildAt("step", start)
+	step.EndAt(start.Add(time.Second))
+	child.End()
+	root.End()
+
+	spans := exporter.Spans()
+	assert.Len(t, spans, 3)
+	assert.Equal(t, root.TraceID, child.TraceID)
+	assert.Equal(t, root.TraceID, step.TraceID)
+	assert.False(t, root.ParentID.IsValid())
+	assert.Equal(t, root.SpanID, child.ParentID)
+	assert.Equal(t, child.SpanID, step.ParentID)
+	assert.Equal(t, time.Second, step.EndTime.Sub(step.StartTime))
+	assert.Equal(t, "push", root.Attribute("event"))
+	assert.Equal(t, 1, exporter.Find("build").Attribute("build"))
+}
+
+func TestSpanEndsOnce(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	s := NewTracer(exporter).Start("op")
+	s.SetError(errors.New("failed"))
+	s.SetError(nil)
+	s.End()
+	s.End()
+	assert.Len(t, exporter.Spans(), 1)
+	assert.EqualError(t, s.Err, "failed")
+}
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan otlpRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		var req otlpRequest
+		assert.NoError(t, json.Unmarshal(body, &req))
+		received <- req
+	}))
+	defer server.Close()
+
+	exporter, err := NewOTLPExporter(server.URL, "seneferu")
+	assert.NoError(t, err)
+	tracer := NewTracer(exporter)
+	root := tracer.Start("build", "org", "org", "build", 7, "success", false)
+	child := root.Child("step")
+	child.SetError(errors.New("exit code 1"))
+	child.End()
+	root.End()
+	exporter.Shutdown()
+
+	req := <-received
+	assert.Equal(t, "service.name", req.ResourceSpans[0].Resource.Attributes[0].Key)
+	assert.Equal(t, "seneferu", *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+
+	step, build := spans[0], spans[1]
+	assert.Equal(t, "step", step.Name)
+	assert.Equal(t, build.SpanID, step.ParentSpanID)
+	assert.Equal(t, build.TraceID, step.TraceID)
+	assert.Len(t, step.TraceID, 32)
+	assert.Len(t, step.SpanID, 16)
+	assert.Equal(t, statusCodeError, step.Status.Code)
+	assert.Equal(t, "exit code 1", step.Status.Message)
+
+	assert.Empty(t, build.ParentSpanID)
+	assert.Equal(t, statusCodeOk, build.Status.Code)
+	assert.Equal(t, "7", *build.Attributes[1].Value.IntValue)
+	assert.False(t, *build.Attributes[2].Value.BoolValue)
+}
+
+func TestOTLPEndpointMustBeURL(t *testing.T) {
+	_, err := NewOTLPExporter("localhost:4318", "seneferu")
+	assert.Error(t, err)
+}
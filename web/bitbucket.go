@@ -0,0 +1,201 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/scm"
+)
+
+// bitbucketCloudRepository is a repository in Bitbucket Cloud webhooks
+type bitbucketCloudRepository struct {
+	FullName string `json:"full_name"`
+	Links    struct {
+		HTML struct {
+			Href string `json:"href"`
+		} `json:"html"`
+	} `json:"links"`
+}
+
+// bitbucketActor is the user causing a Bitbucket Cloud or Bitbucket Server event
+type bitbucketActor struct {
+	// Nickname is set by Bitbucket Cloud
+	Nickname string `json:"nickname"`
+	// Name is set by Bitbucket Server
+	Name string `json:"name"`
+}
+
+func (a bitbucketActor) login() string {
+	if a.Nickname != "" {
+		return a.Nickname
+	}
+	return a.Name
+}
+
+// bitbucketCloudPushPayload is the part of the Bitbucket Cloud repo:push event used to build the pushed commit
+type bitbucketCloudPushPayload struct {
+	Actor      bitbucketActor           `json:"actor"`
+	Repository bitbucketCloudRepository `json:"repository"`
+	Push       struct {
+		Changes []struct {
+			// New is null when a branch or tag is deleted
+			New *struct {
+				Type   string `json:"type"`
+				Name   string `json:"name"`
+				Target struct {
+					Hash string `json:"hash"`
+				} `json:"target"`
+			} `json:"new"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+// bitbucketCloudBranch is the source or destination of a Bitbucket Cloud pull request
+type bitbucketCloudBranch struct {
+	Branch struct {
+		Name string `json:"name"`
+	} `json:"branch"`
+	Commit struct {
+		Hash string `json:"hash"`
+	} `json:"commit"`
+	Repository bitbucketCloudRepository `json:"repository"`
+}
+
+// bitbucketCloudPullRequestPayload is the part of the Bitbucket Cloud pullrequest events used to build the source
+// branch in the destination repository
+type bitbucketCloudPullRequestPayload struct {
+	Actor       bitbucketActor `json:"actor"`
+	PullRequest struct {
+		ID          int                  `json:"id"`
+		Source      bitbucketCloudBranch `json:"source"`
+		Destination bitbucketCloudBranch `json:"destination"`
+	} `json:"pullrequest"`
+}
+
+// bitbucketServerRepository is a repository in Bitbucket Server webhooks
+type bitbucketServerRepository struct {
+	Slug    string `json:"slug"`
+	Project struct {
+		Key string `json:"key"`
+	} `json:"project"`
+	Links struct {
+		Self []struct {
+			Href string `json:"href"`
+		} `json:"self"`
+	} `json:"links"`
+}
+
+func (r bitbucketServerRepository) webURL() string {
+	if len(r.Links.Self) == 0 {
+		return ""
+	}
+	return r.Links.Self[0].Href
+}
+
+// bitbucketServerPushPayload is the part of the Bitbucket Server repo:refs_changed event used to build the pushed commit
+type bitbucketServerPushPayload struct {
+	Actor      bitbucketActor            `json:"actor"`
+	Repository bitbucketServerRepository `json:"repository"`
+	Changes    []struct {
+		Ref struct {
+			ID string `json:"id"`
+		} `json:"ref"`
+		ToHash string `json:"toHash"`
+		Type   string `json:"type"`
+	} `json:"changes"`
+}
+
+// bitbucketServerRef is the source or target of a Bitbucket Server pull request
+type bitbucketServerRef struct {
+	DisplayID    string                    `json:"displayId"`
+	LatestCommit string                    `json:"latestCommit"`
+	Repository   bitbucketServerRepository `json:"repository"`
+}
+
+// bitbucketServerPullRequestPayload is the part of the Bitbucket Server pr events used to build the source branch
+// in the target repository
+type bitbucketServerPullRequestPayload struct {
+	Actor       bitbucketActor `json:"actor"`
+	PullRequest struct {
+		ID      int                `json:"id"`
+		FromRef bitbucketServerRef `json:"fromRef"`
+		ToRef   bitbucketServerRef `json:"toRef"`
+	} `json:"pullRequest"`
+}
+
+// bitbucketBuild returns the build the Bitbucket Cloud or Bitbucket Server event with body asks for, or nil if
+// nothing should be built. Of a push changing several branches the first one that wasn't deleted is built.
+func bitbucketBuild(event string, body []byte) (*model.Build, *model.Repo, error) {
+	switch event {
+	case "repo:push":
+		var pl bitbucketCloudPushPayload
+		if err := json.Unmarshal(body, &pl); err != nil {
+			return nil, nil, err
+		}
+		for _, change := range pl.Push.Changes {
+			if change.New == nil {
+				continue
+			}
+			ref := "refs/heads/" + change.New.Name
+			if change.New.Type == "tag" {
+				ref = "refs/tags/" + change.New.Name
+			}
+			org, name := splitPath(pl.Repository.FullName)
+			return newBuild(org, name, change.New.Target.Hash, ref, pl.Actor.login(), pushEvent(ref)), &model.Repo{URL: pl.Repository.Links.HTML.Href}, nil
+		}
+	case "pullrequest:created", "pullrequest:updated":
+		var pl bitbucketCloudPullRequestPayload
+		if err := json.Unmarshal(body, &pl); err != nil {
+			return nil, nil, err
+		}
+		source, destination := pl.PullRequest.Source, pl.PullRequest.Destination
+		org, name := splitPath(destination.Repository.FullName)
+		build := newBuild(org, name, source.Commit.Hash, source.Branch.Name, pl.Actor.login(), "pull_request")
+		build.PullRequest = pl.PullRequest.ID
+		build.BaseRef = destination.Branch.Name
+		build.Fork = !strings.EqualFold(source.Repository.FullName, destination.Repository.FullName)
+		return build, &model.Repo{URL: destination.Repository.Links.HTML.Href}, nil
+	case "repo:refs_changed":
+		var pl bitbucketServerPushPayload
+		if err := json.Unmarshal(body, &pl); err != nil {
+			return nil, nil, err
+		}
+		for _, change := range pl.Changes {
+			if change.Type == "DELETE" {
+				continue
+			}
+			r := pl.Repository
+			return newBuild(r.Project.Key, r.Slug, change.ToHash, change.Ref.ID, pl.Actor.login(), pushEvent(change.Ref.ID)), &model.Repo{URL: r.webURL()}, nil
+		}
+	case "pr:opened", "pr:from_ref_updated":
+		var pl bitbucketServerPullRequestPayload
+		if err := json.Unmarshal(body, &pl); err != nil {
+			return nil, nil, err
+		}
+		from, to := pl.PullRequest.FromRef, pl.PullRequest.ToRef
+		r := to.Repository
+		build := newBuild(r.Project.Key, r.Slug, from.LatestCommit, from.DisplayID, pl.Actor.login(), "pull_request")
+		build.PullRequest = pl.PullRequest.ID
+		build.BaseRef = to.DisplayID
+		build.Fork = !strings.EqualFold(from.Repository.Project.Key, r.Project.Key) || !strings.EqualFold(from.Repository.Slug, r.Slug)
+		return build, &model.Repo{URL: r.webURL()}, nil
+	}
+	return nil, nil, nil
+}
+
+// bitbucketSource receives the webhooks of bitbucket, both Bitbucket Cloud and Bitbucket Server
+// sign them with HMAC-SHA256 in X-Hub-Signature
+func bitbucketSource(bitbucket *scm.Bitbucket) webhookSource {
+	return webhookSource{
+		provider: bitbucket,
+		event:    func(h http.Header) string { return h.Get("X-Event-Key") },
+		verify: func(h http.Header, body []byte) bool {
+			signature := h.Get("X-Hub-Signature")
+			return bitbucket.Secret != "" && strings.HasPrefix(signature, "sha256=") && validHMAC(sha256.New, bitbucket.Secret, body, signature[7:])
+		},
+		parse: bitbucketBuild,
+	}
+}
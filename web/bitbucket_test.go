@@ -0,0 +1,94 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/storage/memory"
+)
+
+const bitbucketCloudPushEvent = `{
+  "actor": {"nickname": "jane"},
+  "repository": {"full_name": "workspace/repo", "links": {"html": {"href": "https://bitbucket.org/workspace/repo"}}},
+  "push": {"changes": [{"new": null}, {"new": {"type": "tag", "name": "v1.0", "target": {"hash": "abc"}}}]}
+}`
+
+const bitbucketServerPullRequestEvent = `{
+  "actor": {"name": "jane"},
+  "pullRequest": {"id": 3,
+    "fromRef": {"displayId": "feature", "latestCommit": "def",
+      "repository": {"slug": "repo", "project": {"key": "~JANE"}, "links": {"self": [{"href": "https://bitbucket.example.com/users/jane/repos/repo/browse"}]}}},
+    "toRef": {"displayId": "master", "latestCommit": "abc",
+      "repository": {"slug": "repo", "project": {"key": "PROJ"}, "links": {"self": [{"href": "https://bitbucket.example.com/projects/PROJ/repos/repo/browse"}]}}}}
+}`
+
+func TestBitbucketBuild(t *testing.T) {
+	build, repo, err := bitbucketBuild("repo:push", []byte(bitbucketCloudPushEvent))
+	assert.NoError(t, err)
+	assert.Equal(t, "workspace", build.Org)
+	assert.Equal(t, "repo", build.Name)
+	assert.Equal(t, "abc", build.Commit)
+	assert.Equal(t, "refs/tags/v1.0", build.Ref)
+	assert.Equal(t, []string{"jane"}, build.Committers)
+	assert.Equal(t, "https://bitbucket.org/workspace/repo", repo.URL)
+
+	build, repo, err = bitbucketBuild("pr:opened", []byte(bitbucketServerPullRequestEvent))
+	assert.NoError(t, err)
+	assert.Equal(t, "PROJ", build.Org, "built in the target repository")
+	assert.Equal(t, "def", build.Commit)
+	assert.Equal(t, "feature", build.Ref)
+	assert.Equal(t, 3, build.PullRequest)
+	assert.Equal(t, "master", build.BaseRef)
+	assert.True(t, build.Fork)
+	assert.Equal(t, "https://bitbucket.example.com/projects/PROJ/repos/repo/browse", repo.URL)
+
+	build, repo, err = bitbucketBuild("pullrequest:created", []byte(`{"actor": {"nickname": "jane"}, "pullrequest": {"id": 4,
+	  "source": {"branch": {"name": "feature"}, "commit": {"hash": "def"}, "repository": {"full_name": "workspace/repo"}},
+	  "destination": {"branch": {"name": "main"}, "repository": {"full_name": "workspace/repo", "links": {"html": {"href": "https://bitbucket.org/workspace/repo"}}}}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "workspace", build.Org)
+	assert.Equal(t, 4, build.PullRequest)
+	assert.Equal(t, "main", build.BaseRef)
+	assert.False(t, build.Fork)
+	assert.Equal(t, "https://bitbucket.org/workspace/repo", repo.URL)
+
+	build, _, err = bitbucketBuild("repo:refs_changed", []byte(`{"changes": [{"ref": {"id": "refs/heads/old"}, "type": "DELETE"}]}`))
+	assert.NoError(t, err)
+	assert.Nil(t, build)
+	build, _, err = bitbucketBuild("pr:comment:added", []byte(`{}`))
+	assert.NoError(t, err)
+	assert.Nil(t, build)
+}
+
+func TestBitbucketWebhookSignature(t *testing.T) {
+	bitbucket, err := scm.NewBitbucket(scm.BitbucketCloud, "token", "", "secret", "", 0)
+	assert.NoError(t, err)
+	h := handleProviderWebhook(memory.New(), nil, bitbucketSource(bitbucket), "", "", "")
+
+	body := `{"push": {"changes": []}}`
+	mac := hmac.New(sha256.New, []byte("wrong"))
+	mac.Write([]byte(body))
+	req := httptest.NewRequest(echo.POST, "/webhook/bitbucket", strings.NewReader(body))
+	req.Header.Set("X-Event-Key", "repo:push")
+	req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	mac = hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	req = httptest.NewRequest(echo.POST, "/webhook/bitbucket", strings.NewReader(body))
+	req.Header.Set("X-Event-Key", "repo:push")
+	req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
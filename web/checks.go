@@ -0,0 +1,168 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/builder"
+	"gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/logging"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/storage"
+	"gitlab.com/sorenmat/seneferu/tracing"
+	"k8s.io/client-go/kubernetes"
+)
+
+// checkRunPayload is the part of the GitHub check_run event used to build a commit again,
+// the event isn't known by the webhooks package
+type checkRunPayload struct {
+	Action   string `json:"action"`
+	CheckRun struct {
+		HeadSHA    string `json:"head_sha"`
+		ExternalID string `json:"external_id"`
+		CheckSuite struct {
+			HeadBranch string `json:"head_branch"`
+		} `json:"check_suite"`
+	} `json:"check_run"`
+	RequestedAction struct {
+		Identifier string `json:"identifier"`
+	} `json:"requested_action"`
+	Repository struct {
+		Name  string `json:"name"`
+		Owner struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+		TreesURL    string `json:"trees_url"`
+		StatusesURL string `json:"statuses_url"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+}
+
+// rerun returns true if the event asks for the commit to be built again,
+// either with Re-run on GitHub or with the action added to the check runs
+func (pl *checkRunPayload) rerun() bool {
+	return pl.Action == "rerequested" || (pl.Action == "requested_action" && pl.RequestedAction.Identifier == github.RerunAction)
+}
+
+// validSignature checks the X-Hub-Signature header GitHub signs webhooks with, nothing is valid without a secret
+func validSignature(secret string, body []byte, signature string) bool {
+	if secret == "" || !strings.HasPrefix(signature, "sha1=") {
+		return false
+	}
+	return validHMAC(sha1.New, secret, body, signature[5:])
+}
+
+// validHMAC checks signature is the hex encoded HMAC of body with secret
+func validHMAC(h func() hash.Hash, secret string, body []byte, signature string) bool {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil))))
+}
+
+// readWebhook reads the body of a webhook the webhooks package doesn't handle, ok is false if it isn't signed with secret
+func readWebhook(c echo.Context, secret string) (body []byte, ok bool, err error) {
+	body, err = ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return body, validSignature(secret, body, c.Request().Header.Get("X-Hub-Signature")), nil
+}
+
+// rerunBuild creates a new build of the commit a check run event is about. The check run must be of a build of the
+// repository of the event, its ref, pull request and changed files are built again. Pull requests from forks are
+// only built again when forks are built.
+func rerunBuild(service storage.Service, pl *checkRunPayload) (*model.Build, error) {
+	org, name, number, err := builder.ParseCheckRunExternalID(pl.CheckRun.ExternalID)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(org, pl.Repository.Owner.Login) || !strings.EqualFold(name, pl.Repository.Name) {
+		return nil, fmt.Errorf("check run %v isn't of repository %v/%v", pl.CheckRun.ExternalID, pl.Repository.Owner.Login, pl.Repository.Name)
+	}
+	previous, err := service.LoadBuild(org, name, number)
+	if err == nil && previous == nil {
+		err = errors.New("no such build")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to load the build of check run %v", pl.CheckRun.ExternalID)
+	}
+	if previous.Fork && !BuildForks {
+		return nil, fmt.Errorf("build %v is of a pull request from a fork", number)
+	}
+	ref := previous.Ref
+	if ref == "" {
+		// builds from before the ref was stored
+		ref = "refs/heads/" + pl.CheckRun.CheckSuite.HeadBranch
+	}
+	return &model.Build{
+		Org:          previous.Org,
+		Name:         previous.Name,
+		Commit:       pl.CheckRun.HeadSHA,
+		Ref:          ref,
+		Committers:   []string{pl.Sender.Login},
+		Status:       "Created",
+		Timestamp:    time.Now(),
+		TreesURL:     pl.Repository.TreesURL,
+		StatusURL:    pl.Repository.StatusesURL,
+		Event:        "manual",
+		PullRequest:  previous.PullRequest,
+		BaseRef:      previous.BaseRef,
+		Fork:         previous.Fork,
+		ChangedFiles: previous.ChangedFiles,
+	}, nil
+}
+
+// handleCheckRun builds a commit again when it's asked for on one of the check runs seneferu reported
+func handleCheckRun(service storage.Service, kubectl *kubernetes.Clientset, secret string, provider scm.Provider, targetURL string, dockerRegHost string, sshkey string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body, ok, err := readWebhook(c, secret)
+		if err != nil {
+			return errors.Wrap(err, "unable to read check_run event")
+		}
+		if !ok {
+			return c.String(http.StatusForbidden, "invalid signature")
+		}
+		var pl checkRunPayload
+		if err := json.Unmarshal(body, &pl); err != nil {
+			return c.String(http.StatusBadRequest, "unable to parse check_run event")
+		}
+		if !pl.rerun() {
+			return c.NoContent(http.StatusNoContent)
+		}
+
+		build, err := rerunBuild(service, &pl)
+		if err != nil {
+			slog.Warn("not building again", "check_run", pl.CheckRun.ExternalID, "requested_by", pl.Sender.Login, "error", err)
+			return c.String(http.StatusUnprocessableEntity, err.Error())
+		}
+		logger := logging.Build(build)
+		logger.Info("building again", "requested_by", pl.Sender.Login, "check_run", pl.CheckRun.ExternalID)
+		repo, err := service.LoadByOrgAndName(build.Org, build.Name)
+		if err != nil {
+			return errors.Wrap(err, "unable to load repository")
+		}
+		go func() {
+			span := tracing.Start("webhook check_run", logging.OrgKey, build.Org, logging.RepoKey, build.Name, "action", pl.Action)
+			defer span.End()
+			if err := builder.ExecuteBuild(span, kubectl, service, build, repo, provider, targetURL, dockerRegHost, sshkey); err != nil {
+				span.SetError(err)
+				logger.Error("build failure", "error", err)
+			}
+		}()
+		return c.NoContent(http.StatusAccepted)
+	}
+}
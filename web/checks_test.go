@@ -0,0 +1,137 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	ghapi "gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/storage"
+	"gitlab.com/sorenmat/seneferu/storage/memory"
+)
+
+const checkRunEvent = `{
+  "action": "requested_action",
+  "check_run": {"head_sha": "abc", "external_id": "org/repo/4", "check_suite": {"head_branch": "feature"}},
+  "requested_action": {"identifier": "rerun"},
+  "repository": {"name": "repo", "owner": {"login": "org"},
+    "trees_url": "https://api.github.com/repos/org/repo/git/trees{/sha}",
+    "statuses_url": "https://api.github.com/repos/org/repo/statuses/{sha}"},
+  "sender": {"login": "reviewer"}
+}`
+
+func sign(secret string, body string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidSignature(t *testing.T) {
+	assert.True(t, validSignature("secret", []byte(checkRunEvent), sign("secret", checkRunEvent)))
+	assert.False(t, validSignature("secret", []byte(checkRunEvent), sign("other", checkRunEvent)))
+	assert.False(t, validSignature("secret", []byte(checkRunEvent), ""))
+	assert.False(t, validSignature("", []byte(checkRunEvent), ""), "unsigned events are rejected without a secret")
+	assert.False(t, validSignature("", []byte(checkRunEvent), sign("", checkRunEvent)))
+}
+
+// buildStore loads one build, the memory storage doesn't keep builds
+type buildStore struct {
+	storage.Service
+	build *model.Build
+}
+
+func (s *buildStore) LoadBuild(org string, name string, number int) (*model.Build, error) {
+	if s.build.Org == org && s.build.Name == name && s.build.Number == number {
+		return s.build, nil
+	}
+	return nil, errors.New("no such build")
+}
+
+func TestRerunBuild(t *testing.T) {
+	db := &buildStore{Service: memory.New(), build: &model.Build{Org: "org", Name: "repo", Number: 4, Ref: "feature-branch"}}
+
+	pl := &checkRunPayload{}
+	pl.Repository.Name = "repo"
+	pl.Repository.Owner.Login = "org"
+	pl.CheckRun.HeadSHA = "abc"
+	pl.CheckRun.ExternalID = "org/repo/4"
+	pl.CheckRun.CheckSuite.HeadBranch = "feature"
+	pl.Sender.Login = "reviewer"
+
+	build, err := rerunBuild(db, pl)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", build.Commit)
+	assert.Equal(t, "feature-branch", build.Ref)
+	assert.Equal(t, []string{"reviewer"}, build.Committers)
+	assert.Equal(t, "Created", build.Status)
+	assert.Equal(t, "manual", build.Event)
+
+	db.build.Ref = ""
+	build, err = rerunBuild(db, pl)
+	assert.NoError(t, err)
+	assert.Equal(t, "refs/heads/feature", build.Ref, "builds from before the ref was stored")
+
+	pl.CheckRun.ExternalID = "org/repo/5"
+	_, err = rerunBuild(db, pl)
+	assert.Error(t, err, "unknown builds aren't built again")
+	pl.CheckRun.ExternalID = ""
+	_, err = rerunBuild(db, pl)
+	assert.Error(t, err)
+	pl.CheckRun.ExternalID = "other/repo/4"
+	_, err = rerunBuild(db, pl)
+	assert.Error(t, err, "the check run must be of the repository of the event")
+}
+
+func TestRerunPullRequestBuild(t *testing.T) {
+	previous := &model.Build{Org: "org", Name: "repo", Number: 4, Ref: "feature", PullRequest: 7, BaseRef: "master", ChangedFiles: []string{"go.mod"}}
+	db := &buildStore{Service: memory.New(), build: previous}
+	pl := &checkRunPayload{}
+	pl.Repository.Name = "repo"
+	pl.Repository.Owner.Login = "org"
+	pl.CheckRun.HeadSHA = "abc"
+	pl.CheckRun.ExternalID = "org/repo/4"
+
+	build, err := rerunBuild(db, pl)
+	assert.NoError(t, err)
+	assert.Equal(t, "feature", build.Ref)
+	assert.Equal(t, 7, build.PullRequest)
+	assert.Equal(t, "master", build.BaseRef)
+	assert.Equal(t, []string{"go.mod"}, build.ChangedFiles)
+	assert.False(t, build.Fork)
+
+	previous.Fork = true
+	_, err = rerunBuild(db, pl)
+	assert.Error(t, err, "forks aren't built")
+	defer func() { BuildForks = false }()
+	BuildForks = true
+	build, err = rerunBuild(db, pl)
+	assert.NoError(t, err)
+	assert.True(t, build.Fork)
+}
+
+func TestCheckRunEventIgnoresOtherActions(t *testing.T) {
+	h := handleCheckRun(memory.New(), nil, "secret", scm.NewGitHub(ghapi.StaticToken("")), "", "", "")
+	e := echo.New()
+
+	body := strings.Replace(checkRunEvent, "requested_action", "created", 1)
+	req := httptest.NewRequest(echo.POST, "/webhook", strings.NewReader(body))
+	req.Header.Set("X-Hub-Signature", sign("secret", body))
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	req = httptest.NewRequest(echo.POST, "/webhook", strings.NewReader(checkRunEvent))
+	req.Header.Set("X-Hub-Signature", sign("wrong", checkRunEvent))
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
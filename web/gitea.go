@@ -0,0 +1,104 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/scm"
+)
+
+// giteaRepository is a repository in Gitea webhooks
+type giteaRepository struct {
+	FullName      string `json:"full_name"`
+	HTMLURL       string `json:"html_url"`
+	DefaultBranch string `json:"default_branch"`
+}
+
+// giteaUser is a user in Gitea webhooks
+type giteaUser struct {
+	Login string `json:"login"`
+}
+
+// giteaPushPayload is the part of the Gitea push event used to build the pushed commit
+type giteaPushPayload struct {
+	Ref        string          `json:"ref"`
+	Before     string          `json:"before"`
+	After      string          `json:"after"`
+	Repository giteaRepository `json:"repository"`
+	Pusher     giteaUser       `json:"pusher"`
+	// Commits are the last commits of the push, TotalCommits is the number of commits pushed
+	Commits      []pushCommit `json:"commits"`
+	TotalCommits int          `json:"total_commits"`
+}
+
+// giteaBranch is the head or base of a Gitea pull request
+type giteaBranch struct {
+	Ref  string          `json:"ref"`
+	Sha  string          `json:"sha"`
+	Repo giteaRepository `json:"repo"`
+}
+
+// giteaPullRequestPayload is the part of the Gitea pull_request event used to build the head branch in the base repository
+type giteaPullRequestPayload struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		Head giteaBranch `json:"head"`
+		Base giteaBranch `json:"base"`
+	} `json:"pull_request"`
+	Sender giteaUser `json:"sender"`
+}
+
+// giteaBuild returns the build the Gitea or Forgejo event with body asks for, or nil if nothing should be built.
+// Pushes deleting a branch aren't built, and neither are pull requests that weren't opened or given new commits.
+func giteaBuild(event string, body []byte) (*model.Build, *model.Repo, error) {
+	switch event {
+	case "push":
+		var pl giteaPushPayload
+		if err := json.Unmarshal(body, &pl); err != nil {
+			return nil, nil, err
+		}
+		if pl.After == deletedSHA || pl.After == "" {
+			return nil, nil, nil
+		}
+		org, name := splitPath(pl.Repository.FullName)
+		build := newBuild(org, name, pl.After, pl.Ref, pl.Pusher.Login, pushEvent(pl.Ref))
+		// the changes of new branches and of pushes with more commits than listed aren't known
+		if pl.Before != deletedSHA && pl.TotalCommits <= len(pl.Commits) {
+			build.ChangedFiles = changedFiles(pl.Commits)
+		}
+		return build, &model.Repo{URL: pl.Repository.HTMLURL, DefaultBranch: pl.Repository.DefaultBranch}, nil
+	case "pull_request":
+		var pl giteaPullRequestPayload
+		if err := json.Unmarshal(body, &pl); err != nil {
+			return nil, nil, err
+		}
+		if pl.Action != "opened" && pl.Action != "reopened" && pl.Action != "synchronized" {
+			return nil, nil, nil
+		}
+		head, base := pl.PullRequest.Head, pl.PullRequest.Base
+		org, name := splitPath(base.Repo.FullName)
+		build := newBuild(org, name, head.Sha, head.Ref, pl.Sender.Login, "pull_request")
+		build.PullRequest = pl.Number
+		build.BaseRef = base.Ref
+		build.Fork = !strings.EqualFold(head.Repo.FullName, base.Repo.FullName)
+		return build, &model.Repo{URL: base.Repo.HTMLURL, DefaultBranch: base.Repo.DefaultBranch}, nil
+	}
+	return nil, nil, nil
+}
+
+// giteaSource receives the webhooks of gitea, they are signed with HMAC-SHA256 in X-Gitea-Signature.
+// Forgejo sends the same headers as Gitea besides its own.
+func giteaSource(gitea *scm.Gitea) webhookSource {
+	return webhookSource{
+		provider: gitea,
+		event:    func(h http.Header) string { return h.Get("X-Gitea-Event") },
+		verify: func(h http.Header, body []byte) bool {
+			return gitea.Secret != "" && validHMAC(sha256.New, gitea.Secret, body, h.Get("X-Gitea-Signature"))
+		},
+		parse: giteaBuild,
+	}
+}
@@ -0,0 +1,73 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/storage/memory"
+)
+
+const giteaPullRequestEvent = `{
+  "action": "synchronized",
+  "number": 2,
+  "pull_request": {
+    "head": {"ref": "feature", "sha": "def", "repo": {"full_name": "jane/repo", "html_url": "https://gitea.example.com/jane/repo"}},
+    "base": {"ref": "main", "sha": "abc", "repo": {"full_name": "org/repo", "html_url": "https://gitea.example.com/org/repo", "default_branch": "main"}}
+  },
+  "sender": {"login": "jane"}
+}`
+
+func TestGiteaBuild(t *testing.T) {
+	build, repo, err := giteaBuild("pull_request", []byte(giteaPullRequestEvent))
+	assert.NoError(t, err)
+	assert.Equal(t, "org", build.Org, "built in the base repository")
+	assert.Equal(t, "repo", build.Name)
+	assert.Equal(t, "def", build.Commit)
+	assert.Equal(t, "feature", build.Ref)
+	assert.Equal(t, 2, build.PullRequest)
+	assert.Equal(t, "main", build.BaseRef)
+	assert.True(t, build.Fork)
+	assert.Equal(t, "https://gitea.example.com/org/repo", repo.URL)
+	assert.Equal(t, "main", repo.DefaultBranch)
+
+	build, _, err = giteaBuild("pull_request", []byte(strings.Replace(giteaPullRequestEvent, "synchronized", "label_updated", 1)))
+	assert.NoError(t, err)
+	assert.Nil(t, build)
+
+	build, _, err = giteaBuild("push", []byte(`{"ref": "refs/heads/master", "after": "abc", "repository": {"full_name": "org/repo"}, "pusher": {"login": "jane"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", build.Commit)
+	assert.Equal(t, "refs/heads/master", build.Ref)
+	build, _, err = giteaBuild("push", []byte(`{"ref": "refs/heads/old", "after": "`+deletedSHA+`"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, build)
+}
+
+func TestGiteaWebhookSignature(t *testing.T) {
+	gitea, err := scm.NewGitea("https://gitea.example.com", "token", "secret", "", 0)
+	assert.NoError(t, err)
+	source := giteaSource(gitea)
+
+	body := []byte(giteaPullRequestEvent)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	h := http.Header{}
+	h.Set("X-Gitea-Signature", hex.EncodeToString(mac.Sum(nil)))
+	assert.True(t, source.verify(h, body))
+	assert.False(t, source.verify(h, append(body, ' ')))
+	assert.False(t, source.verify(http.Header{}, body))
+
+	req := httptest.NewRequest(echo.POST, "/webhook/gitea", strings.NewReader(giteaPullRequestEvent))
+	req.Header.Set("X-Gitea-Event", "pull_request")
+	rec := httptest.NewRecorder()
+	assert.NoError(t, handleProviderWebhook(memory.New(), nil, source, "", "", "")(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
@@ -0,0 +1,101 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/scm"
+)
+
+// gitlabProject is a project in GitLab webhooks
+type gitlabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	WebURL            string `json:"web_url"`
+	DefaultBranch     string `json:"default_branch"`
+}
+
+// gitlabPushPayload is the part of the GitLab push hook used to build the pushed commit
+type gitlabPushPayload struct {
+	Ref          string        `json:"ref"`
+	Before       string        `json:"before"`
+	After        string        `json:"after"`
+	CheckoutSHA  string        `json:"checkout_sha"`
+	UserUsername string        `json:"user_username"`
+	Project      gitlabProject `json:"project"`
+	// Commits are the last 20 commits of the push, TotalCommitsCount is the number of commits pushed
+	Commits           []pushCommit `json:"commits"`
+	TotalCommitsCount int          `json:"total_commits_count"`
+}
+
+// gitlabMergeRequestPayload is the part of the GitLab merge request hook used to build the source branch in the target project
+type gitlabMergeRequestPayload struct {
+	User struct {
+		Username string `json:"username"`
+	} `json:"user"`
+	ObjectAttributes struct {
+		IID          int    `json:"iid"`
+		Action       string `json:"action"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+		// OldRev is only set on updates pushing new commits
+		OldRev     string        `json:"oldrev"`
+		Source     gitlabProject `json:"source"`
+		Target     gitlabProject `json:"target"`
+		LastCommit struct {
+			ID string `json:"id"`
+		} `json:"last_commit"`
+	} `json:"object_attributes"`
+}
+
+// gitlabBuild returns the build the GitLab webhook event with body asks for, or nil if nothing should be built.
+// Pushes deleting a branch aren't built, and neither are merge requests that weren't opened or given new commits.
+func gitlabBuild(event string, body []byte) (*model.Build, *model.Repo, error) {
+	switch event {
+	case "Push Hook":
+		var pl gitlabPushPayload
+		if err := json.Unmarshal(body, &pl); err != nil {
+			return nil, nil, err
+		}
+		if pl.After == deletedSHA || pl.CheckoutSHA == "" {
+			return nil, nil, nil
+		}
+		org, name := splitPath(pl.Project.PathWithNamespace)
+		build := newBuild(org, name, pl.CheckoutSHA, pl.Ref, pl.UserUsername, pushEvent(pl.Ref))
+		// the changes of new branches and of pushes with more commits than listed aren't known
+		if pl.Before != deletedSHA && pl.TotalCommitsCount <= len(pl.Commits) {
+			build.ChangedFiles = changedFiles(pl.Commits)
+		}
+		return build, &model.Repo{URL: pl.Project.WebURL, DefaultBranch: pl.Project.DefaultBranch}, nil
+	case "Merge Request Hook":
+		var pl gitlabMergeRequestPayload
+		if err := json.Unmarshal(body, &pl); err != nil {
+			return nil, nil, err
+		}
+		attrs := pl.ObjectAttributes
+		if attrs.Action != "open" && attrs.Action != "reopen" && (attrs.Action != "update" || attrs.OldRev == "") {
+			return nil, nil, nil
+		}
+		org, name := splitPath(attrs.Target.PathWithNamespace)
+		build := newBuild(org, name, attrs.LastCommit.ID, attrs.SourceBranch, pl.User.Username, "pull_request")
+		build.PullRequest = attrs.IID
+		build.BaseRef = attrs.TargetBranch
+		build.Fork = !strings.EqualFold(attrs.Source.PathWithNamespace, attrs.Target.PathWithNamespace)
+		return build, &model.Repo{URL: attrs.Target.WebURL, DefaultBranch: attrs.Target.DefaultBranch}, nil
+	}
+	return nil, nil, nil
+}
+
+// gitlabSource receives the webhooks of gitlab, they carry the secret token in X-Gitlab-Token
+func gitlabSource(gitlab *scm.GitLab) webhookSource {
+	return webhookSource{
+		provider: gitlab,
+		event:    func(h http.Header) string { return h.Get("X-Gitlab-Event") },
+		verify: func(h http.Header, body []byte) bool {
+			return gitlab.Secret != "" && subtle.ConstantTimeCompare([]byte(h.Get("X-Gitlab-Token")), []byte(gitlab.Secret)) == 1
+		},
+		parse: gitlabBuild,
+	}
+}
@@ -0,0 +1,139 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/storage/memory"
+)
+
+const gitlabPushEvent = `{
+  "object_kind": "push",
+  "ref": "refs/heads/master",
+  "before": "123",
+  "after": "abc",
+  "checkout_sha": "abc",
+  "user_username": "jane",
+  "project": {"path_with_namespace": "group/sub/repo", "web_url": "https://gitlab.example.com/group/sub/repo"},
+  "commits": [
+    {"added": ["services/api/new.go"], "modified": ["go.mod"], "removed": []},
+    {"added": [], "modified": ["go.mod", "docs/index.md"], "removed": ["services/api/old.go"]}
+  ],
+  "total_commits_count": 2
+}`
+
+const gitlabMergeRequestEvent = `{
+  "object_kind": "merge_request",
+  "user": {"username": "jane"},
+  "object_attributes": {
+    "iid": 3,
+    "action": "open",
+    "source_branch": "feature",
+    "target_branch": "master",
+    "source": {"path_with_namespace": "jane/repo", "web_url": "https://gitlab.example.com/jane/repo"},
+    "target": {"path_with_namespace": "group/repo", "web_url": "https://gitlab.example.com/group/repo", "default_branch": "main"},
+    "last_commit": {"id": "def"}
+  }
+}`
+
+func TestGitLabPushBuild(t *testing.T) {
+	build, repo, err := gitlabBuild("Push Hook", []byte(gitlabPushEvent))
+	assert.NoError(t, err)
+	assert.Equal(t, "group/sub", build.Org)
+	assert.Equal(t, "repo", build.Name)
+	assert.Equal(t, "abc", build.Commit)
+	assert.Equal(t, "refs/heads/master", build.Ref)
+	assert.Equal(t, []string{"jane"}, build.Committers)
+	assert.Equal(t, "https://gitlab.example.com/group/sub/repo", repo.URL)
+	assert.Equal(t, []string{"services/api/new.go", "go.mod", "docs/index.md", "services/api/old.go"}, build.ChangedFiles)
+
+	truncated := strings.Replace(gitlabPushEvent, `"total_commits_count": 2`, `"total_commits_count": 25`, 1)
+	build, _, err = gitlabBuild("Push Hook", []byte(truncated))
+	assert.NoError(t, err)
+	assert.Nil(t, build.ChangedFiles)
+
+	deleted := strings.Replace(strings.Replace(gitlabPushEvent, `"abc"`, `"`+deletedSHA+`"`, 1), `"checkout_sha": "abc"`, `"checkout_sha": null`, 1)
+	build, _, err = gitlabBuild("Push Hook", []byte(deleted))
+	assert.NoError(t, err)
+	assert.Nil(t, build)
+}
+
+func TestGitLabMergeRequestBuild(t *testing.T) {
+	build, repo, err := gitlabBuild("Merge Request Hook", []byte(gitlabMergeRequestEvent))
+	assert.NoError(t, err)
+	assert.Equal(t, "group", build.Org, "built in the target project")
+	assert.Equal(t, "def", build.Commit)
+	assert.Equal(t, "feature", build.Ref)
+	assert.Equal(t, 3, build.PullRequest)
+	assert.Equal(t, "master", build.BaseRef)
+	assert.True(t, build.Fork)
+	assert.Equal(t, "https://gitlab.example.com/group/repo", repo.URL)
+	assert.Equal(t, "main", repo.DefaultBranch)
+
+	build, _, err = gitlabBuild("Merge Request Hook", []byte(strings.Replace(gitlabMergeRequestEvent, `"jane/repo"`, `"group/repo"`, 1)))
+	assert.NoError(t, err)
+	assert.False(t, build.Fork)
+
+	// updates without new commits, like a changed title, aren't built
+	update := strings.Replace(gitlabMergeRequestEvent, `"open"`, `"update"`, 1)
+	build, _, err = gitlabBuild("Merge Request Hook", []byte(update))
+	assert.NoError(t, err)
+	assert.Nil(t, build)
+	build, _, err = gitlabBuild("Merge Request Hook", []byte(strings.Replace(update, `"iid": 3,`, `"iid": 3, "oldrev": "abc",`, 1)))
+	assert.NoError(t, err)
+	assert.NotNil(t, build)
+
+	build, _, err = gitlabBuild("Merge Request Hook", []byte(strings.Replace(gitlabMergeRequestEvent, `"open"`, `"merge"`, 1)))
+	assert.NoError(t, err)
+	assert.Nil(t, build)
+}
+
+func TestGitLabWebhookChecksToken(t *testing.T) {
+	gitlab, err := scm.NewGitLab("https://gitlab.example.com", "token", "secret", "", 0)
+	assert.NoError(t, err)
+	h := handleProviderWebhook(memory.New(), nil, gitlabSource(gitlab), "", "", "")
+
+	req := httptest.NewRequest(echo.POST, "/webhook/gitlab", strings.NewReader(gitlabPushEvent))
+	req.Header.Set("X-Gitlab-Event", "Push Hook")
+	req.Header.Set("X-Gitlab-Token", "wrong")
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	gitlab.Secret = ""
+	req = httptest.NewRequest(echo.POST, "/webhook/gitlab", strings.NewReader(gitlabPushEvent))
+	req.Header.Set("X-Gitlab-Event", "Push Hook")
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusForbidden, rec.Code, "an empty token doesn't match an empty secret")
+
+	gitlab.Secret = "secret"
+	req = httptest.NewRequest(echo.POST, "/webhook/gitlab", strings.NewReader(`{}`))
+	req.Header.Set("X-Gitlab-Event", "Tag Push Hook")
+	req.Header.Set("X-Gitlab-Token", "secret")
+	rec = httptest.NewRecorder()
+	assert.NoError(t, h(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
+
+func TestGitLabForksAreOnlyBuiltWhenEnabled(t *testing.T) {
+	gitlab, err := scm.NewGitLab("https://gitlab.example.com", "token", "secret", "", 0)
+	assert.NoError(t, err)
+	db := memory.New()
+	h := handleProviderWebhook(db, nil, gitlabSource(gitlab), "", "", "")
+
+	req := httptest.NewRequest(echo.POST, "/webhook/gitlab", strings.NewReader(gitlabMergeRequestEvent))
+	req.Header.Set("X-Gitlab-Event", "Merge Request Hook")
+	req.Header.Set("X-Gitlab-Token", "secret")
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	repos, err := db.All()
+	assert.NoError(t, err)
+	assert.Empty(t, repos)
+}
@@ -0,0 +1,106 @@
+package web
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	ghapi "gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/logging"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/storage"
+	"gopkg.in/go-playground/webhooks.v3"
+	"gopkg.in/go-playground/webhooks.v3/github"
+)
+
+// installationRepository is a repository in the installation events of a GitHub App
+type installationRepository struct {
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+}
+
+// installationRepositoriesPayload is the GitHub installation_repositories event,
+// it isn't known by the webhooks package
+type installationRepositoriesPayload struct {
+	Action       string `json:"action"`
+	Installation struct {
+		ID      int64 `json:"id"`
+		Account struct {
+			Login string `json:"login"`
+		} `json:"account"`
+	} `json:"installation"`
+	RepositoriesAdded []installationRepository `json:"repositories_added"`
+}
+
+// registerRepo saves the repository with full name org/name unless it's known already
+func registerRepo(service storage.Service, fullName string) error {
+	parts := strings.SplitN(fullName, "/", 2)
+	if len(parts) != 2 {
+		return errors.Errorf("%v isn't the full name of a repository", fullName)
+	}
+	if _, err := service.LoadByOrgAndName(parts[0], parts[1]); err == nil {
+		return nil
+	}
+	slog.Info("registering repository", logging.OrgKey, parts[0], logging.RepoKey, parts[1])
+	return service.SaveRepo(&model.Repo{Org: parts[0], Name: parts[1], URL: ghapi.DefaultHost.WebURL(parts[0], parts[1])})
+}
+
+// installed records the installation of the app and registers the repositories it was given access to
+func installed(service storage.Service, tokens ghapi.TokenSource, account string, id int64, repos []installationRepository) {
+	if app, ok := tokens.(*ghapi.App); ok {
+		app.SetInstallation(account, id)
+	}
+	for _, r := range repos {
+		if err := registerRepo(service, r.FullName); err != nil {
+			slog.Error("unable to register repository", "repository", r.FullName, "error", err)
+		}
+	}
+}
+
+// HandleInstallation registers the repositories of a new installation of the GitHub App,
+// and forgets the installations the app is removed from
+func HandleInstallation(service storage.Service, tokens ghapi.TokenSource) webhooks.ProcessPayloadFunc {
+	return func(payload interface{}, header webhooks.Header) {
+		pl := payload.(github.InstallationPayload)
+		slog.Info("handling installation", "account", pl.Installation.Account.Login, "installation", pl.Installation.ID, "action", pl.Action)
+		if pl.Action == "deleted" || pl.Action == "suspend" {
+			if app, ok := tokens.(*ghapi.App); ok {
+				app.RemoveInstallation(pl.Installation.ID)
+			}
+			return
+		}
+		if pl.Action != "created" {
+			return
+		}
+		repos := make([]installationRepository, 0, len(pl.Repositories))
+		for _, r := range pl.Repositories {
+			repos = append(repos, installationRepository{Name: r.Name, FullName: r.FullName})
+		}
+		installed(service, tokens, pl.Installation.Account.Login, pl.Installation.ID, repos)
+	}
+}
+
+// handleInstallationRepositories registers the repositories added to an installation of the GitHub App
+func handleInstallationRepositories(service storage.Service, secret string, tokens ghapi.TokenSource) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body, ok, err := readWebhook(c, secret)
+		if err != nil {
+			return errors.Wrap(err, "unable to read installation_repositories event")
+		}
+		if !ok {
+			return c.String(http.StatusForbidden, "invalid signature")
+		}
+		var pl installationRepositoriesPayload
+		if err := json.Unmarshal(body, &pl); err != nil {
+			return c.String(http.StatusBadRequest, "unable to parse installation_repositories event")
+		}
+		slog.Info("handling installation repositories", "account", pl.Installation.Account.Login, "installation", pl.Installation.ID, "action", pl.Action)
+		if pl.Action == "added" {
+			installed(service, tokens, pl.Installation.Account.Login, pl.Installation.ID, pl.RepositoriesAdded)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
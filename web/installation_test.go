@@ -0,0 +1,72 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	ghapi "gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/storage/memory"
+	"gopkg.in/go-playground/webhooks.v3/github"
+)
+
+const installationRepositoriesEvent = `{
+  "action": "added",
+  "installation": {"id": 7, "account": {"login": "org"}},
+  "repositories_added": [{"name": "repo", "full_name": "org/repo"}, {"name": "other", "full_name": "org/other"}]
+}`
+
+func TestInstallationRepositoriesRegistersRepos(t *testing.T) {
+	db := memory.New()
+	assert.NoError(t, registerRepo(db, "org/other"))
+
+	h := handleInstallationRepositories(db, "secret", ghapi.StaticToken(""))
+	req := httptest.NewRequest(echo.POST, "/webhook", strings.NewReader(installationRepositoriesEvent))
+	req.Header.Set("X-Hub-Signature", sign("secret", installationRepositoriesEvent))
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	repos, err := db.All()
+	assert.NoError(t, err)
+	assert.Len(t, repos, 2)
+	repo, err := db.LoadByOrgAndName("org", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://github.com/org/repo", repo.URL)
+}
+
+func TestDeletedInstallationIsForgotten(t *testing.T) {
+	var lookups int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/org/repo/installation" {
+			lookups++
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	app, err := ghapi.NewApp(1, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), server.URL)
+	assert.NoError(t, err)
+	app.SetInstallation("org", 7)
+
+	var pl github.InstallationPayload
+	assert.NoError(t, json.Unmarshal([]byte(`{"action": "deleted", "installation": {"id": 7, "account": {"login": "org"}}}`), &pl))
+	HandleInstallation(memory.New(), app)(pl, nil)
+
+	_, err = app.Token("org", "repo")
+	assert.Error(t, err)
+	assert.Equal(t, 1, lookups, "the installation should have been looked up again")
+}
+
+func TestRegisterRepoNeedsFullName(t *testing.T) {
+	assert.Error(t, registerRepo(memory.New(), "repo"))
+}
@@ -0,0 +1,149 @@
+package web
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"gitlab.com/sorenmat/seneferu/builder"
+	"gitlab.com/sorenmat/seneferu/logging"
+	"gitlab.com/sorenmat/seneferu/metrics"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/storage"
+	"gitlab.com/sorenmat/seneferu/tracing"
+	"k8s.io/client-go/kubernetes"
+)
+
+// deletedSHA is the commit a push deleting a branch points the branch at
+const deletedSHA = "0000000000000000000000000000000000000000"
+
+// Providers are the source code hosts besides GitHub builds are triggered from, the ones that are nil aren't used
+type Providers struct {
+	GitLab    *scm.GitLab
+	Bitbucket *scm.Bitbucket
+	Gitea     *scm.Gitea
+}
+
+// webhookSource turns the webhooks of a provider into builds
+type webhookSource struct {
+	provider scm.Provider
+	// event returns the name of the event in a request
+	event func(h http.Header) string
+	// verify checks a request with body was sent by the provider
+	verify func(h http.Header, body []byte) bool
+	// parse returns the build an event asks for and the URL and default branch of the repository as far as the
+	// event tells, the build is nil if nothing should be built
+	parse func(event string, body []byte) (*model.Build, *model.Repo, error)
+}
+
+// handleProviderWebhook builds what the webhooks of source ask for
+func handleProviderWebhook(service storage.Service, kubectl *kubernetes.Clientset, source webhookSource, targetURL string, dockerRegHost string, sshkey string) echo.HandlerFunc {
+	name := source.provider.Name()
+	return func(c echo.Context) error {
+		req := c.Request()
+		event := source.event(req.Header)
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return errors.Wrap(err, "unable to read "+name+" event")
+		}
+		if !source.verify(req.Header, body) {
+			metrics.WebhooksReceived.Inc(name + " unknown")
+			return c.String(http.StatusForbidden, "invalid signature")
+		}
+		// the event is only counted by name once it's verified, so unsigned requests can't add labels
+		metrics.WebhooksReceived.Inc(name + " " + event)
+		build, reported, err := source.parse(event, body)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "unable to parse "+name+" event")
+		}
+		if build == nil {
+			return c.NoContent(http.StatusNoContent)
+		}
+		if build.Fork && !BuildForks {
+			slog.Info("not building pull request from a fork", "provider", name, logging.OrgKey, build.Org, logging.RepoKey, build.Name, "number", build.PullRequest)
+			return c.NoContent(http.StatusNoContent)
+		}
+		build.Org = scm.QualifiedOrg(name, build.Org)
+
+		logger := slog.With(logging.OrgKey, build.Org, logging.RepoKey, build.Name)
+		logger.Info("handling "+name+" event", "event", event, "ref", build.Ref)
+		repo, err := service.LoadByOrgAndName(build.Org, build.Name)
+		if err != nil {
+			logger.Info("got an error, assuming we couldn't find the repository", "error", err)
+			repo = &model.Repo{Org: build.Org, Name: build.Name, URL: reported.URL, DefaultBranch: reported.DefaultBranch}
+			if err := service.SaveRepo(repo); err != nil {
+				logger.Error("unable to save repository", "error", err)
+			}
+		}
+		updateDefaultBranch(service, repo, reported.DefaultBranch)
+		go func() {
+			span := tracing.Start("webhook "+name, logging.OrgKey, build.Org, logging.RepoKey, build.Name, "event", event, "ref", build.Ref)
+			defer span.End()
+			if err := builder.ExecuteBuild(span, kubectl, service, build, repo, source.provider, targetURL, dockerRegHost, sshkey); err != nil {
+				span.SetError(err)
+				logging.Build(build).Error("build failure", "error", err)
+			}
+		}()
+		return c.NoContent(http.StatusAccepted)
+	}
+}
+
+// newBuild returns a build of commit on ref of repository org/name triggered by event
+func newBuild(org string, name string, commit string, ref string, committer string, event string) *model.Build {
+	return &model.Build{
+		Org:        org,
+		Name:       name,
+		Commit:     commit,
+		Ref:        ref,
+		Committers: []string{committer},
+		Status:     "Created",
+		Timestamp:  time.Now(),
+		Event:      event,
+	}
+}
+
+// pushEvent returns the event of a push to ref, pushing a tag is the tag event
+func pushEvent(ref string) string {
+	if strings.HasPrefix(ref, "refs/tags/") {
+		return "tag"
+	}
+	return "push"
+}
+
+// splitPath splits the path of a repository into the owner, which can contain subgroups on GitLab, and the name
+func splitPath(path string) (string, string) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
+// pushCommit is a commit in the push webhooks of GitHub, GitLab and Gitea, they list the files it changed
+type pushCommit struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+// changedFiles returns the paths changed by commits, each path once
+func changedFiles(commits []pushCommit) []string {
+	files := []string{}
+	seen := make(map[string]bool)
+	for _, c := range commits {
+		for _, list := range [][]string{c.Added, c.Modified, c.Removed} {
+			for _, f := range list {
+				if !seen[f] {
+					seen[f] = true
+					files = append(files, f)
+				}
+			}
+		}
+	}
+	return files
+}
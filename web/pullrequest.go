@@ -0,0 +1,28 @@
+package web
+
+import (
+	"strings"
+
+	"gopkg.in/go-playground/webhooks.v3/github"
+)
+
+// BuildForks builds pull requests from forks, on every provider. They run the build configuration of the fork,
+// without the secrets of the repository.
+var BuildForks = false
+
+// isFork returns true if the pull request of pl comes from another repository than the one it's opened against
+func isFork(pl *github.PullRequestPayload) bool {
+	return !strings.EqualFold(pl.PullRequest.Head.Repo.FullName, pl.Repository.FullName)
+}
+
+// buildsPullRequest returns true if the pull_request event pl asks for a build, when the pull request was opened
+// or got new commits, or when the skip label was removed from it
+func buildsPullRequest(pl *github.PullRequestPayload) bool {
+	switch pl.Action {
+	case "opened", "reopened", "synchronize":
+		return true
+	case "unlabeled":
+		return pl.PullRequest.State == "open" && SkipLabel != "" && strings.EqualFold(pl.Label.Name, SkipLabel)
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package web
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/go-playground/webhooks.v3/github"
+)
+
+func TestBuildsPullRequest(t *testing.T) {
+	var pl github.PullRequestPayload
+	pl.PullRequest.State = "open"
+	for action, builds := range map[string]bool{"opened": true, "reopened": true, "synchronize": true, "labeled": false, "closed": false, "edited": false, "unlabeled": false} {
+		pl.Action = action
+		assert.Equal(t, builds, buildsPullRequest(&pl), action)
+	}
+
+	// removing the skip label builds the pull request
+	pl.Action = "unlabeled"
+	pl.Label.Name = "skip-ci"
+	assert.True(t, buildsPullRequest(&pl))
+	pl.PullRequest.State = "closed"
+	assert.False(t, buildsPullRequest(&pl))
+}
+
+func TestIsFork(t *testing.T) {
+	var pl github.PullRequestPayload
+	pl.Repository.FullName = "org/repo"
+	pl.PullRequest.Head.Repo.FullName = "org/repo"
+	assert.False(t, isFork(&pl))
+	pl.PullRequest.Head.Repo.FullName = "someone/repo"
+	assert.True(t, isFork(&pl))
+}
@@ -0,0 +1,89 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/storage/memory"
+)
+
+func TestUpdateRepoConfigPath(t *testing.T) {
+	db := memory.New()
+	assert.NoError(t, registerRepo(db, "org/repo"))
+
+	e := echo.New()
+	req := httptest.NewRequest(echo.PUT, "/repo/org/repo", strings.NewReader(`{"configpath": "/ci/build.yaml"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("org", "id")
+	c.SetParamValues("org", "repo")
+	assert.NoError(t, handleUpdateRepo(db)(c))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	repo, err := db.LoadByOrgAndName("org", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci/build.yaml", repo.ConfigPath)
+	repos, err := db.All()
+	assert.NoError(t, err)
+	assert.Len(t, repos, 1)
+}
+
+func TestUpdateRepoDefaultBranch(t *testing.T) {
+	db := memory.New()
+	assert.NoError(t, db.SaveRepo(&model.Repo{Org: "org", Name: "repo", ConfigPath: "ci/build.yaml", DefaultBranch: "master"}))
+
+	e := echo.New()
+	req := httptest.NewRequest(echo.PUT, "/repo/org/repo", strings.NewReader(`{"defaultbranch": "refs/heads/main"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("org", "id")
+	c.SetParamValues("org", "repo")
+	assert.NoError(t, handleUpdateRepo(db)(c))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	repo, err := db.LoadByOrgAndName("org", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "main", repo.DefaultBranch)
+	// settings that aren't given are kept
+	assert.Equal(t, "ci/build.yaml", repo.ConfigPath)
+}
+
+func TestUpdateDefaultBranch(t *testing.T) {
+	db := memory.New()
+	repo := &model.Repo{Org: "org", Name: "repo", DefaultBranch: "master"}
+	assert.NoError(t, db.SaveRepo(repo))
+
+	updateDefaultBranch(db, repo, "")
+	updateDefaultBranch(db, repo, "main")
+	saved, err := db.LoadByOrgAndName("org", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "main", saved.DefaultBranch)
+}
+
+func TestAdminAuth(t *testing.T) {
+	db := memory.New()
+	assert.NoError(t, registerRepo(db, "org/repo"))
+	e := echo.New()
+	e.PUT("/repo/:org/:id", handleUpdateRepo(db), adminAuth("secret"))
+
+	for token, code := range map[string]int{"": http.StatusBadRequest, "wrong": http.StatusUnauthorized, "secret": http.StatusOK} {
+		req := httptest.NewRequest(echo.PUT, "/repo/org/repo", strings.NewReader(`{"configpath": "ci/build.yaml"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, code, rec.Code, token)
+	}
+	repo, err := db.LoadByOrgAndName("org", "repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci/build.yaml", repo.ConfigPath)
+}
@@ -0,0 +1,89 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/storage/logstore"
+	"gitlab.com/sorenmat/seneferu/storage/logstore/disk"
+	"gitlab.com/sorenmat/seneferu/storage/memory"
+)
+
+func TestSearchLogs(t *testing.T) {
+	db := memory.New()
+	for _, repo := range []string{"api", "web"} {
+		db.SaveStep(&model.Step{StepInfo: model.StepInfo{Org: "testorg", Reponame: repo, BuildNumber: 1, Name: "build"}})
+		db.AppendLogLines("testorg", repo, 1, "build", []*model.LogLine{
+			{Number: 0, Timestamp: time.Now(), Content: "go build ./..."},
+			{Number: 1, Timestamp: time.Now(), Content: "panic: <nil> Pointer Dereference"},
+		})
+	}
+
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/search/logs?q=pointer+dereference&repo=testorg/api&since=1h", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	assert.NoError(t, handleSearchLogs(db)(c))
+
+	var res []model.LogMatch
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, "api", res[0].Reponame)
+	assert.Equal(t, 1, res[0].BuildNumber)
+	assert.Equal(t, 1, len(res[0].Lines))
+	assert.Equal(t, 1, res[0].Lines[0].Number)
+	assert.Equal(t, "panic: &lt;nil&gt; <mark>Pointer Dereference</mark>", res[0].Lines[0].Highlight)
+}
+
+func TestSearchLogsWithoutQueryShouldFail(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/search/logs", nil)
+	c := e.NewContext(req, httptest.NewRecorder())
+	assert.Error(t, handleSearchLogs(memory.New())(c))
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	s, err := parseSince("72h", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2018, 4, 28, 12, 0, 0, 0, time.UTC), s)
+
+	s, err = parseSince("2018-04-01", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC), s)
+
+	_, err = parseSince("yesterday", now)
+	assert.Error(t, err)
+}
+
+func TestHighlight(t *testing.T) {
+	assert.Equal(t, "<mark>err</mark>or and <mark>ERR</mark>", highlight("error and ERR", "err"))
+	assert.Equal(t, "nothing", highlight("nothing", "err"))
+}
+
+func TestSearchArchivedLogsIsNotImplemented(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := disk.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/search/logs?q=panic", nil)
+	err = handleSearchLogs(logstore.New(memory.New(), store))(e.NewContext(req, httptest.NewRecorder()))
+	if assert.IsType(t, &echo.HTTPError{}, err) {
+		assert.Equal(t, http.StatusNotImplemented, err.(*echo.HTTPError).Code)
+	}
+}
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"strings"
+
+	"gitlab.com/sorenmat/seneferu/builder"
+	"gitlab.com/sorenmat/seneferu/logging"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/storage"
+	"gitlab.com/sorenmat/seneferu/tracing"
+)
+
+// SkipLabel is the label of pull requests that aren't built, pull requests are always built if it's empty
+var SkipLabel = "skip-ci"
+
+// skipDirectives are the directives in the head commit message of a push suppressing its build
+var skipDirectives = []string{"[skip ci]", "[ci skip]"}
+
+// fullDirective in the head commit message of a push, or in the title of a pull request, runs every step
+// regardless of the paths changed
+const fullDirective = "[ci full]"
+
+// hasDirective returns true if message contains one of directives, the case of the directives doesn't matter
+func hasDirective(message string, directives ...string) bool {
+	message = strings.ToLower(message)
+	for _, d := range directives {
+		if strings.Contains(message, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSkipLabel returns true if one of labels is SkipLabel
+func hasSkipLabel(labels []string) bool {
+	for _, l := range labels {
+		if SkipLabel != "" && strings.EqualFold(l, SkipLabel) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipBuild records build as skipped for reason instead of running it, failures are logged
+func skipBuild(span *tracing.Span, service storage.Service, build *model.Build, repo *model.Repo, provider scm.Provider, targetURL string, reason string) {
+	logger := logging.Build(build)
+	logger.Info("skipping build", "reason", reason)
+	if err := builder.SkipBuild(span, service, build, repo, provider, targetURL, reason); err != nil {
+		span.SetError(err)
+		logger.Error("unable to skip build", "error", err)
+	}
+}
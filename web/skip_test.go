@@ -0,0 +1,23 @@
+package web
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasDirective(t *testing.T) {
+	assert.True(t, hasDirective("Fix typo [skip ci]", skipDirectives...))
+	assert.True(t, hasDirective("[CI SKIP] update docs", skipDirectives...))
+	assert.False(t, hasDirective("skip ci", skipDirectives...))
+	assert.True(t, hasDirective("Bump go.mod [ci full]", fullDirective))
+	assert.False(t, hasDirective("Bump go.mod", fullDirective))
+}
+
+func TestHasSkipLabel(t *testing.T) {
+	assert.True(t, hasSkipLabel([]string{"bug", "Skip-CI"}))
+	assert.False(t, hasSkipLabel([]string{"bug"}))
+	SkipLabel = ""
+	defer func() { SkipLabel = "skip-ci" }()
+	assert.False(t, hasSkipLabel([]string{""}))
+}
@@ -0,0 +1,87 @@
+package web
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/sorenmat/seneferu/builder"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/storage/memory"
+	"golang.org/x/net/websocket"
+)
+
+func TestStreamStepReplaysAndFollows(t *testing.T) {
+	key := builder.StreamKey("testorg", "repo", 1, "build")
+	s := builder.Logs.Open(key)
+	s.Write([]byte("line 1\n"))
+
+	e := echo.New()
+	e.GET("/repo/:org/:id/build/:buildid/step/:step/stream", handleStreamStep(memory.New()))
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/repo/testorg/repo/build/1/step/build/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get(echo.HeaderContentType))
+
+	r := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		var event string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return event
+			}
+			event += line
+		}
+	}
+
+	assert.Equal(t, "event: log\ndata: line 1\n", readEvent())
+	s.Write([]byte("line 2\n"))
+	assert.Equal(t, "event: log\ndata: line 2\n", readEvent())
+	builder.Logs.Close(key)
+	assert.Equal(t, "event: end\ndata: \n", readEvent())
+}
+
+func TestStreamFinishedStepOverWebSocket(t *testing.T) {
+	db := memory.New()
+	db.SaveStep(&model.Step{StepInfo: model.StepInfo{Org: "testorg", Reponame: "repo", BuildNumber: 2, Name: "build"}, Log: "done\n"})
+
+	e := echo.New()
+	e.GET("/repo/:org/:id/build/:buildid/step/:step/stream", handleStreamStep(db))
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/repo/testorg/repo/build/2/step/build/stream", "", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(ws)
+	assert.NoError(t, err, "the socket is closed after the stored log")
+	assert.Equal(t, "done\n", string(b))
+}
+
+func TestFetchStepRejectsNegativeRange(t *testing.T) {
+	e := echo.New()
+	e.GET("/repo/:org/:id/build/:buildid/step/:step", handleFetchStep(memory.New()))
+	for _, query := range []string{"offset=-1", "limit=-5"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(echo.GET, "/repo/testorg/repo/build/1/step/build?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
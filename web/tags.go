@@ -0,0 +1,158 @@
+package web
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/sorenmat/seneferu/builder"
+	ghapi "gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/logging"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/storage"
+	"gitlab.com/sorenmat/seneferu/tracing"
+	"gopkg.in/go-playground/webhooks.v3"
+	"gopkg.in/go-playground/webhooks.v3/github"
+	"k8s.io/client-go/kubernetes"
+)
+
+// tagBuildWindow is how long after a tag is built the same commit isn't built again for the tag and event.
+// Publishing a release with a new tag sends both a push of the tag and the release event, both are built as the release.
+const tagBuildWindow = 10 * time.Minute
+
+// tagBuilds are the commits of tags being built, by repository, ref and event
+var tagBuilds = struct {
+	sync.Mutex
+	building map[string]bool
+}{building: make(map[string]bool)}
+
+// claimTag reports whether the commit of the tag of build should be built, it isn't when it's being built or was
+// built for the same event within the tagBuildWindow. done must be called once the build has been saved.
+func claimTag(service storage.Service, build *model.Build) (done func(), ok bool) {
+	key := build.Org + "/" + build.Name + "/" + build.Ref + "@" + build.Commit + " " + build.Event
+	tagBuilds.Lock()
+	defer tagBuilds.Unlock()
+	if tagBuilds.building[key] {
+		return nil, false
+	}
+	builds, err := service.LoadBuildsSince(build.Org, build.Name, time.Now().Add(-tagBuildWindow))
+	if err != nil {
+		logging.Build(build).Warn("unable to load the recent builds, building the tag", "error", err)
+	}
+	for _, b := range builds {
+		if b.Ref == build.Ref && b.Commit == build.Commit && b.Event == build.Event {
+			return nil, false
+		}
+	}
+	tagBuilds.building[key] = true
+	return func() {
+		tagBuilds.Lock()
+		defer tagBuilds.Unlock()
+		delete(tagBuilds.building, key)
+	}, true
+}
+
+// HandleRelease builds the tag of releases published on GitHub as release events, with the release in the build
+func HandleRelease(service storage.Service, kubectl *kubernetes.Clientset, provider scm.Provider, targetURL string, dockerRegHost string, sshkey string) webhooks.ProcessPayloadFunc {
+	return func(payload interface{}, header webhooks.Header) {
+		pl := payload.(github.ReleasePayload)
+		// drafts aren't published, and releases that are edited or deleted are already built
+		if pl.Action != "published" {
+			return
+		}
+		span := tracing.Start("webhook release", logging.OrgKey, pl.Repository.Owner.Login, logging.RepoKey, pl.Repository.Name, "tag", pl.Release.TagName)
+		defer span.End()
+		name := ""
+		if pl.Release.Name != nil {
+			name = *pl.Release.Name
+		}
+		release := newRelease(&ghapi.Release{ID: pl.Release.ID, TagName: pl.Release.TagName, Name: name, HTMLURL: pl.Release.HTMLURL, Prerelease: pl.Release.Prerelease})
+		build := &model.Build{
+			Org:        pl.Repository.Owner.Login,
+			Name:       pl.Repository.Name,
+			Ref:        "refs/tags/" + pl.Release.TagName,
+			Committers: []string{pl.Sender.Login},
+			Status:     "Created",
+			Timestamp:  time.Now(),
+			TreesURL:   pl.Repository.TreesURL,
+			StatusURL:  pl.Repository.StatusesURL,
+			Event:      "release",
+			Release:    release,
+		}
+		buildTag(span, service, kubectl, provider, build, targetURL, dockerRegHost, sshkey)
+	}
+}
+
+// buildTag builds the commit the tag of build points at, release events don't name the commit
+func buildTag(span *tracing.Span, service storage.Service, kubectl *kubernetes.Clientset, provider scm.Provider, build *model.Build, targetURL string, dockerRegHost string, sshkey string) {
+	logger := slog.With(logging.OrgKey, build.Org, logging.RepoKey, build.Name)
+	logger.Info("handling tag", "ref", build.Ref, "event", build.Event)
+
+	repo, err := service.LoadByOrgAndName(build.Org, build.Name)
+	if err != nil {
+		logger.Info("got an error, assuming we couldn't find the repository", "error", err)
+		repo = &model.Repo{Org: build.Org, Name: build.Name}
+		if err := service.SaveRepo(repo); err != nil {
+			logger.Error("unable to save repository", "error", err)
+		}
+	}
+	build.Commit, err = tagCommit(provider, build)
+	if err != nil {
+		span.SetError(err)
+		logger.Error("unable to find the commit of the tag", "ref", build.Ref, "error", err)
+		return
+	}
+	done, ok := claimTag(service, build)
+	if !ok {
+		logger.Info("not building tag, the commit has just been built for it", "ref", build.Ref, "commit", build.Commit)
+		return
+	}
+	defer done()
+	err = builder.ExecuteBuild(span, kubectl, service, build, repo, provider, targetURL, dockerRegHost, sshkey)
+	if err != nil {
+		span.SetError(err)
+		logging.Build(build).Error("build failure", "error", err)
+	}
+}
+
+// newRelease returns the release of a build, releases without a name are named after their tag
+func newRelease(r *ghapi.Release) *model.Release {
+	release := &model.Release{ID: r.ID, Name: r.Name, URL: r.HTMLURL, Prerelease: r.Prerelease}
+	if release.Name == "" {
+		release.Name = r.TagName
+	}
+	return release
+}
+
+// tagRelease returns the published release of the tag of build, or nil. Publishing a release with a new tag
+// creates the release before the tag is pushed.
+func tagRelease(provider scm.Provider, build *model.Build) (*model.Release, error) {
+	token, err := provider.Token(build.Org, build.Name)
+	if err != nil {
+		return nil, err
+	}
+	repoURL, err := ghapi.RepoURL(build.StatusURL)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ghapi.TagRelease(repoURL, strings.TrimPrefix(build.Ref, "refs/tags/"), token)
+	if r == nil || err != nil {
+		return nil, err
+	}
+	return newRelease(r), nil
+}
+
+// tagCommit returns the commit the tag of build points at
+func tagCommit(provider scm.Provider, build *model.Build) (string, error) {
+	token, err := provider.Token(build.Org, build.Name)
+	if err != nil {
+		return "", err
+	}
+	repoURL, err := ghapi.RepoURL(build.StatusURL)
+	if err != nil {
+		return "", err
+	}
+	return ghapi.RefCommit(repoURL, strings.TrimPrefix(build.Ref, "refs/"), token)
+}
@@ -0,0 +1,65 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ghapi "gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/storage"
+)
+
+func TestTagCommit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/repos/org/repo/commits/tags/v1.0", r.URL.Path)
+		assert.Equal(t, "token secret", r.Header.Get("Authorization"))
+		fmt.Fprint(w, "abc123")
+	}))
+	defer server.Close()
+
+	build := &model.Build{Org: "org", Name: "repo", Ref: "refs/tags/v1.0", StatusURL: server.URL + "/repos/org/repo/statuses/{sha}"}
+	sha, err := tagCommit(scm.NewGitHub(ghapi.StaticToken("secret")), build)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc123", sha)
+}
+
+// recentBuilds is a service with the builds of the last minutes
+type recentBuilds struct {
+	storage.Service
+	builds []*model.Build
+}
+
+func (r *recentBuilds) LoadBuildsSince(org string, name string, since time.Time) ([]*model.Build, error) {
+	return r.builds, nil
+}
+
+func TestTagIsBuiltOnce(t *testing.T) {
+	service := &recentBuilds{}
+	// the push of a new tag of a release is built as the release
+	build := &model.Build{Org: "org", Name: "repo", Ref: "refs/tags/v1.0", Commit: "abc", Event: "release"}
+	done, ok := claimTag(service, build)
+	assert.True(t, ok)
+	// the release event arriving while the push of the tag is built
+	_, ok = claimTag(service, &model.Build{Org: "org", Name: "repo", Ref: "refs/tags/v1.0", Commit: "abc", Event: "release"})
+	assert.False(t, ok)
+	done()
+
+	// or after it has been built
+	service.builds = []*model.Build{build}
+	_, ok = claimTag(service, &model.Build{Org: "org", Name: "repo", Ref: "refs/tags/v1.0", Commit: "abc", Event: "release"})
+	assert.False(t, ok)
+
+	// a tag pushed before its release is published is built for both events
+	done, ok = claimTag(service, &model.Build{Org: "org", Name: "repo", Ref: "refs/tags/v1.0", Commit: "abc", Event: "tag"})
+	assert.True(t, ok)
+	done()
+	// and when it moved to another commit
+	done, ok = claimTag(service, &model.Build{Org: "org", Name: "repo", Ref: "refs/tags/v1.0", Commit: "def", Event: "release"})
+	assert.True(t, ok)
+	done()
+}
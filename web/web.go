@@ -1,97 +1,142 @@
 package web
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"fmt"
-	"log"
+	"html"
+	"io"
+	"io/ioutil"
+	"log/slog"
 	"strconv"
+	"strings"
 	"time"
 
 	"net/http"
 
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
+	"github.com/pkg/errors"
 	"gitlab.com/sorenmat/seneferu/builder"
+	ghapi "gitlab.com/sorenmat/seneferu/github"
+	"gitlab.com/sorenmat/seneferu/logging"
+	"gitlab.com/sorenmat/seneferu/metrics"
 	"gitlab.com/sorenmat/seneferu/model"
+	"gitlab.com/sorenmat/seneferu/retention"
+	"gitlab.com/sorenmat/seneferu/scm"
+	"gitlab.com/sorenmat/seneferu/stats"
 	"gitlab.com/sorenmat/seneferu/storage"
+	"gitlab.com/sorenmat/seneferu/tracing"
 	"golang.org/x/net/websocket"
 	"gopkg.in/go-playground/webhooks.v3"
 	"gopkg.in/go-playground/webhooks.v3/github"
 	"k8s.io/client-go/kubernetes"
 )
 
-// HandleRelease handles GitHub release events
-func HandleRelease(payload interface{}, header webhooks.Header) {
-	log.Println("Not Handling Release right now")
-
-	pl := payload.(github.ReleasePayload)
-
-	// only want to compile on full releases
-	if pl.Release.Draft || pl.Release.Prerelease || pl.Release.TargetCommitish != "master" {
-		return
-	}
-}
-
 // HandlePullRequest handles GitHub pull_request events
-func HandlePullRequest(service storage.Service, kubectl *kubernetes.Clientset, token string, targetURL string, dockerRegHost string, sshkey string) webhooks.ProcessPayloadFunc {
-	log.Println("Handling Pull Request right now")
+func HandlePullRequest(service storage.Service, kubectl *kubernetes.Clientset, provider scm.Provider, targetURL string, dockerRegHost string, sshkey string) webhooks.ProcessPayloadFunc {
 	return func(payload interface{}, header webhooks.Header) {
 		pl := payload.(github.PullRequestPayload)
+		logger := slog.With(logging.OrgKey, pl.Repository.Owner.Login, logging.RepoKey, pl.Repository.Name)
+		if !buildsPullRequest(&pl) {
+			logger.Debug("not building pull request", "number", pl.Number, "action", pl.Action)
+			return
+		}
+		fork := isFork(&pl)
+		if fork && !BuildForks {
+			logger.Info("not building pull request from a fork", "number", pl.Number, "fork", pl.PullRequest.Head.Repo.FullName)
+			return
+		}
+		logger.Info("handling pull request", "number", pl.Number, "action", pl.Action)
+		span := tracing.Start("webhook pull_request", logging.OrgKey, pl.Repository.Owner.Login, logging.RepoKey, pl.Repository.Name, "number", pl.Number, "action", pl.Action)
+		defer span.End()
 
 		repo, err := service.LoadByOrgAndName(pl.Repository.Owner.Login, pl.Repository.Name)
 		if err != nil {
-			log.Println("got an error, assuming we couldn't find the repository")
+			logger.Info("got an error, assuming we couldn't find the repository", "error", err)
 			repo = &model.Repo{
-				Org:  pl.Repository.Owner.Login,
-				Name: pl.Repository.Name,
+				Org:           pl.Repository.Owner.Login,
+				Name:          pl.Repository.Name,
+				DefaultBranch: pl.Repository.DefaultBranch,
 			}
-			log.Printf("Trying to save %v\n", repo)
 			// this is odd move to a save function
 			err = service.SaveRepo(repo)
 			if err != nil {
-				log.Println(err)
+				logger.Error("unable to save repository", "error", err)
 			}
 		}
+		updateDefaultBranch(service, repo, pl.Repository.DefaultBranch)
 
+		// pull requests from forks are built in the base repository, which has the commits of its pull requests
 		build := &model.Build{
-			Org:        pl.PullRequest.Head.Repo.Owner.Login,
-			Name:       pl.PullRequest.Head.Repo.Name,
-			Commit:     pl.PullRequest.Head.Sha,
-			Ref:        pl.PullRequest.Head.Ref,
-			Committers: []string{pl.PullRequest.Head.User.Login},
-			Status:     "Created",
-			Timestamp:  time.Now(),
-			TreesURL:   pl.PullRequest.Head.Repo.TreesURL,
-			StatusURL:  pl.PullRequest.StatusesURL,
+			Org:         pl.Repository.Owner.Login,
+			Name:        pl.Repository.Name,
+			Commit:      pl.PullRequest.Head.Sha,
+			Ref:         pl.PullRequest.Head.Ref,
+			Committers:  []string{pl.PullRequest.Head.User.Login},
+			Status:      "Created",
+			Timestamp:   time.Now(),
+			TreesURL:    pl.Repository.TreesURL,
+			StatusURL:   pl.PullRequest.StatusesURL,
+			Event:       "pull_request",
+			PullRequest: int(pl.Number),
+			BaseRef:     pl.PullRequest.Base.Ref,
+			Fork:        fork,
 		}
-		fmt.Println("Build: ", build)
-		err = builder.ExecuteBuild(kubectl, service, build, repo, token, targetURL, dockerRegHost, sshkey)
+		var labels []string
+		for _, l := range pl.PullRequest.Labels {
+			labels = append(labels, l.Name)
+		}
+		if hasSkipLabel(labels) {
+			skipBuild(span, service, build, repo, provider, targetURL, "skipped by the "+SkipLabel+" label")
+			return
+		}
+		// without the changed files every step runs
+		if !hasDirective(pl.PullRequest.Title, fullDirective) {
+			token, err := provider.Token(pl.Repository.Owner.Login, pl.Repository.Name)
+			if err == nil {
+				build.ChangedFiles, err = ghapi.PullRequestFiles(pl.PullRequest.URL, token)
+			}
+			if err != nil {
+				logger.Warn("unable to fetch the files changed by the pull request, path constraints are ignored", "error", err)
+			}
+		}
+		err = builder.ExecuteBuild(span, kubectl, service, build, repo, provider, targetURL, dockerRegHost, sshkey)
 		if err != nil {
-			log.Printf("Build failure %v\n", err)
+			span.SetError(err)
+			logging.Build(build).Error("build failure", "error", err)
 		}
 	}
 }
 
 // HandlePush receives and handles the push event from github
-func HandlePush(service storage.Service, kubectl *kubernetes.Clientset, token string, targetURL string, dockerRegHost string, sshkey string) webhooks.ProcessPayloadFunc {
+func HandlePush(service storage.Service, kubectl *kubernetes.Clientset, provider scm.Provider, targetURL string, dockerRegHost string, sshkey string) webhooks.ProcessPayloadFunc {
 	return func(payload interface{}, header webhooks.Header) {
-		log.Println("Handling Push Request")
-
 		pl := payload.(github.PushPayload)
+		logger := slog.With(logging.OrgKey, pl.Repository.Owner.Name, logging.RepoKey, pl.Repository.Name)
+		if pl.Deleted {
+			logger.Debug("not building deleted ref", "ref", pl.Ref)
+			return
+		}
+		logger.Info("handling push", "ref", pl.Ref)
+		span := tracing.Start("webhook push", logging.OrgKey, pl.Repository.Owner.Name, logging.RepoKey, pl.Repository.Name, "ref", pl.Ref)
+		defer span.End()
 
 		repo, err := service.LoadByOrgAndName(pl.Repository.Owner.Name, pl.Repository.Name)
 		if err != nil {
-			log.Println("got an error, assuming we couldn't find the repository")
+			logger.Info("got an error, assuming we couldn't find the repository", "error", err)
 			repo = &model.Repo{
-				Org:  pl.Repository.Owner.Name,
-				Name: pl.Repository.Name,
+				Org:           pl.Repository.Owner.Name,
+				Name:          pl.Repository.Name,
+				DefaultBranch: pl.Repository.DefaultBranch,
 			}
-			log.Printf("Trying to save %v\n", repo)
 			// this is odd move to a save function
 			err = service.SaveRepo(repo)
 			if err != nil {
-				log.Println(err)
+				logger.Error("unable to save repository", "error", err)
 			}
 		}
+		updateDefaultBranch(service, repo, pl.Repository.DefaultBranch)
 
 		build := &model.Build{
 			Org:        pl.Repository.Owner.Name,
@@ -103,11 +148,42 @@ func HandlePush(service storage.Service, kubectl *kubernetes.Clientset, token st
 			Timestamp:  time.Now(),
 			TreesURL:   pl.Repository.TreesURL,
 			StatusURL:  pl.Repository.StatusesURL,
+			Event:      pushEvent(pl.Ref),
+		}
+		if hasDirective(pl.HeadCommit.Message, skipDirectives...) {
+			skipBuild(span, service, build, repo, provider, targetURL, "skipped by the commit message")
+			return
+		}
+		// the changes of new branches and force pushes aren't known from the pushed commits
+		if !pl.Created && !pl.Forced && !hasDirective(pl.HeadCommit.Message, fullDirective) {
+			var commits []pushCommit
+			for _, c := range pl.Commits {
+				commits = append(commits, pushCommit{Added: c.Added, Modified: c.Modified, Removed: c.Removed})
+			}
+			build.ChangedFiles = changedFiles(commits)
+		}
+		if build.Event == "tag" {
+			// a new tag of a release is built once, as the release
+			release, err := tagRelease(provider, build)
+			if err != nil {
+				logger.Warn("unable to find the release of the tag, building it as a tag", "ref", build.Ref, "error", err)
+			}
+			if release != nil {
+				build.Event = "release"
+				build.Release = release
+			}
+			done, ok := claimTag(service, build)
+			if !ok {
+				logger.Info("not building tag, the commit has just been built for it", "ref", build.Ref, "commit", build.Commit)
+				return
+			}
+			defer done()
 		}
 
-		err = builder.ExecuteBuild(kubectl, service, build, repo, token, targetURL, dockerRegHost, sshkey)
+		err = builder.ExecuteBuild(span, kubectl, service, build, repo, provider, targetURL, dockerRegHost, sshkey)
 		if err != nil {
-			log.Printf("Build failure %v\n", err)
+			span.SetError(err)
+			logging.Build(build).Error("build failure", "error", err)
 		}
 
 	}
@@ -116,24 +192,45 @@ func HandlePush(service storage.Service, kubectl *kubernetes.Clientset, token st
 func HandlePing() webhooks.ProcessPayloadFunc {
 	return func(payload interface{}, header webhooks.Header) {
 		pl := payload.(github.PingPayload)
-		log.Println("Got Ping Request", pl)
+		slog.Info("got ping request", "hook", pl.HookID)
 	}
 }
 
 func HandleStatus() webhooks.ProcessPayloadFunc {
 	return func(payload interface{}, header webhooks.Header) {
-		log.Println("Got Status Request")
+		pl := payload.(github.StatusPayload)
+		slog.Info("got status request", logging.OrgKey, pl.Repository.Owner.Login, logging.RepoKey, pl.Repository.Name, "state", pl.State)
+	}
+}
+
+// githubEvents are the GitHub events handled, the metrics label the others as unknown since the header isn't verified yet
+var githubEvents = map[string]bool{
+	string(github.ReleaseEvent): true, string(github.StatusEvent): true, string(github.PullRequestEvent): true,
+	string(github.PingEvent): true, string(github.PushEvent): true, string(github.InstallationEvent): true,
+	string(github.IntegrationInstallationEvent): true, "check_run": true, "installation_repositories": true,
+}
+
+// eventLabel returns the label of the GitHub event in the webhook metrics
+func eventLabel(event string) string {
+	if !githubEvents[event] {
+		return "unknown"
 	}
+	return event
 }
-func StartWebServer(db storage.Service, kubectl *kubernetes.Clientset, secret string, targetURL string, token string, dockerRegHost string, sshkey string) {
+
+// StartWebServer serves the API and the webhooks of GitHub and of the other providers that are configured.
+// Changing repository settings and the retention plan need adminToken, they aren't served if it's empty.
+func StartWebServer(db storage.Service, kubectl *kubernetes.Clientset, secret string, targetURL string, tokens ghapi.TokenSource, providers Providers, dockerRegHost string, sshkey string, janitor *retention.Janitor, adminToken string) {
+	gh := scm.NewGitHub(tokens)
 
 	// Github hook
 	hook := github.New(&github.Config{Secret: secret})
-	hook.RegisterEvents(HandleRelease, github.ReleaseEvent)
+	hook.RegisterEvents(HandleRelease(db, kubectl, gh, targetURL, dockerRegHost, sshkey), github.ReleaseEvent)
 	hook.RegisterEvents(HandleStatus(), github.StatusEvent)
-	hook.RegisterEvents(HandlePullRequest(db, kubectl, token, targetURL, dockerRegHost, sshkey), github.PullRequestEvent)
+	hook.RegisterEvents(HandlePullRequest(db, kubectl, gh, targetURL, dockerRegHost, sshkey), github.PullRequestEvent)
 	hook.RegisterEvents(HandlePing(), github.PingEvent)
-	hook.RegisterEvents(HandlePush(db, kubectl, token, targetURL, dockerRegHost, sshkey), github.PushEvent)
+	hook.RegisterEvents(HandlePush(db, kubectl, gh, targetURL, dockerRegHost, sshkey), github.PushEvent)
+	hook.RegisterEvents(HandleInstallation(db, tokens), github.InstallationEvent, github.IntegrationInstallationEvent)
 
 	e := echo.New()
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
@@ -151,6 +248,21 @@ func StartWebServer(db storage.Service, kubectl *kubernetes.Clientset, secret st
 	e.GET("/repo/:org/:id/builds", handleFetchBuilds(db))
 	e.GET("/repo/:org/:id/build/:buildid", handleFetchBuild(db))
 	e.GET("/repo/:org/:id/build/:buildid/step/:step", handleFetchStep(db))
+	e.GET("/repo/:org/:id/build/:buildid/step/:step/stream", handleStreamStep(db))
+	e.GET("/search/logs", handleSearchLogs(db))
+	e.GET("/stats", handleStats(db))
+	e.GET("/repo/:org/:id/stats", handleStats(db))
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+	if adminToken != "" {
+		admin := adminAuth(adminToken)
+		e.PUT("/repo/:org/:id", handleUpdateRepo(db), admin)
+		e.GET("/admin/retention", handleRetentionPlan(janitor), admin)
+	} else {
+		slog.Warn("no admin token given, repository settings can't be changed and the retention plan isn't served")
+	}
+
+	checkRun := handleCheckRun(db, kubectl, secret, gh, targetURL, dockerRegHost, sshkey)
+	installationRepositories := handleInstallationRepositories(db, secret, tokens)
 
 	// handle github web hook
 	e.Any("/webhook", func(c echo.Context) (err error) {
@@ -158,57 +270,129 @@ func StartWebServer(db storage.Service, kubectl *kubernetes.Clientset, secret st
 		res := c.Response()
 		ct := req.Header.Get("Content-Type")
 		if ct != "application/json" {
-			log.Printf("Received payload on /webhook with unsupported mediatype, the request was %v", ct)
-			return fmt.Errorf(http.StatusText(415))
+			slog.Warn("received payload on /webhook with unsupported mediatype", "content_type", ct)
+			return errors.New(http.StatusText(415))
+		}
+		event := req.Header.Get("X-GitHub-Event")
+		metrics.WebhooksReceived.Inc(eventLabel(event))
+		// events the webhooks package doesn't know
+		switch event {
+		case "check_run":
+			return checkRun(c)
+		case "installation_repositories":
+			return installationRepositories(c)
 		}
 		webhooks.Handler(hook).ServeHTTP(res, req)
 		return nil
 	})
-	log.Println("Starting server....")
+	if providers.GitLab != nil {
+		e.POST("/webhook/gitlab", handleProviderWebhook(db, kubectl, gitlabSource(providers.GitLab), targetURL, dockerRegHost, sshkey))
+	}
+	if providers.Bitbucket != nil {
+		e.POST("/webhook/bitbucket", handleProviderWebhook(db, kubectl, bitbucketSource(providers.Bitbucket), targetURL, dockerRegHost, sshkey))
+	}
+	if providers.Gitea != nil {
+		e.POST("/webhook/gitea", handleProviderWebhook(db, kubectl, giteaSource(providers.Gitea), targetURL, dockerRegHost, sshkey))
+	}
+	slog.Info("starting server", "addr", ":8080")
 	e.Start(":8080")
 }
 
-var sockets = NewSockets()
+func handleStreamStep(db storage.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		org := c.Param("org")
+		id := c.Param("id")
+		step := c.Param("step")
+		buildid, err := strconv.Atoi(c.Param("buildid"))
+		if err != nil {
+			return err
+		}
 
-type Sockets struct {
-	Add     chan *websocket.Conn
-	Remove  chan *websocket.Conn
-	sockets []*websocket.Conn
-}
+		sub, ok := builder.Logs.Subscribe(builder.StreamKey(org, id, buildid, step))
+		defer sub.Cancel()
+		chunks := sub.C
+		replay, err := builder.ReplayLog(db, org, id, buildid, step, sub)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// the step isn't running, so the complete log is already stored
+			s, err := db.LoadStep(org, id, buildid, step)
+			if err != nil {
+				return err
+			}
+			replay = []byte(s.Log)
+		}
 
-func (s *Sockets) GetSockets() []*websocket.Conn {
-	return s.sockets
-}
+		if c.IsWebSocket() {
+			websocket.Handler(func(ws *websocket.Conn) {
+				defer ws.Close()
+				if _, err := ws.Write(replay); err != nil || chunks == nil {
+					return
+				}
+				// clients don't send anything, reading only notices when they disconnect
+				gone := make(chan struct{})
+				go func() {
+					io.Copy(ioutil.Discard, ws)
+					close(gone)
+				}()
+				for {
+					select {
+					case chunk, open := <-chunks:
+						if !open {
+							return
+						}
+						if _, err := ws.Write(chunk); err != nil {
+							return
+						}
+					case <-gone:
+						return
+					}
+				}
+			}).ServeHTTP(c.Response(), c.Request())
+			return nil
+		}
 
-func (s *Sockets) handle() {
-	for {
-		select {
-		case add := <-s.Add:
-			s.sockets = append(s.sockets, add)
-		case remove := <-s.Remove:
-			for i, c := range s.sockets {
-				if c == remove {
-					s.sockets = append(s.sockets[:i], s.sockets[i+1:]...)
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set("Cache-Control", "no-cache")
+		res.Header().Set("Connection", "keep-alive")
+		res.WriteHeader(http.StatusOK)
+
+		writeEvent(res, "log", replay)
+		if chunks != nil {
+			done := c.Request().Context().Done()
+		loop:
+			for {
+				select {
+				case chunk, open := <-chunks:
+					if !open {
+						break loop
+					}
+					writeEvent(res, "log", chunk)
+				case <-done:
+					return nil
 				}
 			}
 		}
+		if sub.Lagged() {
+			// the log sent is incomplete, clients should fetch the stored log or stream again
+			writeEvent(res, "lagged", nil)
+			return nil
+		}
+		writeEvent(res, "end", nil)
+		return nil
 	}
 }
 
-func NewSockets() *Sockets {
-	s := Sockets{}
-	s.Add = make(chan *websocket.Conn)
-	s.Remove = make(chan *websocket.Conn)
-
-	go s.handle()
-	return &s
-}
-
-func logStream(c echo.Context) error {
-	websocket.Handler(func(ws *websocket.Conn) {
-		sockets.Add <- ws
-	}).ServeHTTP(c.Response(), c.Request())
-	return nil
+// writeEvent writes data as a single Server-Sent Event and flushes it to the client
+func writeEvent(res *echo.Response, event string, data []byte) {
+	fmt.Fprintf(res, "event: %v\n", event)
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		fmt.Fprintf(res, "data: %v\n", line)
+	}
+	fmt.Fprint(res, "\n")
+	res.Flush()
 }
 
 func handleFetchBuilds(db storage.Service) echo.HandlerFunc {
@@ -221,13 +405,11 @@ func handleFetchBuilds(db storage.Service) echo.HandlerFunc {
 		if id == "" {
 			return fmt.Errorf("id can't be empty")
 		}
-		log.Printf("Fetching builds for repo id: %v", id)
-
 		builds, err := db.LoadBuilds(org, id)
 		if err != nil {
 			return err
 		}
-		log.Printf("Found %v builds", len(builds))
+		slog.Debug("fetched builds", logging.OrgKey, org, logging.RepoKey, id, "count", len(builds))
 		return c.JSON(200, builds)
 	}
 }
@@ -236,27 +418,69 @@ func handleFetchRepoData(db storage.Service) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		org := c.Param("org")
 		id := c.Param("id")
-		log.Printf("Id: %v\tOrg: %v\n", id, org)
 		repo, err := db.LoadByOrgAndName(org, id)
 		if err != nil {
 			return err
 		}
 
-		log.Println("Found repo ", repo)
 		err = c.JSON(200, repo)
 		if err != nil {
-			log.Println("unable to marshal json")
+			slog.Error("unable to marshal json", logging.OrgKey, org, logging.RepoKey, id, "error", err)
 		}
 		return err
 	}
 }
 
+// adminAuth lets requests through that carry token as bearer token in the Authorization header
+func adminAuth(token string) echo.MiddlewareFunc {
+	return middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+	})
+}
+
+// updateDefaultBranch saves the default branch of repo when the provider reports another one, failures are logged
+func updateDefaultBranch(service storage.Service, repo *model.Repo, branch string) {
+	if branch == "" || branch == repo.DefaultBranch {
+		return
+	}
+	repo.DefaultBranch = branch
+	if err := service.SaveRepo(repo); err != nil {
+		slog.Error("unable to save the default branch of the repository", logging.OrgKey, repo.Org, logging.RepoKey, repo.Name, "error", err)
+	}
+}
+
+// handleUpdateRepo changes the settings of a repository, the path of its build configuration and its default branch.
+// The default branch is reported by GitHub, GitLab and Gitea, and is only set by hand for Bitbucket.
+func handleUpdateRepo(db storage.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		org := c.Param("org")
+		id := c.Param("id")
+		repo, err := db.LoadByOrgAndName(org, id)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+		}
+		settings := struct {
+			ConfigPath    string `json:"configpath"`
+			DefaultBranch string `json:"defaultbranch"`
+		}{repo.ConfigPath, repo.DefaultBranch}
+		if err := c.Bind(&settings); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "unable to parse repository settings")
+		}
+		repo.ConfigPath = strings.Trim(settings.ConfigPath, "/")
+		repo.DefaultBranch = strings.TrimPrefix(settings.DefaultBranch, "refs/heads/")
+		if err := db.SaveRepo(repo); err != nil {
+			slog.Error("unable to save repository", logging.OrgKey, org, logging.RepoKey, id, "error", err)
+			return err
+		}
+		return c.JSON(200, repo)
+	}
+}
+
 func handleFetchBuild(db storage.Service) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		org := c.Param("org")
 		id := c.Param("id")
 		buildidStr := c.Param("buildid")
-		log.Printf("Id: %v\tOrg: %v\tBuildId: %v\n", id, org, buildidStr)
 
 		buildid, err := strconv.Atoi(buildidStr)
 		if err != nil {
@@ -278,13 +502,39 @@ func handleFetchStep(db storage.Service) echo.HandlerFunc {
 		buildidStr := c.Param("buildid")
 		step := c.Param("step")
 
-		log.Printf("Id: %v\tOrg: %v\tBuildId: %v\tStep: %v\n", id, org, buildidStr, step)
-
 		buildid, err := strconv.Atoi(buildidStr)
 		if err != nil {
 			return err
 		}
 
+		// only return the requested range of log lines
+		offsetStr := c.QueryParam("offset")
+		limitStr := c.QueryParam("limit")
+		if offsetStr != "" || limitStr != "" {
+			offset, limit := 0, 0
+			if offsetStr != "" {
+				offset, err = strconv.Atoi(offsetStr)
+				if err != nil || offset < 0 {
+					return echo.NewHTTPError(http.StatusBadRequest, "offset must be a number of 0 or more")
+				}
+			}
+			if limitStr != "" {
+				limit, err = strconv.Atoi(limitStr)
+				if err != nil || limit < 0 {
+					return echo.NewHTTPError(http.StatusBadRequest, "limit must be a number of 0 or more")
+				}
+			}
+			info, err := db.LoadStepInfo(org, id, step, buildid)
+			if err != nil {
+				return err
+			}
+			lines, err := db.LoadLogLines(org, id, buildid, step, offset, limit)
+			if err != nil {
+				return err
+			}
+			return c.JSON(200, &model.StepLines{StepInfo: *info, Lines: lines})
+		}
+
 		b, err := db.LoadStep(org, id, buildid, step)
 		if err != nil {
 			return err
@@ -297,7 +547,7 @@ func handleFetchRepos(db storage.Service) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		repos, err := db.All()
 		if err != nil {
-			log.Println(err)
+			slog.Error("unable to load repositories", "error", err)
 			return err
 		}
 		return c.JSON(200, repos)
@@ -313,13 +563,169 @@ func handleFetchAllBuilds(db storage.Service) echo.HandlerFunc {
 		}
 		repos, err := db.LoadAllBuilds(max)
 		if err != nil {
-			log.Println(err)
+			slog.Error("unable to load builds", "error", err)
 			return err
 		}
 		return c.JSON(200, repos)
 	}
 }
 
+// maxSearchResults is the default and maximum number of lines returned by a log search
+const maxSearchResults = 500
+
+// handleSearchLogs finds the log lines containing the text in the q parameter. The search can be narrowed
+// to a repository with repo=org/name, and to lines written since a date or duration ago with since.
+func handleSearchLogs(db storage.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		query := model.LogQuery{Text: c.QueryParam("q"), Limit: maxSearchResults}
+		if strings.TrimSpace(query.Text) == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "q can't be empty")
+		}
+		if repo := c.QueryParam("repo"); repo != "" {
+			parts := strings.SplitN(repo, "/", 2)
+			query.Org = parts[0]
+			if len(parts) == 2 {
+				query.Reponame = parts[1]
+			}
+		}
+		if since := c.QueryParam("since"); since != "" {
+			t, err := parseSince(since, time.Now())
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			query.Since = t
+		}
+		if limitStr := c.QueryParam("limit"); limitStr != "" {
+			limit, err := strconv.Atoi(limitStr)
+			if err != nil || limit <= 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive number")
+			}
+			if limit < maxSearchResults {
+				query.Limit = limit
+			}
+		}
+
+		matches, err := db.SearchLogs(query)
+		if errors.Cause(err) == storage.ErrSearchUnsupported {
+			return echo.NewHTTPError(http.StatusNotImplemented, err.Error()+", start Seneferu with --logstore=db")
+		}
+		if err != nil {
+			slog.Error("unable to search logs", "error", err)
+			return err
+		}
+		for _, m := range matches {
+			for _, l := range m.Lines {
+				l.Highlight = highlight(l.Content, query.Text)
+			}
+		}
+		return c.JSON(200, matches)
+	}
+}
+
+// parseSince parses a date, a RFC3339 timestamp or a duration before now
+func parseSince(since string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(since); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", since); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("since must be a date, a RFC3339 timestamp or a duration like 72h, got %v", since)
+}
+
+// highlight HTML escapes line and wraps every case insensitive occurrence of text in a mark element
+func highlight(line, text string) string {
+	var buf bytes.Buffer
+	lower := strings.ToLower(line)
+	needle := strings.ToLower(text)
+	if len(lower) != len(line) || len(needle) != len(text) {
+		// lower casing changed the length, so offsets can't be mapped back to the line
+		lower, needle = line, text
+	}
+	for {
+		i := strings.Index(lower, needle)
+		if i < 0 || needle == "" {
+			break
+		}
+		buf.WriteString(html.EscapeString(line[:i]))
+		buf.WriteString("<mark>" + html.EscapeString(line[i:i+len(needle)]) + "</mark>")
+		line = line[i+len(needle):]
+		lower = lower[i+len(needle):]
+	}
+	buf.WriteString(html.EscapeString(line))
+	return buf.String()
+}
+
+// defaultStatsWindow is the window statistics are calculated over when since isn't given
+const defaultStatsWindow = 30 * 24 * time.Hour
+
+// handleStats returns the build statistics of every branch, of all repositories or the one in the path.
+// The window starts at since, a date or duration ago, and MTTR is calculated for the default branch.
+func handleStats(db storage.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		org := c.Param("org")
+		id := c.Param("id")
+		now := time.Now()
+		since := now.Add(-defaultStatsWindow)
+		if s := c.QueryParam("since"); s != "" {
+			t, err := parseSince(s, now)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			since = t
+		}
+		repos, err := db.All()
+		if err != nil {
+			slog.Error("unable to load repositories", "error", err)
+			return err
+		}
+		defaultBranches := make(map[string]string, len(repos))
+		for _, r := range repos {
+			defaultBranches[r.Org+"/"+r.Name] = r.DefaultBranch
+		}
+
+		window, err := db.LoadBuildsSince(org, id, since)
+		if err != nil {
+			slog.Error("unable to load builds", logging.OrgKey, org, logging.RepoKey, id, "error", err)
+			return err
+		}
+		steps, err := db.LoadStepInfos(org, id, since)
+		if err != nil {
+			slog.Error("unable to load steps", logging.OrgKey, org, logging.RepoKey, id, "error", err)
+			return err
+		}
+		return c.JSON(200, map[string]interface{}{
+			"since":    since,
+			"until":    now,
+			"branches": stats.Compute(window, steps, defaultBranches),
+		})
+	}
+}
+
+// handleRetentionPlan shows what the janitor would prune if it ran now
+func handleRetentionPlan(janitor *retention.Janitor) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		plan, err := janitor.Plan()
+		if err != nil {
+			slog.Error("unable to plan retention", "error", err)
+			return err
+		}
+		policy := janitor.Policy()
+		return c.JSON(200, map[string]interface{}{
+			"policy": map[string]interface{}{
+				"keepbuilds": policy.KeepBuilds,
+				"logmaxage":  policy.LogMaxAge.String(),
+				"keeptags":   policy.KeepTags,
+			},
+			"builds": plan.Builds,
+			"logs":   plan.Logs,
+		})
+	}
+}
+
 func handleStatus() echo.HandlerFunc {
 	return func(c echo.Context) error {
 		return c.JSON(200, "ok")
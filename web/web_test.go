@@ -178,3 +178,10 @@ func TestGetRepos(t *testing.T) {
 		t.Error("Repos should have been in the repo list", foundFirst, foundSecond)
 	}
 }
+
+func TestEventLabel(t *testing.T) {
+	assert.Equal(t, "push", eventLabel("push"))
+	assert.Equal(t, "check_run", eventLabel("check_run"))
+	assert.Equal(t, "unknown", eventLabel("made-up-event-1234"))
+	assert.Equal(t, "unknown", eventLabel(""))
+}